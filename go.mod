@@ -1,10 +1,11 @@
 module github.com/tinyzimmer/gsvnc
 
-go 1.15
+go 1.16
 
 require (
 	github.com/go-vgo/robotgo v0.91.0
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+	github.com/robotn/xgb v0.0.0-20190912153532-2cb92d044934
 	github.com/spf13/cobra v1.0.0
 	github.com/tinyzimmer/go-gst v0.1.1
 	golang.org/x/image v0.0.0-20200927104501-e162460cd6b5
@@ -0,0 +1,139 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/rfb"
+)
+
+// Client is a client for the admin API.
+type Client struct {
+	http    *http.Client
+	baseURL string
+	display string
+}
+
+// NewClient returns a client for the admin API listening on the given network and
+// address. The network is either "unix" or "tcp".
+func NewClient(network, addr string) *Client {
+	dialer := &net.Dialer{Timeout: time.Second * 5}
+	return &Client{
+		http: &http.Client{
+			Timeout: time.Second * 30,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, addr)
+				},
+			},
+		},
+		// The host is ignored by the dialer
+		baseURL: "http://gsvnc",
+	}
+}
+
+// ForDisplay returns a client whose password, encodings and security types requests
+// apply to the display with the given name, for servers hosting several displays.
+func (c *Client) ForDisplay(name string) *Client {
+	out := *c
+	out.display = name
+	return &out
+}
+
+// ListSessions returns all connected sessions.
+func (c *Client) ListSessions() ([]rfb.Session, error) {
+	var out []rfb.Session
+	return out, c.do(http.MethodGet, "/sessions", nil, &out)
+}
+
+// GetSession returns the session with the given ID.
+func (c *Client) GetSession(id string) (*rfb.Session, error) {
+	out := &rfb.Session{}
+	return out, c.do(http.MethodGet, "/sessions/"+url.PathEscape(id), nil, out)
+}
+
+// Disconnect disconnects the session with the given ID.
+func (c *Client) Disconnect(id string) error {
+	return c.do(http.MethodDelete, "/sessions/"+url.PathEscape(id), nil, nil)
+}
+
+// SetViewOnly sets whether input from the session with the given ID is ignored.
+func (c *Client) SetViewOnly(id string, viewOnly bool) (*rfb.Session, error) {
+	out := &rfb.Session{}
+	return out, c.do(http.MethodPost, "/sessions/"+url.PathEscape(id)+"/view-only", &ViewOnlyRequest{ViewOnly: viewOnly}, out)
+}
+
+// RotatePassword sets the VNCAuth password for new connections. If password is empty,
+// the server generates one. The new password is returned.
+func (c *Client) RotatePassword(password string) (string, error) {
+	out := &PasswordResponse{}
+	return out.Password, c.do(http.MethodPost, "/password", &PasswordRequest{Password: password}, out)
+}
+
+// GetEncodings returns the encodings enabled for new connections.
+func (c *Client) GetEncodings() ([]string, error) {
+	var out []string
+	return out, c.do(http.MethodGet, "/encodings", nil, &out)
+}
+
+// SetEncodings sets the encodings enabled for new connections.
+func (c *Client) SetEncodings(names []string) ([]string, error) {
+	var out []string
+	return out, c.do(http.MethodPut, "/encodings", names, &out)
+}
+
+// GetSecurityTypes returns the security types enabled for new connections.
+func (c *Client) GetSecurityTypes() ([]string, error) {
+	var out []string
+	return out, c.do(http.MethodGet, "/security-types", nil, &out)
+}
+
+// SetSecurityTypes sets the security types enabled for new connections.
+func (c *Client) SetSecurityTypes(names []string) ([]string, error) {
+	var out []string
+	return out, c.do(http.MethodPut, "/security-types", names, &out)
+}
+
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	if c.display != "" {
+		path += "?display=" + url.QueryEscape(c.display)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		errRes := &ErrorResponse{}
+		if err := json.NewDecoder(res.Body).Decode(errRes); err != nil || errRes.Error == "" {
+			return fmt.Errorf("Admin API returned %s", res.Status)
+		}
+		return fmt.Errorf("Admin API returned %s: %s", res.Status, errRes.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
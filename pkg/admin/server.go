@@ -0,0 +1,254 @@
+// Package admin implements an HTTP API for managing a running gsvnc server.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+	"github.com/tinyzimmer/gsvnc/pkg/internal/util"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb"
+)
+
+// Server serves the admin API for an rfb server or router. All requests and responses
+// are JSON.
+//
+// With a router, sessions of all displays are managed, and the password, encodings and
+// security types requests apply to the display named by the display query parameter.
+//
+//	GET    /sessions                   List connected sessions
+//	GET    /sessions/{id}              Get a single session
+//	DELETE /sessions/{id}              Disconnect a session
+//	POST   /sessions/{id}/view-only    Set view-only for a session: {"viewOnly": true}
+//	POST   /password                   Rotate the VNCAuth password: {"password": "..."}
+//	                                   A password is generated if one is not provided.
+//	GET    /encodings                  List the encodings enabled for new connections
+//	PUT    /encodings                  Set the encodings enabled for new connections: ["TightEncoding"]
+//	GET    /security-types             List the security types enabled for new connections
+//	PUT    /security-types             Set the security types enabled for new connections: ["VNCAuth"]
+type Server struct {
+	sessions Sessions
+	display  func(r *http.Request) (*rfb.Server, error)
+	mux      *http.ServeMux
+}
+
+// Sessions is the session registry of an rfb.Server or rfb.Router.
+type Sessions interface {
+	GetSessions() []rfb.Session
+	GetSession(id string) (rfb.Session, error)
+	Disconnect(id string) error
+	SetViewOnly(id string, viewOnly bool) error
+}
+
+// NewServer returns a new admin server for the given rfb server.
+func NewServer(s *rfb.Server) *Server {
+	return newServer(s, func(*http.Request) (*rfb.Server, error) { return s, nil })
+}
+
+// NewRouterServer returns a new admin server for all displays of the given router.
+func NewRouterServer(router *rfb.Router) *Server {
+	return newServer(router, func(r *http.Request) (*rfb.Server, error) {
+		name := r.URL.Query().Get("display")
+		if name == "" {
+			return nil, errors.New("The display query parameter is required")
+		}
+		s := router.Display(name)
+		if s == nil {
+			return nil, fmt.Errorf("Unknown display %q", name)
+		}
+		return s, nil
+	})
+}
+
+func newServer(sessions Sessions, display func(r *http.Request) (*rfb.Server, error)) *Server {
+	a := &Server{sessions: sessions, display: display, mux: http.NewServeMux()}
+	a.mux.HandleFunc("/sessions", a.handleSessions)
+	a.mux.HandleFunc("/sessions/", a.handleSession)
+	a.mux.HandleFunc("/password", a.handlePassword)
+	a.mux.HandleFunc("/encodings", a.handleEncodings)
+	a.mux.HandleFunc("/security-types", a.handleSecurityTypes)
+	return a
+}
+
+// ServeHTTP implements http.Handler.
+func (a *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("Admin request: %s %s", r.Method, r.URL.Path)
+	a.mux.ServeHTTP(w, r)
+}
+
+// Serve serves the admin API on the given listener until the context is cancelled.
+func (a *Server) Serve(ctx context.Context, ln net.Listener) error {
+	srvr := &http.Server{Handler: a}
+	go func() {
+		<-ctx.Done()
+		srvr.Close()
+	}()
+	err := srvr.Serve(ln)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// PasswordRequest is the body of a password rotation request.
+type PasswordRequest struct {
+	Password string `json:"password,omitempty"`
+}
+
+// PasswordResponse is returned from a password rotation request.
+type PasswordResponse struct {
+	Password string `json:"password"`
+}
+
+// ViewOnlyRequest is the body of a view-only request.
+type ViewOnlyRequest struct {
+	ViewOnly bool `json:"viewOnly"`
+}
+
+// ErrorResponse is returned when a request fails.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func (a *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.sessions.GetSessions())
+}
+
+func (a *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
+	spl := strings.Split(path, "/")
+	id := spl[0]
+
+	switch {
+	case len(spl) == 1 && r.Method == http.MethodGet:
+		sess, err := a.sessions.GetSession(id)
+		if err != nil {
+			writeSessionError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, sess)
+
+	case len(spl) == 1 && r.Method == http.MethodDelete:
+		if err := a.sessions.Disconnect(id); err != nil {
+			writeSessionError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(spl) == 2 && spl[1] == "view-only" && r.Method == http.MethodPost:
+		var req ViewOnlyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := a.sessions.SetViewOnly(id, req.ViewOnly); err != nil {
+			writeSessionError(w, err)
+			return
+		}
+		sess, err := a.sessions.GetSession(id)
+		if err != nil {
+			writeSessionError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, sess)
+
+	default:
+		writeError(w, http.StatusNotFound, errors.New("Not found"))
+	}
+}
+
+func (a *Server) handlePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+	s, err := a.display(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !s.VNCAuthIsEnabled() {
+		writeError(w, http.StatusConflict, errors.New("VNCAuth is not enabled"))
+		return
+	}
+	var req PasswordRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if req.Password == "" {
+		req.Password = util.RandomString(8)
+	}
+	s.SetPassword(req.Password)
+	log.Info("VNCAuth password rotated via the admin API")
+	writeJSON(w, http.StatusOK, &PasswordResponse{Password: req.Password})
+}
+
+func (a *Server) handleEncodings(w http.ResponseWriter, r *http.Request) {
+	s, err := a.display(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	handleFeatures(w, r, s.GetEnabledEncodings, s.SetEnabledEncodings)
+}
+
+func (a *Server) handleSecurityTypes(w http.ResponseWriter, r *http.Request) {
+	s, err := a.display(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	handleFeatures(w, r, s.GetEnabledAuthTypes, s.SetEnabledAuthTypes)
+}
+
+func handleFeatures(w http.ResponseWriter, r *http.Request, get func() []string, set func([]string) error) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, get())
+	case http.MethodPut:
+		var names []string
+		if err := json.NewDecoder(r.Body).Decode(&names); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := set(names); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, get())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+	}
+}
+
+func writeSessionError(w http.ResponseWriter, err error) {
+	if err == rfb.ErrSessionNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &ErrorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("Error writing admin response: ", err.Error())
+	}
+}
@@ -0,0 +1,202 @@
+package admin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/auth"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/client"
+)
+
+// newTestServer serves an rfb server with the given options and its admin API, and
+// returns a client for the API along with the address of the rfb server.
+func newTestServer(t *testing.T, opts *rfb.ServerOpts) (*Client, string) {
+	t.Helper()
+	opts.Display = providers.NewCanvas(16, 8)
+	s := rfb.NewServer(opts)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		s.Serve(ctx, ln)
+	}()
+	srv := httptest.NewServer(NewServer(s))
+	t.Cleanup(func() {
+		srv.Close()
+		cancel()
+		<-served
+	})
+	return NewClient("tcp", strings.TrimPrefix(srv.URL, "http://")), ln.Addr().String()
+}
+
+func TestAdminDisconnect(t *testing.T) {
+	admin, addr := newTestServer(t, &rfb.ServerOpts{EnabledAuthTypes: []auth.Type{&auth.None{}}})
+	c, err := client.Dial(addr, time.Second*5, &client.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	done := make(chan error, 1)
+	go func() { done <- c.Run() }()
+
+	sessions, err := admin.ListSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("Expected one session, got %d", len(sessions))
+	}
+	id := sessions[0].ID
+	if sess, err := admin.GetSession(id); err != nil || sess.ID != id {
+		t.Fatalf("Expected session %s, got %v, %v", id, sess, err)
+	}
+	if err := admin.Disconnect(id); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected the client to be disconnected")
+	}
+	if err := admin.Disconnect(id); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("Expected a disconnected session to be not found, got %v", err)
+	}
+	if _, err := admin.GetSession("nonexistent"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("Expected an unknown session to be not found, got %v", err)
+	}
+}
+
+func TestAdminRotatePassword(t *testing.T) {
+	admin, addr := newTestServer(t, &rfb.ServerOpts{
+		ServerPassword:   "initial",
+		EnabledAuthTypes: []auth.Type{&auth.VNCAuth{}},
+	})
+	connect := func(password string) error {
+		c, err := client.Dial(addr, time.Second*5, &client.Opts{Password: password})
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+	if err := connect("initial"); err != nil {
+		t.Fatal(err)
+	}
+
+	password, err := admin.RotatePassword("rotated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "rotated" {
+		t.Fatalf("Expected the given password to be returned, got %q", password)
+	}
+	if err := connect("initial"); err == nil {
+		t.Fatal("Expected the old password to be refused")
+	}
+	if err := connect("rotated"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A password is generated when none is given
+	if password, err = admin.RotatePassword(""); err != nil {
+		t.Fatal(err)
+	}
+	if len(password) != 8 {
+		t.Fatalf("Expected a generated password of 8 characters, got %q", password)
+	}
+	if err := connect(password); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdminRotatePasswordWithoutVNCAuth(t *testing.T) {
+	admin, _ := newTestServer(t, &rfb.ServerOpts{EnabledAuthTypes: []auth.Type{&auth.None{}}})
+	if _, err := admin.RotatePassword("rotated"); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Fatalf("Expected a conflict without VNCAuth, got %v", err)
+	}
+}
+
+func TestAdminFeatures(t *testing.T) {
+	admin, _ := newTestServer(t, &rfb.ServerOpts{})
+	for _, tc := range []struct {
+		name  string
+		get   func() ([]string, error)
+		set   func([]string) ([]string, error)
+		valid []string
+	}{
+		{"Encodings", admin.GetEncodings, admin.SetEncodings, []string{"RawEncoding", "TightEncoding"}},
+		{"SecurityTypes", admin.GetSecurityTypes, admin.SetSecurityTypes, []string{"VNCAuth"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.set(tc.valid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.valid, ",") {
+				t.Fatalf("Expected %v to be enabled, got %v", tc.valid, got)
+			}
+			if got, err = tc.get(); err != nil || strings.Join(got, ",") != strings.Join(tc.valid, ",") {
+				t.Fatalf("Expected %v to be listed, got %v, %v", tc.valid, got, err)
+			}
+			for _, invalid := range [][]string{{"Nonexistent"}, {}} {
+				if _, err := tc.set(invalid); err == nil || !strings.Contains(err.Error(), "400") {
+					t.Fatalf("Expected %v to be refused, got %v", invalid, err)
+				}
+			}
+			if got, _ = tc.get(); strings.Join(got, ",") != strings.Join(tc.valid, ",") {
+				t.Fatalf("Expected a refused request to leave %v enabled, got %v", tc.valid, got)
+			}
+		})
+	}
+}
+
+func TestAdminRouterRequiresDisplay(t *testing.T) {
+	router := rfb.NewRouter(&rfb.RouterOpts{})
+	if err := router.Add("a", rfb.NewServer(&rfb.ServerOpts{Display: providers.NewCanvas(16, 8)})); err != nil {
+		t.Fatal(err)
+	}
+	defer router.Shutdown(context.Background())
+	srv := httptest.NewServer(NewRouterServer(router))
+	defer srv.Close()
+	admin := NewClient("tcp", strings.TrimPrefix(srv.URL, "http://"))
+
+	if _, err := admin.SetEncodings([]string{"RawEncoding"}); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("Expected a request without a display to be refused, got %v", err)
+	}
+	if _, err := admin.ForDisplay("b").SetEncodings([]string{"RawEncoding"}); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("Expected a request for an unknown display to be refused, got %v", err)
+	}
+	got, err := admin.ForDisplay("a").SetEncodings([]string{"RawEncoding"})
+	if err != nil || len(got) != 1 || got[0] != "RawEncoding" {
+		t.Fatalf("Expected only RawEncoding on display a, got %v, %v", got, err)
+	}
+}
+
+func TestAdminMethodNotAllowed(t *testing.T) {
+	srv := httptest.NewServer(NewServer(rfb.NewServer(&rfb.ServerOpts{Display: providers.NewCanvas(16, 8)})))
+	defer srv.Close()
+	for _, path := range []string{"/sessions", "/password", "/encodings", "/security-types"} {
+		req, err := http.NewRequest(http.MethodPatch, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusMethodNotAllowed {
+			t.Fatalf("Expected PATCH %s to be refused, got %s", path, res.Status)
+		}
+	}
+}
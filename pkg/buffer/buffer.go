@@ -6,6 +6,7 @@ import (
 	"errors"
 	"net"
 	"reflect"
+	"sync"
 )
 
 // ReadWriter is a buffer read/writer for RFB conncetions. It is held in a separate
@@ -17,28 +18,57 @@ type ReadWriter struct {
 	br *bufio.Reader
 	bw *bufio.Writer
 
-	wq chan []byte
+	wq        chan []byte
+	closing   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // NewReadWriteBuffer returns a new ReadWriter for the given connection.
 func NewReadWriteBuffer(c net.Conn) *ReadWriter {
 	rw := &ReadWriter{
-		br: bufio.NewReader(c),
-		bw: bufio.NewWriter(c),
-		wq: make(chan []byte, 100),
+		br:      bufio.NewReader(c),
+		bw:      bufio.NewWriter(c),
+		wq:      make(chan []byte, 100),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
 	}
-	go func() {
-		for msg := range rw.wq {
+	go rw.writeLoop()
+	return rw
+}
+
+// writeLoop writes out queued messages until the buffer is closed, then writes
+// whatever is left on the queue.
+func (rw *ReadWriter) writeLoop() {
+	defer close(rw.done)
+	for {
+		select {
+		case msg := <-rw.wq:
 			rw.write(msg)
 			rw.flush()
+		case <-rw.closing:
+			for {
+				select {
+				case msg := <-rw.wq:
+					rw.write(msg)
+					rw.flush()
+				default:
+					return
+				}
+			}
 		}
-	}()
-	return rw
+	}
 }
 
-// Close will stop this buffer from processing messages.
+// Close will stop this buffer from processing messages. Messages already on the
+// queue are written out before it returns, and any dispatched afterwards are dropped.
+//
+// Dispatches blocked on a full queue return once the buffer is closed. If the
+// connection isn't being read from, set a write deadline on it first so the queued
+// messages don't block Close.
 func (rw *ReadWriter) Close() {
-	close(rw.wq)
+	rw.closeOnce.Do(func() { close(rw.closing) })
+	<-rw.done
 }
 
 // Reader returns a direct reference to the underlying reader.
@@ -98,5 +128,16 @@ func (rw *ReadWriter) flush() error {
 	return rw.bw.Flush()
 }
 
-// Dispatch will push packed message(s) onto the buffer queue.
-func (rw *ReadWriter) Dispatch(msg []byte) { rw.wq <- msg }
+// Dispatch will push packed message(s) onto the buffer queue. It blocks while the
+// queue is full, and the message is dropped if the buffer is closed.
+func (rw *ReadWriter) Dispatch(msg []byte) {
+	select {
+	case <-rw.closing:
+		return
+	default:
+	}
+	select {
+	case rw.wq <- msg:
+	case <-rw.closing:
+	}
+}
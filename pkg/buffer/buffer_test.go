@@ -0,0 +1,113 @@
+package buffer
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCloseFlushesQueue(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	rw := NewReadWriteBuffer(server)
+
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(client)
+		received <- data
+	}()
+
+	for _, msg := range []string{"hello ", "world"} {
+		rw.Dispatch([]byte(msg))
+	}
+	rw.Close()
+	server.Close()
+
+	select {
+	case data := <-received:
+		if string(data) != "hello world" {
+			t.Fatalf("Expected the queued messages to be written, got %q", data)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Timed out reading the queued messages")
+	}
+}
+
+func TestDispatchAfterClose(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	rw := NewReadWriteBuffer(server)
+	rw.Close()
+	rw.Close() // Closing twice is a no-op
+
+	done := make(chan struct{})
+	go func() {
+		rw.Dispatch([]byte("dropped"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Dispatch blocked on a closed buffer")
+	}
+}
+
+func TestCloseUnblocksFullQueue(t *testing.T) {
+	// Nothing reads from the client side, so the writer blocks and the queue fills up
+	server, client := net.Pipe()
+	defer client.Close()
+	rw := NewReadWriteBuffer(server)
+
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		for i := 0; i < cap(rw.wq)*2; i++ {
+			rw.Dispatch([]byte("message"))
+		}
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	server.SetWriteDeadline(time.Now())
+	closed := make(chan struct{})
+	go func() {
+		rw.Close()
+		close(closed)
+	}()
+	for _, ch := range []chan struct{}{closed, dispatched} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second * 5):
+			t.Fatal("Close and Dispatch deadlocked on a full queue")
+		}
+	}
+}
+
+func TestReadInto(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	rw := NewReadWriteBuffer(server)
+	defer rw.Close()
+
+	go client.Write([]byte{0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x03})
+	var msg struct {
+		A uint8
+		B uint16
+		C uint32
+	}
+	if err := rw.ReadInto(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.A != 1 || msg.B != 2 || msg.C != 3 {
+		t.Fatalf("Unexpected message %+v", msg)
+	}
+	if err := rw.ReadInto(msg); err == nil {
+		t.Fatal("Expected an error for a non-pointer")
+	}
+
+	server.Close()
+	if _, err := rw.ReadByte(); err != io.EOF && err != io.ErrClosedPipe {
+		t.Fatalf("Expected the closed connection to fail reads, got %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+// Package certs provides TLS certificates for gsvnc listeners, either loaded from
+// files or self-signed, with support for reloading them at runtime.
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SelfSignedValidity is how long generated certificates are valid for.
+const SelfSignedValidity = time.Hour * 24 * 365
+
+// Reloader holds a certificate that can be swapped out while listeners are using it.
+type Reloader struct {
+	load func() (*tls.Certificate, error)
+	cert *tls.Certificate
+	mux  sync.RWMutex
+}
+
+// NewFileReloader returns a Reloader for the given PEM encoded certificate and key files.
+// If selfSigned is true and neither file exists, a self-signed certificate for the given
+// hosts is generated and written to them first.
+func NewFileReloader(certFile, keyFile string, selfSigned bool, hosts []string) (*Reloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("Both a certificate and key file are required")
+	}
+	if selfSigned && !exists(certFile) && !exists(keyFile) {
+		certPEM, keyPEM, err := generate(hosts)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return newReloader(func() (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &cert, nil
+	})
+}
+
+// NewSelfSignedReloader returns a Reloader for an in-memory self-signed certificate for the
+// given hosts. The certificate is generated once, reloading it is a no-op.
+func NewSelfSignedReloader(hosts []string) (*Reloader, error) {
+	certPEM, keyPEM, err := generate(hosts)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return newReloader(func() (*tls.Certificate, error) { return &cert, nil })
+}
+
+func newReloader(load func() (*tls.Certificate, error)) (*Reloader, error) {
+	r := &Reloader{load: load}
+	return r, r.Reload()
+}
+
+// Reload reloads the certificate. New connections use the new certificate, the current
+// one is kept if loading fails.
+func (r *Reloader) Reload() error {
+	cert, err := r.load()
+	if err != nil {
+		return err
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.cert = cert
+	return nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the current certificate.
+func (r *Reloader) Fingerprint() string {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return Fingerprint(r.cert)
+}
+
+// GetCertificate returns the current certificate. It implements tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return r.cert, nil
+}
+
+// TLSConfig returns a server TLS configuration using the current certificate.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+}
+
+// Fingerprint returns the colon separated SHA-256 fingerprint of the leaf of the given
+// certificate.
+func Fingerprint(cert *tls.Certificate) string {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// generate returns a PEM encoded self-signed certificate and key for the given hosts.
+func generate(hosts []string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"gsvnc"}, CommonName: "gsvnc"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(SelfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,172 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePair generates a self-signed certificate for the given hosts and writes it to
+// the given files.
+func writePair(t *testing.T, certFile, keyFile string, hosts ...string) {
+	t.Helper()
+	certPEM, keyPEM, err := generate(hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// currentLeaf returns the parsed leaf certificate returned by GetCertificate.
+func currentLeaf(t *testing.T, r *Reloader) *x509.Certificate {
+	t.Helper()
+	cert, err := r.TLSConfig().GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+func TestFileReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	// Without the files a certificate is generated for the hosts
+	r, err := NewFileReloader(certFile, keyFile, true, []string{"vnc.example.com", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := currentLeaf(t, r)
+	if err := leaf.VerifyHostname("vnc.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(keyFile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("Expected the key to be written with mode 0600, got %v, %v", fi, err)
+	}
+	first := r.Fingerprint()
+	if len(first) != 32*3-1 {
+		t.Fatalf("Unexpected fingerprint %q", first)
+	}
+
+	// A new pair written to the files is picked up on reload
+	writePair(t, certFile, keyFile, "other.example.com")
+	if got := currentLeaf(t, r); got.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Fatal("Expected the certificate to be kept until it is reloaded")
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := currentLeaf(t, r)
+	if reloaded.SerialNumber.Cmp(leaf.SerialNumber) == 0 || reloaded.VerifyHostname("other.example.com") != nil {
+		t.Fatal("Expected the new certificate after reloading")
+	}
+	if r.Fingerprint() == first {
+		t.Fatal("Expected the fingerprint to change after reloading")
+	}
+
+	// A broken pair is refused and the current certificate kept
+	if err := ioutil.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("Expected a broken key to be refused")
+	}
+	if got := currentLeaf(t, r); got.SerialNumber.Cmp(reloaded.SerialNumber) != 0 {
+		t.Fatal("Expected the current certificate to be kept after a failed reload")
+	}
+
+	// Existing files are not overwritten with a generated certificate
+	if _, err := NewFileReloader(certFile, keyFile, true, nil); err == nil {
+		t.Fatal("Expected the broken files to be loaded rather than replaced")
+	}
+}
+
+func TestFileReloaderServesTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writePair(t, certFile, keyFile, "127.0.0.1")
+	r, err := NewFileReloader(certFile, keyFile, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", r.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.(*tls.Conn).Handshake()
+			c.Close()
+		}
+	}()
+
+	// peer returns the fingerprint of the certificate presented by the listener
+	peer := func() string {
+		t.Helper()
+		c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		state := c.ConnectionState()
+		return Fingerprint(&tls.Certificate{Certificate: [][]byte{state.PeerCertificates[0].Raw}})
+	}
+	if got := peer(); got != r.Fingerprint() {
+		t.Fatalf("Expected the loaded certificate %s, got %s", r.Fingerprint(), got)
+	}
+	before := r.Fingerprint()
+	writePair(t, certFile, keyFile, "127.0.0.1")
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := peer(); got == before || got != r.Fingerprint() {
+		t.Fatalf("Expected new connections to get the reloaded certificate, got %s", got)
+	}
+}
+
+func TestFileReloaderErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewFileReloader("", filepath.Join(dir, "tls.key"), true, nil); err == nil {
+		t.Fatal("Expected a missing certificate file to be refused")
+	}
+	if _, err := NewFileReloader(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), false, nil); err == nil {
+		t.Fatal("Expected missing files to be refused without self-signing")
+	}
+}
+
+func TestSelfSignedReloader(t *testing.T) {
+	r, err := NewSelfSignedReloader([]string{"::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := currentLeaf(t, r)
+	if len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.ParseIP("::1")) {
+		t.Fatalf("Expected the certificate for ::1, got %v", leaf.IPAddresses)
+	}
+	before := r.Fingerprint()
+	if err := r.Reload(); err != nil || r.Fingerprint() != before {
+		t.Fatal("Expected reloading an in-memory certificate to keep it")
+	}
+}
@@ -0,0 +1,156 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tinyzimmer/gsvnc/pkg/admin"
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+	"github.com/tinyzimmer/gsvnc/pkg/listeners"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb"
+)
+
+var sessionsCmd = &cobra.Command{
+	Use:   "sessions",
+	Short: "Manage the sessions of a running gsvnc server.",
+	Long: `Manage the sessions of a running gsvnc server through its admin API.
+
+The server must be started with --admin. The same --admin-socket or --admin-addr
+flags given to the server are used to reach it.`,
+}
+
+var sessionsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the connected sessions.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sessions, err := newAdminClient().ListSessions()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tDISPLAY\tREMOTE ADDR\tSECURITY\tUSER\tENCODING\tVIEW ONLY\tCONNECTED\tRX\tTX")
+		for _, sess := range sessions {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%v\t%s\t%d\t%d\n",
+				sess.ID, sess.Display, sess.RemoteAddr, sess.AuthType, sess.Username, sess.Encoding, sess.ViewOnly,
+				time.Since(sess.ConnectedAt).Round(time.Second), sess.BytesRead, sess.BytesWritten,
+			)
+		}
+		return w.Flush()
+	},
+}
+
+var sessionsKillCmd = &cobra.Command{
+	Use:   "kill <id>...",
+	Short: "Disconnect one or more sessions.",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client := newAdminClient()
+		for _, id := range args {
+			if err := client.Disconnect(id); err != nil {
+				return fmt.Errorf("Could not disconnect session %s: %s", id, err.Error())
+			}
+			fmt.Println("Disconnected session", id)
+		}
+		return nil
+	},
+}
+
+func init() {
+	sessionsCmd.AddCommand(sessionsListCmd)
+	sessionsCmd.AddCommand(sessionsKillCmd)
+	RootCmd.AddCommand(sessionsCmd)
+}
+
+// defaultAdminSocket returns the default path of the admin API socket. Without
+// XDG_RUNTIME_DIR, it is kept in a directory of its own in the temp dir, which is
+// shared with other users.
+func defaultAdminSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "gsvnc.sock")
+	}
+	return filepath.Join(fallbackAdminDir(), "gsvnc.sock")
+}
+
+// fallbackAdminDir returns the directory of the admin socket when XDG_RUNTIME_DIR is unset.
+func fallbackAdminDir() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("gsvnc-%d", os.Getuid()))
+}
+
+// ensurePrivateDir creates a directory only the user can access, or checks that an
+// existing one is not accessible by other users.
+func ensurePrivateDir(dir string) error {
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	// Windows has no permission bits, and its temp dir is per user already
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("The directory %s is accessible by other users", dir)
+	}
+	return nil
+}
+
+func newAdminClient() *admin.Client {
+	if adminAddr != "" {
+		return admin.NewClient("tcp", adminAddr)
+	}
+	return admin.NewClient("unix", adminSocket)
+}
+
+// adminServeFunc returns a serve function for the admin API. With a router, the API
+// manages all of its displays.
+func adminServeFunc(router *rfb.Router) serveFunc {
+	return func(ctx context.Context, srvr *rfb.Server) error {
+		l, err := listenAdmin()
+		if err != nil {
+			return err
+		}
+		return newAdminServer(router, srvr).Serve(ctx, l)
+	}
+}
+
+func newAdminServer(router *rfb.Router, srvr *rfb.Server) *admin.Server {
+	if router != nil {
+		return admin.NewRouterServer(router)
+	}
+	return admin.NewServer(srvr)
+}
+
+func listenAdmin() (net.Listener, error) {
+	var l net.Listener
+	var err error
+	if adminAddr != "" {
+		l, err = net.Listen("tcp", adminAddr)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Listening for admin API requests on ", adminAddr)
+	} else {
+		if filepath.Dir(adminSocket) == fallbackAdminDir() {
+			if err := ensurePrivateDir(fallbackAdminDir()); err != nil {
+				return nil, err
+			}
+		}
+		l, err = listeners.Unix(adminSocket, 0600)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Listening for admin API requests on ", adminSocket)
+	}
+	return l, nil
+}
@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultAdminSocket(t *testing.T) {
+	prev, ok := os.LookupEnv("XDG_RUNTIME_DIR")
+	defer func() {
+		if ok {
+			os.Setenv("XDG_RUNTIME_DIR", prev)
+		} else {
+			os.Unsetenv("XDG_RUNTIME_DIR")
+		}
+	}()
+
+	os.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	if got := defaultAdminSocket(); got != "/run/user/1000/gsvnc.sock" {
+		t.Fatalf("Expected the socket in XDG_RUNTIME_DIR, got %s", got)
+	}
+	os.Unsetenv("XDG_RUNTIME_DIR")
+	if got := defaultAdminSocket(); filepath.Dir(got) == os.TempDir() || filepath.Dir(got) != fallbackAdminDir() {
+		t.Fatalf("Expected the socket in a directory of its own, got %s", got)
+	}
+}
+
+func TestEnsurePrivateDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "gsvnc")
+	if err := ensurePrivateDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(dir); err != nil || fi.Mode().Perm() != 0700 {
+		t.Fatalf("Expected a directory with mode 0700, got %v, %v", fi, err)
+	}
+	if err := ensurePrivateDir(dir); err != nil {
+		t.Fatalf("Expected an existing private directory to be accepted, got %v", err)
+	}
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensurePrivateDir(dir); err == nil {
+		t.Fatal("Expected a directory other users can access to be refused")
+	}
+}
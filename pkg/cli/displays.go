@@ -0,0 +1,201 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+	"github.com/tinyzimmer/gsvnc/pkg/internal/util"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb"
+)
+
+var displaysFile string
+var displayTokensFile string
+var defaultDisplay string
+
+// displayConfig represents a display in the --displays file. Empty fields use the values
+// of the command line flags.
+type displayConfig struct {
+	Name            string            `json:"name"`
+	Provider        string            `json:"provider,omitempty"`
+	ProviderOptions map[string]string `json:"providerOptions,omitempty"`
+	Resolution      string            `json:"resolution,omitempty"`
+	Port            int32             `json:"port,omitempty"`
+	PasswordFile    string            `json:"passwordFile,omitempty"`
+	Encodings       []string          `json:"encodings,omitempty"`
+	SecurityTypes   []string          `json:"securityTypes,omitempty"`
+}
+
+// routedDisplay is a display served by the router along with the port it listens on.
+type routedDisplay struct {
+	name   string
+	port   int32
+	server *rfb.Server
+}
+
+func loadDisplays(path string) ([]*displayConfig, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []*displayConfig
+	if err := json.Unmarshal(body, &configs); err != nil {
+		return nil, fmt.Errorf("Could not parse displays file %s: %s", path, err.Error())
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("No displays defined in %s", path)
+	}
+	return configs, nil
+}
+
+// loadDisplayTokens reads a websockify style token file. Each line maps a token to the
+// name of a display, as in "token: name". Empty lines and lines starting with # are ignored.
+func loadDisplayTokens(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		spl := strings.SplitN(line, ":", 2)
+		if len(spl) != 2 || strings.TrimSpace(spl[0]) == "" || strings.TrimSpace(spl[1]) == "" {
+			return nil, fmt.Errorf("%s:%d: expected \"token: display\"", path, lineNo)
+		}
+		tokens[strings.TrimSpace(spl[0])] = strings.TrimSpace(spl[1])
+	}
+	return tokens, scanner.Err()
+}
+
+// buildRouter creates a server for each display in the --displays file, starting from the
+// given options, and returns a router for them.
+func buildRouter(base *rfb.ServerOpts) (*rfb.Router, []*routedDisplay, error) {
+	configs, err := loadDisplays(displaysFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	routerOpts := &rfb.RouterOpts{
+		TokenValidator: base.TokenValidator,
+		TokenParam:     base.TokenParam,
+		WebRoot:        base.WebRoot,
+	}
+	if displayTokensFile != "" {
+		if routerOpts.Tokens, err = loadDisplayTokens(displayTokensFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	router := rfb.NewRouter(routerOpts)
+
+	displays := make([]*routedDisplay, 0, len(configs))
+	for i, cfg := range configs {
+		opts := *base
+		// The --display-opt flags belong to the --display provider, so they don't carry
+		// over to a display using a different one.
+		if cfg.Provider != "" || cfg.ProviderOptions != nil {
+			opts.DisplayProviderOptions = cfg.ProviderOptions
+		}
+		if cfg.Provider != "" {
+			opts.DisplayProvider = providers.Provider(cfg.Provider)
+		}
+		if cfg.Resolution != "" {
+			if opts.Width, opts.Height, err = parseResolution(cfg.Resolution); err != nil {
+				return nil, nil, err
+			}
+		}
+		if cfg.PasswordFile != "" {
+			passw, err := ioutil.ReadFile(cfg.PasswordFile)
+			if err != nil {
+				return nil, nil, err
+			}
+			opts.ServerPassword = string(passw)
+		}
+
+		// The server uses this instance, so the provider is only created once
+		if opts.Display, err = providers.New(opts.DisplayProvider, opts.DisplayProviderOptions); err != nil {
+			return nil, nil, fmt.Errorf("Display provider for %q is invalid: %s", cfg.Name, err.Error())
+		}
+		if opts.Width == 0 || opts.Height == 0 {
+			opts.Width, opts.Height = detectSize(opts.Display)
+		}
+		server := rfb.NewServer(&opts)
+		if len(cfg.Encodings) > 0 {
+			if err := server.SetEnabledEncodings(cfg.Encodings); err != nil {
+				return nil, nil, fmt.Errorf("Display %q: %s", cfg.Name, err.Error())
+			}
+		}
+		if len(cfg.SecurityTypes) > 0 {
+			if err := server.SetEnabledAuthTypes(cfg.SecurityTypes); err != nil {
+				return nil, nil, fmt.Errorf("Display %q: %s", cfg.Name, err.Error())
+			}
+			if server.VNCAuthIsEnabled() && opts.ServerPassword == "" && len(opts.Users) == 0 {
+				opts.ServerPassword = util.RandomString(8)
+				server.SetPassword(opts.ServerPassword)
+				log.Infof("Clients using VNCAuth can connect to display %q with the following password: %s", cfg.Name, opts.ServerPassword)
+			}
+		}
+		if err := router.Add(cfg.Name, server); err != nil {
+			return nil, nil, err
+		}
+
+		port := cfg.Port
+		if port == 0 {
+			port = bindPort + int32(i)
+		}
+		log.Infof("Display %q: provider %s, resolution %dx%d, port %d", cfg.Name, opts.DisplayProvider, opts.Width, opts.Height, port)
+		displays = append(displays, &routedDisplay{name: cfg.Name, port: port, server: server})
+	}
+	return router, displays, nil
+}
+
+// defaultRoutedDisplay returns the display served by the listeners that can't select
+// one, named by --default-display or the first one.
+func defaultRoutedDisplay(displays []*routedDisplay) (*routedDisplay, error) {
+	if defaultDisplay == "" {
+		return displays[0], nil
+	}
+	for _, d := range displays {
+		if d.name == defaultDisplay {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("--default-display %q is not defined in %s", defaultDisplay, displaysFile)
+}
+
+// displayServeFunc returns a serve function for the rfb listener of a routed display.
+func displayServeFunc(d *routedDisplay) serveFunc {
+	return func(ctx context.Context, _ *rfb.Server) error {
+		bindAddr := net.JoinHostPort(bindHost, strconv.Itoa(int(d.port)))
+		l, err := listenRFB(bindAddr)
+		if err != nil {
+			return err
+		}
+		log.Infof("Listening for rfb connections to display %q on %s", d.name, bindAddr)
+		return d.server.Serve(ctx, l)
+	}
+}
+
+// routerServeFunc returns a serve function for the websockify listener of the router.
+func routerServeFunc(router *rfb.Router) serveFunc {
+	return func(ctx context.Context, _ *rfb.Server) error {
+		l, scheme, err := listenWebsockify()
+		if err != nil {
+			return err
+		}
+		log.Infof("Displays are available at %s://%s/ws/<name>", scheme, l.Addr())
+		return router.ServeWebsockify(ctx, l)
+	}
+}
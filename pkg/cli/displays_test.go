@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb"
+)
+
+// writeDisplaysFile points --displays at a file with the given contents for the test.
+func writeDisplaysFile(t *testing.T, body string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "displays.json")
+	if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	prev := displaysFile
+	displaysFile = path
+	t.Cleanup(func() { displaysFile = prev })
+}
+
+func TestBuildRouterWithDefaultProvider(t *testing.T) {
+	writeDisplaysFile(t, `[
+		{"name": "a", "resolution": "64x48"},
+		{"name": "b", "port": 5999, "encodings": ["RawEncoding"]}
+	]`)
+	// The displays use the default provider of the --display flag
+	router, displays, err := buildRouter(&rfb.ServerOpts{
+		DisplayProvider: providers.Provider(RootCmd.PersistentFlags().Lookup("display").DefValue),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Shutdown(context.Background())
+
+	if names := router.Displays(); len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Fatalf("Expected the displays a and b, got %v", names)
+	}
+	if displays[0].port != bindPort || displays[1].port != 5999 {
+		t.Fatalf("Expected the ports %d and 5999, got %d and %d", bindPort, displays[0].port, displays[1].port)
+	}
+	if encs := displays[1].server.GetEnabledEncodings(); len(encs) != 1 || encs[0] != "RawEncoding" {
+		t.Fatalf("Expected only RawEncoding on display b, got %v", encs)
+	}
+	def, err := defaultRoutedDisplay(displays)
+	if err != nil || def.name != "a" {
+		t.Fatalf("Expected the first display to be the default, got %v, %v", def, err)
+	}
+}
+
+func TestBuildRouterInvalidProvider(t *testing.T) {
+	writeDisplaysFile(t, `[{"name": "a", "provider": "nonexistent"}]`)
+	if _, _, err := buildRouter(&rfb.ServerOpts{}); err == nil {
+		t.Fatal("Expected an unknown provider to be refused")
+	}
+}
@@ -2,29 +2,41 @@ package cli
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"text/tabwriter"
+	"time"
 
 	"github.com/go-vgo/robotgo"
 	"github.com/spf13/cobra"
 
 	"github.com/tinyzimmer/go-gst/gst"
 
+	"github.com/tinyzimmer/gsvnc/pkg/certs"
 	"github.com/tinyzimmer/gsvnc/pkg/config"
+	"github.com/tinyzimmer/gsvnc/pkg/display"
 	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
 	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
 	"github.com/tinyzimmer/gsvnc/pkg/internal/util"
+	"github.com/tinyzimmer/gsvnc/pkg/listeners"
 	"github.com/tinyzimmer/gsvnc/pkg/rfb"
 	"github.com/tinyzimmer/gsvnc/pkg/rfb/auth"
 	"github.com/tinyzimmer/gsvnc/pkg/rfb/encodings"
 	"github.com/tinyzimmer/gsvnc/pkg/rfb/events"
+	"github.com/tinyzimmer/gsvnc/pkg/token"
+	"github.com/tinyzimmer/gsvnc/pkg/webclient"
 )
 
 var bindHost string
@@ -32,11 +44,46 @@ var bindPort int32
 var initialResolution string
 var listFeatures bool
 var displayProvider string
+var displayOptions map[string]string
+var gstPipeline, gstScaleMethod, gstRegion string
+var gstFPS float64
+var gstMonitor int
 var websockify bool
 var websockifyHost string
 var websockifyPort int32
 var noTCP bool
 var serverPasswordFile string
+var usersFile string
+var clipboardDirection string
+var clipboardMaxSize int
+var clipboardRedact []string
+var clipboardRedactWith string
+var clipboardBlock []string
+var sharePolicy string
+var versionTimeout, authTimeout, clientInitTimeout time.Duration
+var maxConnections int
+var shutdownTimeout time.Duration
+var adminEnabled bool
+var adminSocket string
+var adminAddr string
+var connectAddrs []string
+var reconnect bool
+var reconnectMinBackoff, reconnectMaxBackoff time.Duration
+var reconnectMaxAttempts int
+var repeaterAddr, repeaterID, repeaterDest string
+var unixSocket, unixSocketMode string
+var serveStdio bool
+var systemdActivation bool
+var rfbTLS, websockifyTLS bool
+var tlsCertFile, tlsKeyFile string
+var tlsSelfSigned bool
+var certReloader *certs.Reloader
+var websockifyPath string
+var webDir string
+var noWeb bool
+var allowedOrigins []string
+var tokenSecretFile string
+var tokenParam string
 
 // RootCmd is the exported root cmd for the gsvnc server.
 var RootCmd = &cobra.Command{
@@ -57,6 +104,7 @@ By default only core security types and encodings are enabled, however you can d
 A list of all available features and their default status can be obtained with --list-features.
    (You can also use this command to see the effect of the positional flags)
 `,
+	Args: cobra.ArbitraryArgs,
 	RunE: run,
 }
 
@@ -67,12 +115,59 @@ func init() {
 	RootCmd.PersistentFlags().Int32VarP(&bindPort, "port", "p", 5900, "The port to bind the server to.")
 	RootCmd.PersistentFlags().StringVarP(&initialResolution, "resolution", "r", "", "The initial resolution to set for display connections. Defaults to auto-detect.")
 	RootCmd.PersistentFlags().StringVarP(&serverPasswordFile, "password-file", "", "", "A file to read in a server password from. One will be generated if this is omitted.")
+	RootCmd.PersistentFlags().StringVarP(&usersFile, "users-file", "", "", "A file of username:password lines. Clients using VNCAuth that send one of these passwords are recorded as that user.")
 	RootCmd.PersistentFlags().BoolVarP(&listFeatures, "list-features", "l", false, "List the available features and exit.")
 	RootCmd.PersistentFlags().StringVarP(&displayProvider, "display", "D", providers.ProviderGstreamer, "The display provider to use for RFB connections.")
+	RootCmd.PersistentFlags().StringToStringVarP(&displayOptions, "display-opt", "", nil, "Options for the display provider as key=value pairs. See --list-features for the options of each provider.")
+	RootCmd.PersistentFlags().StringVarP(&gstPipeline, "gst-pipeline", "", "", "A gst-launch style description of the video source for the gstreamer provider, such as \"videotestsrc\". Defaults to capturing the screen.")
+	RootCmd.PersistentFlags().Float64VarP(&gstFPS, "gst-fps", "", 5, "The number of frames the gstreamer provider captures per second.")
+	RootCmd.PersistentFlags().StringVarP(&gstScaleMethod, "gst-scale-method", "", "nearest-neighbour", "The videoscale method the gstreamer provider fits frames to the display with.")
+	RootCmd.PersistentFlags().IntVarP(&gstMonitor, "gst-monitor", "", -1, "The screen the gstreamer provider captures. -1 captures the default screen.")
+	RootCmd.PersistentFlags().StringVarP(&gstRegion, "gst-region", "", "", "The region of the screen the gstreamer provider captures, as STARTX,STARTY,ENDX,ENDY.")
 	RootCmd.PersistentFlags().BoolVarP(&websockify, "websockify", "w", false, "Start a websockify listener")
 	RootCmd.PersistentFlags().StringVarP(&websockifyHost, "websockify-host", "W", "127.0.0.1", "The host address to bind the websockify server to.")
 	RootCmd.PersistentFlags().Int32VarP(&websockifyPort, "websockify-port", "P", 8080, "The port to bind the websockify server to.")
+	RootCmd.PersistentFlags().StringVarP(&websockifyPath, "websockify-path", "", rfb.DefaultWebsockifyPath, "The path to accept websockify connections on.")
+	RootCmd.PersistentFlags().StringVarP(&webDir, "web-dir", "", "", "Serve this directory from the websockify listener instead of the built-in web client, e.g. a noVNC checkout.")
+	RootCmd.PersistentFlags().BoolVarP(&noWeb, "no-web", "", false, "Don't serve a web client from the websockify listener.")
+	RootCmd.PersistentFlags().StringSliceVarP(&allowedOrigins, "websockify-allowed-origins", "", nil, "Origins allowed to open websockify connections, or \"*\" for any. Defaults to any origin, or only the same origin for tokens read from cookies.")
+	RootCmd.PersistentFlags().StringVarP(&tokenSecretFile, "token-secret-file", "", "", "A file containing the HMAC secret for signed websockify tokens. When set, websockify connections require a valid token.")
+	RootCmd.PersistentFlags().StringVarP(&tokenParam, "token-param", "", rfb.DefaultTokenParam, "The query parameter or cookie websockify tokens are read from.")
 	RootCmd.PersistentFlags().BoolVarP(&noTCP, "no-tcp", "T", false, "Disable the TCP listener. Only makes sense with --websockify.")
+	RootCmd.PersistentFlags().StringVarP(&clipboardDirection, "clipboard", "", string(display.ClipboardBoth), "The direction(s) clipboard data may flow. One of off, client-to-server, server-to-client, or both.")
+	RootCmd.PersistentFlags().IntVarP(&clipboardMaxSize, "clipboard-max-size", "", 0, "The maximum size in bytes of clipboard transfers. Defaults to no limit beyond the built-in hard cap.")
+	RootCmd.PersistentFlags().StringSliceVarP(&clipboardRedact, "clipboard-redact", "", nil, "A regular expression whose matches are redacted from clipboard transfers. Can be specified multiple times.")
+	RootCmd.PersistentFlags().StringVarP(&clipboardRedactWith, "clipboard-redact-with", "", "[REDACTED]", "The text to replace redacted clipboard content with.")
+	RootCmd.PersistentFlags().StringSliceVarP(&clipboardBlock, "clipboard-block", "", nil, "A regular expression that blocks any clipboard transfer it matches. Can be specified multiple times.")
+	RootCmd.PersistentFlags().StringVarP(&sharePolicy, "share-policy", "", string(rfb.SharePolicyDisconnect), "How to handle clients requesting exclusive access. One of disconnect, refuse, or always (treat every client as shared).")
+	RootCmd.PersistentFlags().DurationVarP(&versionTimeout, "version-timeout", "", rfb.DefaultVersionTimeout, "The deadline for clients to complete the protocol version handshake.")
+	RootCmd.PersistentFlags().DurationVarP(&authTimeout, "auth-timeout", "", rfb.DefaultAuthTimeout, "The deadline for clients to complete authentication.")
+	RootCmd.PersistentFlags().DurationVarP(&clientInitTimeout, "client-init-timeout", "", rfb.DefaultClientInitTimeout, "The deadline for clients to send their ClientInit message.")
+	RootCmd.PersistentFlags().IntVarP(&maxConnections, "max-connections", "", 0, "The maximum number of concurrent client connections. Zero means unlimited.")
+	RootCmd.PersistentFlags().DurationVarP(&shutdownTimeout, "shutdown-timeout", "", time.Second*10, "How long to wait for clients to disconnect when shutting down.")
+	RootCmd.PersistentFlags().BoolVarP(&adminEnabled, "admin", "", false, "Start the admin API listener.")
+	RootCmd.PersistentFlags().StringVarP(&adminSocket, "admin-socket", "", defaultAdminSocket(), "The unix socket to serve the admin API on.")
+	RootCmd.PersistentFlags().StringVarP(&adminAddr, "admin-addr", "", "", "A TCP address to serve the admin API on instead of the unix socket. The API is unauthenticated, so only bind to trusted interfaces.")
+	RootCmd.PersistentFlags().StringSliceVarP(&connectAddrs, "connect", "", nil, "The host:port of a listening viewer to connect to. The port defaults to 5500. Can be specified multiple times.")
+	RootCmd.PersistentFlags().BoolVarP(&reconnect, "reconnect", "", false, "Reconnect to listening viewers when the connection fails or is closed.")
+	RootCmd.PersistentFlags().DurationVarP(&reconnectMinBackoff, "reconnect-min-backoff", "", rfb.DefaultConnectMinBackoff, "The initial delay between reconnect attempts.")
+	RootCmd.PersistentFlags().DurationVarP(&reconnectMaxBackoff, "reconnect-max-backoff", "", rfb.DefaultConnectMaxBackoff, "The maximum delay between reconnect attempts.")
+	RootCmd.PersistentFlags().IntVarP(&reconnectMaxAttempts, "reconnect-max-attempts", "", 0, "The number of consecutive failed reconnect attempts before giving up. Zero means unlimited.")
+	RootCmd.PersistentFlags().StringVarP(&repeaterAddr, "repeater", "", "", "The host:port of an UltraVNC repeater to connect to. Requires one of --repeater-id or --repeater-dest.")
+	RootCmd.PersistentFlags().StringVarP(&repeaterID, "repeater-id", "", "", "Register with the repeater under this numeric ID (mode II). The port defaults to 5500.")
+	RootCmd.PersistentFlags().StringVarP(&repeaterDest, "repeater-dest", "", "", "Have the repeater route to a listening viewer at this host:port (mode I). The port defaults to 5901.")
+	RootCmd.PersistentFlags().StringVarP(&unixSocket, "unix-socket", "", "", "A unix socket to listen for rfb connections on, in addition to the TCP listener.")
+	RootCmd.PersistentFlags().StringVarP(&unixSocketMode, "unix-socket-mode", "", "0600", "The permissions to set on the --unix-socket.")
+	RootCmd.PersistentFlags().BoolVarP(&serveStdio, "stdio", "", false, "Serve a single rfb connection on stdin/stdout and exit, as when run from inetd. No other listeners are started.")
+	RootCmd.PersistentFlags().BoolVarP(&systemdActivation, "systemd", "", false, "Use the sockets passed by systemd socket activation instead of the TCP and websockify listeners. Sockets named \"websockify\" or \"admin\" (FileDescriptorName=) serve those, all others serve rfb.")
+	RootCmd.PersistentFlags().BoolVarP(&rfbTLS, "rfb-tls", "", false, "Wrap the rfb TCP listener in TLS, as with stunnel.")
+	RootCmd.PersistentFlags().BoolVarP(&websockifyTLS, "websockify-tls", "", false, "Serve the websockify listener over TLS (wss://).")
+	RootCmd.PersistentFlags().StringVarP(&tlsCertFile, "tls-cert", "", "", "A PEM encoded certificate file for the TLS listeners. Reloaded on SIGHUP.")
+	RootCmd.PersistentFlags().StringVarP(&tlsKeyFile, "tls-key", "", "", "A PEM encoded key file for the TLS listeners. Reloaded on SIGHUP.")
+	RootCmd.PersistentFlags().BoolVarP(&tlsSelfSigned, "tls-self-signed", "", false, "Generate a self-signed certificate for the TLS listeners. It is written to --tls-cert and --tls-key if they are given and don't exist yet.")
+	RootCmd.PersistentFlags().StringVarP(&displaysFile, "displays", "", "", "A JSON file defining several displays to serve. Each display listens on its own port (--port plus its index unless set) and on /ws/<name> of the websockify listener. The admin API manages all displays.")
+	RootCmd.PersistentFlags().StringVarP(&defaultDisplay, "default-display", "", "", "The display served by listeners that can't select one, such as --unix-socket, --connect and --repeater. Defaults to the first display in the --displays file.")
+	RootCmd.PersistentFlags().StringVarP(&displayTokensFile, "display-tokens", "", "", "A websockify style token file mapping tokens to display names, one \"token: name\" per line. Used with --displays.")
 	RootCmd.PersistentFlags().BoolVarP(&config.Debug, "debug", "d", false, "Enable debug logging.")
 }
 
@@ -87,33 +182,50 @@ func run(cmd *cobra.Command, args []string) error {
 		os.Exit(0)
 	}
 
+	// Under inetd stderr is usually the same socket as stdin/stdout, in which case
+	// logging would corrupt the stream.
+	if serveStdio {
+		if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			log.SetOutput(ioutil.Discard)
+		}
+	}
+
 	log.Info("Starting gsvnc")
 
-	// Make sure the configured display provider is valid.
-	if p := providers.GetDisplayProvider(providers.Provider(displayProvider)); p == nil {
-		return fmt.Errorf("Display provider is invalid: %s", displayProvider)
+	if err := applyGstreamerFlags(cmd); err != nil {
+		return err
 	}
-	log.Info("Using display provider: ", displayProvider)
 
-	// Configure initial display resolution
-	var w, h int
-	if initialResolution == "" {
-		w, h = robotgo.GetScreenSize()
-		log.Infof("Detected initial screen resolution of %dx%d", w, h)
-	} else {
-		spl := strings.Split(strings.ToLower(initialResolution), "x")
-		if len(spl) != 2 {
-			return fmt.Errorf("Could not parse provided resolution: %s", initialResolution)
+	// Make sure the configured display provider is valid. With several displays each
+	// one creates and checks its own.
+	var provider providers.Display
+	if displaysFile == "" {
+		if provider, err = providers.New(providers.Provider(displayProvider), displayOptions); err != nil {
+			return fmt.Errorf("Display provider is invalid: %s", err.Error())
 		}
-		w, err = strconv.Atoi(spl[0])
-		if err != nil {
-			return fmt.Errorf("Could not parse '%s' as an integer", spl[0])
-		}
-		h, err = strconv.Atoi(spl[1])
-		if err != nil {
-			return fmt.Errorf("Could not parse '%s' as an integer", spl[1])
+		log.Info("Using display provider: ", displayProvider)
+	}
+
+	// Configure initial display resolution. Displays without one detect their own.
+	var w, h int
+	if initialResolution != "" {
+		if w, h, err = parseResolution(initialResolution); err != nil {
+			return err
 		}
 		log.Infof("Using initial screen resolution of %dx%d", w, h)
+	} else if provider != nil {
+		w, h = detectSize(provider)
+		log.Infof("Detected initial screen resolution of %dx%d", w, h)
+	}
+
+	clipboardPolicy, err := buildClipboardPolicy()
+	if err != nil {
+		return err
+	}
+	log.Info("Clipboard direction: ", clipboardPolicy.Direction)
+
+	if !sharePolicyIsValid(sharePolicy) {
+		return fmt.Errorf("Invalid share policy %q, must be one of %v", sharePolicy, rfb.SharePolicies)
 	}
 
 	var enabledAuths, enabledEncs, enabledEvents []string
@@ -134,11 +246,64 @@ func run(cmd *cobra.Command, args []string) error {
 	opts := &rfb.ServerOpts{
 		Width: w, Height: h,
 		DisplayProvider:  providers.Provider(displayProvider),
+		Display:          provider,
 		EnabledAuthTypes: authTypes,
 		EnabledEncodings: encTypes,
 		EnabledEvents:    eventTypes,
+		ClipboardPolicy:  clipboardPolicy,
+		SharePolicy:      rfb.SharePolicy(sharePolicy),
+
+		DisplayProviderOptions: displayOptions,
+
+		VersionTimeout:    versionTimeout,
+		AuthTimeout:       authTimeout,
+		ClientInitTimeout: clientInitTimeout,
+		MaxConnections:    maxConnections,
+		WebsockifyPath:    websockifyPath,
+		AllowedOrigins:    allowedOrigins,
+		TokenParam:        tokenParam,
+	}
+
+	if tokenSecretFile != "" {
+		secret, err := readTokenSecret()
+		if err != nil {
+			return err
+		}
+		opts.TokenValidator = token.NewHMAC(secret)
+		log.Info("Websockify connections require a signed token")
+	}
+
+	switch {
+	case noWeb:
+	case webDir != "":
+		if fi, err := os.Stat(webDir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("Web directory %q does not exist or is not a directory", webDir)
+		}
+		opts.WebRoot = http.Dir(webDir)
+	default:
+		opts.WebRoot = webclient.FS()
 	}
 
+	if repeaterAddr != "" {
+		opts.Repeater = &rfb.RepeaterOpts{
+			Addr: repeaterAddr,
+			ID:   repeaterID,
+			Dest: repeaterDest,
+			ConnectOpts: rfb.ConnectOpts{
+				MinBackoff:  reconnectMinBackoff,
+				MaxBackoff:  reconnectMaxBackoff,
+				MaxAttempts: reconnectMaxAttempts,
+			},
+		}
+	} else if repeaterID != "" || repeaterDest != "" {
+		return errors.New("--repeater-id and --repeater-dest require --repeater")
+	}
+
+	if usersFile != "" {
+		if opts.Users, err = readUsersFile(usersFile); err != nil {
+			return err
+		}
+	}
 	if authIsEnabled(authTypes, "VNCAuth") {
 		if serverPasswordFile != "" {
 			passw, err := ioutil.ReadFile(serverPasswordFile)
@@ -146,47 +311,412 @@ func run(cmd *cobra.Command, args []string) error {
 				return err
 			}
 			opts.ServerPassword = string(passw)
-		} else {
+		} else if len(opts.Users) == 0 {
 			log.Info("VNCAuth is enabled and no password provided, generating a server password")
 			opts.ServerPassword = util.RandomString(8)
 			log.Info("Clients using VNCAuth can connect with the following password: ", opts.ServerPassword)
 		}
 	}
 
-	// Create a new rfb server
-	server := rfb.NewServer(opts)
+	// Create the rfb server, or one for each display. With several displays, the
+	// listeners that can't select a display serve the default one.
+	var server *rfb.Server
+	var router *rfb.Router
+	var displays []*routedDisplay
+	var target shutdowner
+	if displaysFile != "" {
+		if router, displays, err = buildRouter(opts); err != nil {
+			return err
+		}
+		def, err := defaultRoutedDisplay(displays)
+		if err != nil {
+			return err
+		}
+		if unixSocket != "" || len(connectAddrs) > 0 || repeaterAddr != "" || serveStdio || systemdActivation {
+			log.Infof("Listeners without a display path serve display %q", def.name)
+		}
+		server, target = def.server, router
+	} else {
+		server = rfb.NewServer(opts)
+		target = server
+	}
+
+	if rfbTLS || websockifyTLS {
+		certReloader, err = buildCertReloader()
+		if err != nil {
+			return err
+		}
+		log.Info("TLS certificate SHA-256 fingerprint: ", certReloader.Fingerprint())
+		go reloadCertsOnSignal(certReloader)
+	}
+
+	serveFuncs, err := buildServeFuncs(router, displays)
+	if err != nil {
+		return err
+	}
+
+	// The context is cancelled once the rfb server has shut down
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Shut down gracefully on SIGINT/SIGTERM
+	go shutdownOnSignal(target, cancel)
+
+	return runServers(ctx, cancel, server, target, serveFuncs)
+}
+
+// detectSize returns the size of the display of a provider, or of the screen if the
+// provider doesn't know it.
+func detectSize(provider providers.Display) (w, h int) {
+	if sizer, ok := provider.(providers.Sizer); ok {
+		w, h = sizer.Size()
+	}
+	if w == 0 || h == 0 {
+		w, h = robotgo.GetScreenSize()
+	}
+	return w, h
+}
 
-	if noTCP && !websockify {
-		return errors.New("No listeners configured")
+func parseResolution(res string) (w, h int, err error) {
+	spl := strings.Split(strings.ToLower(res), "x")
+	if len(spl) != 2 {
+		return 0, 0, fmt.Errorf("Could not parse provided resolution: %s", res)
+	}
+	w, err = strconv.Atoi(spl[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Could not parse '%s' as an integer", spl[0])
 	}
+	h, err = strconv.Atoi(spl[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Could not parse '%s' as an integer", spl[1])
+	}
+	return w, h, nil
+}
 
-	if noTCP && websockify {
-		// We are only doing websockify
-		return serveWebsockify(server)
+// serveFunc serves a listener for the server until it shuts down or the context is cancelled.
+type serveFunc func(context.Context, *rfb.Server) error
+
+// shutdowner is implemented by rfb.Server and rfb.Router.
+type shutdowner interface {
+	Shutdown(context.Context) error
+}
+
+// runServers runs all the given serve functions until they return. If any of them fail,
+// the server is shut down and the first error is returned.
+func runServers(ctx context.Context, cancel context.CancelFunc, server *rfb.Server, target shutdowner, serveFuncs []serveFunc) error {
+	errCh := make(chan error, len(serveFuncs))
+	for _, f := range serveFuncs {
+		go func(f serveFunc) { errCh <- f(ctx, server) }(f)
+	}
+	var firstErr error
+	for range serveFuncs {
+		err := <-errCh
+		if err == nil || err == rfb.ErrServerClosed || err == context.Canceled {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+			log.Error("Listener failed, shutting down: ", err.Error())
+			go shutdownServer(target, cancel)
+		}
 	}
+	return firstErr
+}
+
+func shutdownOnSignal(target shutdowner, cancel context.CancelFunc) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	log.Infof("Received %s, shutting down", sig)
+	shutdownServer(target, cancel)
+}
 
-	if websockify {
-		go serveWebsockify(server)
+func shutdownServer(target shutdowner, cancel context.CancelFunc) {
+	defer cancel()
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelTimeout()
+	if err := target.Shutdown(ctx); err != nil {
+		log.Error("Error during shutdown: ", err.Error())
 	}
+}
 
-	// Create a listener
+func serveTCP(ctx context.Context, srvr *rfb.Server) error {
 	bindAddr := fmt.Sprintf("%s:%d", bindHost, bindPort)
-	l, err := net.Listen("tcp", bindAddr)
+	l, err := listenRFB(bindAddr)
 	if err != nil {
 		return err
 	}
+	return srvr.Serve(ctx, l)
+}
+
+// listenRFB creates a listener for rfb connections on the given address, wrapped in
+// TLS if enabled.
+func listenRFB(bindAddr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return nil, err
+	}
+	if rfbTLS {
+		log.Info("Listening for TLS rfb connections on ", bindAddr)
+		return tls.NewListener(l, certReloader.TLSConfig()), nil
+	}
 	log.Info("Listening for rfb connections on ", bindAddr)
-	return server.Serve(l)
+	return l, nil
 }
 
-func serveWebsockify(srvr *rfb.Server) error {
-	wsAddr := fmt.Sprintf("%s:%d", websockifyHost, websockifyPort)
-	l, err := net.Listen("tcp", wsAddr)
+// buildServeFuncs returns the serve functions for all configured listeners.
+func buildServeFuncs(router *rfb.Router, displays []*routedDisplay) ([]serveFunc, error) {
+	// In stdio mode, the only connection is the one on stdin/stdout
+	if serveStdio {
+		return []serveFunc{serveStdioConn}, nil
+	}
+
+	serveFuncs := make([]serveFunc, 0)
+	if adminEnabled {
+		serveFuncs = append(serveFuncs, adminServeFunc(router))
+	}
+	if systemdActivation {
+		systemdFuncs, err := systemdServeFuncs(router)
+		if err != nil {
+			return nil, err
+		}
+		serveFuncs = append(serveFuncs, systemdFuncs...)
+	} else if router != nil {
+		if websockify {
+			serveFuncs = append(serveFuncs, routerServeFunc(router))
+		}
+		if !noTCP {
+			for _, d := range displays {
+				serveFuncs = append(serveFuncs, displayServeFunc(d))
+			}
+		}
+	} else {
+		if websockify {
+			serveFuncs = append(serveFuncs, serveWebsockify)
+		}
+		if !noTCP {
+			serveFuncs = append(serveFuncs, serveTCP)
+		}
+	}
+	if unixSocket != "" {
+		serveFuncs = append(serveFuncs, serveUnix)
+	}
+	for _, addr := range connectAddrs {
+		serveFuncs = append(serveFuncs, connectFunc(addr))
+	}
+	if repeaterAddr != "" {
+		serveFuncs = append(serveFuncs, serveRepeater)
+	}
+
+	if len(serveFuncs) == 0 || (adminEnabled && len(serveFuncs) == 1) {
+		return nil, errors.New("No listeners configured")
+	}
+	return serveFuncs, nil
+}
+
+func serveUnix(ctx context.Context, srvr *rfb.Server) error {
+	mode, err := strconv.ParseUint(unixSocketMode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("Could not parse unix socket mode %q: %s", unixSocketMode, err.Error())
+	}
+	l, err := listeners.Unix(unixSocket, os.FileMode(mode))
+	if err != nil {
+		return err
+	}
+	log.Info("Listening for rfb connections on ", unixSocket)
+	return srvr.Serve(ctx, l)
+}
+
+func serveStdioConn(ctx context.Context, srvr *rfb.Server) error {
+	return srvr.ServeConn(listeners.Stdio())
+}
+
+// systemdServeFuncs returns serve functions for the sockets passed by systemd. With a
+// router, the websockify socket serves all displays.
+func systemdServeFuncs(router *rfb.Router) ([]serveFunc, error) {
+	named, err := listeners.Systemd()
+	if err != nil {
+		return nil, err
+	}
+	if len(named) == 0 {
+		return nil, errors.New("No sockets were passed by systemd")
+	}
+	serveFuncs := make([]serveFunc, 0)
+	for name, ll := range named {
+		for _, l := range ll {
+			l := l
+			log.Infof("Using %s socket %s passed by systemd", name, l.Addr())
+			switch name {
+			case "websockify":
+				if websockifyTLS {
+					l = tls.NewListener(l, certReloader.TLSConfig())
+				}
+				serveFuncs = append(serveFuncs, func(ctx context.Context, srvr *rfb.Server) error {
+					if router != nil {
+						return router.ServeWebsockify(ctx, l)
+					}
+					return srvr.ServeWebsockify(ctx, l)
+				})
+			case "admin":
+				serveFuncs = append(serveFuncs, func(ctx context.Context, srvr *rfb.Server) error { return newAdminServer(router, srvr).Serve(ctx, l) })
+			default:
+				if rfbTLS {
+					l = tls.NewListener(l, certReloader.TLSConfig())
+				}
+				serveFuncs = append(serveFuncs, func(ctx context.Context, srvr *rfb.Server) error { return srvr.Serve(ctx, l) })
+			}
+		}
+	}
+	return serveFuncs, nil
+}
+
+// buildCertReloader returns the certificate source for the TLS listeners.
+func buildCertReloader() (*certs.Reloader, error) {
+	hosts := []string{"localhost", bindHost, websockifyHost}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	switch {
+	case tlsCertFile != "" || tlsKeyFile != "":
+		return certs.NewFileReloader(tlsCertFile, tlsKeyFile, tlsSelfSigned, hosts)
+	case tlsSelfSigned:
+		log.Info("Generating a self-signed TLS certificate")
+		return certs.NewSelfSignedReloader(hosts)
+	default:
+		return nil, errors.New("TLS requires --tls-cert and --tls-key, or --tls-self-signed")
+	}
+}
+
+func reloadCertsOnSignal(reloader *certs.Reloader) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		if err := reloader.Reload(); err != nil {
+			log.Error("Could not reload TLS certificate, keeping the current one: ", err.Error())
+			continue
+		}
+		log.Info("Reloaded TLS certificate, SHA-256 fingerprint: ", reloader.Fingerprint())
+	}
+}
+
+// connectFunc returns a serve function that connects to the listening viewer at the given address.
+func connectFunc(addr string) serveFunc {
+	return func(ctx context.Context, srvr *rfb.Server) error {
+		log.Info("Connecting to listening viewer at ", addr)
+		return srvr.Connect(ctx, addr, &rfb.ConnectOpts{
+			Reconnect:   reconnect,
+			MinBackoff:  reconnectMinBackoff,
+			MaxBackoff:  reconnectMaxBackoff,
+			MaxAttempts: reconnectMaxAttempts,
+		})
+	}
+}
+
+func serveRepeater(ctx context.Context, srvr *rfb.Server) error {
+	log.Info("Connecting to repeater at ", repeaterAddr)
+	return srvr.ServeRepeater(ctx)
+}
+
+// applyGstreamerFlags copies the --gst-* flags that were set into the display provider
+// options. Options given with --display-opt take precedence.
+func applyGstreamerFlags(cmd *cobra.Command) error {
+	flags := map[string]string{}
+	set := func(flag, option, value string) {
+		if cmd.Flags().Changed(flag) {
+			flags[option] = value
+		}
+	}
+	set("gst-pipeline", "pipeline", gstPipeline)
+	set("gst-fps", "fps", strconv.FormatFloat(gstFPS, 'f', -1, 64))
+	set("gst-scale-method", "scale-method", gstScaleMethod)
+	set("gst-monitor", "monitor", strconv.Itoa(gstMonitor))
+	if cmd.Flags().Changed("gst-region") {
+		spl := strings.Split(gstRegion, ",")
+		if len(spl) != 4 {
+			return fmt.Errorf("Invalid region, expected STARTX,STARTY,ENDX,ENDY: %s", gstRegion)
+		}
+		for i, option := range []string{"startx", "starty", "endx", "endy"} {
+			flags[option] = strings.TrimSpace(spl[i])
+		}
+	}
+	if len(flags) == 0 {
+		return nil
+	}
+	if displayProvider != string(providers.ProviderGstreamer) {
+		return fmt.Errorf("The --gst-* flags only apply to the %s display provider", providers.ProviderGstreamer)
+	}
+	if displayOptions == nil {
+		displayOptions = make(map[string]string, len(flags))
+	}
+	for option, value := range flags {
+		if _, ok := displayOptions[option]; !ok {
+			displayOptions[option] = value
+		}
+	}
+	return nil
+}
+
+func buildClipboardPolicy() (*display.ClipboardPolicy, error) {
+	dir, err := display.ParseClipboardDirection(clipboardDirection)
+	if err != nil {
+		return nil, err
+	}
+	policy := &display.ClipboardPolicy{
+		Direction:  dir,
+		MaxSize:    clipboardMaxSize,
+		RedactWith: clipboardRedactWith,
+	}
+	for _, expr := range clipboardRedact {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Could not compile clipboard redact expression %q: %s", expr, err.Error())
+		}
+		policy.Redact = append(policy.Redact, re)
+	}
+	for _, expr := range clipboardBlock {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Could not compile clipboard block expression %q: %s", expr, err.Error())
+		}
+		policy.Block = append(policy.Block, re)
+	}
+	return policy, nil
+}
+
+func sharePolicyIsValid(policy string) bool {
+	for _, p := range rfb.SharePolicies {
+		if string(p) == policy {
+			return true
+		}
+	}
+	return false
+}
+
+func serveWebsockify(ctx context.Context, srvr *rfb.Server) error {
+	l, scheme, err := listenWebsockify()
 	if err != nil {
 		return err
 	}
+	if !noWeb {
+		log.Infof("The web client is available at %s://%s/", scheme, l.Addr())
+	}
+	return srvr.ServeWebsockify(ctx, l)
+}
+
+// listenWebsockify creates the listener for websockify connections, wrapped in TLS if
+// enabled. The URL scheme for the listener is returned with it.
+func listenWebsockify() (l net.Listener, scheme string, err error) {
+	wsAddr := fmt.Sprintf("%s:%d", websockifyHost, websockifyPort)
+	l, err = net.Listen("tcp", wsAddr)
+	if err != nil {
+		return nil, "", err
+	}
+	if websockifyTLS {
+		log.Info("Listening for TLS websockify connections on ", wsAddr)
+		return tls.NewListener(l, certReloader.TLSConfig()), "https", nil
+	}
 	log.Info("Listening for websockify connections on ", wsAddr)
-	return srvr.ServeWebsockify(l)
+	return l, "http", nil
 }
 
 func doListFeatures(authTypes []auth.Type, encTypes []encodings.Encoding, evTypes []events.Event) {
@@ -223,6 +753,19 @@ func doListFeatures(authTypes []auth.Type, encTypes []encodings.Encoding, evType
 	for _, ev := range evTypes {
 		fmt.Fprintf(w, lformat, reflect.TypeOf(ev).Elem().Name())
 	}
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Display Providers")
+	fmt.Fprintln(w, "-----------------")
+	for _, name := range providers.Registered() {
+		fmt.Fprintln(w, name)
+		for _, opt := range providers.OptionsFor(name) {
+			desc := opt.Description
+			if opt.Default != "" {
+				desc = fmt.Sprintf("%s (default: %s)", desc, opt.Default)
+			}
+			fmt.Fprintf(w, "  %s\t%s\n", opt.Name, desc)
+		}
+	}
 
 	w.Flush()
 	fmt.Println(buf.String())
@@ -243,6 +786,31 @@ func authIsEnabled(tt []auth.Type, name string) bool {
 	return false
 }
 
+// readUsersFile reads VNCAuth passwords by username from lines of username:password.
+// Empty lines and lines starting with # are skipped.
+func readUsersFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s:%d: Expected username:password", path, i+1)
+		}
+		users[parts[0]] = parts[1]
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("Users file %s is empty", path)
+	}
+	return users, nil
+}
+
 func configureAuthTypes(tt []auth.Type, args []string) []auth.Type {
 	for _, arg := range args {
 		if strings.HasPrefix(arg, "-") {
@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tinyzimmer/gsvnc/pkg/token"
+)
+
+var tokenUser string
+var tokenViewOnly bool
+var tokenDisplay string
+var tokenTTL time.Duration
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Generate a signed token for websockify connections.",
+	Long: `Generate a signed token for websockify connections to a server started with --token-secret-file.
+
+The token can be passed in the websocket URL (e.g. /websockify?token=...), or set as a cookie.
+With the built-in web client, use /vnc.html?path=websockify%3Ftoken%3D...`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		secret, err := readTokenSecret()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		claims := &token.Claims{
+			Subject:  tokenUser,
+			ViewOnly: tokenViewOnly,
+			Display:  tokenDisplay,
+			IssuedAt: now.Unix(),
+		}
+		if tokenTTL > 0 {
+			claims.ExpiresAt = now.Add(tokenTTL).Unix()
+		}
+		tok, err := token.NewHMAC(secret).Sign(claims)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), tok)
+		return nil
+	},
+}
+
+func init() {
+	tokenCmd.Flags().StringVarP(&tokenUser, "user", "u", "", "The user identity to carry in the token.")
+	tokenCmd.Flags().BoolVarP(&tokenViewOnly, "view-only", "", false, "Make sessions using the token view-only.")
+	tokenCmd.Flags().StringVarP(&tokenDisplay, "display", "", "", "The display the token grants access to, when serving several displays with --displays.")
+	tokenCmd.Flags().DurationVarP(&tokenTTL, "ttl", "", time.Hour, "How long the token is valid for. Zero means it never expires.")
+	RootCmd.AddCommand(tokenCmd)
+}
+
+// readTokenSecret reads the HMAC secret from the --token-secret-file.
+func readTokenSecret() ([]byte, error) {
+	if tokenSecretFile == "" {
+		return nil, errors.New("No --token-secret-file provided")
+	}
+	secret, err := ioutil.ReadFile(tokenSecretFile)
+	if err != nil {
+		return nil, err
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("Token secret file %s is empty", tokenSecretFile)
+	}
+	return secret, nil
+}
@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb"
+	"github.com/tinyzimmer/gsvnc/pkg/token"
+)
+
+// runTokenCmd runs the token subcommand with the given flags and returns the token it
+// printed.
+func runTokenCmd(t *testing.T, args ...string) string {
+	t.Helper()
+	var out bytes.Buffer
+	RootCmd.SetOut(&out)
+	RootCmd.SetArgs(append([]string{"token"}, args...))
+	defer RootCmd.SetOut(nil)
+	defer RootCmd.SetArgs(nil)
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(out.String())
+}
+
+// upgradeStatus returns the status of a websocket upgrade request to the given URL.
+func upgradeStatus(t *testing.T, url string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestTokenDisplayClaim(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tokenSecretFile, tokenDisplay = "", "" }()
+	tok := runTokenCmd(t, "--token-secret-file", secretFile, "--display", "b")
+
+	secret, err := readTokenSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := token.NewHMAC(secret)
+	claims, err := validator.Validate(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Display != "b" {
+		t.Fatalf("Expected the token to be for display b, got %q", claims.Display)
+	}
+
+	writeDisplaysFile(t, `[
+		{"name": "a"},
+		{"name": "b"}
+	]`)
+	router, _, err := buildRouter(&rfb.ServerOpts{
+		DisplayProvider: providers.ProviderTestPattern,
+		Width:           16,
+		Height:          8,
+		TokenValidator:  validator,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Shutdown(context.Background())
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/?token=" + tok, http.StatusSwitchingProtocols},
+		{"/ws/b?token=" + tok, http.StatusSwitchingProtocols},
+		{"/ws/a?token=" + tok, http.StatusUnauthorized},
+	} {
+		if got := upgradeStatus(t, srv.URL+tc.path); got != tc.want {
+			t.Fatalf("Expected status %d for %s, got %d", tc.want, strings.SplitN(tc.path, "?", 2)[0], got)
+		}
+	}
+}
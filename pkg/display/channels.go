@@ -1,9 +1,11 @@
 package display
 
 import (
+	"image"
 	"time"
 
 	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/types"
 )
 
 func (d *Display) handleKeyEvents() {
@@ -16,9 +18,20 @@ func (d *Display) handleKeyEvents() {
 			}
 			log.Debug("Got key event: ", ev)
 			if ev.IsDown() {
+				if d.ViewOnly() {
+					continue
+				}
+				if d.inputHandler != nil {
+					d.inputHandler.KeyEvent(ev.Key, true)
+					continue
+				}
 				d.appendDownKeyIfMissing(ev.Key)
 				d.dispatchDownKeys()
 			} else {
+				if d.inputHandler != nil {
+					d.inputHandler.KeyEvent(ev.Key, false)
+					continue
+				}
 				d.removeDownKey(ev.Key)
 			}
 		}
@@ -34,13 +47,39 @@ func (d *Display) handlePointerEvents() {
 				return
 			}
 			log.Debug("Got pointer event: ", ev)
+			if d.ViewOnly() {
+				continue
+			}
 			d.servePointerEvent(ev)
 		}
 	}
 }
 
+// pullFrames pulls frames from the display provider until it returns nil or the
+// display is closed. The provider may block until it has a new frame, so this is kept
+// apart from answering update requests.
+func (d *Display) pullFrames() {
+	defer close(d.frames)
+	for {
+		frame := d.displayProvider.PullFrame()
+		if frame == nil {
+			return
+		}
+		select {
+		case d.frames <- frame:
+		case <-d.closing:
+			return
+		}
+	}
+}
+
 func (d *Display) handleFrameBufferEvents() {
 	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+	frames := d.frames
+	// The latest frame from the provider, and a request that couldn't be answered yet
+	var latest *image.RGBA
+	var pending *types.FrameBufferUpdateRequest
 	for {
 		select {
 		// Framebuffer update requests
@@ -50,13 +89,37 @@ func (d *Display) handleFrameBufferEvents() {
 				return
 			}
 			log.Debug("Handling framebuffer update request")
-			d.pushFrame(ur)
+			if latest != nil && d.pushFrame(ur, latest) {
+				continue
+			}
+			// Answered once there is a frame, or one that changed. A full update
+			// request is not replaced by an incremental one.
+			if pending == nil || pending.Incremental() {
+				pending = ur
+			}
+
+		// New frames from the provider
+		case frame, ok := <-frames:
+			if !ok {
+				// The provider stopped, keep draining requests until the client is gone
+				frames = nil
+				close(d.sourceDone)
+				continue
+			}
+			latest = frame
+			if pending != nil && d.pushFrame(pending, latest) {
+				pending = nil
+			}
 
 		// Send a frame update anyway if there are no updates on the queue
 		case <-ticker.C:
-			log.Debug("Pushing latest frame to client")
-			last := d.GetLastImage()
-			d.pushImage(last)
+			if latest != nil {
+				log.Debug("Pushing latest frame to client")
+				if d.pushDamage(latest) {
+					pending = nil
+				}
+			}
+			d.syncLockState()
 		}
 	}
 }
@@ -70,7 +133,7 @@ func (d *Display) handleCutTextEvents() {
 				return
 			}
 			log.Debug("Got cut-text event: ", ev)
-			d.syncToClipboard(ev)
+			d.handleClientCutText(ev)
 		}
 	}
 }
@@ -78,6 +141,7 @@ func (d *Display) handleCutTextEvents() {
 func (d *Display) watchChannels() {
 	go d.handleKeyEvents()
 	go d.handlePointerEvents()
+	go d.pullFrames()
 	go d.handleFrameBufferEvents()
 	go d.handleCutTextEvents()
 }
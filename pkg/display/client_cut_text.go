@@ -2,10 +2,35 @@ package display
 
 import (
 	"github.com/go-vgo/robotgo"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
 	"github.com/tinyzimmer/gsvnc/pkg/rfb/types"
 )
 
-func (d *Display) syncToClipboard(ev *types.ClientCutText) { robotgo.WriteAll(toUTF8(ev.Text)) }
+func (d *Display) handleClientCutText(ev *types.ClientCutText) {
+	if ev.IsExtended() {
+		if err := d.handleExtendedCutText(ev.Text); err != nil {
+			log.Errorf("Error handling extended clipboard message from client %s: %s", d.connID, err.Error())
+		}
+		return
+	}
+	d.syncToClipboard(&ClipboardData{Text: toUTF8(ev.Text)})
+}
+
+func (d *Display) syncToClipboard(data *ClipboardData) {
+	if d.ViewOnly() {
+		log.Warningf("Blocked %s clipboard transfer for client %s: client is view-only", ClipboardClientToServer, d.connID)
+		return
+	}
+	if data = d.filterClipboard(ClipboardClientToServer, data); data == nil {
+		return
+	}
+	if d.clipboard != nil {
+		d.clipboard.write(d, data)
+		return
+	}
+	robotgo.WriteAll(data.Text)
+}
 
 func toUTF8(in []byte) string {
 	buf := make([]rune, len(in))
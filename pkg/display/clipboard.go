@@ -0,0 +1,164 @@
+package display
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-vgo/robotgo"
+
+	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+)
+
+// Clipboard watches the host clipboard and fans out changes to all subscribed displays.
+// A single Clipboard is meant to be shared by every display on a server.
+//
+// The watcher only runs while at least one display is subscribed.
+type Clipboard struct {
+	pollInterval time.Duration
+	// Used instead of the host clipboard when set
+	handler providers.ClipboardHandler
+
+	last     *ClipboardData
+	displays map[*Display]struct{}
+	stopCh   chan struct{}
+	mux      sync.Mutex
+}
+
+// NewClipboard returns a new clipboard watcher that polls the host clipboard
+// at the given interval. If the interval is zero, a default of 500ms is used.
+func NewClipboard(pollInterval time.Duration) *Clipboard {
+	if pollInterval == 0 {
+		pollInterval = time.Millisecond * 500
+	}
+	return &Clipboard{
+		pollInterval: pollInterval,
+		last:         &ClipboardData{},
+		displays:     make(map[*Display]struct{}),
+	}
+}
+
+// SetHandler makes the clipboard read and write the given handler instead of the host
+// clipboard. It must be called before any displays subscribe.
+func (c *Clipboard) SetHandler(h providers.ClipboardHandler) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.handler = h
+}
+
+// subscribe adds the given display to the list of displays receiving clipboard
+// updates, starting the watcher if necessary.
+func (c *Clipboard) subscribe(d *Display) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.displays[d] = struct{}{}
+	if c.stopCh == nil {
+		// Seed with the current contents so they aren't pushed to the first client
+		text, _ := c.readHost()
+		c.last = &ClipboardData{Text: text}
+		c.stopCh = make(chan struct{})
+		go c.watch(c.stopCh)
+	}
+}
+
+// unsubscribe removes the given display from receiving clipboard updates, stopping
+// the watcher if it was the last one.
+func (c *Clipboard) unsubscribe(d *Display) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.displays, d)
+	if len(c.displays) == 0 && c.stopCh != nil {
+		close(c.stopCh)
+		c.stopCh = nil
+	}
+}
+
+// get returns the most recent clipboard contents.
+func (c *Clipboard) get() *ClipboardData {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.last
+}
+
+// write sets the host clipboard to the given data on behalf of the given display.
+// The data is forwarded to every other subscribed display, but not echoed back to
+// the one it came from.
+//
+// Only the text format is written to the host. Other formats are kept for relaying
+// to clients that support them.
+func (c *Clipboard) write(from *Display, data *ClipboardData) {
+	c.mux.Lock()
+	if *data == *c.last {
+		c.mux.Unlock()
+		return
+	}
+	c.last = data
+	if err := c.writeHost(data.Text); err != nil {
+		log.Error("Could not write to host clipboard: ", err.Error())
+	}
+	displays := c.getDisplays(from)
+	c.mux.Unlock()
+
+	for _, d := range displays {
+		d.pushCutText(data)
+	}
+}
+
+func (c *Clipboard) watch(stopCh chan struct{}) {
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			text, err := c.readHost()
+			if err != nil {
+				log.Debug("Could not read host clipboard: ", err.Error())
+				continue
+			}
+			c.mux.Lock()
+			if text == c.last.Text {
+				c.mux.Unlock()
+				continue
+			}
+			log.Debug("Host clipboard changed, notifying clients")
+			data := &ClipboardData{Text: text}
+			c.last = data
+			displays := c.getDisplays(nil)
+			c.mux.Unlock()
+
+			for _, d := range displays {
+				d.pushCutText(data)
+			}
+		}
+	}
+}
+
+// getDisplays returns the currently subscribed displays, excluding the given one.
+// The lock must be held when calling this method.
+func (c *Clipboard) getDisplays(exclude *Display) []*Display {
+	out := make([]*Display, 0, len(c.displays))
+	for d := range c.displays {
+		if d != exclude {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// readHost reads the text on the host clipboard, or the handler if one is set.
+func (c *Clipboard) readHost() (string, error) {
+	if c.handler != nil {
+		return c.handler.ReadClipboard()
+	}
+	return robotgo.ReadAll()
+}
+
+// writeHost writes text to the host clipboard, or the handler if one is set.
+func (c *Clipboard) writeHost(text string) error {
+	if c.handler != nil {
+		return c.handler.WriteClipboard(text)
+	}
+	return robotgo.WriteAll(text)
+}
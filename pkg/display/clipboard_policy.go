@@ -0,0 +1,140 @@
+package display
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+)
+
+// ClipboardDirection represents the direction(s) clipboard data is allowed to flow.
+type ClipboardDirection string
+
+// Clipboard direction options.
+const (
+	ClipboardOff            ClipboardDirection = "off"
+	ClipboardClientToServer ClipboardDirection = "client-to-server"
+	ClipboardServerToClient ClipboardDirection = "server-to-client"
+	ClipboardBoth           ClipboardDirection = "both"
+)
+
+// ClipboardDirections lists all valid clipboard direction options.
+var ClipboardDirections = []ClipboardDirection{
+	ClipboardOff, ClipboardClientToServer, ClipboardServerToClient, ClipboardBoth,
+}
+
+// ClipboardFilterFunc is a function that can inspect clipboard data before it is transferred
+// in the given direction. It returns the data to transfer, which may be modified, or an error
+// if the transfer should be blocked.
+type ClipboardFilterFunc func(dir ClipboardDirection, data *ClipboardData) (*ClipboardData, error)
+
+// ClipboardPolicy controls how clipboard data flows between clients and the host.
+type ClipboardPolicy struct {
+	// The direction(s) clipboard data is allowed to flow. Defaults to both.
+	Direction ClipboardDirection
+	// The maximum size, in bytes, of clipboard data in any format. Zero means
+	// only the hard limits apply.
+	MaxSize int
+	// Matches of these expressions are replaced with RedactWith before transfer.
+	Redact     []*regexp.Regexp
+	RedactWith string
+	// Transfers containing a match of any of these expressions are blocked.
+	Block []*regexp.Regexp
+	// An optional callback run after the expressions have been applied.
+	Filter ClipboardFilterFunc
+}
+
+// DefaultClipboardPolicy is used when no policy is provided to a display.
+var DefaultClipboardPolicy = &ClipboardPolicy{Direction: ClipboardBoth}
+
+// ParseClipboardDirection parses the given string into a ClipboardDirection.
+func ParseClipboardDirection(s string) (ClipboardDirection, error) {
+	for _, d := range ClipboardDirections {
+		if string(d) == s {
+			return d, nil
+		}
+	}
+	return "", fmt.Errorf("Invalid clipboard direction %q, must be one of %v", s, ClipboardDirections)
+}
+
+// Allows returns true if the policy allows clipboard data to flow in the given direction.
+func (p *ClipboardPolicy) Allows(dir ClipboardDirection) bool {
+	switch p.Direction {
+	case ClipboardBoth, "":
+		return true
+	case ClipboardOff:
+		return false
+	}
+	return p.Direction == dir
+}
+
+// limit returns the effective size limit for a single clipboard format.
+func (p *ClipboardPolicy) limit(hardLimit int) int {
+	if p.MaxSize > 0 && p.MaxSize < hardLimit {
+		return p.MaxSize
+	}
+	return hardLimit
+}
+
+// apply runs the policy against the given data, returning the data to transfer or an
+// error describing why it was blocked.
+func (p *ClipboardPolicy) apply(dir ClipboardDirection, data *ClipboardData) (*ClipboardData, error) {
+	if !p.Allows(dir) {
+		return nil, errors.New("direction is disabled by policy")
+	}
+	out := &ClipboardData{}
+	for _, f := range supportedClipboardFormats {
+		val := data.get(f)
+		if p.MaxSize > 0 && len(val) > p.MaxSize {
+			return nil, fmt.Errorf("%d bytes exceeds the limit of %d", len(val), p.MaxSize)
+		}
+		for _, re := range p.Block {
+			if re.MatchString(val) {
+				return nil, fmt.Errorf("content matched blocked pattern %q", re.String())
+			}
+		}
+		for _, re := range p.Redact {
+			val = re.ReplaceAllString(val, p.RedactWith)
+		}
+		out.set(f, val)
+	}
+	if p.Filter != nil {
+		return p.Filter(dir, out)
+	}
+	return out, nil
+}
+
+// filterClipboard applies the clipboard policy for this display to the given data. If the
+// transfer is blocked, it is logged and nil is returned.
+func (d *Display) filterClipboard(dir ClipboardDirection, data *ClipboardData) *ClipboardData {
+	out, err := d.clipboardPolicy.apply(dir, data)
+	if err != nil {
+		log.Warningf("Blocked %s clipboard transfer for client %s: %s", dir, d.connID, err.Error())
+		return nil
+	}
+	if out == nil {
+		log.Warningf("Blocked %s clipboard transfer for client %s: rejected by filter", dir, d.connID)
+	}
+	return out
+}
+
+// CutTextAllowed returns true if a cut text message of the given size should be read from
+// the client. Messages that are not allowed are logged and should be discarded without being
+// read into memory. Extended messages are only checked against the size limit, since their
+// direction is not known until the payload is read.
+func (d *Display) CutTextAllowed(size int, extended bool) bool {
+	if !extended && !d.clipboardPolicy.Allows(ClipboardClientToServer) {
+		log.Warningf("Blocked %s clipboard transfer for client %s: direction is disabled by policy", ClipboardClientToServer, d.connID)
+		return false
+	}
+	limit := MaxCutTextLength
+	if !extended {
+		limit = d.clipboardPolicy.limit(limit)
+	}
+	if size > limit {
+		log.Warningf("Blocked %s clipboard transfer for client %s: %d bytes exceeds the limit of %d", ClipboardClientToServer, d.connID, size, limit)
+		return false
+	}
+	return true
+}
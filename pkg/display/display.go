@@ -1,7 +1,10 @@
 package display
 
 import (
+	"fmt"
 	"image"
+	"sync"
+	"sync/atomic"
 
 	"github.com/tinyzimmer/gsvnc/pkg/buffer"
 	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
@@ -13,23 +16,64 @@ import (
 // and listens for events from the RFB event handlers.
 type Display struct {
 	displayProvider providers.Display
+	// The provider behind displayProvider, which may be shared with other displays
+	provider providers.Display
+	// Set when the provider handles input itself
+	inputHandler providers.InputHandler
+	// Set when the provider reports the damage between its frames
+	damager providers.Damager
 
 	width, height    int
-	pixelFormat      *types.PixelFormat
 	getEncodingsFunc GetEncodingsFunc
-	encodings        []int32
-	pseudoEncodings  []int32
-	currentEnc       encodings.Encoding
+
+	// The pixel format and encodings set by the client. They are read by the frame
+	// buffer goroutine and for session snapshots while the client changes them.
+	formatMux       sync.RWMutex
+	pixelFormat     *types.PixelFormat
+	encodings       []int32
+	pseudoEncodings []int32
+	currentEnc      encodings.Encoding
+
+	// The last frame sent to the client, used for tracking damage
+	lastFrame *image.RGBA
+
+	// Frames pulled from the display provider. Closed when the provider stops.
+	frames chan *image.RGBA
+	// Closed when the display is closed
+	closing chan struct{}
+	// Closed when the display provider stops producing frames
+	sourceDone chan struct{}
 
 	// Read/writer for the connected client
 	buf *buffer.ReadWriter
 
+	// Identifies the connected client in logs
+	connID string
+
+	// Set to 1 when input from the client should be ignored
+	viewOnly int32
+
+	// Shared host clipboard and extended clipboard state
+	clipboard       *Clipboard
+	clipboardPolicy *ClipboardPolicy
+	extClipCaps     *clipboardCaps
+	extClipMux      sync.Mutex
+
 	// Incoming event queues
 	fbReqQueue chan *types.FrameBufferUpdateRequest
 	ptrEvQueue chan *types.PointerEvent
 	keyEvQueue chan *types.KeyEvent
 	cutTxtEvsQ chan *types.ClientCutText
 
+	// The LED state pseudo-encoding used by the client, and the last
+	// lock key state sent to it. The encoding and whether the state was
+	// sent are guarded by formatMux.
+	ledEncoding  int32
+	ledState     LockState
+	ledStateSent bool
+	// The host lock key state, shared by all displays
+	locks *lockStateCache
+
 	// Memory of keys that are currently down. Reiterated in order
 	// on every down subsequent down event.
 	downKeys []uint32
@@ -56,28 +100,70 @@ type GetEncodingsFunc func(encs []int32) encodings.Encoding
 // Opts represents options for building a new display.
 type Opts struct {
 	DisplayProvider providers.Provider
+	ProviderOptions providers.Options
+	SharedProvider  *providers.Shared
 	Width, Height   int
 	Buffer          *buffer.ReadWriter
 	GetEncodingFunc GetEncodingsFunc
+	Clipboard       *Clipboard
+	ClipboardPolicy *ClipboardPolicy
+	ConnID          string
 }
 
 // NewDisplay returns a new display with the given dimensions. These
-// dimensions can be mutated later on depending on client support.
-func NewDisplay(opts *Opts) *Display {
+// dimensions can be mutated later on depending on client support. An error is
+// returned if the display has no shared provider and its own can't be created.
+func NewDisplay(opts *Opts) (*Display, error) {
+	clipboardPolicy := opts.ClipboardPolicy
+	if clipboardPolicy == nil {
+		clipboardPolicy = DefaultClipboardPolicy
+	}
+	var displayProvider, provider providers.Display
+	if opts.SharedProvider != nil {
+		displayProvider = opts.SharedProvider.Consumer()
+		provider = opts.SharedProvider.Provider()
+	} else {
+		var err error
+		provider, err = providers.New(opts.DisplayProvider, opts.ProviderOptions)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create display provider: %s", err.Error())
+		}
+		displayProvider = provider
+	}
+	inputHandler, _ := provider.(providers.InputHandler)
+	damager, _ := provider.(providers.Damager)
 	return &Display{
-		displayProvider:  providers.GetDisplayProvider(opts.DisplayProvider),
+		displayProvider:  displayProvider,
+		provider:         provider,
+		inputHandler:     inputHandler,
+		damager:          damager,
 		width:            opts.Width,
 		height:           opts.Height,
 		buf:              opts.Buffer,
+		connID:           opts.ConnID,
+		clipboard:        opts.Clipboard,
+		clipboardPolicy:  clipboardPolicy,
 		getEncodingsFunc: opts.GetEncodingFunc,
 		pixelFormat:      DefaultPixelFormat,
+		locks:            hostLocks,
 		// Buffered channels
 		fbReqQueue: make(chan *types.FrameBufferUpdateRequest, 128),
 		ptrEvQueue: make(chan *types.PointerEvent, 128),
 		keyEvQueue: make(chan *types.KeyEvent, 128),
 		cutTxtEvsQ: make(chan *types.ClientCutText, 128),
+		frames:     make(chan *image.RGBA, 1),
+		closing:    make(chan struct{}),
+		sourceDone: make(chan struct{}),
 		// down key memory
 		downKeys: make([]uint32, 0),
+	}, nil
+}
+
+// SetUser passes the name the client authenticated as to the display provider, if it
+// serves each user their own display.
+func (d *Display) SetUser(name string) {
+	if u, ok := d.provider.(providers.UserDisplay); ok {
+		u.SetUser(name)
 	}
 }
 
@@ -90,28 +176,87 @@ func (d *Display) SetDimensions(width, height int) {
 	d.height = height
 }
 
+// ConnID returns the identifier of the connected client used in logs.
+func (d *Display) ConnID() string { return d.connID }
+
+// ViewOnly returns true if input from the client is being ignored.
+func (d *Display) ViewOnly() bool { return atomic.LoadInt32(&d.viewOnly) == 1 }
+
+// SetViewOnly sets whether input from the client should be ignored. Key releases
+// are still processed so no keys are left held down at the host.
+func (d *Display) SetViewOnly(viewOnly bool) {
+	var v int32
+	if viewOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&d.viewOnly, v)
+}
+
 // GetPixelFormat returns the current pixel format for the display.
-func (d *Display) GetPixelFormat() *types.PixelFormat { return d.pixelFormat }
+func (d *Display) GetPixelFormat() *types.PixelFormat {
+	d.formatMux.RLock()
+	defer d.formatMux.RUnlock()
+	return d.pixelFormat
+}
 
 // SetPixelFormat sets the pixel format for the display.
-func (d *Display) SetPixelFormat(pf *types.PixelFormat) { d.pixelFormat = pf }
+func (d *Display) SetPixelFormat(pf *types.PixelFormat) {
+	d.formatMux.Lock()
+	defer d.formatMux.Unlock()
+	d.pixelFormat = pf
+}
 
 // GetEncodings returns the encodings currently supported by the client
 // connected to this display.
-func (d *Display) GetEncodings() []int32 { return d.encodings }
+func (d *Display) GetEncodings() []int32 {
+	d.formatMux.RLock()
+	defer d.formatMux.RUnlock()
+	return d.encodings
+}
 
 // SetEncodings sets the encodings that the connected client supports.
 func (d *Display) SetEncodings(encs []int32, pseudoEns []int32) {
+	d.formatMux.Lock()
 	d.encodings = encs
 	d.pseudoEncodings = pseudoEns
 	d.currentEnc = d.getEncodingsFunc(encs)
+	extClip := d.clientSupports(PseudoEncodingExtendedClipboard)
+	d.ledEncoding = 0
+	d.ledStateSent = false
+	for _, e := range pseudoEns {
+		if e == PseudoEncodingLEDState || e == PseudoEncodingVMwareLEDState {
+			d.ledEncoding = e
+			break
+		}
+	}
+	d.formatMux.Unlock()
+
+	if extClip {
+		d.enableExtendedClipboard()
+	}
+}
+
+// clientSupports returns true if the client included the given code in its encodings.
+// formatMux must be held.
+func (d *Display) clientSupports(code int32) bool {
+	for _, e := range append(d.encodings, d.pseudoEncodings...) {
+		if e == code {
+			return true
+		}
+	}
+	return false
 }
 
 // GetCurrentEncoding returns the encoder that is currently being used.
-func (d *Display) GetCurrentEncoding() encodings.Encoding { return d.currentEnc }
+func (d *Display) GetCurrentEncoding() encodings.Encoding {
+	d.formatMux.RLock()
+	defer d.formatMux.RUnlock()
+	return d.currentEnc
+}
 
-// GetLastImage returns the most recent frame for the display.
-func (d *Display) GetLastImage() *image.RGBA { return d.displayProvider.PullFrame() }
+// Done returns a channel that is closed when the display provider stops producing
+// frames, after which the client should be disconnected.
+func (d *Display) Done() <-chan struct{} { return d.sourceDone }
 
 // DispatchFrameBufferUpdate dispatches a FrameBufferUpdateRequest on the request queue.
 func (d *Display) DispatchFrameBufferUpdate(req *types.FrameBufferUpdateRequest) { d.fbReqQueue <- req }
@@ -131,11 +276,18 @@ func (d *Display) Start() error {
 		return err
 	}
 	go d.watchChannels()
+	if d.clipboard != nil {
+		d.clipboard.subscribe(d)
+	}
 	return nil
 }
 
 // Close will stop the gstreamer pipeline.
 func (d *Display) Close() error {
+	if d.clipboard != nil {
+		d.clipboard.unsubscribe(d)
+	}
+	close(d.closing)
 	close(d.fbReqQueue)
 	close(d.ptrEvQueue)
 	close(d.keyEvQueue)
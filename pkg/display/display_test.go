@@ -0,0 +1,204 @@
+package display
+
+import (
+	"encoding/binary"
+	"image"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/buffer"
+	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/encodings"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/types"
+)
+
+// onceProvider serves a single frame and then blocks until it is closed, like a static
+// source that only produces frames on damage. Closing stopCh makes it stop on its own.
+type onceProvider struct {
+	frame  *image.RGBA
+	sent   bool
+	stopCh chan struct{}
+	closed chan struct{}
+}
+
+func newOnceProvider(width, height int) *onceProvider {
+	return &onceProvider{
+		frame:  image.NewRGBA(image.Rect(0, 0, width, height)),
+		stopCh: make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+func (p *onceProvider) Start(width, height int) error { return nil }
+
+func (p *onceProvider) PullFrame() *image.RGBA {
+	if !p.sent {
+		p.sent = true
+		return p.frame
+	}
+	select {
+	case <-p.stopCh:
+	case <-p.closed:
+	}
+	return nil
+}
+
+func (p *onceProvider) Close() error {
+	close(p.closed)
+	return nil
+}
+
+func newTestDisplay(t *testing.T, p providers.Display) (*Display, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	d, err := NewDisplay(&Opts{
+		Width:           8,
+		Height:          4,
+		Buffer:          buffer.NewReadWriteBuffer(server),
+		SharedProvider:  providers.NewShared(p),
+		GetEncodingFunc: func([]int32) encodings.Encoding { return &encodings.RawEncoding{} },
+		ConnID:          "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetEncodings([]int32{0}, nil)
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return d, client
+}
+
+// readUpdate reads a framebuffer update with one raw rectangle and returns the rectangle.
+func readUpdate(t *testing.T, c net.Conn) types.FrameBufferRectangle {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var hdr struct {
+		Type, Padding uint8
+		Count         uint16
+		Rect          types.FrameBufferRectangle
+	}
+	if err := binary.Read(c, binary.BigEndian, &hdr); err != nil {
+		t.Fatal("Reading update: ", err)
+	}
+	if hdr.Type != cmdFramebufferUpdate || hdr.Count != 1 {
+		t.Fatalf("Unexpected update header %+v", hdr)
+	}
+	bpp := int(DefaultPixelFormat.BPP) / 8
+	if _, err := io.ReadFull(c, make([]byte, int(hdr.Rect.Width)*int(hdr.Rect.Height)*bpp)); err != nil {
+		t.Fatal("Reading pixels: ", err)
+	}
+	return hdr.Rect
+}
+
+func TestNewDisplayUnknownProvider(t *testing.T) {
+	d, err := NewDisplay(&Opts{DisplayProvider: "does-not-exist"})
+	if err == nil || d != nil {
+		t.Fatal("Expected an error for an unknown provider")
+	}
+}
+
+func TestFullUpdateWithoutNewFrame(t *testing.T) {
+	d, c := newTestDisplay(t, newOnceProvider(8, 4))
+	defer c.Close()
+	defer d.Close()
+
+	// The provider never produces a second frame, both requests are answered anyway
+	for i := 0; i < 2; i++ {
+		d.DispatchFrameBufferUpdate(&types.FrameBufferUpdateRequest{Width: 8, Height: 4})
+		rect := readUpdate(t, c)
+		if rect.Width != 8 || rect.Height != 4 {
+			t.Fatalf("Expected the full frame, got %+v", rect)
+		}
+	}
+
+	// An incremental request for an unchanged frame is left pending
+	d.DispatchFrameBufferUpdate(&types.FrameBufferUpdateRequest{IncrementalFlag: 1, Width: 8, Height: 4})
+	c.SetReadDeadline(time.Now().Add(time.Millisecond * 300))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected no update for an unchanged frame")
+	}
+}
+
+func TestDoneWhenProviderStops(t *testing.T) {
+	p := newOnceProvider(8, 4)
+	d, c := newTestDisplay(t, p)
+	defer c.Close()
+	defer d.Close()
+
+	d.DispatchFrameBufferUpdate(&types.FrameBufferUpdateRequest{Width: 8, Height: 4})
+	readUpdate(t, c)
+
+	select {
+	case <-d.Done():
+		t.Fatal("Display is done before the provider stopped")
+	default:
+	}
+	close(p.stopCh)
+	select {
+	case <-d.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("Display was not done after the provider stopped")
+	}
+}
+
+func TestFormatChangesWhileReading(t *testing.T) {
+	d, c := newTestDisplay(t, newOnceProvider(8, 4))
+	defer c.Close()
+	defer d.Close()
+
+	// The client changes its format on the event goroutine while sessions are listed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			d.SetPixelFormat(&types.PixelFormat{BPP: 32, Depth: 24, TrueColour: 1})
+			d.SetEncodings([]int32{0}, []int32{PseudoEncodingLEDState})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if d.GetPixelFormat() == nil || d.GetCurrentEncoding() == nil {
+			t.Fatal("Expected a pixel format and encoding")
+		}
+	}
+	<-done
+	if bpp := d.GetPixelFormat().BPP; bpp != 32 {
+		t.Fatalf("Expected the last pixel format to be kept, got %d bpp", bpp)
+	}
+}
+
+// damageProvider reports the damage between frames instead of having them compared.
+type damageProvider struct {
+	onceProvider
+	damage map[[2]*image.RGBA]image.Rectangle
+}
+
+func (p *damageProvider) DamageSince(prev, cur *image.RGBA) (image.Rectangle, bool) {
+	r, ok := p.damage[[2]*image.RGBA{prev, cur}]
+	return r, ok
+}
+
+func TestFrameDamage(t *testing.T) {
+	a, b, c := image.NewRGBA(image.Rect(0, 0, 8, 4)), image.NewRGBA(image.Rect(0, 0, 8, 4)), image.NewRGBA(image.Rect(0, 0, 8, 4))
+	b.Pix[0] = 1
+
+	// Without a Damager the frames are compared
+	d := &Display{}
+	if got := d.frameDamage(a, b); got != image.Rect(0, 0, 1, 1) {
+		t.Fatalf("Expected the changed pixel, got %s", got)
+	}
+
+	// A Damager is trusted, and frames it no longer tracks are sent in full
+	d.damager = &damageProvider{damage: map[[2]*image.RGBA]image.Rectangle{{a, b}: image.Rect(2, 1, 4, 3)}}
+	if got := d.frameDamage(a, b); got != image.Rect(2, 1, 4, 3) {
+		t.Fatalf("Expected the reported damage, got %s", got)
+	}
+	if got := d.frameDamage(a, c); got != c.Bounds() {
+		t.Fatalf("Expected the whole frame for an untracked frame, got %s", got)
+	}
+	if got := d.frameDamage(nil, c); got != c.Bounds() {
+		t.Fatalf("Expected the whole frame without a previous one, got %s", got)
+	}
+}
@@ -0,0 +1,362 @@
+package display
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-vgo/robotgo"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+	"github.com/tinyzimmer/gsvnc/pkg/internal/util"
+)
+
+// PseudoEncodingExtendedClipboard is the pseudo-encoding a client sends to signal
+// support for the Extended Clipboard extension (0xC0A1E5CE).
+const PseudoEncodingExtendedClipboard int32 = -0x3F5E1A32
+
+// Extended clipboard formats. These occupy the lower 16 bits of the flags.
+const (
+	ClipboardFormatText  uint32 = 1 << 0
+	ClipboardFormatRTF   uint32 = 1 << 1
+	ClipboardFormatHTML  uint32 = 1 << 2
+	ClipboardFormatDIB   uint32 = 1 << 3
+	ClipboardFormatFiles uint32 = 1 << 4
+)
+
+// Extended clipboard actions. These occupy the upper 8 bits of the flags.
+const (
+	clipboardActionCaps    uint32 = 1 << 24
+	clipboardActionRequest uint32 = 1 << 25
+	clipboardActionPeek    uint32 = 1 << 26
+	clipboardActionNotify  uint32 = 1 << 27
+	clipboardActionProvide uint32 = 1 << 28
+
+	clipboardActionMask uint32 = 0xff000000
+	clipboardFormatMask uint32 = 0x0000ffff
+)
+
+// supportedClipboardFormats are the formats the server handles, in wire order.
+var supportedClipboardFormats = []uint32{ClipboardFormatText, ClipboardFormatRTF, ClipboardFormatHTML}
+
+// MaxCutTextLength is a hard limit, in bytes, on the size of any cut text message
+// read from a client. Larger messages are discarded without being read into memory.
+var MaxCutTextLength = 10 * 1024 * 1024
+
+// ClipboardSizeLimits are the maximum sizes, in bytes, the server accepts for each
+// extended clipboard format. They are advertised to clients in the caps message.
+var ClipboardSizeLimits = map[uint32]uint32{
+	ClipboardFormatText: 10 * 1024 * 1024,
+	ClipboardFormatRTF:  10 * 1024 * 1024,
+	ClipboardFormatHTML: 10 * 1024 * 1024,
+}
+
+// defaultClientClipboardCaps are assumed for clients that enable the extension but
+// never send their own caps.
+var defaultClientClipboardCaps = &clipboardCaps{
+	flags: clipboardActionRequest | clipboardActionNotify | clipboardActionProvide | ClipboardFormatText,
+	sizes: map[uint32]uint32{ClipboardFormatText: 20 * 1024},
+}
+
+// ClipboardData represents the contents of the clipboard in each of the supported formats.
+// Empty fields are treated as unavailable.
+type ClipboardData struct {
+	Text, RTF, HTML string
+}
+
+// formats returns the format flags for the data that is available.
+func (c *ClipboardData) formats() uint32 {
+	var flags uint32
+	for _, f := range supportedClipboardFormats {
+		if c.get(f) != "" {
+			flags |= f
+		}
+	}
+	return flags
+}
+
+func (c *ClipboardData) get(format uint32) string {
+	switch format {
+	case ClipboardFormatText:
+		return c.Text
+	case ClipboardFormatRTF:
+		return c.RTF
+	case ClipboardFormatHTML:
+		return c.HTML
+	}
+	return ""
+}
+
+func (c *ClipboardData) set(format uint32, val string) {
+	switch format {
+	case ClipboardFormatText:
+		c.Text = val
+	case ClipboardFormatRTF:
+		c.RTF = val
+	case ClipboardFormatHTML:
+		c.HTML = val
+	}
+}
+
+// clipboardCaps represents the extended clipboard capabilities of a client.
+type clipboardCaps struct {
+	flags uint32
+	sizes map[uint32]uint32
+}
+
+func (c *clipboardCaps) supports(flag uint32) bool { return c.flags&flag != 0 }
+
+// ExtendedClipboardEnabled returns true if the client negotiated the Extended
+// Clipboard pseudo-encoding.
+func (d *Display) ExtendedClipboardEnabled() bool {
+	d.extClipMux.Lock()
+	defer d.extClipMux.Unlock()
+	return d.extClipCaps != nil
+}
+
+// enableExtendedClipboard is called when the client sends the extended clipboard
+// pseudo-encoding. It sends the server caps to the client.
+func (d *Display) enableExtendedClipboard() {
+	d.extClipMux.Lock()
+	defer d.extClipMux.Unlock()
+	if d.extClipCaps != nil {
+		return
+	}
+	log.Info("Client supports extended clipboard, sending caps")
+	d.extClipCaps = defaultClientClipboardCaps
+
+	flags := clipboardActionCaps | clipboardActionRequest | clipboardActionPeek |
+		clipboardActionNotify | clipboardActionProvide | serverClipboardFormats()
+	payload := new(bytes.Buffer)
+	util.Write(payload, flags)
+	for _, f := range supportedClipboardFormats {
+		util.Write(payload, uint32(d.clipboardPolicy.limit(int(ClipboardSizeLimits[f]))))
+	}
+	d.dispatchExtendedCutText(payload.Bytes())
+}
+
+// handleExtendedCutText handles an extended ClientCutText payload.
+func (d *Display) handleExtendedCutText(payload []byte) error {
+	if len(payload) < 4 {
+		return errors.New("extended clipboard message is too short")
+	}
+	rdr := bytes.NewReader(payload)
+	var flags uint32
+	util.Read(rdr, &flags)
+
+	formats := flags & clipboardFormatMask
+	action := flags & clipboardActionMask
+	if action&clipboardActionCaps != 0 {
+		// Caps messages also carry the actions the client supports
+		action = clipboardActionCaps
+	}
+
+	switch action {
+	case clipboardActionCaps:
+		caps := &clipboardCaps{flags: flags, sizes: make(map[uint32]uint32)}
+		for i := uint(0); i < 16; i++ {
+			f := uint32(1) << i
+			if formats&f == 0 {
+				continue
+			}
+			var size uint32
+			if err := util.Read(rdr, &size); err != nil {
+				return fmt.Errorf("reading clipboard caps: %s", err.Error())
+			}
+			caps.sizes[f] = size
+		}
+		log.Debugf("Client clipboard caps: %#x %v", caps.flags, caps.sizes)
+		d.extClipMux.Lock()
+		d.extClipCaps = caps
+		d.extClipMux.Unlock()
+
+	case clipboardActionRequest:
+		if data := d.filterClipboard(ClipboardServerToClient, d.currentClipboardData()); data != nil {
+			d.provideClipboard(data, formats)
+		}
+
+	case clipboardActionPeek:
+		if data := d.filterClipboard(ClipboardServerToClient, d.currentClipboardData()); data != nil {
+			d.notifyClipboard(data)
+		}
+
+	case clipboardActionNotify:
+		// Request any of the announced formats that we support
+		wanted := formats & serverClipboardFormats()
+		if wanted != 0 {
+			buf := new(bytes.Buffer)
+			util.Write(buf, clipboardActionRequest|wanted)
+			d.dispatchExtendedCutText(buf.Bytes())
+		}
+
+	case clipboardActionProvide:
+		data, err := decodeClipboardProvide(formats, payload[4:], d.clipboardPolicy)
+		if err != nil {
+			return err
+		}
+		if data.formats() == 0 {
+			log.Debugf("Client provided no clipboard formats the server handles: %#x", formats)
+			return nil
+		}
+		d.syncToClipboard(data)
+
+	default:
+		return fmt.Errorf("unsupported extended clipboard action: %#x", action)
+	}
+
+	return nil
+}
+
+// pushExtendedClipboard sends the given data to a client that supports the extended clipboard.
+// It returns false if the client's caps don't allow it and a legacy message should be used instead.
+func (d *Display) pushExtendedClipboard(data *ClipboardData) bool {
+	d.extClipMux.Lock()
+	caps := d.extClipCaps
+	d.extClipMux.Unlock()
+
+	switch {
+	case caps.supports(clipboardActionNotify):
+		d.notifyClipboard(data)
+	case caps.supports(clipboardActionProvide):
+		d.provideClipboard(data, data.formats())
+	default:
+		return false
+	}
+	return true
+}
+
+func (d *Display) notifyClipboard(data *ClipboardData) {
+	buf := new(bytes.Buffer)
+	util.Write(buf, clipboardActionNotify|data.formats())
+	d.dispatchExtendedCutText(buf.Bytes())
+}
+
+// provideClipboard sends the requested formats of the given data to the client. Formats
+// that exceed the size limits of the client are omitted.
+func (d *Display) provideClipboard(data *ClipboardData, formats uint32) {
+	d.extClipMux.Lock()
+	caps := d.extClipCaps
+	d.extClipMux.Unlock()
+
+	var flags uint32
+	raw := new(bytes.Buffer)
+	for _, f := range supportedClipboardFormats {
+		if formats&f == 0 || !caps.supports(f) {
+			continue
+		}
+		val := data.get(f)
+		if val == "" {
+			continue
+		}
+		if f == ClipboardFormatText {
+			val = toCRLF(val)
+		}
+		// All formats are null terminated on the wire
+		val += "\x00"
+		if uint32(len(val)) > caps.sizes[f] {
+			log.Warningf("Clipboard data of format %#x exceeds client limit of %d bytes, omitting", f, caps.sizes[f])
+			continue
+		}
+		flags |= f
+		util.Write(raw, uint32(len(val)))
+		util.Write(raw, []byte(val))
+	}
+
+	payload := new(bytes.Buffer)
+	util.Write(payload, clipboardActionProvide|flags)
+	zw := zlib.NewWriter(payload)
+	zw.Write(raw.Bytes())
+	zw.Close()
+
+	d.dispatchExtendedCutText(payload.Bytes())
+}
+
+// dispatchExtendedCutText wraps the given payload in a ServerCutText message with a
+// negative length and queues it for the client.
+func (d *Display) dispatchExtendedCutText(payload []byte) {
+	buf := new(bytes.Buffer)
+	util.Write(buf, uint8(cmdServerCutText))
+	util.Write(buf, [3]uint8{}) // padding
+	util.Write(buf, int32(-len(payload)))
+	util.Write(buf, payload)
+	d.buf.Dispatch(buf.Bytes())
+}
+
+// currentClipboardData returns the most recent clipboard contents known to the display.
+func (d *Display) currentClipboardData() *ClipboardData {
+	if d.clipboard != nil {
+		return d.clipboard.get()
+	}
+	text, _ := robotgo.ReadAll()
+	return &ClipboardData{Text: text}
+}
+
+// decodeClipboardProvide decodes the zlib compressed body of a provide message. The size
+// of each format is checked against the server and policy limits before anything is read.
+func decodeClipboardProvide(formats uint32, compressed []byte, policy *ClipboardPolicy) (*ClipboardData, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("reading clipboard provide: %s", err.Error())
+	}
+	defer zr.Close()
+
+	data := &ClipboardData{}
+	for i := uint(0); i < 16; i++ {
+		f := uint32(1) << i
+		if formats&f == 0 {
+			continue
+		}
+		var size uint32
+		if err := util.Read(zr, &size); err != nil {
+			return nil, fmt.Errorf("reading clipboard provide: %s", err.Error())
+		}
+		hardLimit, supported := ClipboardSizeLimits[f]
+		if !supported {
+			// Formats come in ascending order, so there is nothing left to read if none
+			// of the later ones are handled either.
+			if formats&serverClipboardFormats()&^(f<<1-1) == 0 {
+				break
+			}
+			if size > uint32(MaxCutTextLength) {
+				return nil, fmt.Errorf("client provided %d bytes of clipboard format %#x, limit is %d", size, f, MaxCutTextLength)
+			}
+			if n, err := io.CopyN(ioutil.Discard, zr, int64(size)); err != nil || n != int64(size) {
+				return nil, errors.New("clipboard provide message is truncated")
+			}
+			continue
+		}
+		limit := uint32(policy.limit(int(hardLimit)))
+		if size > limit {
+			return nil, fmt.Errorf("client provided %d bytes of clipboard format %#x, limit is %d", size, f, limit)
+		}
+		val, err := ioutil.ReadAll(io.LimitReader(zr, int64(size)))
+		if err != nil {
+			return nil, fmt.Errorf("reading clipboard provide: %s", err.Error())
+		}
+		if uint32(len(val)) != size {
+			return nil, errors.New("clipboard provide message is truncated")
+		}
+		str := strings.TrimRight(string(val), "\x00")
+		if f == ClipboardFormatText {
+			str = strings.Replace(str, "\r\n", "\n", -1)
+		}
+		data.set(f, str)
+	}
+	return data, nil
+}
+
+func serverClipboardFormats() uint32 {
+	var flags uint32
+	for _, f := range supportedClipboardFormats {
+		flags |= f
+	}
+	return flags
+}
+
+func toCRLF(in string) string {
+	return strings.Replace(strings.Replace(in, "\r\n", "\n", -1), "\n", "\r\n", -1)
+}
@@ -0,0 +1,382 @@
+package display
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/buffer"
+	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/encodings"
+)
+
+// newClipboardTestDisplay returns a display that is not started, using the given
+// clipboard and policy, and the client end of its connection.
+func newClipboardTestDisplay(t *testing.T, clipboard *Clipboard, policy *ClipboardPolicy) (*Display, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	d, err := NewDisplay(&Opts{
+		Width:           8,
+		Height:          4,
+		Buffer:          buffer.NewReadWriteBuffer(server),
+		SharedProvider:  providers.NewShared(newOnceProvider(8, 4)),
+		GetEncodingFunc: func([]int32) encodings.Encoding { return &encodings.RawEncoding{} },
+		Clipboard:       clipboard,
+		ClipboardPolicy: policy,
+		ConnID:          "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		d.buf.Close()
+	})
+	return d, client
+}
+
+// readCutText reads a ServerCutText message and returns its payload, and whether it is
+// an extended message.
+func readCutText(t *testing.T, c net.Conn) ([]byte, bool) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var hdr struct {
+		Type    uint8
+		Padding [3]uint8
+		Length  int32
+	}
+	if err := binary.Read(c, binary.BigEndian, &hdr); err != nil {
+		t.Fatal("Reading cut text: ", err)
+	}
+	if hdr.Type != cmdServerCutText {
+		t.Fatalf("Expected a cut text message, got type %d", hdr.Type)
+	}
+	length, extended := hdr.Length, hdr.Length < 0
+	if extended {
+		length = -length
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c, payload); err != nil {
+		t.Fatal("Reading cut text payload: ", err)
+	}
+	return payload, extended
+}
+
+// provided is a value in a provide message, sent with the given declared size, or its
+// length when the size is zero.
+type provided struct {
+	val  string
+	size uint32
+}
+
+// providePayload builds the compressed body of a provide message with the given values
+// in wire order.
+func providePayload(t *testing.T, values ...provided) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	for _, v := range values {
+		size := v.size
+		if size == 0 {
+			size = uint32(len(v.val))
+		}
+		binary.Write(zw, binary.BigEndian, size)
+		zw.Write([]byte(v.val))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestClipboardCapsRoundTrip(t *testing.T) {
+	d, c := newClipboardTestDisplay(t, nil, &ClipboardPolicy{MaxSize: 1024})
+	d.enableExtendedClipboard()
+
+	payload, extended := readCutText(t, c)
+	if !extended {
+		t.Fatal("Expected an extended message")
+	}
+	var caps struct {
+		Flags uint32
+		Sizes [3]uint32
+	}
+	if err := binary.Read(bytes.NewReader(payload), binary.BigEndian, &caps); err != nil {
+		t.Fatal(err)
+	}
+	if caps.Flags&clipboardActionCaps == 0 || caps.Flags&clipboardFormatMask != serverClipboardFormats() {
+		t.Fatalf("Unexpected caps flags %#x", caps.Flags)
+	}
+	// The policy limit applies to every format
+	if caps.Sizes != [3]uint32{1024, 1024, 1024} {
+		t.Fatalf("Expected the policy limit for each format, got %v", caps.Sizes)
+	}
+
+	// The client answers with its own caps
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.BigEndian, clipboardActionCaps|clipboardActionProvide|ClipboardFormatText|ClipboardFormatHTML)
+	binary.Write(&msg, binary.BigEndian, []uint32{100, 200})
+	if err := d.handleExtendedCutText(msg.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.extClipCaps.sizes; len(got) != 2 || got[ClipboardFormatText] != 100 || got[ClipboardFormatHTML] != 200 {
+		t.Fatalf("Unexpected client sizes %v", got)
+	}
+	if err := d.handleExtendedCutText(msg.Bytes()[:8]); err == nil {
+		t.Fatal("Expected truncated caps to be refused")
+	}
+}
+
+func TestClipboardProvideRoundTrip(t *testing.T) {
+	d, c := newClipboardTestDisplay(t, nil, nil)
+	d.extClipCaps = &clipboardCaps{
+		flags: clipboardActionProvide | ClipboardFormatText | ClipboardFormatHTML,
+		sizes: map[uint32]uint32{ClipboardFormatText: 1024, ClipboardFormatHTML: 4},
+	}
+	// The HTML is over the client's limit, and RTF is not supported by it
+	d.provideClipboard(&ClipboardData{Text: "one\ntwo", RTF: "{\\rtf}", HTML: "<b>bold</b>"}, serverClipboardFormats())
+
+	payload, _ := readCutText(t, c)
+	flags := binary.BigEndian.Uint32(payload)
+	if flags != clipboardActionProvide|ClipboardFormatText {
+		t.Fatalf("Expected only text to be provided, got %#x", flags)
+	}
+	data, err := decodeClipboardProvide(flags&clipboardFormatMask, payload[4:], DefaultClipboardPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *data != (ClipboardData{Text: "one\ntwo"}) {
+		t.Fatalf("Unexpected data %+v", data)
+	}
+}
+
+func TestClipboardProvideDecode(t *testing.T) {
+	policy := &ClipboardPolicy{MaxSize: 16}
+	for _, tc := range []struct {
+		name    string
+		policy  *ClipboardPolicy
+		formats uint32
+		body    []byte
+		want    ClipboardData
+		wantErr bool
+	}{
+		{
+			name:    "AllSupported",
+			formats: ClipboardFormatText | ClipboardFormatRTF | ClipboardFormatHTML,
+			body:    providePayload(t, provided{val: "a\r\nb\x00"}, provided{val: "{\\rtf}\x00"}, provided{val: "<p>\x00"}),
+			want:    ClipboardData{Text: "a\nb", RTF: "{\\rtf}", HTML: "<p>"},
+		},
+		{
+			name:    "UnsupportedFormatsSkipped",
+			formats: ClipboardFormatText | ClipboardFormatDIB | ClipboardFormatFiles,
+			body:    providePayload(t, provided{val: "text\x00"}, provided{val: strings.Repeat("x", 64)}, provided{val: "file"}),
+			want:    ClipboardData{Text: "text"},
+		},
+		{
+			name:    "OnlyUnsupported",
+			formats: ClipboardFormatDIB,
+			body:    providePayload(t, provided{val: "bitmap"}),
+		},
+		{
+			name:    "OverPolicyLimit",
+			formats: ClipboardFormatText,
+			body:    providePayload(t, provided{val: strings.Repeat("x", 17)}),
+			wantErr: true,
+		},
+		{
+			// The declared size is refused before anything is read
+			name:    "OverHardLimit",
+			policy:  DefaultClipboardPolicy,
+			formats: ClipboardFormatHTML,
+			body:    providePayload(t, provided{val: "x", size: ClipboardSizeLimits[ClipboardFormatHTML] + 1}),
+			wantErr: true,
+		},
+		{
+			name:    "Truncated",
+			formats: ClipboardFormatText,
+			body:    providePayload(t, provided{val: "short", size: 10}),
+			wantErr: true,
+		},
+		{
+			name:    "NotCompressed",
+			formats: ClipboardFormatText,
+			body:    []byte("text"),
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.policy == nil {
+				tc.policy = policy
+			}
+			data, err := decodeClipboardProvide(tc.formats, tc.body, tc.policy)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %+v", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *data != tc.want {
+				t.Fatalf("Expected %+v, got %+v", tc.want, *data)
+			}
+		})
+	}
+}
+
+func TestClipboardPolicy(t *testing.T) {
+	data := &ClipboardData{Text: "token=secret123 hello", HTML: "<p>secret456</p>"}
+	for _, tc := range []struct {
+		name    string
+		policy  *ClipboardPolicy
+		dir     ClipboardDirection
+		want    ClipboardData
+		blocked bool
+	}{
+		{name: "Both", policy: &ClipboardPolicy{Direction: ClipboardBoth}, dir: ClipboardClientToServer, want: *data},
+		{name: "DefaultDirection", policy: &ClipboardPolicy{}, dir: ClipboardServerToClient, want: *data},
+		{name: "Off", policy: &ClipboardPolicy{Direction: ClipboardOff}, dir: ClipboardServerToClient, blocked: true},
+		{name: "ClientToServerAllowed", policy: &ClipboardPolicy{Direction: ClipboardClientToServer}, dir: ClipboardClientToServer, want: *data},
+		{name: "ClientToServerOnly", policy: &ClipboardPolicy{Direction: ClipboardClientToServer}, dir: ClipboardServerToClient, blocked: true},
+		{name: "ServerToClientOnly", policy: &ClipboardPolicy{Direction: ClipboardServerToClient}, dir: ClipboardClientToServer, blocked: true},
+		{name: "UnderMaxSize", policy: &ClipboardPolicy{MaxSize: 21}, dir: ClipboardClientToServer, want: *data},
+		{name: "OverMaxSize", policy: &ClipboardPolicy{MaxSize: 20}, dir: ClipboardClientToServer, blocked: true},
+		{name: "Block", policy: &ClipboardPolicy{Block: []*regexp.Regexp{regexp.MustCompile(`secret4\d+`)}}, dir: ClipboardClientToServer, blocked: true},
+		{name: "BlockNoMatch", policy: &ClipboardPolicy{Block: []*regexp.Regexp{regexp.MustCompile(`password`)}}, dir: ClipboardClientToServer, want: *data},
+		{
+			name:   "Redact",
+			policy: &ClipboardPolicy{Redact: []*regexp.Regexp{regexp.MustCompile(`secret\d+`)}, RedactWith: "***"},
+			dir:    ClipboardServerToClient,
+			want:   ClipboardData{Text: "token=*** hello", HTML: "<p>***</p>"},
+		},
+		{
+			// Blocking is checked before redacting
+			name: "BlockBeforeRedact",
+			policy: &ClipboardPolicy{
+				Redact: []*regexp.Regexp{regexp.MustCompile(`secret\d+`)},
+				Block:  []*regexp.Regexp{regexp.MustCompile(`secret123`)},
+			},
+			dir:     ClipboardClientToServer,
+			blocked: true,
+		},
+		{
+			name: "FilterSeesRedacted",
+			policy: &ClipboardPolicy{
+				Redact: []*regexp.Regexp{regexp.MustCompile(`secret\d+`)},
+				Filter: func(dir ClipboardDirection, d *ClipboardData) (*ClipboardData, error) {
+					return &ClipboardData{Text: strings.ToUpper(d.Text) + " " + string(dir)}, nil
+				},
+			},
+			dir:  ClipboardClientToServer,
+			want: ClipboardData{Text: "TOKEN= HELLO client-to-server"},
+		},
+		{
+			name: "FilterBlocks",
+			policy: &ClipboardPolicy{Filter: func(ClipboardDirection, *ClipboardData) (*ClipboardData, error) {
+				return nil, errors.New("denied")
+			}},
+			dir:     ClipboardServerToClient,
+			blocked: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := tc.policy.apply(tc.dir, data)
+			if tc.blocked {
+				if err == nil {
+					t.Fatalf("Expected the transfer to be blocked, got %+v", out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *out != tc.want {
+				t.Fatalf("Expected %+v, got %+v", tc.want, *out)
+			}
+		})
+	}
+
+	if limit := (&ClipboardPolicy{MaxSize: 10}).limit(100); limit != 10 {
+		t.Fatalf("Expected the policy limit, got %d", limit)
+	}
+	if limit := (&ClipboardPolicy{MaxSize: 1000}).limit(100); limit != 100 {
+		t.Fatalf("Expected the hard limit, got %d", limit)
+	}
+}
+
+// fakeClipboard is a clipboard handler for tests.
+type fakeClipboard struct {
+	mux    sync.Mutex
+	text   string
+	writes []string
+}
+
+func (f *fakeClipboard) ReadClipboard() (string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.text, nil
+}
+
+func (f *fakeClipboard) WriteClipboard(text string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.text = text
+	f.writes = append(f.writes, text)
+	return nil
+}
+
+func (f *fakeClipboard) set(text string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.text = text
+}
+
+func TestClipboardEchoSuppression(t *testing.T) {
+	host := &fakeClipboard{text: "initial"}
+	clipboard := NewClipboard(time.Millisecond * 10)
+	clipboard.SetHandler(host)
+	a, ca := newClipboardTestDisplay(t, clipboard, nil)
+	b, cb := newClipboardTestDisplay(t, clipboard, nil)
+	clipboard.subscribe(a)
+	clipboard.subscribe(b)
+	defer clipboard.unsubscribe(b)
+	defer clipboard.unsubscribe(a)
+
+	// Text from a client goes to the host and the other client only, and the watcher
+	// doesn't send it again once it reads it back from the host
+	a.syncToClipboard(&ClipboardData{Text: "from a"})
+	if payload, _ := readCutText(t, cb); string(payload) != "from a" {
+		t.Fatalf("Expected the other client to get the text, got %q", payload)
+	}
+	expectNothingSent(t, ca)
+	expectNothingSent(t, cb)
+
+	// The same text again is not written or forwarded
+	a.syncToClipboard(&ClipboardData{Text: "from a"})
+	b.syncToClipboard(&ClipboardData{Text: "from a"})
+	expectNothingSent(t, ca)
+	expectNothingSent(t, cb)
+	host.mux.Lock()
+	if len(host.writes) != 1 || host.writes[0] != "from a" {
+		t.Fatalf("Expected a single write to the host, got %q", host.writes)
+	}
+	host.mux.Unlock()
+
+	// A change at the host goes to every client
+	host.set("from host")
+	for _, c := range []net.Conn{ca, cb} {
+		if payload, _ := readCutText(t, c); string(payload) != "from host" {
+			t.Fatalf("Expected the host text, got %q", payload)
+		}
+	}
+	expectNothingSent(t, ca)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"image"
 
+	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
 	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
 	"github.com/tinyzimmer/gsvnc/pkg/internal/util"
 	"github.com/tinyzimmer/gsvnc/pkg/rfb/types"
@@ -15,19 +16,34 @@ const (
 	cmdFramebufferUpdate = 0
 )
 
-func (d *Display) pushFrame(ur *types.FrameBufferUpdateRequest) {
-
-	li := d.GetLastImage()
-	if li == nil {
-		return
-	}
-
+// pushFrame answers an update request from the given frame. It returns false if the
+// request is incremental and nothing changed since the last update, in which case it
+// should be answered once something does.
+func (d *Display) pushFrame(ur *types.FrameBufferUpdateRequest, li *image.RGBA) bool {
 	if ur.Incremental() {
-		li = truncateImage(ur, li)
+		return d.pushDamage(li)
 	}
 
-	log.Debug("Pushing latest frame to client")
-	d.pushImage(li)
+	log.Debug("Pushing requested region to client")
+	rect := image.Rect(int(ur.X), int(ur.Y), int(ur.X)+int(ur.Width), int(ur.Y)+int(ur.Height))
+	d.pushImage(li.SubImage(rect.Intersect(li.Bounds())).(*image.RGBA))
+	d.lastFrame = li
+	return true
+}
+
+// pushDamage sends the region of the given frame that changed since the last frame
+// that was sent to the client. Nothing is sent if the frame is unchanged, in which
+// case false is returned.
+func (d *Display) pushDamage(img *image.RGBA) bool {
+	damage := d.frameDamage(d.lastFrame, img)
+	d.lastFrame = img
+	if damage.Empty() {
+		log.Debug("Frame is unchanged, skipping update")
+		return false
+	}
+	log.Debug("Pushing damaged region to client: ", damage)
+	d.pushImage(img.SubImage(damage).(*image.RGBA))
+	return true
 }
 
 func (d *Display) pushImage(img *image.RGBA) {
@@ -59,18 +75,15 @@ func (d *Display) pushImage(img *image.RGBA) {
 	d.buf.Dispatch(buf.Bytes())
 }
 
-func truncateImage(ur *types.FrameBufferUpdateRequest, img *image.RGBA) *image.RGBA {
-	truncated := image.NewRGBA(
-		image.Rect(
-			int(ur.X), int(ur.Y), int(ur.Width), int(ur.Height),
-		),
-	)
-
-	for y := ur.Y; y < ur.Height; y++ {
-		for x := ur.X; x < ur.Width; x++ {
-			truncated.Set(int(x), int(y), img.At(int(x), int(y)))
-		}
+// frameDamage returns the region of cur that changed since prev. It is asked of the
+// provider if it tracks damage, or else found by comparing the frames.
+func (d *Display) frameDamage(prev, cur *image.RGBA) image.Rectangle {
+	if d.damager == nil || prev == nil {
+		return providers.DiffBounds(prev, cur)
 	}
-
-	return truncated
+	if damage, ok := d.damager.DamageSince(prev, cur); ok {
+		return damage.Intersect(cur.Bounds())
+	}
+	// prev is too old for the provider to know what changed since
+	return cur.Bounds()
 }
@@ -7,8 +7,17 @@ import (
 )
 
 func (d *Display) dispatchDownKeys() {
+	// Errors are ignored, the keys are sent as-is if the lock state is unknown
+	lockState, _ := d.locks.get()
+	for _, key := range d.downKeys {
+		if isLockKey(key) {
+			// The state changes once the key is sent
+			defer d.locks.invalidate()
+			break
+		}
+	}
 	if len(d.downKeys) == 1 {
-		ks, ok := robotASCIMap[d.downKeys[0]]
+		ks, ok := robotASCIMap[reconcileKey(d.downKeys[0], lockState)]
 		if !ok {
 			log.Println("Unhandled keysym:", d.downKeys[0])
 			return
@@ -18,7 +27,7 @@ func (d *Display) dispatchDownKeys() {
 	}
 	args := make([]interface{}, len(d.downKeys))
 	for idx, key := range d.downKeys {
-		ks, ok := robotASCIMap[key]
+		ks, ok := robotASCIMap[reconcileKey(key, lockState)]
 		if !ok {
 			log.Println("Unhandled keysym:", d.downKeys[0])
 			return
@@ -0,0 +1,144 @@
+package display
+
+import (
+	"bytes"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+	"github.com/tinyzimmer/gsvnc/pkg/internal/util"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/types"
+)
+
+// Pseudo-encodings used for sending lock key state to clients.
+const (
+	PseudoEncodingLEDState       int32 = -261
+	PseudoEncodingVMwareLEDState int32 = 0x574D5668
+)
+
+// LockState represents the state of the host lock keys. The bits match the layout
+// used by the LED state pseudo-encodings.
+type LockState uint8
+
+// Lock key bits.
+const (
+	ScrollLock LockState = 1 << 0
+	NumLock    LockState = 1 << 1
+	CapsLock   LockState = 1 << 2
+)
+
+// Has returns true if the given lock key is on.
+func (l LockState) Has(key LockState) bool { return l&key != 0 }
+
+// Keysyms of the lock keys.
+const (
+	keysymScrollLock uint32 = 0xff14
+	keysymNumLock    uint32 = 0xff7f
+	keysymCapsLock   uint32 = 0xffe5
+)
+
+func isLockKey(key uint32) bool {
+	return key == keysymScrollLock || key == keysymNumLock || key == keysymCapsLock
+}
+
+// lockStateMaxAge is how long the host lock key state is cached. Changes made at the
+// host, which the X server can't notify without XKB, are picked up by reading it again
+// once it is older.
+const lockStateMaxAge = time.Second
+
+// hostLocks is the lock key state of the host.
+var hostLocks = &lockStateCache{read: hostLockState}
+
+// lockStateCache caches the host lock key state, so that it is not read on every key
+// event. It is read again when it gets old, or after a lock key is sent to the host.
+type lockStateCache struct {
+	read func() (LockState, error)
+
+	mux    sync.Mutex
+	state  LockState
+	err    error
+	readAt time.Time
+}
+
+// get returns the lock key state, reading it from the host if it is out of date.
+func (c *lockStateCache) get() (LockState, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.readAt.IsZero() || time.Since(c.readAt) >= lockStateMaxAge {
+		c.state, c.err = c.read()
+		c.readAt = time.Now()
+	}
+	return c.state, c.err
+}
+
+// invalidate makes the next call to get read the state from the host.
+func (c *lockStateCache) invalidate() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.readAt = time.Time{}
+}
+
+// syncLockState checks the host lock key state and pushes it to the client if it
+// negotiated one of the LED state pseudo-encodings and the state has changed.
+func (d *Display) syncLockState() {
+	d.formatMux.RLock()
+	enc, sent := d.ledEncoding, d.ledStateSent
+	d.formatMux.RUnlock()
+	if enc == 0 {
+		return
+	}
+	state, err := d.locks.get()
+	if err != nil {
+		log.Debug("Could not read host lock key state: ", err.Error())
+		return
+	}
+	if sent && state == d.ledState {
+		return
+	}
+	log.Debugf("Sending lock key state %#x to client", state)
+	d.pushLockState(enc, state)
+	d.ledState = state
+	d.formatMux.Lock()
+	// The client may have changed its encodings meanwhile
+	if d.ledEncoding == enc {
+		d.ledStateSent = true
+	}
+	d.formatMux.Unlock()
+}
+
+func (d *Display) pushLockState(enc int32, state LockState) {
+	buf := new(bytes.Buffer)
+
+	util.Write(buf, uint8(cmdFramebufferUpdate))
+	util.Write(buf, uint8(0))  // padding byte
+	util.Write(buf, uint16(1)) // 1 rectangle
+
+	util.PackStruct(buf, &types.FrameBufferRectangle{EncType: enc})
+
+	switch enc {
+	case PseudoEncodingLEDState:
+		util.Write(buf, uint8(state))
+	case PseudoEncodingVMwareLEDState:
+		util.Write(buf, uint32(state))
+	}
+
+	d.buf.Dispatch(buf.Bytes())
+}
+
+// reconcileKey adjusts the given keysym for the host lock key state. Letters are sent
+// to the host with an explicit case, so when Caps Lock is on at the host their case needs
+// to be inverted to produce what the client typed.
+func reconcileKey(key uint32, state LockState) uint32 {
+	if !state.Has(CapsLock) || key > unicode.MaxLatin1 {
+		return key
+	}
+	r := rune(key)
+	if !unicode.IsLetter(r) {
+		return key
+	}
+	if unicode.IsUpper(r) {
+		return uint32(unicode.ToLower(r))
+	}
+	return uint32(unicode.ToUpper(r))
+}
@@ -0,0 +1,95 @@
+package display
+
+import (
+	"sync"
+	"time"
+
+	"github.com/robotn/xgb"
+	"github.com/robotn/xgb/xproto"
+)
+
+// The connection to the X server used to read the lock key state. When connecting
+// fails, it is retried after a backoff instead of on every read.
+var (
+	xConn        *xgb.Conn
+	xConnErr     error
+	xConnRetry   time.Time
+	xConnBackoff time.Duration
+	xConnMux     sync.Mutex
+
+	xNewConn = xgb.NewConn
+)
+
+// Bounds of the backoff between attempts to connect to the X server.
+const (
+	xConnMinBackoff = time.Second
+	xConnMaxBackoff = time.Minute
+)
+
+// X server indicator bits in the LED mask.
+const (
+	xLedCapsLock   = 1 << 0
+	xLedNumLock    = 1 << 1
+	xLedScrollLock = 1 << 2
+)
+
+// lockStateConn returns the connection to the X server, connecting if there is none
+// and the backoff after the last failure has passed.
+func lockStateConn() (*xgb.Conn, error) {
+	xConnMux.Lock()
+	defer xConnMux.Unlock()
+	if xConn != nil {
+		return xConn, nil
+	}
+	if time.Now().Before(xConnRetry) {
+		return nil, xConnErr
+	}
+	conn, err := xNewConn()
+	if err != nil {
+		if xConnBackoff == 0 {
+			xConnBackoff = xConnMinBackoff
+		} else if xConnBackoff *= 2; xConnBackoff > xConnMaxBackoff {
+			xConnBackoff = xConnMaxBackoff
+		}
+		xConnErr, xConnRetry = err, time.Now().Add(xConnBackoff)
+		return nil, err
+	}
+	xConn, xConnErr, xConnBackoff = conn, nil, 0
+	return conn, nil
+}
+
+// dropLockStateConn closes the given connection after a failed request, so that the
+// next read connects again.
+func dropLockStateConn(conn *xgb.Conn) {
+	xConnMux.Lock()
+	defer xConnMux.Unlock()
+	if xConn == conn {
+		xConn = nil
+		conn.Close()
+	}
+}
+
+func hostLockState() (LockState, error) {
+	conn, err := lockStateConn()
+	if err != nil {
+		return 0, err
+	}
+
+	reply, err := xproto.GetKeyboardControl(conn).Reply()
+	if err != nil {
+		dropLockStateConn(conn)
+		return 0, err
+	}
+
+	var state LockState
+	if reply.LedMask&xLedCapsLock != 0 {
+		state |= CapsLock
+	}
+	if reply.LedMask&xLedNumLock != 0 {
+		state |= NumLock
+	}
+	if reply.LedMask&xLedScrollLock != 0 {
+		state |= ScrollLock
+	}
+	return state, nil
+}
@@ -0,0 +1,51 @@
+package display
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/robotn/xgb"
+)
+
+func TestLockStateConnBackoff(t *testing.T) {
+	prevNewConn := xNewConn
+	defer func() {
+		xNewConn = prevNewConn
+		xConnMux.Lock()
+		xConn, xConnErr, xConnRetry, xConnBackoff = nil, nil, time.Time{}, 0
+		xConnMux.Unlock()
+	}()
+	xConnMux.Lock()
+	xConn, xConnErr, xConnRetry, xConnBackoff = nil, nil, time.Time{}, 0
+	xConnMux.Unlock()
+
+	attempts := 0
+	xNewConn = func() (*xgb.Conn, error) {
+		attempts++
+		return nil, errors.New("no X server")
+	}
+	for _, want := range []time.Duration{xConnMinBackoff, 2 * xConnMinBackoff, 4 * xConnMinBackoff} {
+		if _, err := lockStateConn(); err == nil {
+			t.Fatal("Expected an error without an X server")
+		}
+		// Reads before the backoff has passed don't connect again
+		if _, err := lockStateConn(); err == nil {
+			t.Fatal("Expected the last error within the backoff")
+		}
+		if xConnBackoff != want {
+			t.Fatalf("Expected a backoff of %s, got %s", want, xConnBackoff)
+		}
+		xConnRetry = time.Now()
+	}
+	if attempts != 3 {
+		t.Fatalf("Expected one attempt per backoff, got %d", attempts)
+	}
+
+	xConnBackoff = xConnMaxBackoff
+	xConnRetry = time.Now()
+	lockStateConn()
+	if xConnBackoff != xConnMaxBackoff {
+		t.Fatalf("Expected the backoff to be capped at %s, got %s", xConnMaxBackoff, xConnBackoff)
+	}
+}
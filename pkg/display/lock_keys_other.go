@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package display
+
+import "errors"
+
+func hostLockState() (LockState, error) {
+	return 0, errors.New("reading lock key state is not supported on this platform")
+}
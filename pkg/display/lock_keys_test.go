@@ -0,0 +1,184 @@
+package display
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/buffer"
+	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/encodings"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/types"
+)
+
+// fakeLocks is a host lock key state for tests, counting how often it is read.
+type fakeLocks struct {
+	state LockState
+	err   error
+	reads int
+}
+
+func (f *fakeLocks) read() (LockState, error) {
+	f.reads++
+	return f.state, f.err
+}
+
+// newLockTestDisplay returns a display that is not started, reading the lock key state
+// from the given fake, and the client end of its connection.
+func newLockTestDisplay(t *testing.T, locks *fakeLocks) (*Display, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	d, err := NewDisplay(&Opts{
+		Width:           8,
+		Height:          4,
+		Buffer:          buffer.NewReadWriteBuffer(server),
+		SharedProvider:  providers.NewShared(newOnceProvider(8, 4)),
+		GetEncodingFunc: func([]int32) encodings.Encoding { return &encodings.RawEncoding{} },
+		ConnID:          "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.locks = &lockStateCache{read: locks.read}
+	t.Cleanup(func() {
+		client.Close()
+		d.buf.Close()
+	})
+	return d, client
+}
+
+// readLEDState reads a framebuffer update with a single LED state rectangle of the
+// given pseudo-encoding and returns the state.
+func readLEDState(t *testing.T, c net.Conn, enc int32) LockState {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var hdr struct {
+		Type, Padding uint8
+		Count         uint16
+		Rect          types.FrameBufferRectangle
+	}
+	if err := binary.Read(c, binary.BigEndian, &hdr); err != nil {
+		t.Fatal("Reading update: ", err)
+	}
+	if hdr.Type != cmdFramebufferUpdate || hdr.Count != 1 || hdr.Rect.EncType != enc {
+		t.Fatalf("Unexpected LED state header %+v", hdr)
+	}
+	if hdr.Rect.X != 0 || hdr.Rect.Y != 0 || hdr.Rect.Width != 0 || hdr.Rect.Height != 0 {
+		t.Fatalf("Expected an empty rectangle, got %+v", hdr.Rect)
+	}
+	switch enc {
+	case PseudoEncodingVMwareLEDState:
+		var state uint32
+		if err := binary.Read(c, binary.BigEndian, &state); err != nil {
+			t.Fatal("Reading state: ", err)
+		}
+		return LockState(state)
+	default:
+		var state uint8
+		if err := binary.Read(c, binary.BigEndian, &state); err != nil {
+			t.Fatal("Reading state: ", err)
+		}
+		return LockState(state)
+	}
+}
+
+// expectNothingSent checks the display does not write anything to the client.
+func expectNothingSent(t *testing.T, c net.Conn) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected nothing to be sent")
+	}
+}
+
+func TestLEDStateMessages(t *testing.T) {
+	for _, enc := range []int32{PseudoEncodingLEDState, PseudoEncodingVMwareLEDState} {
+		locks := &fakeLocks{state: CapsLock | NumLock}
+		d, c := newLockTestDisplay(t, locks)
+		d.SetEncodings([]int32{0}, []int32{enc})
+
+		d.syncLockState()
+		if got := readLEDState(t, c, enc); got != CapsLock|NumLock {
+			t.Fatalf("Encoding %d: expected Caps Lock and Num Lock, got %#x", enc, got)
+		}
+
+		// An unchanged state is not sent again
+		d.locks.invalidate()
+		d.syncLockState()
+		expectNothingSent(t, c)
+
+		locks.state = ScrollLock
+		d.locks.invalidate()
+		d.syncLockState()
+		if got := readLEDState(t, c, enc); got != ScrollLock {
+			t.Fatalf("Encoding %d: expected Scroll Lock, got %#x", enc, got)
+		}
+
+		// The state is sent again after the client sets its encodings
+		d.SetEncodings([]int32{0}, []int32{enc})
+		d.syncLockState()
+		if got := readLEDState(t, c, enc); got != ScrollLock {
+			t.Fatalf("Encoding %d: expected Scroll Lock again, got %#x", enc, got)
+		}
+	}
+}
+
+func TestLEDStateNotNegotiated(t *testing.T) {
+	locks := &fakeLocks{state: CapsLock}
+	d, c := newLockTestDisplay(t, locks)
+	d.SetEncodings([]int32{0}, nil)
+	d.syncLockState()
+	expectNothingSent(t, c)
+	if locks.reads != 0 {
+		t.Fatalf("Expected the host state not to be read, got %d reads", locks.reads)
+	}
+
+	// Nothing is sent while the state can't be read
+	locks.err = errors.New("no X server")
+	d.SetEncodings([]int32{0}, []int32{PseudoEncodingLEDState})
+	d.syncLockState()
+	expectNothingSent(t, c)
+}
+
+func TestLockStateCache(t *testing.T) {
+	locks := &fakeLocks{state: CapsLock}
+	cache := &lockStateCache{read: locks.read}
+	for i := 0; i < 3; i++ {
+		if state, err := cache.get(); err != nil || state != CapsLock {
+			t.Fatalf("Expected Caps Lock, got %#x, %v", state, err)
+		}
+	}
+	if locks.reads != 1 {
+		t.Fatalf("Expected the state to be read once, got %d reads", locks.reads)
+	}
+	locks.state = 0
+	cache.invalidate()
+	if state, _ := cache.get(); state != 0 || locks.reads != 2 {
+		t.Fatalf("Expected the state to be read again after invalidating, got %#x after %d reads", state, locks.reads)
+	}
+	cache.readAt = time.Now().Add(-lockStateMaxAge)
+	if cache.get(); locks.reads != 3 {
+		t.Fatalf("Expected an old state to be read again, got %d reads", locks.reads)
+	}
+}
+
+func TestReconcileKey(t *testing.T) {
+	for _, tc := range []struct {
+		key   uint32
+		state LockState
+		want  uint32
+	}{
+		{'a', 0, 'a'},
+		{'a', CapsLock, 'A'},
+		{'A', CapsLock, 'a'},
+		{'a', NumLock | ScrollLock, 'a'},
+		{'1', CapsLock, '1'},
+		{keysymCapsLock, CapsLock, keysymCapsLock},
+	} {
+		if got := reconcileKey(tc.key, tc.state); got != tc.want {
+			t.Fatalf("Expected %#x for %#x with state %#x, got %#x", tc.want, tc.key, tc.state, got)
+		}
+	}
+}
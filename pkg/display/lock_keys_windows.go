@@ -0,0 +1,33 @@
+package display
+
+import "syscall"
+
+var procGetKeyState = syscall.NewLazyDLL("user32.dll").NewProc("GetKeyState")
+
+// Virtual key codes for the lock keys.
+const (
+	vkCapital = 0x14
+	vkNumLock = 0x90
+	vkScroll  = 0x91
+)
+
+func hostLockState() (LockState, error) {
+	if err := procGetKeyState.Find(); err != nil {
+		return 0, err
+	}
+	toggled := func(vk uintptr) bool {
+		ret, _, _ := procGetKeyState.Call(vk)
+		return ret&1 != 0
+	}
+	var state LockState
+	if toggled(vkCapital) {
+		state |= CapsLock
+	}
+	if toggled(vkNumLock) {
+		state |= NumLock
+	}
+	if toggled(vkScroll) {
+		state |= ScrollLock
+	}
+	return state, nil
+}
@@ -0,0 +1,202 @@
+package providers
+
+import (
+	"image"
+	"image/draw"
+	"sync"
+	"time"
+)
+
+// Canvas implements a display provider serving an in-memory image that the application
+// draws into itself. It lets a Go program serve a framebuffer over VNC without a real
+// display, similar to libvncserver.
+//
+// Drawing is done on the image returned by Image while holding the canvas lock, after
+// which the changed region is reported with MarkDirty:
+//
+//	canvas.Lock()
+//	draw.Draw(canvas.Image(), rect, src, image.Point{}, draw.Src)
+//	canvas.Unlock()
+//	canvas.MarkDirty(rect)
+//
+// Input from clients is delivered to the callbacks instead of the host. Callbacks are
+// invoked from the goroutines of the connected clients and should not block.
+//
+// Each frame with changes is a new image the size of the canvas. Nothing is reused on
+// purpose, since consumers keep the frames they are given to compute damage.
+type Canvas struct {
+	// OnKey is called when a client presses or releases a key. The key is an X11 keysym.
+	OnKey func(keysym uint32, down bool)
+	// OnPointer is called when a client moves the pointer or changes the button state.
+	OnPointer func(x, y int, buttonMask uint8)
+	// OnClipboard is called when a client sends clipboard text.
+	OnClipboard func(text string)
+
+	// The image the application draws into, guarded by mux
+	img *image.RGBA
+	mux sync.Mutex
+
+	// Guards the fields below
+	stateMux  sync.Mutex
+	stopCh    chan struct{}
+	dirty     image.Rectangle
+	frame     *image.RGBA
+	clipboard string
+
+	// Signaled when a region is marked dirty
+	notifyCh chan struct{}
+}
+
+// NewCanvas returns a new canvas of the given size. The server should be created with
+// the same dimensions.
+func NewCanvas(width, height int) *Canvas {
+	return &Canvas{
+		img:      image.NewRGBA(image.Rect(0, 0, width, height)),
+		notifyCh: make(chan struct{}, 1),
+	}
+}
+
+// Image returns the image to draw into. The canvas must be locked while drawing.
+func (c *Canvas) Image() draw.Image { return c.img }
+
+// Bounds returns the bounds of the canvas.
+func (c *Canvas) Bounds() image.Rectangle { return c.img.Bounds() }
+
+// Size implements Sizer.
+func (c *Canvas) Size() (width, height int) {
+	b := c.img.Bounds()
+	return b.Dx(), b.Dy()
+}
+
+// Lock locks the canvas for drawing.
+func (c *Canvas) Lock() { c.mux.Lock() }
+
+// Unlock unlocks the canvas after drawing.
+func (c *Canvas) Unlock() { c.mux.Unlock() }
+
+// MarkDirty reports that the given region of the canvas has changed and should be sent
+// to clients. Regions marked before the next frame is taken are merged.
+func (c *Canvas) MarkDirty(rect image.Rectangle) {
+	rect = rect.Intersect(c.img.Bounds())
+	if rect.Empty() {
+		return
+	}
+	c.stateMux.Lock()
+	c.dirty = c.dirty.Union(rect)
+	c.stateMux.Unlock()
+	select {
+	case c.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// SetClipboard sets the clipboard text that is sent to clients.
+func (c *Canvas) SetClipboard(text string) {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	c.clipboard = text
+}
+
+// Start starts serving frames from the canvas. The canvas keeps its own dimensions.
+func (c *Canvas) Start(width, height int) error {
+	c.stateMux.Lock()
+	c.stopCh = make(chan struct{})
+	c.frame = nil
+	c.stateMux.Unlock()
+	// Always send the whole canvas to the first client
+	c.MarkDirty(c.img.Bounds())
+	return nil
+}
+
+// canvasRefreshInterval is how often the last frame is repeated when nothing is drawn,
+// so clients asking for a full update aren't kept waiting.
+const canvasRefreshInterval = time.Millisecond * 100
+
+// PullFrame returns a snapshot of the canvas once a region is marked dirty, or the
+// previous snapshot if nothing changed for a while. Nil is returned once the canvas
+// is closed.
+func (c *Canvas) PullFrame() *image.RGBA {
+	c.stateMux.Lock()
+	stopCh := c.stopCh
+	c.stateMux.Unlock()
+	if stopCh == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(canvasRefreshInterval)
+	defer timer.Stop()
+	select {
+	case <-stopCh:
+		return nil
+	case <-c.notifyCh:
+	case <-timer.C:
+	}
+
+	c.stateMux.Lock()
+	dirty, prev := c.dirty, c.frame
+	c.dirty = image.Rectangle{}
+	c.stateMux.Unlock()
+	if dirty.Empty() && prev != nil {
+		return prev
+	}
+
+	// Frames are kept by consumers to compute damage, so each one is a new image built
+	// from the previous frame and the dirty region.
+	frame := image.NewRGBA(c.img.Bounds())
+	c.mux.Lock()
+	if prev != nil {
+		copy(frame.Pix, prev.Pix)
+		draw.Draw(frame, dirty, c.img, dirty.Min, draw.Src)
+	} else {
+		copy(frame.Pix, c.img.Pix)
+	}
+	c.mux.Unlock()
+
+	c.stateMux.Lock()
+	c.frame = frame
+	c.stateMux.Unlock()
+	return frame
+}
+
+// Close stops serving frames. The canvas can be started again.
+func (c *Canvas) Close() error {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	if c.stopCh != nil {
+		close(c.stopCh)
+		c.stopCh = nil
+	}
+	return nil
+}
+
+// KeyEvent implements InputHandler.
+func (c *Canvas) KeyEvent(keysym uint32, down bool) {
+	if c.OnKey != nil {
+		c.OnKey(keysym, down)
+	}
+}
+
+// PointerEvent implements InputHandler.
+func (c *Canvas) PointerEvent(x, y int, buttonMask uint8) {
+	if c.OnPointer != nil {
+		c.OnPointer(x, y, buttonMask)
+	}
+}
+
+// ReadClipboard implements ClipboardHandler.
+func (c *Canvas) ReadClipboard() (string, error) {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	return c.clipboard, nil
+}
+
+// WriteClipboard implements ClipboardHandler.
+func (c *Canvas) WriteClipboard(text string) error {
+	c.stateMux.Lock()
+	c.clipboard = text
+	c.stateMux.Unlock()
+	if c.OnClipboard != nil {
+		c.OnClipboard(text)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package providers
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+	"time"
+)
+
+func fillCanvas(c *Canvas, r image.Rectangle, col color.Color) {
+	c.Lock()
+	draw.Draw(c.Image(), r, image.NewUniform(col), image.Point{}, draw.Src)
+	c.Unlock()
+}
+
+func TestCanvasFrames(t *testing.T) {
+	c := NewCanvas(8, 4)
+	if w, h := c.Size(); w != 8 || h != 4 {
+		t.Fatalf("Expected a size of 8x4, got %dx%d", w, h)
+	}
+	fillCanvas(c, c.Bounds(), color.White)
+	if err := c.Start(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The whole canvas is sent first
+	first := c.PullFrame()
+	if first == nil || first.Bounds() != c.Bounds() || first.RGBAAt(7, 3) != (color.RGBA{255, 255, 255, 255}) {
+		t.Fatal("Expected the first frame to be the whole canvas")
+	}
+
+	// Drawing without marking the region dirty is not picked up
+	red := color.RGBA{255, 0, 0, 255}
+	fillCanvas(c, image.Rect(0, 0, 2, 2), red)
+	if frame := c.PullFrame(); frame != first {
+		t.Fatal("Expected the previous frame when nothing is marked dirty")
+	}
+
+	// Only the dirty region is taken from the canvas
+	fillCanvas(c, image.Rect(4, 0, 6, 2), red)
+	c.MarkDirty(image.Rect(4, 0, 6, 2))
+	second := c.PullFrame()
+	if second == first || &second.Pix[0] == &first.Pix[0] {
+		t.Fatal("Expected a new frame with pixels of its own")
+	}
+	if second.RGBAAt(4, 0) != red || second.RGBAAt(0, 0) == red {
+		t.Fatalf("Expected only the dirty region to change, got %v and %v", second.RGBAAt(4, 0), second.RGBAAt(0, 0))
+	}
+	if first.RGBAAt(4, 0) == red {
+		t.Fatal("Expected the earlier frame to be left alone")
+	}
+
+	// Regions marked before the next frame are merged, and outside regions ignored
+	c.MarkDirty(image.Rect(0, 0, 1, 1))
+	c.MarkDirty(image.Rect(1, 1, 2, 2))
+	c.MarkDirty(image.Rect(100, 100, 200, 200))
+	third := c.PullFrame()
+	if third.RGBAAt(0, 0) != red || third.RGBAAt(1, 1) != red {
+		t.Fatal("Expected both dirty regions in the frame")
+	}
+
+	// Close unblocks a pending pull
+	done := make(chan *image.RGBA)
+	go func() { done <- c.PullFrame() }()
+	c.Close()
+	select {
+	case frame := <-done:
+		if frame != nil && frame != third {
+			t.Fatal("Expected the last frame or nil while closing")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("PullFrame did not return after Close")
+	}
+	if c.PullFrame() != nil {
+		t.Fatal("Expected no frames once closed")
+	}
+}
+
+func TestCanvasCallbacks(t *testing.T) {
+	c := NewCanvas(8, 4)
+	// Without callbacks input is dropped
+	c.KeyEvent(0x61, true)
+	c.PointerEvent(1, 2, 1)
+	if err := c.WriteClipboard("dropped"); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []uint32
+	var pointer [3]int
+	var clipboard string
+	c.OnKey = func(keysym uint32, down bool) {
+		if down {
+			keys = append(keys, keysym)
+		}
+	}
+	c.OnPointer = func(x, y int, buttonMask uint8) { pointer = [3]int{x, y, int(buttonMask)} }
+	c.OnClipboard = func(text string) { clipboard = text }
+
+	c.KeyEvent(0x61, true)
+	c.KeyEvent(0x61, false)
+	c.PointerEvent(3, 2, 4)
+	if len(keys) != 1 || keys[0] != 0x61 || pointer != [3]int{3, 2, 4} {
+		t.Fatalf("Unexpected input %v, %v", keys, pointer)
+	}
+
+	if err := c.WriteClipboard("from client"); err != nil {
+		t.Fatal(err)
+	}
+	if clipboard != "from client" {
+		t.Fatalf("Expected the clipboard callback, got %q", clipboard)
+	}
+	c.SetClipboard("from app")
+	if text, err := c.ReadClipboard(); err != nil || text != "from app" {
+		t.Fatalf("Expected the text set by the application, got %q, %v", text, err)
+	}
+}
@@ -0,0 +1,110 @@
+package providers
+
+import (
+	"bytes"
+	"image"
+	"sync"
+)
+
+// DiffBounds returns the smallest rectangle containing every pixel that differs between
+// the two frames. If there is no previous frame, or the sizes differ, the bounds of the
+// new frame are returned.
+func DiffBounds(prev, cur *image.RGBA) image.Rectangle {
+	b := cur.Bounds()
+	if prev == nil || prev.Bounds() != b {
+		return b
+	}
+	if prev == cur {
+		return image.Rectangle{}
+	}
+	damage := image.Rectangle{}
+	rowLen := b.Dx() * 4
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		prevRow := prev.Pix[prev.PixOffset(b.Min.X, y):][:rowLen]
+		curRow := cur.Pix[cur.PixOffset(b.Min.X, y):][:rowLen]
+		if bytes.Equal(prevRow, curRow) {
+			continue
+		}
+		minX, maxX := b.Max.X, b.Min.X
+		for x := 0; x < rowLen; x += 4 {
+			if !bytes.Equal(prevRow[x:x+4], curRow[x:x+4]) {
+				px := b.Min.X + x/4
+				if px < minX {
+					minX = px
+				}
+				if px+1 > maxX {
+					maxX = px + 1
+				}
+			}
+		}
+		damage = damage.Union(image.Rect(minX, y, maxX, y+1))
+	}
+	return damage
+}
+
+// trackedFrames is how many frames a frameRing tracks.
+const trackedFrames = 4
+
+// frameRing tracks the last frames returned by a provider and the regions that changed
+// between them, implementing Damager. Frames are handed to consumers that keep them for
+// as long as they like, so their pixels are never written to once they are tracked.
+type frameRing struct {
+	frames [trackedFrames]trackedFrame // Oldest first, starting at next
+	next   int
+	mux    sync.Mutex
+}
+
+// trackedFrame is a frame and the region that changed since the frame before it.
+type trackedFrame struct {
+	img    *image.RGBA
+	damage image.Rectangle
+}
+
+// reset forgets all frames.
+func (r *frameRing) reset() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.frames, r.next = [trackedFrames]trackedFrame{}, 0
+}
+
+// newest returns the last frame that was pushed, or nil if there is none.
+func (r *frameRing) newest() *image.RGBA {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.frames[(r.next+trackedFrames-1)%trackedFrames].img
+}
+
+// push tracks a frame that changed in the given region since the newest one, and stops
+// tracking the oldest.
+func (r *frameRing) push(frame *image.RGBA, damage image.Rectangle) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.frames[r.next] = trackedFrame{img: frame, damage: damage}
+	r.next = (r.next + 1) % trackedFrames
+}
+
+// DamageSince implements Damager.
+func (r *frameRing) DamageSince(prev, cur *image.RGBA) (image.Rectangle, bool) {
+	if prev == cur {
+		return image.Rectangle{}, true
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	from, to := -1, -1
+	for i := 0; i < trackedFrames; i++ {
+		switch r.frames[(r.next+i)%trackedFrames].img {
+		case prev:
+			from = i
+		case cur:
+			to = i
+		}
+	}
+	if from < 0 || to < from {
+		return image.Rectangle{}, false
+	}
+	var damage image.Rectangle
+	for i := from + 1; i <= to; i++ {
+		damage = damage.Union(r.frames[(r.next+i)%trackedFrames].damage)
+	}
+	return damage, true
+}
@@ -0,0 +1,62 @@
+package providers
+
+import (
+	"image"
+	"testing"
+)
+
+func TestDiffBounds(t *testing.T) {
+	a, b := image.NewRGBA(image.Rect(0, 0, 8, 4)), image.NewRGBA(image.Rect(0, 0, 8, 4))
+	if got := DiffBounds(nil, b); got != b.Bounds() {
+		t.Fatalf("Expected the whole frame without a previous one, got %s", got)
+	}
+	if got := DiffBounds(a, b); !got.Empty() {
+		t.Fatalf("Expected no damage between equal frames, got %s", got)
+	}
+	b.Pix[b.PixOffset(2, 1)] = 1
+	b.Pix[b.PixOffset(5, 2)+3] = 1
+	if got := DiffBounds(a, b); got != image.Rect(2, 1, 6, 3) {
+		t.Fatalf("Expected the changed pixels, got %s", got)
+	}
+	if got := DiffBounds(image.NewRGBA(image.Rect(0, 0, 4, 4)), b); got != b.Bounds() {
+		t.Fatalf("Expected the whole frame after a resize, got %s", got)
+	}
+}
+
+func TestFrameRing(t *testing.T) {
+	var r frameRing
+	var frames []*image.RGBA
+	for i := 0; i < trackedFrames+2; i++ {
+		frame := image.NewRGBA(image.Rect(0, 0, 8, 8))
+		r.push(frame, image.Rect(i, i, i+1, i+1))
+		if r.newest() != frame {
+			t.Fatal("Expected the pushed frame to be the newest")
+		}
+		frames = append(frames, frame)
+	}
+
+	last := len(frames) - 1
+	if got, ok := r.DamageSince(frames[last-1], frames[last]); !ok || got != image.Rect(last, last, last+1, last+1) {
+		t.Fatalf("Unexpected damage between the last frames %s, %v", got, ok)
+	}
+	if got, ok := r.DamageSince(frames[last-2], frames[last]); !ok || got != image.Rect(last-1, last-1, last+1, last+1) {
+		t.Fatalf("Unexpected damage over two frames %s, %v", got, ok)
+	}
+	if got, ok := r.DamageSince(frames[0], frames[0]); !ok || !got.Empty() {
+		t.Fatalf("Expected no damage for the same frame, got %s, %v", got, ok)
+	}
+	oldest := frames[last-trackedFrames+1]
+	if got, ok := r.DamageSince(oldest, frames[last]); !ok || got != image.Rect(last-trackedFrames+2, last-trackedFrames+2, last+1, last+1) {
+		t.Fatalf("Unexpected damage since the oldest tracked frame %s, %v", got, ok)
+	}
+	if _, ok := r.DamageSince(frames[last-trackedFrames], frames[last]); ok {
+		t.Fatal("Expected a frame pushed out of the ring to be untracked")
+	}
+	if _, ok := r.DamageSince(frames[last], frames[last-1]); ok {
+		t.Fatal("Expected frames out of order to be refused")
+	}
+	r.reset()
+	if _, ok := r.DamageSince(frames[last-1], frames[last]); ok || r.newest() != nil {
+		t.Fatal("Expected no frames to be tracked after a reset")
+	}
+}
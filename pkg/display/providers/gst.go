@@ -1,149 +1,196 @@
 package providers
 
 import (
+	"errors"
 	"fmt"
 	"image"
-	"image/jpeg"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/tinyzimmer/go-gst/gst"
 	"github.com/tinyzimmer/go-gst/gst/app"
-	"github.com/tinyzimmer/go-gst/gst/video"
 
 	"github.com/tinyzimmer/gsvnc/pkg/config"
 	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
 )
 
+func init() {
+	Register(ProviderGstreamer, func(opts Options) (Display, error) {
+		g := &Gstreamer{}
+		if err := opts.Decode(g); err != nil {
+			return nil, err
+		}
+		return g, g.validate()
+	}, OptionSpec{
+		Name:        "display",
+		Description: "The X display to capture (Linux only). Defaults to $DISPLAY.",
+	}, OptionSpec{
+		Name:        "pipeline",
+		Description: "A gst-launch style description of the video source, such as \"videotestsrc\" or \"v4l2src device=/dev/video0\". Defaults to capturing the screen.",
+	}, OptionSpec{
+		Name:        "fps",
+		Description: "The number of frames captured per second.",
+		Default:     "5",
+	}, OptionSpec{
+		Name:        "scale-method",
+		Description: "The videoscale method used to fit frames to the display, such as nearest-neighbour, bilinear or lanczos.",
+		Default:     "nearest-neighbour",
+	}, OptionSpec{
+		Name:        "monitor",
+		Description: "The screen to capture. The X screen number on Linux, or the monitor index on Windows and macOS. -1 captures the default screen.",
+		Default:     "-1",
+	}, OptionSpec{
+		Name:        "startx",
+		Description: "The left edge of the region of the screen to capture.",
+	}, OptionSpec{
+		Name:        "starty",
+		Description: "The top edge of the region of the screen to capture.",
+	}, OptionSpec{
+		Name:        "endx",
+		Description: "The right edge of the region of the screen to capture, inclusive. 0 is the right edge of the screen.",
+	}, OptionSpec{
+		Name:        "endy",
+		Description: "The bottom edge of the region of the screen to capture, inclusive. 0 is the bottom edge of the screen.",
+	})
+}
+
+// gstScaleMethods are the methods supported by the videoscale element.
+var gstScaleMethods = []string{
+	"nearest-neighbour", "bilinear", "4-tap", "lanczos", "bilinear2",
+	"sinc", "hermite", "spline", "catrom", "mitchell",
+}
+
+// gstSinkName is the name of the appsink at the end of the pipeline.
+const gstSinkName = "gsvncsink"
+
 // Gstreamer implements a display provider using gstreamer to capture
-// video from the display.
+// video from the display. The regions that changed between frames are reported with
+// DamageSince.
 type Gstreamer struct {
+	DisplayName string  `option:"display"`
+	Source      string  `option:"pipeline"`
+	FPS         float64 `option:"fps"`
+	ScaleMethod string  `option:"scale-method"`
+	Monitor     int     `option:"monitor"`
+	StartX      uint    `option:"startx"`
+	StartY      uint    `option:"starty"`
+	EndX        uint    `option:"endx"`
+	EndY        uint    `option:"endy"`
+
 	pipeline   *gst.Pipeline
 	frameQueue chan *image.RGBA // A channel that will essentially only ever have the latest frame available.
+	stopCh     chan struct{}
+
+	// The last frames returned, implementing Damager
+	frameRing
 }
 
 // Close stops the gstreamer pipeline.
-func (g *Gstreamer) Close() error { return g.pipeline.Destroy() }
+func (g *Gstreamer) Close() error {
+	if g.stopCh == nil {
+		return nil
+	}
+	close(g.stopCh)
+	if g.pipeline == nil {
+		// Start failed before the pipeline was built
+		return nil
+	}
+	return g.pipeline.Destroy()
+}
 
 // PullFrame returns a frame from the queue.
-func (g *Gstreamer) PullFrame() *image.RGBA { return <-g.frameQueue }
+func (g *Gstreamer) PullFrame() *image.RGBA {
+	select {
+	case frame := <-g.frameQueue:
+		// Frames are compared once here, instead of by every consumer
+		g.push(frame, DiffBounds(g.newest(), frame))
+		return frame
+	case <-g.stopCh:
+		return nil
+	}
+}
 
 // Start will start the gstreamer pipelines and send imags to the frame queue.
 func (g *Gstreamer) Start(width, height int) error {
 	log.Debug("Building gstreamer pipeline for display connection")
 	g.frameQueue = make(chan *image.RGBA, 2)
+	g.stopCh = make(chan struct{})
+	g.reset()
+	frameQueue := g.frameQueue
 
-	pipeline, err := gst.NewPipeline("")
+	src, err := g.source()
 	if err != nil {
 		return err
 	}
 
-	// Get the screen capture element depending on the OS
-	src, err := getScreenCaptureElement()
+	// Let decodebin decide the best pipeline depending on the source stream. The frames
+	// are scaled to the display and handed to the appsink as raw RGBx or BGRx, whichever
+	// needs less conversion.
+	desc := fmt.Sprintf(
+		"%s ! decodebin ! queue ! videorate ! video/x-raw, framerate=%s "+
+			"! videoscale method=%s ! video/x-raw, width=%d, height=%d "+
+			"! videoconvert ! video/x-raw, format={ RGBx, BGRx } "+
+			"! appsink name=%s max-buffers=2 drop=true",
+		src, gstFraction(g.FPS), g.ScaleMethod, width, height, gstSinkName,
+	)
+	log.Debug("Using gstreamer pipeline: ", desc)
+	pipeline, err := gst.NewPipelineFromString(desc)
 	if err != nil {
-		return err
+		return fmt.Errorf("Could not parse gstreamer pipeline %q: %s", desc, err.Error())
 	}
 
-	// Let decodebin decide the best pipelin depending on the source stream
-	decodebin, err := gst.NewElement("decodebin")
+	appsink, err := pipeline.GetElementByName(gstSinkName)
 	if err != nil {
 		return err
 	}
-	pipeline.AddMany(src, decodebin)
-	src.Link(decodebin)
 
-	// Buiild out the rest of the pipeline when decodebin is ready.
-	decodebin.Connect("pad-added", func(self *gst.Element, srcPad *gst.Pad) {
-		log.Debug("Decodebin pad added, linking pipeline")
-		elements, err := gst.NewElementMany("queue", "videorate", "videoscale", "videoconvert", "jpegenc", "appsink")
-		if err != nil {
-			logPipelineErr(err)
-			return
-		}
-
-		queue, videorate, videoscale, videoconvert, jpegenc, appsink :=
-			elements[0], elements[1], elements[2], elements[3], elements[4], elements[5]
-
-		// Build out caps
-		rateCaps := gst.NewCapsFromString("video/x-raw, framerate=5/1")
-		scaleCaps := gst.NewCapsFromString(fmt.Sprintf("video/x-raw, width=%d, height=%d", width, height))
-		videoInfo := video.NewInfo().
-			WithFormat(video.FormatRGBx, uint(width), uint(height)).
-			WithFPS(gst.Fraction(5, 1))
-
-		// Configure and link elements
-		if err := runAllUntilError([]func() error{
-			func() error { return videoscale.SetProperty("sharpen", 1) },
-			func() error { return videoscale.SetProperty("method", 0) }, // Use nearest neighbor - significantly cheaper CPU
-			func() error { return pipeline.AddMany(elements...) },
-			func() error { return queue.Link(videorate) },
-			func() error { return videorate.LinkFiltered(videoscale, rateCaps) },
-			func() error { return videoscale.LinkFiltered(videoconvert, scaleCaps) },
-			func() error { return videoconvert.LinkFiltered(jpegenc, videoInfo.ToCaps()) },
-			func() error { return jpegenc.Link(appsink) },
-		}); err != nil {
-			logPipelineErr(err)
-			return
-		}
-
-		log.Debug("Syncing new element states with parent pipeline")
-		for _, e := range elements {
-			if ok := e.SyncStateWithParent(); !ok {
-				logPipelineErr(fmt.Errorf("Could not sink element state with parent: %s", e.Name()))
-				return
+	// Connect to new samples on the sink
+	sink := app.SinkFromElement(appsink)
+	sink.SetCallbacks(&app.SinkCallbacks{
+		NewSampleFunc: func(self *app.Sink) gst.FlowReturn {
+			// Pull the sample from the sink
+			sample := self.PullSample()
+			if sample == nil {
+				return gst.FlowOK
 			}
-		}
-
-		// Connect to new samples on the sink
-		sink := app.SinkFromElement(appsink)
-		sink.SetCallbacks(&app.SinkCallbacks{
-			NewSampleFunc: func(self *app.Sink) gst.FlowReturn {
-				// Pull the sample from the sink
-				sample := self.PullSample()
-				if sample == nil {
-					return gst.FlowOK
-				}
-				defer sample.Unref()
-
-				log.Debug("Received new frame on the pipeline, decoding")
+			defer sample.Unref()
 
-				// Retrieve the pixels from the sample
-				buf := sample.GetBuffer().Reader()
+			log.Debug("Received new frame on the pipeline")
 
-				img, err := jpeg.Decode(buf)
-				if err != nil {
-					logPipelineErr(err)
-					return gst.FlowError
-				}
+			// Copy the pixels out of the sample
+			img, err := sampleToRGBA(sample)
+			if err != nil {
+				logPipelineErr(err)
+				return gst.FlowError
+			}
 
-				log.Debug("Queueing frame for processing")
-				// Queue the image for processing
-				var ok bool
+			log.Debug("Queueing frame for processing")
+			// Queue the image for processing
+			var ok bool
+			select {
+			case frameQueue <- img:
+				ok = true
+			default:
+				ok = false
+				// pop the oldest item off the queue
+				// and let the next sample try to get in
 				select {
-				case g.frameQueue <- img.(*image.RGBA):
-					ok = true
+				case <-frameQueue:
 				default:
-					ok = false
-					// pop the oldest item off the queue
-					// and let the next sample try to get in
-					select {
-					case <-g.frameQueue:
-					}
-				}
-
-				if !ok {
-					log.Debug("Client is behind on frames, could not push to channel")
-				} else {
-					log.Debug("Successfully queued frame for processing")
 				}
+			}
 
-				return gst.FlowOK
-			},
-		})
+			if !ok {
+				log.Debug("Client is behind on frames, could not push to channel")
+			} else {
+				log.Debug("Successfully queued frame for processing")
+			}
 
-		if ret := srcPad.Link(queue.GetStaticPad("sink")); ret != gst.PadLinkOK {
-			log.Error("Could not link src pad to pipeline")
-		}
+			return gst.FlowOK
+		},
 	})
 
 	if config.Debug {
@@ -164,56 +211,129 @@ func (g *Gstreamer) Start(width, height int) error {
 	return pipeline.SetState(gst.StatePlaying)
 }
 
-func getScreenCaptureElement() (elem *gst.Element, err error) {
+// validate checks the options, and that a custom source description parses, so that
+// mistakes are reported when the provider is configured rather than on the first
+// connection.
+func (g *Gstreamer) validate() error {
+	if g.FPS <= 0 {
+		return fmt.Errorf("Frame rate must be positive: %v", g.FPS)
+	}
+	if !isScaleMethod(g.ScaleMethod) {
+		return fmt.Errorf("Unknown scale method %q, must be one of %v", g.ScaleMethod, gstScaleMethods)
+	}
+	if g.EndX != 0 && g.EndX <= g.StartX {
+		return fmt.Errorf("The capture region ends at x=%d before it starts at x=%d", g.EndX, g.StartX)
+	}
+	if g.EndY != 0 && g.EndY <= g.StartY {
+		return fmt.Errorf("The capture region ends at y=%d before it starts at y=%d", g.EndY, g.StartY)
+	}
+	if g.Source == "" {
+		_, err := g.source()
+		return err
+	}
+	if g.Monitor != -1 || g.hasRegion() {
+		return errors.New("The monitor and region options only apply to screen capture, not a custom pipeline")
+	}
+	// Parse the description into a throwaway pipeline. This creates the elements, which
+	// catches unknown elements and properties, but doesn't start them.
+	pipeline, err := gst.NewPipelineFromString(g.Source + " ! fakesink")
+	if err != nil {
+		return fmt.Errorf("Could not parse gstreamer pipeline %q: %s", g.Source, err.Error())
+	}
+	return pipeline.Destroy()
+}
+
+func isScaleMethod(method string) bool {
+	for _, m := range gstScaleMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Gstreamer) hasRegion() bool {
+	return g.StartX != 0 || g.StartY != 0 || g.EndX != 0 || g.EndY != 0
+}
+
+// source returns the description of the source of the pipeline, either the one given in
+// the options or the screen capture element for the OS.
+func (g *Gstreamer) source() (string, error) {
+	if g.Source != "" {
+		return g.Source, nil
+	}
 	switch runtime.GOOS {
 
 	case "windows":
 		log.Debug("Detected Windows, using gdiscreencapsrc")
 		// Other option is to use directX
-		elem, err = gst.NewElement("gdiscreencapsrc")
-		if err != nil {
-			return
+		props := []string{"cursor=true"}
+		if g.Monitor != -1 {
+			props = append(props, fmt.Sprintf("monitor=%d", g.Monitor))
 		}
-		err = elem.SetProperty("cursor", true)
+		if g.hasRegion() {
+			props = append(props, fmt.Sprintf("x=%d y=%d", g.StartX, g.StartY))
+			// gdiscreencapsrc takes a size rather than the far corner
+			if g.EndX != 0 {
+				props = append(props, fmt.Sprintf("width=%d", g.EndX-g.StartX+1))
+			}
+			if g.EndY != 0 {
+				props = append(props, fmt.Sprintf("height=%d", g.EndY-g.StartY+1))
+			}
+		}
+		return "gdiscreencapsrc " + strings.Join(props, " "), nil
 
 	case "darwin":
 		log.Debug("Detected macOS, using avfvideosrc")
 		// I think this is the only option for mac
-		elem, err = gst.NewElement("avfvideosrc")
-		if err != nil {
-			return
+		if g.hasRegion() {
+			return "", errors.New("Capture regions are not supported on macOS")
 		}
-		err = elem.SetProperty("capture-screen", true)
-		if err != nil {
-			return
+		src := "avfvideosrc capture-screen=true capture-screen-cursor=true"
+		if g.Monitor != -1 {
+			src += fmt.Sprintf(" device-index=%d", g.Monitor)
 		}
-		err = elem.SetProperty("capture-screen-cursor", true)
+		return src, nil
 
 	default:
 		log.Debug("Detected Linux, using ximagesrc")
-		// For now the default assumes an X display
-		elem, err = gst.NewElement("ximagesrc")
-		if err != nil {
-			return
+		// For now the default assumes an X display.
+		// XDamage will increase CPU usage considerably in some cases
+		props := []string{"show-pointer=true", "use-damage=false"}
+		if displayName := g.displayName(); displayName != "" {
+			props = append(props, fmt.Sprintf("display-name=%q", displayName))
 		}
-		err = elem.SetProperty("show-pointer", true)
-		if err != nil {
-			return
+		if g.hasRegion() {
+			props = append(props, fmt.Sprintf("startx=%d starty=%d endx=%d endy=%d", g.StartX, g.StartY, g.EndX, g.EndY))
 		}
-		// XDamage will increase CPU usage considerably in some cases
-		err = elem.SetProperty("use-damage", false)
+		return "ximagesrc " + strings.Join(props, " "), nil
 
 	}
-	return
 }
 
-func runAllUntilError(fs []func() error) error {
-	for _, f := range fs {
-		if err := f(); err != nil {
-			return err
-		}
+// displayName returns the X display to capture, with the monitor option selecting the
+// screen of the display.
+func (g *Gstreamer) displayName() string {
+	if g.Monitor == -1 {
+		return g.DisplayName
+	}
+	name := g.DisplayName
+	if name == "" {
+		name = os.Getenv("DISPLAY")
+	}
+	// Replace any screen number already in the name, as in ":0.1"
+	if i := strings.LastIndex(name, "."); i > strings.LastIndex(name, ":") {
+		name = name[:i]
+	}
+	return fmt.Sprintf("%s.%d", name, g.Monitor)
+}
+
+// gstFraction formats a frame rate as a gstreamer fraction.
+func gstFraction(fps float64) string {
+	if fps == float64(int(fps)) {
+		return fmt.Sprintf("%d/1", int(fps))
 	}
-	return nil
+	return strconv.Itoa(int(fps*1000)) + "/1000"
 }
 
 func logPipelineErr(err error) {
@@ -0,0 +1,97 @@
+package providers
+
+/*
+#cgo pkg-config: gstreamer-1.0 gstreamer-video-1.0
+#include <gst/gst.h>
+#include <gst/video/video.h>
+
+// gsvncSampleInfo reads the dimensions of a raw RGBx or BGRx video sample.
+static gboolean gsvncSampleInfo(GstSample *sample, gint *width, gint *height, gboolean *bgr)
+{
+	GstVideoInfo info;
+	GstCaps *caps = gst_sample_get_caps(sample);
+	if (caps == NULL || !gst_video_info_from_caps(&info, caps))
+		return FALSE;
+	switch (GST_VIDEO_INFO_FORMAT(&info)) {
+	case GST_VIDEO_FORMAT_RGBx:
+		*bgr = FALSE;
+		break;
+	case GST_VIDEO_FORMAT_BGRx:
+		*bgr = TRUE;
+		break;
+	default:
+		return FALSE;
+	}
+	*width = GST_VIDEO_INFO_WIDTH(&info);
+	*height = GST_VIDEO_INFO_HEIGHT(&info);
+	return TRUE;
+}
+
+// gsvncCopySample copies the pixels of a raw RGBx or BGRx video sample into dst, which
+// holds width*height RGBA pixels. Padding at the end of rows is skipped, and the unused
+// byte of each pixel is set to opaque.
+static gboolean gsvncCopySample(GstSample *sample, guint8 *dst, gint width, gint height, gboolean bgr)
+{
+	GstBuffer *buf = gst_sample_get_buffer(sample);
+	GstVideoMeta *meta;
+	GstMapInfo map;
+	gsize offset = 0;
+	gint stride = width * 4;
+	gint x, y;
+
+	if (buf == NULL)
+		return FALSE;
+	meta = gst_buffer_get_video_meta(buf);
+	if (meta != NULL) {
+		offset = meta->offset[0];
+		stride = meta->stride[0];
+	}
+	if (!gst_buffer_map(buf, &map, GST_MAP_READ))
+		return FALSE;
+	if (map.size < offset + (gsize)stride * (height - 1) + (gsize)width * 4) {
+		gst_buffer_unmap(buf, &map);
+		return FALSE;
+	}
+	for (y = 0; y < height; y++) {
+		const guint8 *src = map.data + offset + (gsize)y * stride;
+		guint8 *out = dst + (gsize)y * width * 4;
+		for (x = 0; x < width * 4; x += 4) {
+			out[x] = bgr ? src[x + 2] : src[x];
+			out[x + 1] = src[x + 1];
+			out[x + 2] = bgr ? src[x] : src[x + 2];
+			out[x + 3] = 0xff;
+		}
+	}
+	gst_buffer_unmap(buf, &map);
+	return TRUE;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"unsafe"
+
+	"github.com/tinyzimmer/go-gst/gst"
+)
+
+// sampleToRGBA copies a raw RGBx or BGRx video sample into a new image. The buffer is
+// mapped and copied once, there is no intermediate copy.
+func sampleToRGBA(sample *gst.Sample) (*image.RGBA, error) {
+	// The C types of another package are distinct from the ones here
+	ptr := (*C.GstSample)(unsafe.Pointer(sample.Instance()))
+	var width, height C.gint
+	var bgr C.gboolean
+	if C.gsvncSampleInfo(ptr, &width, &height, &bgr) == C.FALSE {
+		return nil, errors.New("Sample is not raw RGBx or BGRx video")
+	}
+	if width <= 0 || height <= 0 {
+		return nil, errors.New("Sample has no pixels")
+	}
+	img := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+	if C.gsvncCopySample(ptr, (*C.guint8)(unsafe.Pointer(&img.Pix[0])), width, height, bgr) == C.FALSE {
+		return nil, errors.New("Could not read sample buffer")
+	}
+	return img, nil
+}
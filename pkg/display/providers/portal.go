@@ -0,0 +1,286 @@
+//go:build linux
+// +build linux
+
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/dbus"
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+	"github.com/tinyzimmer/gsvnc/pkg/internal/portal"
+)
+
+func init() {
+	Register(ProviderPortal, func(opts Options) (Display, error) {
+		p := &Portal{}
+		if err := opts.Decode(p); err != nil {
+			return nil, err
+		}
+		var err error
+		if p.sourceTypes, err = parsePortalSources(p.Sources); err != nil {
+			return nil, err
+		}
+		switch p.Cursor {
+		case "embedded":
+			p.cursorMode = portal.CursorEmbedded
+		case "hidden":
+			p.cursorMode = portal.CursorHidden
+		default:
+			return nil, fmt.Errorf("Unknown cursor mode %q, must be embedded or hidden", p.Cursor)
+		}
+		if p.FPS <= 0 {
+			return nil, fmt.Errorf("Frame rate must be positive: %v", p.FPS)
+		}
+		if !isScaleMethod(p.ScaleMethod) {
+			return nil, fmt.Errorf("Unknown scale method %q, must be one of %v", p.ScaleMethod, gstScaleMethods)
+		}
+		return p, nil
+	}, OptionSpec{
+		Name:        "bus",
+		Description: "The address of the D-Bus session bus the portal is on. Defaults to $DBUS_SESSION_BUS_ADDRESS.",
+	}, OptionSpec{
+		Name:        "sources",
+		Description: "The kinds of source the user may pick from, a comma separated list of monitor, window and virtual.",
+		Default:     "monitor",
+	}, OptionSpec{
+		Name:        "cursor",
+		Description: "Whether the cursor is embedded in the stream or hidden.",
+		Default:     "embedded",
+	}, OptionSpec{
+		Name:        "input",
+		Description: "Request keyboard and pointer input through the RemoteDesktop portal.",
+		Default:     "true",
+	}, OptionSpec{
+		Name:        "timeout",
+		Description: "How long to wait for the user to answer the screen sharing dialog.",
+		Default:     "2m",
+	}, OptionSpec{
+		Name:        "fps",
+		Description: "The number of frames captured per second.",
+		Default:     "30",
+	}, OptionSpec{
+		Name:        "scale-method",
+		Description: "The videoscale method used to fit frames to the display.",
+		Default:     "nearest-neighbour",
+	})
+}
+
+// portalKeepalive is how often PipeWire repeats the last frame when the screen doesn't
+// change, which is when compositors stop sending frames.
+const portalKeepalive = time.Second
+
+// Portal implements a display provider for Wayland sessions. The screen is shared through
+// the ScreenCast interface of xdg-desktop-portal and read from PipeWire by gstreamer,
+// and input is sent through the RemoteDesktop interface.
+type Portal struct {
+	Bus         string        `option:"bus"`
+	Sources     string        `option:"sources"`
+	Cursor      string        `option:"cursor"`
+	Input       bool          `option:"input"`
+	Timeout     time.Duration `option:"timeout"`
+	FPS         float64       `option:"fps"`
+	ScaleMethod string        `option:"scale-method"`
+
+	sourceTypes, cursorMode uint32
+
+	conn          *dbus.Conn
+	session       *portal.Session
+	stream        portal.Stream
+	pwFD          int
+	gst           *Gstreamer
+	width, height int
+
+	inputMux sync.Mutex
+	input    bool  // Whether input events can be sent
+	buttons  uint8 // The last button mask
+}
+
+// parsePortalSources parses a comma separated list of source types into a mask.
+func parsePortalSources(sources string) (uint32, error) {
+	var mask uint32
+	for _, source := range strings.Split(sources, ",") {
+		switch strings.TrimSpace(source) {
+		case "monitor":
+			mask |= portal.SourceMonitor
+		case "window":
+			mask |= portal.SourceWindow
+		case "virtual":
+			mask |= portal.SourceVirtual
+		default:
+			return 0, fmt.Errorf("Unknown source type %q, must be monitor, window or virtual", source)
+		}
+	}
+	return mask, nil
+}
+
+// Start starts a portal session, which may show the user a dialog to pick what to share,
+// and starts streaming it. Frames are scaled to the given dimensions.
+func (p *Portal) Start(width, height int) (err error) {
+	p.width, p.height = width, height
+	if p.Bus == "" {
+		p.conn, err = dbus.SessionBus()
+	} else {
+		p.conn, err = dbus.Dial(p.Bus)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Info("Requesting a screencast from xdg-desktop-portal, the desktop may ask which screen to share")
+	p.session, err = portal.Start(p.conn, &portal.Opts{
+		SourceTypes:   p.sourceTypes,
+		CursorMode:    p.cursorMode,
+		RemoteDesktop: p.Input,
+		Timeout:       p.Timeout,
+	})
+	if err != nil {
+		p.conn.Close()
+		return err
+	}
+	p.stream = p.session.Streams[0]
+	log.Infof("Portal is sharing PipeWire node %d (%dx%d)", p.stream.NodeID, p.stream.Width, p.stream.Height)
+	if p.Input && p.session.Devices&(portal.DeviceKeyboard|portal.DevicePointer) == 0 {
+		log.Warning("Portal did not grant any input devices, input from clients is ignored")
+	}
+
+	if p.pwFD, err = p.session.OpenPipeWireRemote(); err != nil {
+		p.session.Close()
+		p.conn.Close()
+		return err
+	}
+
+	p.gst = &Gstreamer{
+		// pipewiresrc duplicates the descriptor, which is closed with the provider
+		Source: fmt.Sprintf("pipewiresrc fd=%d path=%d always-copy=true keepalive-time=%d",
+			p.pwFD, p.stream.NodeID, portalKeepalive.Milliseconds()),
+		FPS:         p.FPS,
+		ScaleMethod: p.ScaleMethod,
+		Monitor:     -1,
+	}
+	if err := p.gst.Start(width, height); err != nil {
+		p.gst = nil
+		syscall.Close(p.pwFD)
+		p.session.Close()
+		p.conn.Close()
+		return err
+	}
+
+	p.inputMux.Lock()
+	p.input = p.Input
+	p.inputMux.Unlock()
+	return nil
+}
+
+// PullFrame returns the latest frame of the stream.
+func (p *Portal) PullFrame() *image.RGBA { return p.gst.PullFrame() }
+
+// KeyEvent implements InputHandler.
+func (p *Portal) KeyEvent(keysym uint32, down bool) {
+	p.inputMux.Lock()
+	defer p.inputMux.Unlock()
+	if !p.input || p.session.Devices&portal.DeviceKeyboard == 0 {
+		return
+	}
+	if err := p.session.KeyboardKeysym(int32(keysym), down); err != nil {
+		log.Debug("Could not send key event to the portal: ", err.Error())
+	}
+}
+
+// portalButtons maps bits of the RFB button mask to Linux button codes. Bits 3 to 6 are
+// the scroll wheel, which is sent as axis events.
+var portalButtons = map[uint8]int32{
+	0: portal.ButtonLeft,
+	1: portal.ButtonMiddle,
+	2: portal.ButtonRight,
+	7: portal.ButtonSide,
+}
+
+// PointerEvent implements InputHandler.
+func (p *Portal) PointerEvent(x, y int, buttonMask uint8) {
+	p.inputMux.Lock()
+	defer p.inputMux.Unlock()
+	if !p.input || p.session.Devices&portal.DevicePointer == 0 {
+		return
+	}
+	if err := p.sendPointer(x, y, buttonMask); err != nil {
+		log.Debug("Could not send pointer event to the portal: ", err.Error())
+	}
+	p.buttons = buttonMask
+}
+
+func (p *Portal) sendPointer(x, y int, buttonMask uint8) error {
+	// Frames are scaled to the display, so positions are scaled back to the stream
+	sx, sy := float64(x), float64(y)
+	if p.stream.Width > 0 && p.stream.Height > 0 {
+		sx = sx * float64(p.stream.Width) / float64(p.width)
+		sy = sy * float64(p.stream.Height) / float64(p.height)
+	}
+	if err := p.session.PointerMotionAbsolute(p.stream.NodeID, sx, sy); err != nil {
+		return err
+	}
+	for bit := uint8(0); bit < 8; bit++ {
+		mask := uint8(1) << bit
+		if (buttonMask^p.buttons)&mask == 0 {
+			continue
+		}
+		down := buttonMask&mask != 0
+		if button, ok := portalButtons[bit]; ok {
+			if err := p.session.PointerButton(button, down); err != nil {
+				return err
+			}
+			continue
+		}
+		// Wheel buttons are pressed and released for each step, scroll on the press
+		if !down {
+			continue
+		}
+		var err error
+		switch bit {
+		case 3:
+			err = p.session.PointerAxisDiscrete(portal.AxisVertical, -1)
+		case 4:
+			err = p.session.PointerAxisDiscrete(portal.AxisVertical, 1)
+		case 5:
+			err = p.session.PointerAxisDiscrete(portal.AxisHorizontal, -1)
+		case 6:
+			err = p.session.PointerAxisDiscrete(portal.AxisHorizontal, 1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the stream and closes the portal session.
+func (p *Portal) Close() error {
+	if p.gst == nil {
+		return nil
+	}
+	p.inputMux.Lock()
+	p.input = false
+	p.inputMux.Unlock()
+
+	var errs []string
+	if err := p.gst.Close(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	syscall.Close(p.pwFD)
+	if err := p.session.Close(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := p.conn.Close(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
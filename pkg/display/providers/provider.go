@@ -9,12 +9,60 @@ import "image"
 type Display interface {
 	// Start should take care of any requirements for starting a feed to the frame buffer.
 	Start(width, height int) error
-	// PullFrame should return a queued frame for processing.
+	// PullFrame should return a queued frame for processing. It should return nil
+	// once the provider is closed.
 	PullFrame() *image.RGBA
-	// Close should stop any background processes from running.
+	// Close should stop any background processes from running. It may be called on a
+	// provider that was never started, such as one only created to read its size.
 	Close() error
 }
 
+// An InputHandler is a Display that receives input from clients itself. When the display
+// provider implements it, key and pointer events are delivered to it instead of being
+// injected into the host.
+type InputHandler interface {
+	// KeyEvent is called when a key is pressed or released. The key is an X11 keysym.
+	KeyEvent(keysym uint32, down bool)
+	// PointerEvent is called when the pointer moves or a button changes state. Bits 0 to 7
+	// of the mask are buttons 1 to 8, a set bit meaning the button is down.
+	PointerEvent(x, y int, buttonMask uint8)
+}
+
+// A ClipboardHandler is a Display that keeps its own clipboard. When the display provider
+// implements it, it is used instead of the host clipboard.
+type ClipboardHandler interface {
+	// ReadClipboard returns the current clipboard text. It is polled for changes.
+	ReadClipboard() (string, error)
+	// WriteClipboard is called with text sent by a client.
+	WriteClipboard(text string) error
+}
+
+// A Sizer is a Display with dimensions of its own. They are used as the resolution of
+// the server when none is configured. A zero size means the display has no preference.
+type Sizer interface {
+	Size() (width, height int)
+}
+
+// A Damager is a Display that knows which regions of its frames changed, so they don't
+// have to be compared pixel by pixel.
+type Damager interface {
+	// DamageSince returns the region that changed between two frames returned by
+	// PullFrame. It returns false if prev is no longer tracked.
+	DamageSince(prev, cur *image.RGBA) (image.Rectangle, bool)
+}
+
+// An Isolated display is not shared between connections. When Isolated returns true, a
+// new instance of the provider is created for each connection.
+type Isolated interface {
+	Isolated() bool
+}
+
+// A UserDisplay is a Display that serves each user their own content. SetUser is called
+// with the name the client authenticated as, if any, before Start.
+type UserDisplay interface {
+	SetUser(name string)
+}
+
 // Provider is an enum used for selecting a display provider.
 type Provider string
 
@@ -22,15 +70,20 @@ type Provider string
 const (
 	ProviderGstreamer     = "gstreamer"
 	ProviderScreenCapture = "screencap"
+	ProviderTestPattern   = "testsrc"
+	ProviderImage         = "image"
+	ProviderX11           = "x11"
+	ProviderPortal        = "portal"
+	ProviderXvfb          = "xvfb"
+	ProviderVNC           = "vnc"
 )
 
-// GetDisplayProvider returns the provider to use for the given RFB connection.
+// GetDisplayProvider returns a new instance of the given provider with its default options,
+// or nil if it is not registered.
 func GetDisplayProvider(p Provider) Display {
-	switch p {
-	case ProviderGstreamer:
-		return &Gstreamer{}
-	case ProviderScreenCapture:
-		return &ScreenCapture{}
+	d, err := New(p, nil)
+	if err != nil {
+		return nil
 	}
-	return nil
+	return d
 }
@@ -0,0 +1,170 @@
+package providers
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Options holds provider specific options, such as those given with --display-opt on
+// the command line.
+type Options map[string]string
+
+// OptionSpec describes an option accepted by a provider.
+type OptionSpec struct {
+	Name        string
+	Description string
+	// The value used when the option is not given. Empty means no default.
+	Default string
+}
+
+// Factory creates a new display provider from the given options. Defaults have already
+// been applied to the options, and unknown options rejected.
+type Factory func(opts Options) (Display, error)
+
+type registration struct {
+	factory Factory
+	options []OptionSpec
+}
+
+var (
+	registry    = make(map[Provider]*registration)
+	registryMux sync.RWMutex
+)
+
+// Register makes a display provider available by the given name, along with the options
+// it accepts. It is intended to be called from init functions and panics if a provider
+// with the same name is already registered.
+func Register(name Provider, factory Factory, options ...OptionSpec) {
+	registryMux.Lock()
+	defer registryMux.Unlock()
+	if factory == nil {
+		panic("providers: Register factory is nil")
+	}
+	if _, ok := registry[name]; ok {
+		panic("providers: Register called twice for provider " + string(name))
+	}
+	registry[name] = &registration{factory: factory, options: options}
+}
+
+// New creates a new instance of the named provider with the given options.
+func New(name Provider, opts Options) (Display, error) {
+	registryMux.RLock()
+	reg, ok := registry[name]
+	registryMux.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown display provider: %s", name)
+	}
+	withDefaults := make(Options, len(reg.options))
+	for _, spec := range reg.options {
+		if spec.Default != "" {
+			withDefaults[spec.Name] = spec.Default
+		}
+	}
+	for k, v := range opts {
+		if !hasOption(reg.options, k) {
+			return nil, fmt.Errorf("Display provider %s has no option %q", name, k)
+		}
+		withDefaults[k] = v
+	}
+	return reg.factory(withDefaults)
+}
+
+// Registered returns the names of all registered providers in alphabetical order.
+func Registered() []Provider {
+	registryMux.RLock()
+	defer registryMux.RUnlock()
+	names := make([]Provider, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// OptionsFor returns the options accepted by the named provider.
+func OptionsFor(name Provider) []OptionSpec {
+	registryMux.RLock()
+	defer registryMux.RUnlock()
+	if reg, ok := registry[name]; ok {
+		return reg.options
+	}
+	return nil
+}
+
+func hasOption(specs []OptionSpec, name string) bool {
+	for _, spec := range specs {
+		if spec.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Decode sets the fields of the struct pointed to by v from the options. Fields are
+// matched by their `option:"name"` tag. String, bool, integer, float and time.Duration
+// fields are supported.
+func (o Options) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Decode requires a pointer to a struct, got %T", v)
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		name := rt.Field(i).Tag.Get("option")
+		str, ok := o[name]
+		if name == "" || !ok {
+			continue
+		}
+		if err := setField(rv.Field(i), str); err != nil {
+			return fmt.Errorf("Invalid value %q for option %s: %s", str, name, err.Error())
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, str string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(str)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(str, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(str, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(str, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
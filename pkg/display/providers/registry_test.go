@@ -0,0 +1,39 @@
+package providers
+
+import (
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCloseBeforeStart(t *testing.T) {
+	slide := filepath.Join(t.TempDir(), "slide.png")
+	f, err := os.Create(slide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	// Options for the providers that can't be created without any
+	opts := map[Provider]Options{
+		ProviderImage: {"path": slide},
+		ProviderVNC:   {"address": "127.0.0.1:1"},
+	}
+
+	// Servers close the providers they only created to read the size from
+	for _, name := range Registered() {
+		t.Run(string(name), func(t *testing.T) {
+			d, err := New(name, opts[name])
+			if err != nil {
+				t.Skip("Provider can't be created here: ", err)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package providers
 
 import (
 	"bytes"
+	"fmt"
 	"image"
 	"time"
 
@@ -12,28 +13,63 @@ import (
 	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
 )
 
+func init() {
+	Register(ProviderScreenCapture, func(opts Options) (Display, error) {
+		s := &ScreenCapture{}
+		if err := opts.Decode(s); err != nil {
+			return nil, err
+		}
+		if s.Interval <= 0 {
+			return nil, fmt.Errorf("Capture interval must be positive: %s", s.Interval)
+		}
+		return s, nil
+	}, OptionSpec{
+		Name:        "interval",
+		Description: "How often to capture the screen.",
+		Default:     "200ms",
+	})
+}
+
 // ScreenCapture implements a display provider that periodically captures the screen
 // using native APIs.
 type ScreenCapture struct {
+	Interval time.Duration `option:"interval"`
+
 	frameQueue chan *image.RGBA // A channel that will essentially only ever have the latest frame available.
 	stopCh     chan struct{}
 }
 
 // Close stops the gstreamer pipeline.
 func (s *ScreenCapture) Close() error {
-	s.stopCh <- struct{}{}
+	if s.stopCh == nil {
+		return nil
+	}
+	close(s.stopCh)
 	return nil
 }
 
 // PullFrame returns a frame from the queue.
-func (s *ScreenCapture) PullFrame() *image.RGBA { return <-s.frameQueue }
+func (s *ScreenCapture) PullFrame() *image.RGBA {
+	select {
+	case frame := <-s.frameQueue:
+		return frame
+	case <-s.stopCh:
+		return nil
+	}
+}
 
 // Start starts the screen capture loop.
 func (s *ScreenCapture) Start(width, height int) error {
 	s.frameQueue = make(chan *image.RGBA, 2)
 	s.stopCh = make(chan struct{})
+	frameQueue, stopCh := s.frameQueue, s.stopCh
 	go func() {
-		ticker := time.NewTicker(time.Millisecond * 200) // 5 frames a second
+		interval := s.Interval
+		if interval <= 0 {
+			interval = time.Millisecond * 200 // 5 frames a second
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
 		for range ticker.C {
 			cont := true
 
@@ -65,16 +101,17 @@ func (s *ScreenCapture) Start(width, height int) error {
 				log.Debug("Queueing frame for processing")
 				// Queue the image for processing
 				select {
-				case <-s.stopCh:
+				case <-stopCh:
 					log.Debug("Received event on stop channel, stopping screen capture")
 					cont = false
-				case s.frameQueue <- img.(*image.RGBA):
+				case frameQueue <- img.(*image.RGBA):
 				default:
 					// pop the oldest item off the queue
 					// and let the next sample try to get in
 					log.Debug("Client is behind on frames, forcing oldest one off the queue")
 					select {
-					case <-s.frameQueue:
+					case <-frameQueue:
+					default:
 					}
 				}
 
@@ -0,0 +1,159 @@
+package providers
+
+import (
+	"errors"
+	"image"
+	"sync"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+)
+
+// Shared fans out the frames from a single display provider to any number of consumers.
+// The underlying provider is started when the first consumer starts and closed when the
+// last one closes.
+//
+// Every consumer paces itself. PullFrame on a consumer blocks until there is a frame it has
+// not seen yet and returns the latest one, skipping any it was too slow to pick up. If the
+// provider stops producing frames on its own, PullFrame returns nil on every consumer.
+type Shared struct {
+	provider Display
+
+	// Guards starting and stopping the provider
+	refs         int
+	done         chan struct{}
+	lifecycleMux sync.Mutex
+
+	// Guards the latest frame
+	frame   *image.RGBA
+	seq     uint64
+	ended   bool // Set once the provider stopped producing frames
+	closing bool // Set while the last consumer closes the provider
+	mux     sync.Mutex
+	cond    *sync.Cond
+}
+
+// NewShared returns a new shared display provider wrapping the given one.
+func NewShared(provider Display) *Shared {
+	s := &Shared{provider: provider}
+	s.cond = sync.NewCond(&s.mux)
+	return s
+}
+
+// Provider returns the underlying display provider.
+func (s *Shared) Provider() Display { return s.provider }
+
+// Consumer returns a new Display that receives frames from the shared provider.
+func (s *Shared) Consumer() Display { return &sharedConsumer{shared: s} }
+
+// acquire starts the underlying provider if it is not already running.
+func (s *Shared) acquire(width, height int) error {
+	s.lifecycleMux.Lock()
+	defer s.lifecycleMux.Unlock()
+	if s.provider == nil {
+		return errors.New("No display provider configured")
+	}
+	if s.refs == 0 {
+		log.Debug("Starting shared display provider")
+		if err := s.provider.Start(width, height); err != nil {
+			return err
+		}
+		s.mux.Lock()
+		s.ended, s.closing = false, false
+		s.mux.Unlock()
+		s.done = make(chan struct{})
+		go s.pump(s.done)
+	}
+	s.refs++
+	return nil
+}
+
+// release closes the underlying provider if there are no more consumers.
+func (s *Shared) release() error {
+	s.lifecycleMux.Lock()
+	defer s.lifecycleMux.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	log.Debug("Last consumer released, closing shared display provider")
+	s.mux.Lock()
+	s.closing = true
+	s.mux.Unlock()
+	err := s.provider.Close()
+	<-s.done
+
+	s.mux.Lock()
+	s.frame = nil
+	s.mux.Unlock()
+	return err
+}
+
+// pump pulls frames from the underlying provider and wakes up any waiting consumers.
+// When the provider returns nil the consumers are woken up to return nil as well.
+func (s *Shared) pump(done chan struct{}) {
+	defer close(done)
+	for {
+		frame := s.provider.PullFrame()
+		if frame == nil {
+			s.mux.Lock()
+			if !s.closing {
+				log.Warning("Display provider stopped producing frames, disconnecting its clients")
+			}
+			s.ended = true
+			s.mux.Unlock()
+			s.cond.Broadcast()
+			return
+		}
+		s.mux.Lock()
+		s.frame = frame
+		s.seq++
+		s.mux.Unlock()
+		s.cond.Broadcast()
+	}
+}
+
+// sharedConsumer implements a Display reading from a Shared provider.
+type sharedConsumer struct {
+	shared  *Shared
+	lastSeq uint64
+	started bool
+	closed  bool
+}
+
+// Start starts the shared provider if this is the first consumer.
+func (c *sharedConsumer) Start(width, height int) error {
+	if err := c.shared.acquire(width, height); err != nil {
+		return err
+	}
+	c.started = true
+	return nil
+}
+
+// PullFrame blocks until there is a frame this consumer hasn't seen and returns it.
+// Nil is returned once the consumer is closed or the provider has stopped.
+func (c *sharedConsumer) PullFrame() *image.RGBA {
+	s := c.shared
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for !c.closed && !s.ended && (s.frame == nil || s.seq == c.lastSeq) {
+		s.cond.Wait()
+	}
+	if c.closed || s.ended {
+		return nil
+	}
+	c.lastSeq = s.seq
+	return s.frame
+}
+
+// Close releases this consumer from the shared provider.
+func (c *sharedConsumer) Close() error {
+	c.shared.mux.Lock()
+	c.closed = true
+	c.shared.mux.Unlock()
+	c.shared.cond.Broadcast()
+	if !c.started {
+		return nil
+	}
+	c.started = false
+	return c.shared.release()
+}
@@ -0,0 +1,176 @@
+package providers
+
+import (
+	"image"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chanProvider is a display provider serving the frames sent on its channel. Closing
+// the channel makes it stop as if its source failed.
+type chanProvider struct {
+	frames chan *image.RGBA
+	stop   chan struct{}
+
+	mux            sync.Mutex
+	starts, closes int
+}
+
+func newChanProvider() *chanProvider {
+	return &chanProvider{frames: make(chan *image.RGBA)}
+}
+
+func (p *chanProvider) Start(width, height int) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.starts++
+	p.stop = make(chan struct{})
+	return nil
+}
+
+func (p *chanProvider) PullFrame() *image.RGBA {
+	p.mux.Lock()
+	stop := p.stop
+	p.mux.Unlock()
+	select {
+	case frame := <-p.frames:
+		return frame
+	case <-stop:
+		return nil
+	}
+}
+
+func (p *chanProvider) Close() error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.closes++
+	close(p.stop)
+	return nil
+}
+
+func (p *chanProvider) counts() (starts, closes int) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return p.starts, p.closes
+}
+
+// pullFrame pulls a frame from the display, failing the test if it takes too long.
+func pullFrame(t *testing.T, d Display) *image.RGBA {
+	t.Helper()
+	ch := make(chan *image.RGBA, 1)
+	go func() { ch <- d.PullFrame() }()
+	select {
+	case frame := <-ch:
+		return frame
+	case <-time.After(time.Second * 5):
+		t.Fatal("Timed out waiting for a frame")
+	}
+	return nil
+}
+
+func TestSharedFansOutFrames(t *testing.T) {
+	p := newChanProvider()
+	s := NewShared(p)
+	a, b := s.Consumer(), s.Consumer()
+	if err := a.Start(4, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start(4, 4); err != nil {
+		t.Fatal(err)
+	}
+	if starts, _ := p.counts(); starts != 1 {
+		t.Fatalf("Expected the provider to be started once, got %d", starts)
+	}
+
+	frame := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	p.frames <- frame
+	if got := pullFrame(t, a); got != frame {
+		t.Error("First consumer did not get the frame")
+	}
+	if got := pullFrame(t, b); got != frame {
+		t.Error("Second consumer did not get the frame")
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, closes := p.counts(); closes != 0 {
+		t.Fatal("Provider was closed while a consumer was left")
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, closes := p.counts(); closes != 1 {
+		t.Fatalf("Expected the provider to be closed once, got %d", closes)
+	}
+}
+
+func TestSharedWakesConsumersWhenProviderStops(t *testing.T) {
+	p := newChanProvider()
+	s := NewShared(p)
+	c := s.Consumer()
+	if err := c.Start(4, 4); err != nil {
+		t.Fatal(err)
+	}
+	p.frames <- image.NewRGBA(image.Rect(0, 0, 4, 4))
+	pullFrame(t, c)
+
+	// The consumer is waiting for a new frame when the provider stops
+	result := make(chan *image.RGBA, 1)
+	go func() { result <- c.PullFrame() }()
+	time.Sleep(time.Millisecond * 50)
+	p.mux.Lock()
+	close(p.stop)
+	p.stop = make(chan struct{}) // Close closes it again
+	p.mux.Unlock()
+
+	select {
+	case frame := <-result:
+		if frame != nil {
+			t.Fatal("Expected nil once the provider stopped")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Consumer was not woken up when the provider stopped")
+	}
+	if frame := pullFrame(t, c); frame != nil {
+		t.Fatal("Expected nil on every pull once the provider stopped")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next consumer starts the provider again
+	c = s.Consumer()
+	if err := c.Start(4, 4); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	frame := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	p.frames <- frame
+	if got := pullFrame(t, c); got != frame {
+		t.Fatal("Restarted provider did not deliver frames")
+	}
+}
+
+func TestSharedConsumerCloseUnblocksPull(t *testing.T) {
+	s := NewShared(newChanProvider())
+	c := s.Consumer()
+	if err := c.Start(4, 4); err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan *image.RGBA, 1)
+	go func() { result <- c.PullFrame() }()
+	time.Sleep(time.Millisecond * 50)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case frame := <-result:
+		if frame != nil {
+			t.Fatal("Expected nil from a closed consumer")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Close did not unblock PullFrame")
+	}
+}
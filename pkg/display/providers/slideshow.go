@@ -0,0 +1,193 @@
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	// Supported image formats
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/nfnt/resize"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+)
+
+func init() {
+	Register(ProviderImage, func(opts Options) (Display, error) {
+		s := &Slideshow{}
+		if err := opts.Decode(s); err != nil {
+			return nil, err
+		}
+		if s.Path == "" {
+			return nil, errors.New("The path option is required")
+		}
+		if s.FPS <= 0 {
+			return nil, fmt.Errorf("Frame rate must be positive: %v", s.FPS)
+		}
+		if s.Interval <= 0 {
+			return nil, fmt.Errorf("Slide interval must be positive: %s", s.Interval)
+		}
+		var err error
+		if s.width, s.height, err = parseSize(s.Resolution); err != nil {
+			return nil, err
+		}
+		if s.files, err = listImages(s.Path); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}, OptionSpec{
+		Name:        "path",
+		Description: "A PNG or JPEG image, or a directory of them to cycle through.",
+	}, OptionSpec{
+		Name:        "interval",
+		Description: "How long each image in a directory is shown.",
+		Default:     "5s",
+	}, OptionSpec{
+		Name:        "size",
+		Description: "The size to scale images to, as WIDTHxHEIGHT. It sets the server resolution, so it must match --resolution if both are given. Defaults to the size of a single image, or the server resolution.",
+	}, OptionSpec{
+		Name:        "fps",
+		Description: "The number of frames produced per second.",
+		Default:     "1",
+	})
+}
+
+// Slideshow implements a display provider serving a static image, or cycling through a
+// directory of images. Images are scaled to fit the display and centered.
+type Slideshow struct {
+	Path       string        `option:"path"`
+	Interval   time.Duration `option:"interval"`
+	Resolution string        `option:"size"`
+	FPS        float64       `option:"fps"`
+
+	files         []string
+	width, height int
+	startedAt     time.Time
+	current       int
+	frame         *image.RGBA
+	ticker        *time.Ticker
+	stopCh        chan struct{}
+}
+
+// Size implements Sizer. Without a size option, a single image is served at its own size.
+func (s *Slideshow) Size() (width, height int) {
+	if s.width != 0 || len(s.files) != 1 {
+		return s.width, s.height
+	}
+	f, err := os.Open(s.files[0])
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0
+	}
+	return cfg.Width, cfg.Height
+}
+
+// Start starts producing frames of the given dimensions. They must match the size option
+// when it is set, since frames are not scaled to the server resolution.
+func (s *Slideshow) Start(width, height int) error {
+	if s.Resolution != "" && (s.width != width || s.height != height) {
+		return fmt.Errorf("The size option %dx%d does not match the server resolution of %dx%d", s.width, s.height, width, height)
+	}
+	s.width, s.height = width, height
+	s.startedAt = time.Now()
+	s.current = -1
+	s.frame = image.NewRGBA(image.Rect(0, 0, s.width, s.height))
+	fill(s.frame, s.frame.Bounds(), color.RGBA{0, 0, 0, 255})
+	s.ticker = time.NewTicker(time.Duration(float64(time.Second) / s.FPS))
+	s.stopCh = make(chan struct{})
+	return nil
+}
+
+// PullFrame waits for the next frame interval and returns the current image.
+func (s *Slideshow) PullFrame() *image.RGBA {
+	select {
+	case <-s.stopCh:
+		return nil
+	case <-s.ticker.C:
+	}
+	idx := int(time.Since(s.startedAt)/s.Interval) % len(s.files)
+	if idx != s.current {
+		s.current = idx
+		frame, err := s.load(s.files[idx])
+		if err != nil {
+			// Keep showing the previous image
+			log.Errorf("Could not load image %s: %s", s.files[idx], err.Error())
+		} else {
+			s.frame = frame
+		}
+	}
+	return s.frame
+}
+
+// Close stops producing frames.
+func (s *Slideshow) Close() error {
+	if s.stopCh == nil {
+		return nil
+	}
+	s.ticker.Stop()
+	close(s.stopCh)
+	return nil
+}
+
+// load decodes the given image and fits it to the size of the display.
+func (s *Slideshow) load(path string) (*image.RGBA, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	if b.Dx() != s.width || b.Dy() != s.height {
+		img = resize.Thumbnail(uint(s.width), uint(s.height), img, resize.Lanczos3)
+		b = img.Bounds()
+	}
+	frame := image.NewRGBA(image.Rect(0, 0, s.width, s.height))
+	fill(frame, frame.Bounds(), color.RGBA{0, 0, 0, 255})
+	at := image.Pt((s.width-b.Dx())/2, (s.height-b.Dy())/2)
+	draw.Draw(frame, b.Sub(b.Min).Add(at), img, b.Min, draw.Over)
+	return frame, nil
+}
+
+// listImages returns the given path if it is a file, or the PNG and JPEG images in it
+// sorted by name if it is a directory.
+func listImages(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".png", ".jpg", ".jpeg":
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No PNG or JPEG images found in %s", path)
+	}
+	return files, nil
+}
@@ -0,0 +1,44 @@
+package providers
+
+import (
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSlideshowSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slide.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, image.NewRGBA(image.Rect(0, 0, 40, 20))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// A single image sets the server resolution, but is scaled to a different one
+	d, err := New(ProviderImage, Options{"path": path, "fps": "100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := d.(Sizer).Size(); w != 40 || h != 20 {
+		t.Fatalf("Expected the size of the image, got %dx%d", w, h)
+	}
+	if w, h, err := startSize(t, d, 20, 10); err != nil || w != 20 || h != 10 {
+		t.Fatalf("Expected frames of the server resolution, got %dx%d, %v", w, h, err)
+	}
+
+	d, err = New(ProviderImage, Options{"path": path, "size": "80x40", "fps": "100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h, err := startSize(t, d, 80, 40); err != nil || w != 80 || h != 40 {
+		t.Fatalf("Expected frames of the size option, got %dx%d, %v", w, h, err)
+	}
+	if _, _, err := startSize(t, d, 20, 10); err == nil {
+		t.Fatal("Expected a resolution different from the size option to be refused")
+	}
+}
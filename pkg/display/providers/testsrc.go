@@ -0,0 +1,251 @@
+package providers
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+	"time"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Test patterns supported by the TestPattern provider.
+const (
+	PatternBars     = "bars"
+	PatternGradient = "gradient"
+	PatternText     = "text"
+	PatternClock    = "clock"
+)
+
+func init() {
+	Register(ProviderTestPattern, func(opts Options) (Display, error) {
+		t := &TestPattern{}
+		if err := opts.Decode(t); err != nil {
+			return nil, err
+		}
+		switch t.Pattern {
+		case PatternBars, PatternGradient, PatternText, PatternClock:
+		default:
+			return nil, fmt.Errorf("Unknown test pattern: %s", t.Pattern)
+		}
+		if t.FPS <= 0 {
+			return nil, fmt.Errorf("Frame rate must be positive: %v", t.FPS)
+		}
+		var err error
+		t.width, t.height, err = parseSize(t.Resolution)
+		return t, err
+	}, OptionSpec{
+		Name:        "pattern",
+		Description: "One of bars, gradient, text or clock.",
+		Default:     PatternBars,
+	}, OptionSpec{
+		Name:        "size",
+		Description: "The size of the pattern, as WIDTHxHEIGHT. It sets the server resolution, so it must match --resolution if both are given. Defaults to the server resolution.",
+	}, OptionSpec{
+		Name:        "fps",
+		Description: "The number of frames produced per second.",
+		Default:     "10",
+	}, OptionSpec{
+		Name:        "text",
+		Description: "The text to scroll across the text pattern.",
+		Default:     "gsvnc test pattern",
+	})
+}
+
+// TestPattern implements a display provider that draws synthetic test patterns. It needs
+// no display or gstreamer plugins, which makes it useful for testing viewers and encodings.
+type TestPattern struct {
+	Pattern    string  `option:"pattern"`
+	Resolution string  `option:"size"`
+	FPS        float64 `option:"fps"`
+	Text       string  `option:"text"`
+
+	width, height int
+	startedAt     time.Time
+	frame         *image.RGBA // The last frame, repeated for static patterns
+	ticker        *time.Ticker
+	stopCh        chan struct{}
+}
+
+// Size implements Sizer.
+func (t *TestPattern) Size() (width, height int) { return t.width, t.height }
+
+// Start starts producing frames of the given dimensions. They must match the size option
+// when it is set, since frames are not scaled to the server resolution.
+func (t *TestPattern) Start(width, height int) error {
+	if t.Resolution != "" && (t.width != width || t.height != height) {
+		return fmt.Errorf("The size option %dx%d does not match the server resolution of %dx%d", t.width, t.height, width, height)
+	}
+	t.width, t.height = width, height
+	t.startedAt = time.Now()
+	t.frame = nil
+	t.ticker = time.NewTicker(time.Duration(float64(time.Second) / t.FPS))
+	t.stopCh = make(chan struct{})
+	return nil
+}
+
+// PullFrame waits for the next frame interval and returns the pattern for that moment.
+func (t *TestPattern) PullFrame() *image.RGBA {
+	select {
+	case <-t.stopCh:
+		return nil
+	case <-t.ticker.C:
+	}
+	elapsed := time.Since(t.startedAt)
+	switch t.Pattern {
+	case PatternBars:
+		if t.frame == nil {
+			t.frame = drawBars(t.width, t.height)
+		}
+	case PatternGradient:
+		t.frame = drawGradient(t.width, t.height, int(elapsed/(time.Second/60)))
+	case PatternText:
+		t.frame = drawScrollingText(t.width, t.height, t.Text, int(elapsed/(time.Second/60)))
+	case PatternClock:
+		t.frame = drawCenteredText(t.width, t.height, time.Now().Format("15:04:05"))
+	}
+	return t.frame
+}
+
+// Close stops producing frames.
+func (t *TestPattern) Close() error {
+	if t.stopCh == nil {
+		return nil
+	}
+	t.ticker.Stop()
+	close(t.stopCh)
+	return nil
+}
+
+// SMPTE color bars, see SMPTE EG 1-1990.
+var (
+	smpteTop = []color.RGBA{
+		{191, 191, 191, 255}, {191, 191, 0, 255}, {0, 191, 191, 255}, {0, 191, 0, 255},
+		{191, 0, 191, 255}, {191, 0, 0, 255}, {0, 0, 191, 255},
+	}
+	smpteMiddle = []color.RGBA{
+		{0, 0, 191, 255}, {19, 19, 19, 255}, {191, 0, 191, 255}, {19, 19, 19, 255},
+		{0, 191, 191, 255}, {19, 19, 19, 255}, {191, 191, 191, 255},
+	}
+	smpteBottom = []color.RGBA{
+		{0, 33, 76, 255}, {255, 255, 255, 255}, {50, 0, 106, 255}, {19, 19, 19, 255},
+		{9, 9, 9, 255}, {19, 19, 19, 255}, {29, 29, 29, 255}, {19, 19, 19, 255},
+	}
+	// Widths of the bottom row in sevenths of the frame, the pluge takes up one seventh
+	// split in three.
+	smpteBottomWidths = []float64{5.0 / 4, 5.0 / 4, 5.0 / 4, 5.0 / 4, 1.0 / 3, 1.0 / 3, 1.0 / 3, 1}
+)
+
+func drawBars(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	topH, midH := height*2/3, height/12
+	barW := float64(width) / 7
+	for i := range smpteTop {
+		x0, x1 := int(float64(i)*barW), int(float64(i+1)*barW)
+		fill(img, image.Rect(x0, 0, x1, topH), smpteTop[i])
+		fill(img, image.Rect(x0, topH, x1, topH+midH), smpteMiddle[i])
+	}
+	x := 0.0
+	for i, c := range smpteBottom {
+		x1 := x + smpteBottomWidths[i]*barW
+		fill(img, image.Rect(int(x), topH+midH, int(x1), height), c)
+		x = x1
+	}
+	// Rounding may leave the last column empty
+	fill(img, image.Rect(int(x), topH+midH, width, height), smpteBottom[len(smpteBottom)-1])
+	return img
+}
+
+func drawGradient(width, height, offset int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < width; x++ {
+			row[x*4] = uint8((x + offset) * 256 / max(width, 1))
+			row[x*4+1] = uint8(y * 256 / max(height, 1))
+			row[x*4+2] = uint8(255 - (x+offset)*256/max(width, 1))
+			row[x*4+3] = 255
+		}
+	}
+	return img
+}
+
+func drawScrollingText(width, height int, text string, offset int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	fill(img, img.Bounds(), color.RGBA{0, 0, 0, 255})
+	label := renderText(text, textScale(height))
+	lb := label.Bounds()
+	// Scroll from right to left, wrapping once the text has left the screen
+	x := width - offset%(width+lb.Dx())
+	y := (height - lb.Dy()) / 2
+	draw.Draw(img, lb.Add(image.Pt(x, y)), label, image.Point{}, draw.Over)
+	return img
+}
+
+func drawCenteredText(width, height int, text string) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	fill(img, img.Bounds(), color.RGBA{0, 0, 0, 255})
+	label := renderText(text, textScale(height)*2)
+	lb := label.Bounds()
+	at := image.Pt((width-lb.Dx())/2, (height-lb.Dy())/2)
+	draw.Draw(img, lb.Add(at), label, image.Point{}, draw.Over)
+	return img
+}
+
+// textScale returns how much to scale the 13 pixel high built-in font for a frame of
+// the given height.
+func textScale(height int) int { return max(height/130, 1) }
+
+// renderText draws white text on a transparent background, scaled up by the given factor.
+func renderText(text string, scale int) *image.RGBA {
+	face := basicfont.Face7x13
+	d := &font.Drawer{
+		Src:  image.White,
+		Face: face,
+		Dot:  fixed.P(0, face.Ascent),
+	}
+	w := d.MeasureString(text).Ceil()
+	d.Dst = image.NewRGBA(image.Rect(0, 0, max(w, 1), face.Height))
+	d.DrawString(text)
+	if scale == 1 {
+		return d.Dst.(*image.RGBA)
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, max(w, 1)*scale, face.Height*scale))
+	xdraw.NearestNeighbor.Scale(scaled, scaled.Bounds(), d.Dst, d.Dst.Bounds(), draw.Src, nil)
+	return scaled
+}
+
+func fill(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	draw.Draw(img, r, &image.Uniform{c}, image.Point{}, draw.Src)
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// parseSize parses a size given as WIDTHxHEIGHT. An empty string is a zero size.
+func parseSize(size string) (width, height int, err error) {
+	if size == "" {
+		return 0, 0, nil
+	}
+	spl := strings.Split(size, "x")
+	if len(spl) != 2 {
+		return 0, 0, fmt.Errorf("Invalid size, expected WIDTHxHEIGHT: %s", size)
+	}
+	if width, err = strconv.Atoi(spl[0]); err != nil || width <= 0 {
+		return 0, 0, fmt.Errorf("Invalid width: %s", spl[0])
+	}
+	if height, err = strconv.Atoi(spl[1]); err != nil || height <= 0 {
+		return 0, 0, fmt.Errorf("Invalid height: %s", spl[1])
+	}
+	return width, height, nil
+}
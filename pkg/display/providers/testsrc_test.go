@@ -0,0 +1,46 @@
+package providers
+
+import "testing"
+
+// startSize starts the provider with the given server resolution and returns the size
+// of its first frame.
+func startSize(t *testing.T, d Display, width, height int) (int, int, error) {
+	t.Helper()
+	if err := d.Start(width, height); err != nil {
+		return 0, 0, err
+	}
+	defer d.Close()
+	frame := d.PullFrame()
+	if frame == nil {
+		t.Fatal("Expected a frame")
+	}
+	return frame.Bounds().Dx(), frame.Bounds().Dy(), nil
+}
+
+func TestTestPatternSize(t *testing.T) {
+	d, err := New(ProviderTestPattern, Options{"fps": "100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := d.(Sizer).Size(); w != 0 || h != 0 {
+		t.Fatalf("Expected no preferred size, got %dx%d", w, h)
+	}
+	if w, h, err := startSize(t, d, 32, 16); err != nil || w != 32 || h != 16 {
+		t.Fatalf("Expected frames of the server resolution, got %dx%d, %v", w, h, err)
+	}
+
+	d, err = New(ProviderTestPattern, Options{"size": "24x12", "fps": "100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := d.(Sizer).Size(); w != 24 || h != 12 {
+		t.Fatalf("Expected the size option, got %dx%d", w, h)
+	}
+	if w, h, err := startSize(t, d, 24, 12); err != nil || w != 24 || h != 12 {
+		t.Fatalf("Expected frames of the size option, got %dx%d, %v", w, h, err)
+	}
+	// A different server resolution is refused rather than sending frames of the wrong size
+	if _, _, err := startSize(t, d, 32, 16); err == nil {
+		t.Fatal("Expected a resolution different from the size option to be refused")
+	}
+}
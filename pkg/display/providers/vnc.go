@@ -0,0 +1,399 @@
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/client"
+)
+
+// vncEncodings maps the names accepted by the encodings option to their codes.
+var vncEncodings = map[string]int32{
+	"raw":      client.EncodingRaw,
+	"copyrect": client.EncodingCopyRect,
+	"rre":      client.EncodingRRE,
+	"hextile":  client.EncodingHextile,
+	"zrle":     client.EncodingZRLE,
+}
+
+func init() {
+	Register(ProviderVNC, func(opts Options) (Display, error) {
+		v := &VNC{}
+		if err := opts.Decode(v); err != nil {
+			return nil, err
+		}
+		if v.Address == "" {
+			return nil, errors.New("The address of the upstream VNC server is required")
+		}
+		if _, _, err := net.SplitHostPort(v.Address); err != nil {
+			v.Address = net.JoinHostPort(v.Address, "5900")
+		}
+		if v.PasswordFile != "" {
+			if v.Password != "" {
+				return nil, errors.New("Only one of password and password-file can be given")
+			}
+			data, err := ioutil.ReadFile(v.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("Could not read password file: %s", err.Error())
+			}
+			v.Password = strings.TrimRight(string(data), "\r\n")
+		}
+		for _, name := range strings.Split(v.Encodings, ",") {
+			enc, ok := vncEncodings[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("Unknown encoding %q, must be one of raw, copyrect, rre, hextile or zrle", name)
+			}
+			v.encodings = append(v.encodings, enc)
+		}
+		if v.FPS <= 0 {
+			return nil, fmt.Errorf("Frame rate must be positive: %v", v.FPS)
+		}
+		return v, nil
+	}, OptionSpec{
+		Name:        "address",
+		Description: "The address of the upstream VNC server, as HOST:PORT. The port defaults to 5900.",
+	}, OptionSpec{
+		Name:        "password",
+		Description: "The password for the upstream server, if it requires one.",
+	}, OptionSpec{
+		Name:        "password-file",
+		Description: "A file containing the password for the upstream server.",
+	}, OptionSpec{
+		Name:        "shared",
+		Description: "Ask the upstream server to leave its other clients connected.",
+		Default:     "true",
+	}, OptionSpec{
+		Name:        "encodings",
+		Description: "The encodings requested from the upstream server in order of preference, a comma separated list of raw, copyrect, rre, hextile and zrle.",
+		Default:     "copyrect,zrle,hextile,rre,raw",
+	}, OptionSpec{
+		Name:        "fps",
+		Description: "The maximum number of updates requested from the upstream server per second.",
+		Default:     "30",
+	}, OptionSpec{
+		Name:        "timeout",
+		Description: "How long to wait for the upstream server to connect and complete the handshake.",
+		Default:     "10s",
+	})
+}
+
+// vncRefreshInterval is how often the last frame is repeated when the upstream server
+// sends no updates, so clients asking for a full update aren't kept waiting.
+const vncRefreshInterval = time.Millisecond * 100
+
+// The delay between attempts to reconnect to the upstream server starts at
+// vncMinBackoff and doubles after each failed attempt up to vncMaxBackoff.
+const (
+	vncMinBackoff = time.Second
+	vncMaxBackoff = time.Minute
+)
+
+// VNC implements a display provider that relays another VNC server. It connects to the
+// upstream server as a client, and forwards input and clipboard text from clients to it.
+// This puts the websocket, TLS and authentication options of gsvnc in front of servers
+// that lack them, such as KVMs and QEMU. When the connection to the upstream server is
+// lost the provider reconnects, and clients see the last frame until it is back.
+type VNC struct {
+	Address      string        `option:"address"`
+	Password     string        `option:"password"`
+	PasswordFile string        `option:"password-file"`
+	Shared       bool          `option:"shared"`
+	Encodings    string        `option:"encodings"`
+	FPS          float64       `option:"fps"`
+	Timeout      time.Duration `option:"timeout"`
+
+	encodings []int32
+
+	// Guards the fields below
+	stateMux  sync.Mutex
+	client    *client.Client
+	stopCh    chan struct{}
+	doneCh    chan struct{} // Closed when run returns after the provider is closed
+	dirty     image.Rectangle
+	frame     *image.RGBA
+	clipboard string
+
+	// Signaled when the upstream server sends an update, for PullFrame and for run
+	notifyCh, updateCh chan struct{}
+}
+
+// Size implements Sizer by connecting to the upstream server to read its size.
+func (v *VNC) Size() (width, height int) {
+	c, err := client.Dial(v.Address, v.Timeout, v.clientOpts())
+	if err != nil {
+		log.Warning("Could not get the size of the upstream VNC server: ", err.Error())
+		return 0, 0
+	}
+	defer c.Close()
+	return c.Size()
+}
+
+func (v *VNC) clientOpts() *client.Opts {
+	return &client.Opts{
+		Password:  v.Password,
+		Shared:    v.Shared,
+		Encodings: v.encodings,
+		OnUpdate:  v.markDirty,
+		OnCutText: v.setClipboard,
+	}
+}
+
+// Start connects to the upstream server and starts relaying its updates. Frames have
+// the size of the upstream framebuffer.
+func (v *VNC) Start(width, height int) error {
+	c, err := client.Dial(v.Address, v.Timeout, v.clientOpts())
+	if err != nil {
+		return fmt.Errorf("Could not connect to upstream VNC server at %s: %s", v.Address, err.Error())
+	}
+	uw, uh := c.Size()
+	log.Infof("Connected to upstream VNC server %q at %s (%dx%d)", c.Name, v.Address, uw, uh)
+	if uw != width || uh != height {
+		log.Warningf("The upstream VNC server is %dx%d, frames are not scaled to %dx%d", uw, uh, width, height)
+	}
+
+	v.stateMux.Lock()
+	v.client = c
+	v.doneCh = make(chan struct{})
+	v.stopCh = make(chan struct{})
+	v.notifyCh = make(chan struct{}, 1)
+	v.updateCh = make(chan struct{}, 1)
+	v.dirty, v.frame = image.Rectangle{}, nil
+	v.stateMux.Unlock()
+
+	if err := c.RequestUpdate(false); err != nil {
+		c.Close()
+		return err
+	}
+	go v.run(c, v.stopCh, v.doneCh)
+	return nil
+}
+
+// run relays the upstream server until the provider is closed, reconnecting whenever
+// the connection is lost.
+func (v *VNC) run(c *client.Client, stopCh, doneCh chan struct{}) {
+	defer close(doneCh)
+	for {
+		err := v.relay(c, stopCh)
+		if err == nil {
+			return
+		}
+		backoff := vncMinBackoff
+		log.Errorf("Connection to the upstream VNC server failed (%s), reconnecting in %s", err, backoff)
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(backoff):
+			}
+			if c, err = v.reconnect(stopCh); err == nil {
+				break
+			}
+			backoff *= 2
+			if backoff > vncMaxBackoff {
+				backoff = vncMaxBackoff
+			}
+			log.Warningf("Could not reconnect to the upstream VNC server (%s), retrying in %s", err, backoff)
+		}
+		if c == nil {
+			// Closed while reconnecting
+			return
+		}
+	}
+}
+
+// relay reads updates from the upstream server, requesting the next one once the last
+// was received, at most FPS times a second. It returns nil once stopped, or the error
+// that ended the connection.
+func (v *VNC) relay(c *client.Client, stopCh chan struct{}) error {
+	errCh := make(chan error, 1)
+	go func() { errCh <- c.Run() }()
+
+	interval := time.Duration(float64(time.Second) / v.FPS)
+	last := time.Now()
+	for {
+		select {
+		case <-stopCh:
+			c.Close()
+			<-errCh
+			return nil
+		case err := <-errCh:
+			c.Close()
+			return err
+		case <-v.updateCh:
+		}
+		if wait := interval - time.Since(last); wait > 0 {
+			select {
+			case <-stopCh:
+				continue
+			case <-time.After(wait):
+			}
+		}
+		last = time.Now()
+		if err := c.RequestUpdate(true); err != nil {
+			log.Error("Could not request an update from the upstream VNC server: ", err.Error())
+		}
+	}
+}
+
+// reconnect connects to the upstream server again and makes the new connection the
+// current one. It returns a nil client if the provider was closed meanwhile.
+func (v *VNC) reconnect(stopCh chan struct{}) (*client.Client, error) {
+	c, err := client.Dial(v.Address, v.Timeout, v.clientOpts())
+	if err != nil {
+		return nil, err
+	}
+	if err := c.RequestUpdate(false); err != nil {
+		c.Close()
+		return nil, err
+	}
+	v.stateMux.Lock()
+	defer v.stateMux.Unlock()
+	if v.stopCh != stopCh {
+		c.Close()
+		return nil, nil
+	}
+	pw, ph := v.client.Size()
+	if w, h := c.Size(); w != pw || h != ph {
+		log.Warningf("The upstream VNC server is now %dx%d, it was %dx%d", w, h, pw, ph)
+	}
+	v.client = c
+	log.Infof("Reconnected to upstream VNC server %q at %s", c.Name, v.Address)
+	return c, nil
+}
+
+// markDirty is called by the client for each update.
+func (v *VNC) markDirty(rect image.Rectangle) {
+	v.stateMux.Lock()
+	v.dirty = v.dirty.Union(rect)
+	v.stateMux.Unlock()
+	for _, ch := range []chan struct{}{v.notifyCh, v.updateCh} {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (v *VNC) setClipboard(text string) {
+	v.stateMux.Lock()
+	defer v.stateMux.Unlock()
+	v.clipboard = text
+}
+
+// PullFrame returns a snapshot of the upstream framebuffer once it is updated, or the
+// previous snapshot if nothing changed for a while, as while reconnecting. Nil is
+// returned once the provider is closed.
+func (v *VNC) PullFrame() *image.RGBA {
+	v.stateMux.Lock()
+	stopCh, doneCh := v.stopCh, v.doneCh
+	v.stateMux.Unlock()
+	if stopCh == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(vncRefreshInterval)
+	defer timer.Stop()
+	select {
+	case <-stopCh:
+		return nil
+	case <-doneCh:
+		return nil
+	case <-v.notifyCh:
+	case <-timer.C:
+	}
+
+	// The client is read along with the dirty region, since it changes on reconnects
+	v.stateMux.Lock()
+	c, dirty, prev := v.client, v.dirty, v.frame
+	v.dirty = image.Rectangle{}
+	v.stateMux.Unlock()
+	if c == nil {
+		return nil
+	}
+	if dirty.Empty() && prev != nil {
+		return prev
+	}
+
+	// Frames are kept by consumers to compute damage, so each one is a new image built
+	// from the previous frame and the dirty region.
+	var frame *image.RGBA
+	c.Framebuffer(func(fb *image.RGBA) {
+		frame = image.NewRGBA(fb.Bounds())
+		if prev != nil && prev.Bounds() == fb.Bounds() {
+			copy(frame.Pix, prev.Pix)
+			draw.Draw(frame, dirty, fb, dirty.Min, draw.Src)
+		} else {
+			copy(frame.Pix, fb.Pix)
+		}
+	})
+
+	v.stateMux.Lock()
+	v.frame = frame
+	v.stateMux.Unlock()
+	return frame
+}
+
+// Close disconnects from the upstream server.
+func (v *VNC) Close() error {
+	v.stateMux.Lock()
+	c, stopCh, doneCh := v.client, v.stopCh, v.doneCh
+	v.client, v.stopCh = nil, nil
+	v.stateMux.Unlock()
+	if c == nil {
+		return nil
+	}
+	close(stopCh)
+	<-doneCh
+	return nil
+}
+
+// currentClient returns the client while the provider is started.
+func (v *VNC) currentClient() *client.Client {
+	v.stateMux.Lock()
+	defer v.stateMux.Unlock()
+	return v.client
+}
+
+// KeyEvent implements InputHandler.
+func (v *VNC) KeyEvent(keysym uint32, down bool) {
+	if c := v.currentClient(); c != nil {
+		if err := c.KeyEvent(keysym, down); err != nil {
+			log.Debug("Could not send key event upstream: ", err.Error())
+		}
+	}
+}
+
+// PointerEvent implements InputHandler.
+func (v *VNC) PointerEvent(x, y int, buttonMask uint8) {
+	if c := v.currentClient(); c != nil {
+		if err := c.PointerEvent(x, y, buttonMask); err != nil {
+			log.Debug("Could not send pointer event upstream: ", err.Error())
+		}
+	}
+}
+
+// ReadClipboard implements ClipboardHandler. It returns the last text sent by the
+// upstream server.
+func (v *VNC) ReadClipboard() (string, error) {
+	v.stateMux.Lock()
+	defer v.stateMux.Unlock()
+	return v.clipboard, nil
+}
+
+// WriteClipboard implements ClipboardHandler.
+func (v *VNC) WriteClipboard(text string) error {
+	c := v.currentClient()
+	if c == nil {
+		return errors.New("Not connected to the upstream VNC server")
+	}
+	v.setClipboard(text)
+	return c.CutText(text)
+}
@@ -0,0 +1,530 @@
+//go:build linux
+// +build linux
+
+package providers
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"sync"
+	"time"
+
+	"github.com/robotn/xgb"
+	"github.com/robotn/xgb/damage"
+	"github.com/robotn/xgb/shm"
+	"github.com/robotn/xgb/xfixes"
+	"github.com/robotn/xgb/xproto"
+	"github.com/robotn/xgb/xtest"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+)
+
+func init() {
+	Register(ProviderX11, func(opts Options) (Display, error) {
+		x := &X11{}
+		if err := opts.Decode(x); err != nil {
+			return nil, err
+		}
+		if x.FPS <= 0 {
+			return nil, fmt.Errorf("Frame rate must be positive: %v", x.FPS)
+		}
+		return x, nil
+	}, OptionSpec{
+		Name:        "display",
+		Description: "The X display to capture, such as :1. Defaults to $DISPLAY.",
+	}, OptionSpec{
+		Name:        "fps",
+		Description: "The maximum number of frames captured per second.",
+		Default:     "30",
+	}, OptionSpec{
+		Name:        "shm",
+		Description: "Capture through MIT-SHM shared memory when the X server is local.",
+		Default:     "true",
+	}, OptionSpec{
+		Name:        "damage",
+		Description: "Only capture the regions XDamage reports as changed.",
+		Default:     "true",
+	}, OptionSpec{
+		Name:        "cursor",
+		Description: "Draw the cursor into frames using XFixes.",
+		Default:     "true",
+	})
+}
+
+// X11 implements a display provider that captures an X display over the X protocol,
+// without gstreamer. Frames are captured with XShmGetImage when the server is local, and
+// only the regions reported by XDamage are read. Input is injected with XTEST into the
+// same display.
+//
+// Frames are always the size of the X screen, and the regions that changed between them
+// are reported with DamageSince.
+type X11 struct {
+	DisplayName string  `option:"display"`
+	FPS         float64 `option:"fps"`
+	UseShm      bool    `option:"shm"`
+	UseDamage   bool    `option:"damage"`
+	DrawCursor  bool    `option:"cursor"`
+
+	conn          *xgb.Conn
+	root          xproto.Window
+	width, height int
+	msbFirst      bool
+	shm           *shmSegment // Nil when capturing with GetImage
+	damage        bool        // Whether XDamage is in use
+	xfixes        bool        // Whether XFixes is in use
+	raw           *image.RGBA // The screen without the cursor
+	frame         *image.RGBA // The last frame returned
+	cursor        *x11Cursor
+	ticker        *time.Ticker
+	stopCh        chan struct{}
+	eventsDone    chan struct{}
+	pullMux       sync.Mutex // Held while capturing, so Close can wait for it
+
+	// Regions reported by XDamage since the last capture, and whether XFixes reported
+	// a new cursor shape
+	dirty       image.Rectangle
+	cursorShape bool
+	dirtyMux    sync.Mutex
+
+	// The last frames returned, implementing Damager
+	frameRing
+
+	// Input state
+	xtest    bool
+	keycodes map[uint32]xproto.Keycode
+	buttons  uint8
+	inputMux sync.Mutex
+}
+
+// Size implements Sizer, returning the size of the X screen.
+func (x *X11) Size() (width, height int) {
+	conn, err := xgb.NewConnDisplay(x.DisplayName)
+	if err != nil {
+		return 0, 0
+	}
+	defer conn.Close()
+	screen := xproto.Setup(conn).DefaultScreen(conn)
+	return int(screen.WidthInPixels), int(screen.HeightInPixels)
+}
+
+// Start connects to the X server and sets up the extensions used for capture.
+func (x *X11) Start(width, height int) error {
+	conn, err := xgb.NewConnDisplay(x.DisplayName)
+	if err != nil {
+		return err
+	}
+	setup := xproto.Setup(conn)
+	screen := setup.DefaultScreen(conn)
+	for _, format := range setup.PixmapFormats {
+		if format.Depth == screen.RootDepth && format.BitsPerPixel != 32 {
+			conn.Close()
+			return fmt.Errorf("Unsupported X screen depth %d (%d bits per pixel)", format.Depth, format.BitsPerPixel)
+		}
+	}
+
+	x.conn = conn
+	x.root = screen.Root
+	x.width, x.height = int(screen.WidthInPixels), int(screen.HeightInPixels)
+	x.msbFirst = setup.ImageByteOrder == xproto.ImageOrderMSBFirst
+	if x.width != width || x.height != height {
+		log.Warningf("X screen is %dx%d, not the requested %dx%d", x.width, x.height, width, height)
+	}
+	x.raw = image.NewRGBA(image.Rect(0, 0, x.width, x.height))
+	x.frame = nil
+	x.cursor = nil
+	x.reset()
+
+	x.shm = nil
+	if x.UseShm {
+		if x.shm, err = x.setupShm(); err != nil {
+			log.Warning("MIT-SHM is not available, falling back to GetImage: ", err.Error())
+		}
+	}
+	x.damage = false
+	if x.UseDamage {
+		if err := x.setupDamage(); err != nil {
+			log.Warning("XDamage is not available, capturing full frames: ", err.Error())
+		} else {
+			x.damage = true
+		}
+	}
+	x.xfixes = false
+	if x.DrawCursor {
+		if err := x.setupXFixes(); err != nil {
+			log.Warning("XFixes is not available, the cursor will not be drawn: ", err.Error())
+		} else {
+			x.xfixes = true
+		}
+	}
+	if err := x.setupInput(setup); err != nil {
+		log.Warning("XTEST is not available, input will be ignored: ", err.Error())
+	}
+
+	// The first frame is always captured in full, with the cursor
+	x.dirty = image.Rect(0, 0, x.width, x.height)
+	x.cursorShape = true
+	x.ticker = time.NewTicker(time.Duration(float64(time.Second) / x.FPS))
+	x.stopCh = make(chan struct{})
+	x.eventsDone = make(chan struct{})
+	go x.watchEvents(conn, x.eventsDone)
+	return nil
+}
+
+func (x *X11) setupShm() (*shmSegment, error) {
+	if err := shm.Init(x.conn); err != nil {
+		return nil, err
+	}
+	return newShmSegment(x.conn, x.width*x.height*4)
+}
+
+func (x *X11) setupDamage() error {
+	if err := damage.Init(x.conn); err != nil {
+		return err
+	}
+	if _, err := damage.QueryVersion(x.conn, 1, 1).Reply(); err != nil {
+		return err
+	}
+	id, err := damage.NewDamageId(x.conn)
+	if err != nil {
+		return err
+	}
+	return damage.CreateChecked(x.conn, id, xproto.Drawable(x.root), damage.ReportLevelRawRectangles).Check()
+}
+
+func (x *X11) setupXFixes() error {
+	if err := xfixes.Init(x.conn); err != nil {
+		return err
+	}
+	if _, err := xfixes.QueryVersion(x.conn, 4, 0).Reply(); err != nil {
+		return err
+	}
+	// The cursor image is only read again when its shape changes
+	return xfixes.SelectCursorInputChecked(x.conn, x.root, xfixes.CursorNotifyMaskDisplayCursor).Check()
+}
+
+func (x *X11) setupInput(setup *xproto.SetupInfo) error {
+	x.inputMux.Lock()
+	defer x.inputMux.Unlock()
+	x.xtest = false
+	x.buttons = 0
+	if err := xtest.Init(x.conn); err != nil {
+		return err
+	}
+	count := byte(setup.MaxKeycode - setup.MinKeycode + 1)
+	reply, err := xproto.GetKeyboardMapping(x.conn, setup.MinKeycode, count).Reply()
+	if err != nil {
+		return err
+	}
+	// Prefer the first column, so keysyms map to the key that produces them unshifted
+	x.keycodes = make(map[uint32]xproto.Keycode)
+	per := int(reply.KeysymsPerKeycode)
+	for col := 0; col < per; col++ {
+		for i := 0; i < int(count); i++ {
+			ks := uint32(reply.Keysyms[i*per+col])
+			if _, ok := x.keycodes[ks]; ks != 0 && !ok {
+				x.keycodes[ks] = xproto.Keycode(int(setup.MinKeycode) + i)
+			}
+		}
+	}
+	x.xtest = true
+	return nil
+}
+
+// watchEvents collects damage and cursor events until the connection is closed.
+func (x *X11) watchEvents(conn *xgb.Conn, done chan struct{}) {
+	defer close(done)
+	for {
+		ev, err := conn.WaitForEvent()
+		if ev == nil && err == nil {
+			return
+		}
+		if err != nil {
+			log.Debug("X error: ", err.Error())
+			continue
+		}
+		switch n := ev.(type) {
+		case damage.NotifyEvent:
+			r := image.Rect(int(n.Area.X), int(n.Area.Y), int(n.Area.X)+int(n.Area.Width), int(n.Area.Y)+int(n.Area.Height))
+			x.dirtyMux.Lock()
+			x.dirty = x.dirty.Union(r)
+			x.dirtyMux.Unlock()
+		case xfixes.CursorNotifyEvent:
+			x.dirtyMux.Lock()
+			x.cursorShape = true
+			x.dirtyMux.Unlock()
+		}
+	}
+}
+
+// PullFrame waits for the next frame interval and captures the regions of the screen
+// that changed. The previous frame is returned if nothing did.
+func (x *X11) PullFrame() *image.RGBA {
+	select {
+	case <-x.stopCh:
+		return nil
+	case <-x.ticker.C:
+	}
+	x.pullMux.Lock()
+	defer x.pullMux.Unlock()
+	select {
+	case <-x.stopCh:
+		return nil
+	default:
+	}
+
+	bounds := x.raw.Bounds()
+	dirty := bounds
+	x.dirtyMux.Lock()
+	if x.damage {
+		dirty = x.dirty.Intersect(bounds)
+		x.dirty = image.Rectangle{}
+	}
+	cursorShape := x.cursorShape || x.cursor == nil
+	x.cursorShape = false
+	x.dirtyMux.Unlock()
+
+	// The cursor is requested first, so its round trip overlaps the capture
+	var cursorReq cursorRequest
+	if x.xfixes {
+		cursorReq = x.requestCursor(cursorShape)
+	}
+	if !dirty.Empty() {
+		changed, err := x.capture(dirty)
+		if err != nil {
+			log.Error("Could not capture X screen: ", err.Error())
+		}
+		dirty = changed
+	}
+	if x.xfixes {
+		cursor, err := cursorReq.read(x.cursor)
+		if err != nil {
+			log.Debug("Could not get cursor image: ", err.Error())
+			if cursorShape {
+				x.dirtyMux.Lock()
+				x.cursorShape = true
+				x.dirtyMux.Unlock()
+			}
+		} else if x.cursor == nil || cursor.pos != x.cursor.pos || cursor.img != x.cursor.img {
+			// Both where the cursor was and where it is now changed
+			dirty = dirty.Union(cursor.bounds())
+			if x.cursor != nil {
+				dirty = dirty.Union(x.cursor.bounds())
+			}
+			x.cursor = cursor
+		}
+	}
+	dirty = dirty.Intersect(bounds)
+
+	if x.frame != nil && dirty.Empty() {
+		return x.frame
+	}
+	x.frame = x.nextFrame(dirty)
+	return x.frame
+}
+
+// nextFrame returns a new frame with the given region of the screen updated. Consumers
+// keep frames to compute damage, so each one is a new image copied from the last.
+func (x *X11) nextFrame(damage image.Rectangle) *image.RGBA {
+	bounds := x.raw.Bounds()
+	frame := image.NewRGBA(bounds)
+	refresh := bounds
+	if x.frame != nil && x.frame.Rect == bounds {
+		copy(frame.Pix, x.frame.Pix)
+		refresh = damage
+	}
+	rowLen := refresh.Dx() * 4
+	for y := refresh.Min.Y; y < refresh.Max.Y; y++ {
+		off := x.raw.PixOffset(refresh.Min.X, y)
+		copy(frame.Pix[off:off+rowLen], x.raw.Pix[off:off+rowLen])
+	}
+	if x.cursor != nil {
+		// Elsewhere the frame still has the same cursor drawn at the same place
+		r := x.cursor.bounds().Intersect(refresh)
+		draw.Draw(frame, r, x.cursor.img, r.Min.Sub(x.cursor.pos), draw.Over)
+	}
+	x.push(frame, damage)
+	return frame
+}
+
+// capture reads the given region of the screen into the raw frame, returning the part
+// of it that changed.
+func (x *X11) capture(r image.Rectangle) (image.Rectangle, error) {
+	drawable := xproto.Drawable(x.root)
+	if x.shm != nil {
+		_, err := shm.GetImage(x.conn, drawable, int16(r.Min.X), int16(r.Min.Y), uint16(r.Dx()), uint16(r.Dy()),
+			0xffffffff, xproto.ImageFormatZPixmap, x.shm.seg, 0).Reply()
+		if err != nil {
+			return image.Rectangle{}, err
+		}
+		return x.copyPixels(r, x.shm.data), nil
+	}
+	reply, err := xproto.GetImage(x.conn, xproto.ImageFormatZPixmap, drawable,
+		int16(r.Min.X), int16(r.Min.Y), uint16(r.Dx()), uint16(r.Dy()), 0xffffffff).Reply()
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	return x.copyPixels(r, reply.Data), nil
+}
+
+// copyPixels copies 32 bit ZPixmap data for the given region into the raw frame, and
+// returns the part of the region that changed. Without XDamage every capture is a full
+// one, so this keeps unchanged screens from producing new frames.
+func (x *X11) copyPixels(r image.Rectangle, data []byte) image.Rectangle {
+	rowLen := r.Dx() * 4
+	if len(data) < rowLen*r.Dy() {
+		log.Errorf("Short X image for %s: got %d bytes", r, len(data))
+		return image.Rectangle{}
+	}
+	// Pixels are BGRX in LSB first order, and XRGB in MSB first order
+	ri, gi, bi := 2, 1, 0
+	if x.msbFirst {
+		ri, gi, bi = 1, 2, 3
+	}
+	var changed image.Rectangle
+	for y := 0; y < r.Dy(); y++ {
+		src := data[y*rowLen : (y+1)*rowLen]
+		dst := x.raw.Pix[x.raw.PixOffset(r.Min.X, r.Min.Y+y):][:rowLen]
+		minX, maxX := rowLen, -1
+		for i := 0; i < rowLen; i += 4 {
+			red, green, blue := src[i+ri], src[i+gi], src[i+bi]
+			if dst[i] == red && dst[i+1] == green && dst[i+2] == blue && dst[i+3] == 255 {
+				continue
+			}
+			dst[i], dst[i+1], dst[i+2], dst[i+3] = red, green, blue, 255
+			if i < minX {
+				minX = i
+			}
+			maxX = i
+		}
+		if maxX >= 0 {
+			changed = changed.Union(image.Rect(r.Min.X+minX/4, r.Min.Y+y, r.Min.X+maxX/4+1, r.Min.Y+y+1))
+		}
+	}
+	return changed
+}
+
+// x11Cursor is a cursor image and where to draw it.
+type x11Cursor struct {
+	pos image.Point // Where the top left corner is drawn
+	hot image.Point
+	img *image.RGBA
+}
+
+func (c *x11Cursor) bounds() image.Rectangle { return c.img.Bounds().Add(c.pos) }
+
+// cursorRequest is a request for the cursor that is in flight.
+type cursorRequest struct {
+	image   *xfixes.GetCursorImageCookie // Set when the shape is read
+	pointer *xproto.QueryPointerCookie   // Set when only the position is read
+}
+
+// requestCursor requests the cursor image when its shape changed, or else only the
+// pointer position, which is much smaller.
+func (x *X11) requestCursor(shape bool) cursorRequest {
+	if shape {
+		cookie := xfixes.GetCursorImage(x.conn)
+		return cursorRequest{image: &cookie}
+	}
+	cookie := xproto.QueryPointer(x.conn, x.root)
+	return cursorRequest{pointer: &cookie}
+}
+
+// read returns the requested cursor. Only its position is updated if the shape wasn't
+// requested.
+func (r cursorRequest) read(prev *x11Cursor) (*x11Cursor, error) {
+	if r.pointer != nil {
+		reply, err := r.pointer.Reply()
+		if err != nil {
+			return nil, err
+		}
+		return &x11Cursor{
+			pos: image.Pt(int(reply.RootX), int(reply.RootY)).Sub(prev.hot),
+			hot: prev.hot,
+			img: prev.img,
+		}, nil
+	}
+	reply, err := r.image.Reply()
+	if err != nil {
+		return nil, err
+	}
+	cursor := &x11Cursor{hot: image.Pt(int(reply.Xhot), int(reply.Yhot))}
+	cursor.pos = image.Pt(int(reply.X), int(reply.Y)).Sub(cursor.hot)
+	// Cursor pixels are premultiplied ARGB, the same as image.RGBA
+	cursor.img = image.NewRGBA(image.Rect(0, 0, int(reply.Width), int(reply.Height)))
+	for i, px := range reply.CursorImage {
+		if i*4 >= len(cursor.img.Pix) {
+			break
+		}
+		cursor.img.Pix[i*4] = uint8(px >> 16)
+		cursor.img.Pix[i*4+1] = uint8(px >> 8)
+		cursor.img.Pix[i*4+2] = uint8(px)
+		cursor.img.Pix[i*4+3] = uint8(px >> 24)
+	}
+	return cursor, nil
+}
+
+// KeyEvent implements InputHandler.
+func (x *X11) KeyEvent(keysym uint32, down bool) {
+	x.inputMux.Lock()
+	defer x.inputMux.Unlock()
+	if !x.xtest {
+		return
+	}
+	code, ok := x.keycodes[keysym]
+	if !ok {
+		log.Debugf("No keycode for keysym %#x", keysym)
+		return
+	}
+	typ := byte(xproto.KeyPress)
+	if !down {
+		typ = xproto.KeyRelease
+	}
+	xtest.FakeInput(x.conn, typ, byte(code), 0, x.root, 0, 0, 0)
+}
+
+// PointerEvent implements InputHandler.
+func (x *X11) PointerEvent(px, py int, buttonMask uint8) {
+	x.inputMux.Lock()
+	defer x.inputMux.Unlock()
+	if !x.xtest {
+		return
+	}
+	xtest.FakeInput(x.conn, xproto.MotionNotify, 0, 0, x.root, int16(px), int16(py), 0)
+	for i := uint(0); i < 8; i++ {
+		bit := uint8(1) << i
+		if (buttonMask^x.buttons)&bit == 0 {
+			continue
+		}
+		typ := byte(xproto.ButtonPress)
+		if buttonMask&bit == 0 {
+			typ = xproto.ButtonRelease
+		}
+		xtest.FakeInput(x.conn, typ, byte(i+1), 0, x.root, 0, 0, 0)
+	}
+	x.buttons = buttonMask
+}
+
+// Close disconnects from the X server.
+func (x *X11) Close() error {
+	if x.stopCh == nil {
+		return nil
+	}
+	close(x.stopCh)
+	x.ticker.Stop()
+
+	// Wait for any capture in progress
+	x.pullMux.Lock()
+	defer x.pullMux.Unlock()
+	x.inputMux.Lock()
+	x.xtest = false
+	x.inputMux.Unlock()
+
+	var err error
+	if x.shm != nil {
+		err = x.shm.close()
+	}
+	x.conn.Close()
+	<-x.eventsDone
+	return err
+}
@@ -0,0 +1,23 @@
+//go:build linux && !(amd64 || arm || arm64 || mips64 || mips64le || riscv64)
+// +build linux,!amd64,!arm,!arm64,!mips64,!mips64le,!riscv64
+
+package providers
+
+import (
+	"errors"
+
+	"github.com/robotn/xgb"
+	"github.com/robotn/xgb/shm"
+)
+
+// shmSegment is not supported on this architecture, frames are captured with GetImage.
+type shmSegment struct {
+	seg  shm.Seg
+	data []byte
+}
+
+func newShmSegment(conn *xgb.Conn, size int) (*shmSegment, error) {
+	return nil, errors.New("shared memory is not supported on this architecture")
+}
+
+func (s *shmSegment) close() error { return nil }
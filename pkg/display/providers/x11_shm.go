@@ -0,0 +1,77 @@
+//go:build linux && (amd64 || arm || arm64 || mips64 || mips64le || riscv64)
+// +build linux
+// +build amd64 arm arm64 mips64 mips64le riscv64
+
+package providers
+
+import (
+	"reflect"
+	"syscall"
+	"unsafe"
+
+	"github.com/robotn/xgb"
+	"github.com/robotn/xgb/shm"
+)
+
+// System V IPC constants, see ipc.h.
+const (
+	ipcPrivate = 0
+	ipcCreat   = 01000
+	ipcRmid    = 0
+)
+
+// shmSegment is a System V shared memory segment attached to the X server.
+type shmSegment struct {
+	conn *xgb.Conn
+	seg  shm.Seg
+	addr uintptr
+	data []byte
+}
+
+func newShmSegment(conn *xgb.Conn, size int) (*shmSegment, error) {
+	id, _, errno := syscall.Syscall(syscall.SYS_SHMGET, ipcPrivate, uintptr(size), ipcCreat|0600)
+	if errno != 0 {
+		return nil, errno
+	}
+	// The segment is removed once both sides detach from it
+	defer syscall.Syscall(syscall.SYS_SHMCTL, id, ipcRmid, 0)
+
+	addr, _, errno := syscall.Syscall(syscall.SYS_SHMAT, id, 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	seg, err := shm.NewSegId(conn)
+	if err == nil {
+		// Fails when the X server is not on this machine
+		err = shm.AttachChecked(conn, seg, uint32(id), false).Check()
+	}
+	if err != nil {
+		syscall.Syscall(syscall.SYS_SHMDT, addr, 0, 0)
+		return nil, err
+	}
+	return &shmSegment{
+		conn: conn,
+		seg:  seg,
+		addr: addr,
+		data: shmBytes(addr, size),
+	}, nil
+}
+
+// shmBytes returns the attached segment at addr as a slice. The segment is mapped outside
+// of the Go heap, so the slice header is filled in directly rather than converting the
+// address back to an unsafe.Pointer.
+func shmBytes(addr uintptr, size int) []byte {
+	var data []byte
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&data))
+	hdr.Data, hdr.Len, hdr.Cap = addr, size, size
+	return data
+}
+
+func (s *shmSegment) close() error {
+	shm.Detach(s.conn, s.seg)
+	s.data = nil
+	if _, _, errno := syscall.Syscall(syscall.SYS_SHMDT, s.addr, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
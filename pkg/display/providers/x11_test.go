@@ -0,0 +1,90 @@
+//go:build linux
+// +build linux
+
+package providers
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"testing"
+)
+
+func TestX11CopyPixels(t *testing.T) {
+	x := &X11{raw: image.NewRGBA(image.Rect(0, 0, 4, 4))}
+	// A BGRX region of 2x2 pixels
+	data := bytes.Repeat([]byte{3, 2, 1, 0}, 4)
+	r := image.Rect(1, 1, 3, 3)
+	if changed := x.copyPixels(r, data); changed != r {
+		t.Fatalf("Expected the whole region to change, got %s", changed)
+	}
+	if got := x.raw.RGBAAt(2, 2); got.R != 1 || got.G != 2 || got.B != 3 || got.A != 255 {
+		t.Fatalf("Unexpected pixel %v", got)
+	}
+	if changed := x.copyPixels(r, data); !changed.Empty() {
+		t.Fatalf("Expected no change when copying the same pixels, got %s", changed)
+	}
+	data[4*3] = 9
+	if changed := x.copyPixels(r, data); changed != image.Rect(2, 2, 3, 3) {
+		t.Fatalf("Expected only the last pixel to change, got %s", changed)
+	}
+}
+
+func TestX11FramesAreNew(t *testing.T) {
+	bounds := image.Rect(0, 0, 8, 8)
+	x := &X11{raw: image.NewRGBA(bounds)}
+	cursorImg := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	draw.Draw(cursorImg, cursorImg.Bounds(), image.White, image.Point{}, draw.Src)
+
+	var frames []*image.RGBA
+	var contents [][]byte
+	for i := 0; i < trackedFrames*3; i++ {
+		// One pixel of the screen changes, and every third frame the cursor moves
+		px := image.Rect(i%8, i/8, i%8+1, i/8+1)
+		x.raw.Pix[x.raw.PixOffset(px.Min.X, px.Min.Y)] = uint8(i + 1)
+		damage := px
+		if i%3 == 0 {
+			cursor := &x11Cursor{pos: image.Pt(i%6, 4), img: cursorImg}
+			damage = damage.Union(cursor.bounds())
+			if x.cursor != nil {
+				damage = damage.Union(x.cursor.bounds())
+			}
+			x.cursor = cursor
+		}
+		frame := x.nextFrame(damage)
+		x.frame = frame
+
+		want := image.NewRGBA(bounds)
+		copy(want.Pix, x.raw.Pix)
+		draw.Draw(want, x.cursor.bounds(), cursorImg, image.Point{}, draw.Over)
+		if !bytes.Equal(frame.Pix, want.Pix) {
+			t.Fatalf("Frame %d does not match the screen", i)
+		}
+		if i > 0 {
+			if got, ok := x.DamageSince(frames[i-1], frame); !ok || got != damage {
+				t.Fatalf("Expected damage %s for frame %d, got %s, %v", damage, i, got, ok)
+			}
+		}
+		if i >= trackedFrames {
+			if _, ok := x.DamageSince(frames[i-trackedFrames], frame); ok {
+				t.Fatal("Expected a frame pushed out of the ring to be untracked")
+			}
+			if got, ok := x.DamageSince(frames[i-trackedFrames+1], frame); !ok || got.Empty() {
+				t.Fatalf("Expected the oldest tracked frame to have damage, got %s, %v", got, ok)
+			}
+		}
+		for j, prev := range frames {
+			if &prev.Pix[0] == &frame.Pix[0] {
+				t.Fatalf("Expected frame %d not to share the pixels of frame %d", i, j)
+			}
+		}
+		frames = append(frames, frame)
+		contents = append(contents, append([]byte(nil), frame.Pix...))
+	}
+	// Frames handed out are never written to
+	for i, frame := range frames {
+		if !bytes.Equal(frame.Pix, contents[i]) {
+			t.Fatalf("Frame %d changed after it was returned", i)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+//go:build linux
+// +build linux
+
+package providers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+)
+
+// Scopes of Xvfb sessions.
+const (
+	XvfbScopeDisplay    = "display"
+	XvfbScopeConnection = "connection"
+	XvfbScopeUser       = "user"
+)
+
+func init() {
+	Register(ProviderXvfb, func(opts Options) (Display, error) {
+		x := &Xvfb{}
+		if err := opts.Decode(x); err != nil {
+			return nil, err
+		}
+		switch x.Scope {
+		case XvfbScopeDisplay, XvfbScopeUser:
+		case XvfbScopeConnection:
+			if x.Keep {
+				return nil, errors.New("Sessions can't be kept with the connection scope, nothing could resume them")
+			}
+		default:
+			return nil, fmt.Errorf("Unknown scope %q, must be one of display, connection or user", x.Scope)
+		}
+		if x.Depth != 24 && x.Depth != 32 {
+			return nil, fmt.Errorf("Unsupported depth %d, only 24 and 32 bit screens can be captured", x.Depth)
+		}
+		if x.FPS <= 0 {
+			return nil, fmt.Errorf("Frame rate must be positive: %v", x.FPS)
+		}
+		if _, err := exec.LookPath(x.Binary); err != nil {
+			return nil, fmt.Errorf("Could not find Xvfb: %s", err.Error())
+		}
+		var err error
+		x.width, x.height, err = parseSize(x.Resolution)
+		return x, err
+	}, OptionSpec{
+		Name:        "size",
+		Description: "The size of the virtual screen, as WIDTHxHEIGHT. Defaults to the server resolution, or 1024x768.",
+	}, OptionSpec{
+		Name:        "depth",
+		Description: "The color depth of the virtual screen, 24 or 32.",
+		Default:     "24",
+	}, OptionSpec{
+		Name:        "session",
+		Description: "A command to run on the virtual display once it is up, such as a window manager or xterm. It is run with sh -c.",
+	}, OptionSpec{
+		Name:        "scope",
+		Description: "Who shares a virtual display. One of display (all clients), connection (each client gets its own) or user (clients authenticated as the same user, others get their own).",
+		Default:     XvfbScopeDisplay,
+	}, OptionSpec{
+		Name:        "keep",
+		Description: "Keep virtual displays running after their last client disconnects, for the next one to resume.",
+		Default:     "false",
+	}, OptionSpec{
+		Name:        "xvfb",
+		Description: "The Xvfb binary to run.",
+		Default:     "Xvfb",
+	}, OptionSpec{
+		Name:        "args",
+		Description: "Extra arguments for Xvfb, separated by spaces.",
+	}, OptionSpec{
+		Name:        "fps",
+		Description: "The maximum number of frames captured per second.",
+		Default:     "30",
+	})
+}
+
+// xvfbStartTimeout is how long Xvfb has to start accepting connections.
+const xvfbStartTimeout = time.Second * 10
+
+// xvfbStopTimeout is how long Xvfb has to exit before it is killed.
+const xvfbStopTimeout = time.Second * 5
+
+// Running Xvfb sessions by key. Sessions are shared by providers with the same key.
+var (
+	xvfbSessions = make(map[string]*xvfbSession)
+	xvfbMux      sync.Mutex
+)
+
+// Xvfb implements a display provider that starts its own virtual X server, much like
+// Xvnc. Frames are captured and input is injected with the X11 provider.
+//
+// With the display scope the server is started with the first client and shared by all
+// of them. Otherwise each connection gets its own provider, and with the user scope
+// connections authenticated as the same user share a server, while those without a
+// username get their own. Unless they are kept, servers are stopped when their last client
+// disconnects.
+type Xvfb struct {
+	Resolution string  `option:"size"`
+	Depth      int     `option:"depth"`
+	Session    string  `option:"session"`
+	Scope      string  `option:"scope"`
+	Keep       bool    `option:"keep"`
+	Binary     string  `option:"xvfb"`
+	Args       string  `option:"args"`
+	FPS        float64 `option:"fps"`
+
+	width, height int
+	user          string
+	session       *xvfbSession
+	x11           *X11
+	mux           sync.Mutex // Guards x11, which input may be sent to at any time
+}
+
+// xvfbSession is a running Xvfb and the session command started on it.
+type xvfbSession struct {
+	key     string
+	display string
+	xvfb    *exec.Cmd
+	command *exec.Cmd // Nil without a session command
+	exited  chan struct{}
+	stderr  *tailWriter
+	refs    int
+}
+
+// Size implements Sizer. Without a size option this is the default geometry of vncserver,
+// since there is no screen to take the size of.
+func (x *Xvfb) Size() (width, height int) {
+	if x.width == 0 || x.height == 0 {
+		return 1024, 768
+	}
+	return x.width, x.height
+}
+
+// Isolated implements Isolated. Only the display scope shares a provider.
+func (x *Xvfb) Isolated() bool { return x.Scope != XvfbScopeDisplay }
+
+// SetUser implements UserDisplay.
+func (x *Xvfb) SetUser(name string) { x.user = name }
+
+// Start starts a virtual X server, or joins one that is already running, and starts
+// capturing it. The size option takes precedence over the given dimensions.
+func (x *Xvfb) Start(width, height int) error {
+	if x.width == 0 || x.height == 0 {
+		x.width, x.height = width, height
+	}
+	session, err := x.acquire()
+	if err != nil {
+		return err
+	}
+	x11 := &X11{
+		DisplayName: session.display,
+		FPS:         x.FPS,
+		UseShm:      true,
+		UseDamage:   true,
+		DrawCursor:  true,
+	}
+	if err := x11.Start(x.width, x.height); err != nil {
+		x.release(session)
+		return err
+	}
+	x.mux.Lock()
+	x.session, x.x11 = session, x11
+	x.mux.Unlock()
+	return nil
+}
+
+// PullFrame returns the next frame of the virtual display, or nil when it isn't running.
+func (x *Xvfb) PullFrame() *image.RGBA {
+	x.mux.Lock()
+	x11 := x.x11
+	x.mux.Unlock()
+	if x11 == nil {
+		return nil
+	}
+	return x11.PullFrame()
+}
+
+// KeyEvent implements InputHandler.
+func (x *Xvfb) KeyEvent(keysym uint32, down bool) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	if x.x11 != nil {
+		x.x11.KeyEvent(keysym, down)
+	}
+}
+
+// PointerEvent implements InputHandler.
+func (x *Xvfb) PointerEvent(px, py int, buttonMask uint8) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	if x.x11 != nil {
+		x.x11.PointerEvent(px, py, buttonMask)
+	}
+}
+
+// Close stops capturing, and stops the virtual X server if this was its last client and
+// it isn't kept.
+func (x *Xvfb) Close() error {
+	x.mux.Lock()
+	x11, session := x.x11, x.session
+	x.x11, x.session = nil, nil
+	x.mux.Unlock()
+	if x11 == nil {
+		return nil
+	}
+	err := x11.Close()
+	x.release(session)
+	return err
+}
+
+// key returns the key of the session this provider uses.
+func (x *Xvfb) key() string {
+	if x.Scope != XvfbScopeUser || x.user == "" {
+		// Each provider has its own session. With the display scope the same provider is
+		// started again after the last client left, which finds a kept session. Clients
+		// that didn't authenticate with a username get one to themselves too, rather
+		// than all sharing the session of the empty user.
+		return fmt.Sprintf("%p", x)
+	}
+	// Users only share sessions started with the same options
+	return fmt.Sprintf("user=%s size=%dx%dx%d session=%s args=%s", x.user, x.width, x.height, x.Depth, x.Session, x.Args)
+}
+
+// keep returns whether sessions are kept running for the next client. Sessions of
+// clients without a username aren't, nothing could resume them.
+func (x *Xvfb) keep() bool {
+	return x.Keep && (x.Scope != XvfbScopeUser || x.user != "")
+}
+
+// acquire returns a running session for the provider, starting one if needed.
+func (x *Xvfb) acquire() (*xvfbSession, error) {
+	key := x.key()
+	xvfbMux.Lock()
+	defer xvfbMux.Unlock()
+	if s, ok := xvfbSessions[key]; ok && s.running() {
+		log.Infof("Resuming Xvfb session on %s", s.display)
+		s.refs++
+		return s, nil
+	}
+	s, err := x.launch()
+	if err != nil {
+		return nil, err
+	}
+	s.key = key
+	s.refs = 1
+	xvfbSessions[key] = s
+	return s, nil
+}
+
+// release drops a reference to the session, stopping it once there are none left unless
+// it is kept.
+func (x *Xvfb) release(s *xvfbSession) {
+	xvfbMux.Lock()
+	s.refs--
+	if s.refs > 0 || (x.keep() && s.running()) {
+		xvfbMux.Unlock()
+		return
+	}
+	if xvfbSessions[s.key] == s {
+		delete(xvfbSessions, s.key)
+	}
+	xvfbMux.Unlock()
+	s.stop()
+}
+
+// launch starts Xvfb and the session command, returning once Xvfb accepts connections.
+func (x *Xvfb) launch() (*xvfbSession, error) {
+	// Xvfb picks a free display and writes its number to the pipe once it is ready
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	args := []string{
+		"-displayfd", "3",
+		"-screen", "0", fmt.Sprintf("%dx%dx%d", x.width, x.height, x.Depth),
+		"-nolisten", "tcp",
+	}
+	args = append(args, strings.Fields(x.Args)...)
+	s := &xvfbSession{
+		xvfb:   exec.Command(x.Binary, args...),
+		exited: make(chan struct{}),
+		stderr: &tailWriter{max: 4096},
+	}
+	s.xvfb.ExtraFiles = []*os.File{w}
+	s.xvfb.Stderr = s.stderr
+	// Don't leave X servers behind if gsvnc dies
+	s.xvfb.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+	log.Debug("Starting Xvfb: ", strings.Join(s.xvfb.Args, " "))
+	err = s.xvfb.Start()
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		s.xvfb.Wait()
+		close(s.exited)
+	}()
+
+	display, err := s.waitReady(r)
+	if err != nil {
+		s.stop()
+		return nil, err
+	}
+	s.display = display
+	log.Infof("Started Xvfb on %s (%dx%dx%d)", s.display, x.width, x.height, x.Depth)
+
+	if x.Session != "" {
+		s.command = exec.Command("/bin/sh", "-c", x.Session)
+		s.command.Env = append(os.Environ(), "DISPLAY="+s.display)
+		// The session gets its own process group so everything it starts can be stopped
+		s.command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGTERM}
+		if err := s.command.Start(); err != nil {
+			s.stop()
+			return nil, fmt.Errorf("Could not start session command: %s", err.Error())
+		}
+		go func(cmd *exec.Cmd, display string) {
+			err := cmd.Wait()
+			if err != nil {
+				log.Infof("Session command on %s exited: %s", display, err.Error())
+				return
+			}
+			log.Infof("Session command on %s exited", display)
+		}(s.command, s.display)
+	}
+	return s, nil
+}
+
+// waitReady waits for Xvfb to write its display number to r.
+func (s *xvfbSession) waitReady(r *os.File) (string, error) {
+	lineCh := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(r).ReadString('\n')
+		lineCh <- strings.TrimSpace(line)
+	}()
+	select {
+	case line := <-lineCh:
+		if line != "" {
+			return ":" + line, nil
+		}
+		// The pipe was closed without a number, Xvfb is exiting
+		<-s.exited
+	case <-s.exited:
+	case <-time.After(xvfbStartTimeout):
+		return "", errors.New("Timed out waiting for Xvfb to start")
+	}
+	return "", fmt.Errorf("Xvfb exited: %s", strings.TrimSpace(s.stderr.String()))
+}
+
+func (s *xvfbSession) running() bool {
+	select {
+	case <-s.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// stop stops the session command and Xvfb.
+func (s *xvfbSession) stop() {
+	if s.command != nil && s.command.Process != nil {
+		syscall.Kill(-s.command.Process.Pid, syscall.SIGTERM)
+	}
+	s.xvfb.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-s.exited:
+	case <-time.After(xvfbStopTimeout):
+		log.Warning("Xvfb did not exit, killing it")
+		s.xvfb.Process.Kill()
+		<-s.exited
+	}
+	if s.display != "" {
+		log.Infof("Stopped Xvfb on %s", s.display)
+	}
+}
+
+// tailWriter keeps the last max bytes written to it.
+type tailWriter struct {
+	max int
+	buf []byte
+	mux sync.Mutex
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailWriter) String() string {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return string(t.buf)
+}
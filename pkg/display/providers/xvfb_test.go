@@ -0,0 +1,111 @@
+//go:build linux
+// +build linux
+
+package providers
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// fakeXvfb writes a script that reports its pid as the display number, like Xvfb does
+// with -displayfd, and then waits to be stopped.
+func fakeXvfb(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "Xvfb")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\necho $$ >&3\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestXvfb(binary, scope, user string, keep bool) *Xvfb {
+	x := &Xvfb{Binary: binary, Scope: scope, Keep: keep, Depth: 24, width: 64, height: 48}
+	x.SetUser(user)
+	return x
+}
+
+func TestXvfbUserScope(t *testing.T) {
+	binary := fakeXvfb(t)
+	acquire := func(x *Xvfb) *xvfbSession {
+		t.Helper()
+		s, err := x.acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	alice, alice2 := newTestXvfb(binary, XvfbScopeUser, "alice", false), newTestXvfb(binary, XvfbScopeUser, "alice", false)
+	a, a2 := acquire(alice), acquire(alice2)
+	if a != a2 {
+		t.Fatal("Connections of the same user did not share a session")
+	}
+	bob := newTestXvfb(binary, XvfbScopeUser, "bob", false)
+	b := acquire(bob)
+	if b == a {
+		t.Fatal("Different users shared a session")
+	}
+	anon, anon2 := newTestXvfb(binary, XvfbScopeUser, "", true), newTestXvfb(binary, XvfbScopeUser, "", true)
+	n, n2 := acquire(anon), acquire(anon2)
+	if n == n2 || n == a {
+		t.Fatal("Connections without a username shared a session")
+	}
+
+	alice.release(a)
+	if !a.running() {
+		t.Fatal("Session stopped while a connection still uses it")
+	}
+	alice2.release(a2)
+	bob.release(b)
+	// Sessions without a username are never kept, nothing could resume them
+	anon.release(n)
+	anon2.release(n2)
+	for _, s := range []*xvfbSession{a, b, n, n2} {
+		if s.running() {
+			t.Fatalf("Session on %s still running after its last connection left", s.display)
+		}
+	}
+	xvfbMux.Lock()
+	defer xvfbMux.Unlock()
+	if len(xvfbSessions) != 0 {
+		t.Fatalf("Expected no sessions left, got %d", len(xvfbSessions))
+	}
+}
+
+func TestXvfbKeep(t *testing.T) {
+	x := newTestXvfb(fakeXvfb(t), XvfbScopeUser, "alice", true)
+	s, err := x.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.release(s)
+	if !s.running() {
+		t.Fatal("Kept session was stopped")
+	}
+	resumed, err := newTestXvfb(x.Binary, XvfbScopeUser, "alice", true).acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed != s {
+		t.Fatal("Kept session was not resumed")
+	}
+	xvfbMux.Lock()
+	delete(xvfbSessions, s.key)
+	xvfbMux.Unlock()
+	s.stop()
+}
+
+func TestXvfbNotStarted(t *testing.T) {
+	x := newTestXvfb("Xvfb", XvfbScopeDisplay, "", false)
+	if frame := x.PullFrame(); frame != nil {
+		t.Fatal("Expected no frame before starting")
+	}
+	// Input and closing before starting are no-ops
+	x.KeyEvent(0xff0d, true)
+	x.PointerEvent(1, 1, 1)
+	if err := x.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,6 +6,10 @@ import (
 )
 
 func (d *Display) servePointerEvent(ev *types.PointerEvent) {
+	if d.inputHandler != nil {
+		d.inputHandler.PointerEvent(int(ev.X), int(ev.Y), ev.ButtonMask)
+		return
+	}
 	btns := make(map[string]bool)
 	for mask, maskType := range btnMasks {
 		btns[maskType] = nthBitOf(ev.ButtonMask, mask) == 1
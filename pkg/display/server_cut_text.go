@@ -0,0 +1,43 @@
+package display
+
+import (
+	"bytes"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/util"
+)
+
+// Server -> Client
+const cmdServerCutText = 3
+
+func (d *Display) pushCutText(data *ClipboardData) {
+	if data = d.filterClipboard(ClipboardServerToClient, data); data == nil {
+		return
+	}
+
+	if d.ExtendedClipboardEnabled() && d.pushExtendedClipboard(data) {
+		return
+	}
+
+	latin1 := toLatin1(data.Text)
+
+	buf := new(bytes.Buffer)
+	util.Write(buf, uint8(cmdServerCutText))
+	util.Write(buf, [3]uint8{}) // padding
+	util.Write(buf, uint32(len(latin1)))
+	util.Write(buf, latin1)
+
+	d.buf.Dispatch(buf.Bytes())
+}
+
+// toLatin1 converts the given string to ISO 8859-1 as required by the legacy
+// cut text messages. Characters outside of the range are replaced with '?'.
+func toLatin1(in string) []byte {
+	out := make([]byte, 0, len(in))
+	for _, r := range in {
+		if r > 0xff {
+			r = '?'
+		}
+		out = append(out, byte(r))
+	}
+	return out
+}
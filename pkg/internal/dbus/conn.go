@@ -0,0 +1,549 @@
+//go:build !windows
+// +build !windows
+
+// Package dbus implements a minimal D-Bus client. It supports unix socket transports with
+// EXTERNAL authentication, method calls, signals and file descriptor passing, which is
+// what the display providers need to talk to desktop services.
+//
+// Values are represented by the following Go types: byte (y), bool (b), int16 (n),
+// uint16 (q), int32 (i), uint32 (u), int64 (x), uint64 (t), float64 (d), string (s),
+// ObjectPath (o), Signature (g), UnixFD (h), Variant (v), []interface{} for structs,
+// []byte for byte arrays, maps for dicts and slices for other arrays.
+package dbus
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Well known names of the message bus itself.
+const (
+	BusName      = "org.freedesktop.DBus"
+	BusPath      = ObjectPath("/org/freedesktop/DBus")
+	BusInterface = "org.freedesktop.DBus"
+)
+
+// ErrClosed is returned for calls on a closed connection.
+var ErrClosed = errors.New("D-Bus connection is closed")
+
+// A Handler serves method calls made to the connection. It returns the signature and
+// values of the reply. Returning an *Error replies with that error name.
+type Handler func(call *Message) (Signature, []interface{}, error)
+
+// Conn is a connection to a message bus.
+type Conn struct {
+	conn       *net.UnixConn
+	uniqueName string
+
+	writeMux sync.Mutex
+	serial   uint32
+
+	mux     sync.Mutex
+	calls   map[uint32]chan *Message
+	subs    map[*Subscription]struct{}
+	handler Handler
+	err     error // Set when the connection is closed
+	done    chan struct{}
+}
+
+// SessionBus connects to the session bus of the user.
+func SessionBus() (*Conn, error) {
+	addr := os.Getenv("DBUS_SESSION_BUS_ADDRESS")
+	if addr == "" {
+		// The default for systemd user sessions
+		addr = fmt.Sprintf("unix:path=/run/user/%d/bus", os.Getuid())
+	}
+	return Dial(addr)
+}
+
+// Dial connects to the bus at the given address, as in DBUS_SESSION_BUS_ADDRESS, and
+// registers with it. Only unix socket addresses are supported.
+func Dial(address string) (*Conn, error) {
+	var errs []string
+	for _, addr := range strings.Split(address, ";") {
+		if addr == "" {
+			continue
+		}
+		path, err := parseAddress(addr)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		c, err := newConn(conn)
+		if err != nil {
+			conn.Close()
+			errs = append(errs, err.Error())
+			continue
+		}
+		return c, nil
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("No D-Bus address in %q", address)
+	}
+	return nil, fmt.Errorf("Could not connect to D-Bus at %q: %s", address, strings.Join(errs, "; "))
+}
+
+// parseAddress returns the socket path of a unix transport address. Abstract sockets
+// are returned with a leading @.
+func parseAddress(addr string) (string, error) {
+	spl := strings.SplitN(addr, ":", 2)
+	if len(spl) != 2 || spl[0] != "unix" {
+		return "", fmt.Errorf("Unsupported D-Bus address: %s", addr)
+	}
+	for _, kv := range strings.Split(spl[1], ",") {
+		kspl := strings.SplitN(kv, "=", 2)
+		if len(kspl) != 2 {
+			continue
+		}
+		value, err := url.PathUnescape(kspl[1])
+		if err != nil {
+			return "", fmt.Errorf("Invalid D-Bus address %s: %s", addr, err.Error())
+		}
+		switch kspl[0] {
+		case "path":
+			return value, nil
+		case "abstract":
+			return "@" + value, nil
+		}
+	}
+	return "", fmt.Errorf("D-Bus address has no path: %s", addr)
+}
+
+func newConn(conn *net.UnixConn) (*Conn, error) {
+	if err := authenticate(conn); err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		conn:  conn,
+		calls: make(map[uint32]chan *Message),
+		subs:  make(map[*Subscription]struct{}),
+		done:  make(chan struct{}),
+	}
+	go c.readLoop()
+	reply, err := c.Call(BusName, BusPath, BusInterface, "Hello", "")
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if len(reply) != 1 {
+		c.Close()
+		return nil, errors.New("Invalid reply to Hello")
+	}
+	c.uniqueName, _ = reply[0].(string)
+	return c, nil
+}
+
+// authenticate runs the EXTERNAL authentication handshake, negotiating file descriptor
+// passing.
+func authenticate(conn *net.UnixConn) error {
+	uid := strconv.Itoa(os.Getuid())
+	if _, err := fmt.Fprintf(conn, "\x00AUTH EXTERNAL %x\r\n", uid); err != nil {
+		return err
+	}
+	line, err := readLine(conn)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("D-Bus authentication failed: %s", line)
+	}
+	if _, err := io.WriteString(conn, "NEGOTIATE_UNIX_FD\r\n"); err != nil {
+		return err
+	}
+	if line, err = readLine(conn); err != nil {
+		return err
+	}
+	if line != "AGREE_UNIX_FD" {
+		return fmt.Errorf("D-Bus bus does not support file descriptor passing: %s", line)
+	}
+	_, err = io.WriteString(conn, "BEGIN\r\n")
+	return err
+}
+
+// readLine reads an authentication line a byte at a time, so nothing after it is
+// consumed.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) > 4096 {
+			return "", errors.New("D-Bus authentication line is too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		line = append(line, b[0])
+	}
+	return string(line[:len(line)-2]), nil
+}
+
+// UniqueName returns the name the bus assigned to the connection.
+func (c *Conn) UniqueName() string { return c.uniqueName }
+
+// Close closes the connection. Pending calls return ErrClosed.
+func (c *Conn) Close() error {
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+// Done returns a channel that is closed when the connection is closed.
+func (c *Conn) Done() <-chan struct{} { return c.done }
+
+// Call calls a method and waits for the reply, returning its values. Errors returned by
+// the callee are of type *Error.
+func (c *Conn) Call(dest string, path ObjectPath, iface, method string, sig Signature, args ...interface{}) ([]interface{}, error) {
+	ch := make(chan *Message, 1)
+	msg := &Message{
+		Type:        TypeMethodCall,
+		Path:        path,
+		Interface:   iface,
+		Member:      method,
+		Destination: dest,
+		Signature:   sig,
+		Body:        args,
+	}
+	if err := c.send(msg, ch); err != nil {
+		return nil, err
+	}
+	reply, ok := <-ch
+	if !ok {
+		return nil, c.closeErr()
+	}
+	if reply.Type == TypeError {
+		return nil, reply.toError()
+	}
+	return reply.Body, nil
+}
+
+// CallNoReply calls a method without waiting for, or asking for, a reply.
+func (c *Conn) CallNoReply(dest string, path ObjectPath, iface, method string, sig Signature, args ...interface{}) error {
+	return c.send(&Message{
+		Type:        TypeMethodCall,
+		Flags:       FlagNoReplyExpected,
+		Path:        path,
+		Interface:   iface,
+		Member:      method,
+		Destination: dest,
+		Signature:   sig,
+		Body:        args,
+	}, nil)
+}
+
+// Emit sends a signal.
+func (c *Conn) Emit(path ObjectPath, iface, member string, sig Signature, args ...interface{}) error {
+	return c.send(&Message{
+		Type:      TypeSignal,
+		Path:      path,
+		Interface: iface,
+		Member:    member,
+		Signature: sig,
+		Body:      args,
+	}, nil)
+}
+
+// RequestName asks the bus for a well known name, failing if it is taken.
+func (c *Conn) RequestName(name string) error {
+	// Flag 0x4 is DBUS_NAME_FLAG_DO_NOT_QUEUE
+	reply, err := c.Call(BusName, BusPath, BusInterface, "RequestName", "su", name, uint32(0x4))
+	if err != nil {
+		return err
+	}
+	// Reply 1 is DBUS_REQUEST_NAME_REPLY_PRIMARY_OWNER
+	if len(reply) != 1 || reply[0] != uint32(1) {
+		return fmt.Errorf("D-Bus name %s is already taken", name)
+	}
+	return nil
+}
+
+// HandleCalls sets the handler for method calls made to the connection. Calls are
+// answered with an UnknownMethod error when there is none.
+func (c *Conn) HandleCalls(h Handler) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.handler = h
+}
+
+// MatchRule selects the signals delivered to a subscription. Empty fields match
+// anything.
+type MatchRule struct {
+	Sender    string
+	Path      ObjectPath
+	Interface string
+	Member    string
+}
+
+func (r MatchRule) String() string {
+	rule := []string{"type='signal'"}
+	add := func(key, value string) {
+		if value != "" {
+			rule = append(rule, fmt.Sprintf("%s='%s'", key, strings.ReplaceAll(value, "'", `'\''`)))
+		}
+	}
+	add("sender", r.Sender)
+	add("path", string(r.Path))
+	add("interface", r.Interface)
+	add("member", r.Member)
+	return strings.Join(rule, ",")
+}
+
+// matches checks everything but the sender, which may be a well known name while
+// signals carry the unique name of the owner.
+func (r MatchRule) matches(m *Message) bool {
+	return m.Type == TypeSignal &&
+		(r.Path == "" || r.Path == m.Path) &&
+		(r.Interface == "" || r.Interface == m.Interface) &&
+		(r.Member == "" || r.Member == m.Member)
+}
+
+// Subscription receives the signals matching a rule.
+type Subscription struct {
+	c    *Conn
+	rule MatchRule
+	ch   chan *Message
+}
+
+// Subscribe asks the bus for signals matching the rule and delivers them to the returned
+// subscription. Signals are dropped when the subscriber falls too far behind.
+func (c *Conn) Subscribe(rule MatchRule) (*Subscription, error) {
+	if _, err := c.Call(BusName, BusPath, BusInterface, "AddMatch", "s", rule.String()); err != nil {
+		return nil, err
+	}
+	sub := &Subscription{c: c, rule: rule, ch: make(chan *Message, 16)}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.subs[sub] = struct{}{}
+	return sub, nil
+}
+
+// C returns the channel signals are delivered on. It is closed with the subscription
+// or the connection.
+func (s *Subscription) C() <-chan *Message { return s.ch }
+
+// Close stops delivering signals.
+func (s *Subscription) Close() error {
+	s.c.mux.Lock()
+	if _, ok := s.c.subs[s]; !ok {
+		s.c.mux.Unlock()
+		return nil
+	}
+	delete(s.c.subs, s)
+	close(s.ch)
+	s.c.mux.Unlock()
+	return s.c.CallNoReply(BusName, BusPath, BusInterface, "RemoveMatch", "s", s.rule.String())
+}
+
+// send writes a message, registering reply to receive the reply of a method call.
+func (c *Conn) send(msg *Message, reply chan *Message) error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	c.serial++
+	if c.serial == 0 {
+		c.serial++
+	}
+	msg.Serial = c.serial
+	data, fds, err := msg.marshal()
+	if err != nil {
+		return err
+	}
+	if reply != nil {
+		c.mux.Lock()
+		if c.err != nil {
+			c.mux.Unlock()
+			return c.err
+		}
+		c.calls[msg.Serial] = reply
+		c.mux.Unlock()
+	}
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	if _, _, err := c.conn.WriteMsgUnix(data, oob, nil); err != nil {
+		if reply != nil {
+			c.mux.Lock()
+			delete(c.calls, msg.Serial)
+			c.mux.Unlock()
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *Conn) closeErr() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.err
+}
+
+func (c *Conn) readLoop() {
+	r := &msgReader{conn: c.conn}
+	var err error
+	for {
+		var msg *Message
+		if msg, err = r.next(); err != nil {
+			break
+		}
+		c.dispatch(msg)
+	}
+
+	c.mux.Lock()
+	c.err = ErrClosed
+	for serial, ch := range c.calls {
+		close(ch)
+		delete(c.calls, serial)
+	}
+	for sub := range c.subs {
+		close(sub.ch)
+		delete(c.subs, sub)
+	}
+	c.mux.Unlock()
+	r.closeFDs()
+	c.conn.Close()
+	close(c.done)
+}
+
+func (c *Conn) dispatch(msg *Message) {
+	switch msg.Type {
+	case TypeMethodReturn, TypeError:
+		c.mux.Lock()
+		ch, ok := c.calls[msg.ReplySerial]
+		delete(c.calls, msg.ReplySerial)
+		c.mux.Unlock()
+		if ok {
+			ch <- msg
+		}
+	case TypeSignal:
+		c.mux.Lock()
+		for sub := range c.subs {
+			if !sub.rule.matches(msg) {
+				continue
+			}
+			select {
+			case sub.ch <- msg:
+			default:
+			}
+		}
+		c.mux.Unlock()
+	case TypeMethodCall:
+		c.mux.Lock()
+		h := c.handler
+		c.mux.Unlock()
+		go c.serve(h, msg)
+	}
+}
+
+func (c *Conn) serve(h Handler, call *Message) {
+	var sig Signature
+	var body []interface{}
+	var err error
+	if h == nil {
+		err = &Error{
+			Name:    "org.freedesktop.DBus.Error.UnknownMethod",
+			Message: fmt.Sprintf("No such method %s.%s", call.Interface, call.Member),
+		}
+	} else {
+		sig, body, err = h(call)
+	}
+	if call.Flags&FlagNoReplyExpected != 0 {
+		return
+	}
+	reply := &Message{
+		Type:        TypeMethodReturn,
+		ReplySerial: call.Serial,
+		Destination: call.Sender,
+		Signature:   sig,
+		Body:        body,
+	}
+	if err != nil {
+		dbusErr, ok := err.(*Error)
+		if !ok {
+			dbusErr = &Error{Name: "org.freedesktop.DBus.Error.Failed", Message: err.Error()}
+		}
+		reply.Type = TypeError
+		reply.ErrorName = dbusErr.Name
+		reply.Signature = "s"
+		reply.Body = []interface{}{dbusErr.Message}
+	}
+	c.send(reply, nil)
+}
+
+// msgReader reads messages from the socket, collecting the file descriptors that arrive
+// with them.
+type msgReader struct {
+	conn    *net.UnixConn
+	pending []int
+}
+
+func (r *msgReader) next() (*Message, error) {
+	head := make([]byte, 16)
+	if err := r.readFull(head); err != nil {
+		return nil, err
+	}
+	n, err := messageLength(head)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	copy(data, head)
+	if err := r.readFull(data[16:]); err != nil {
+		return nil, err
+	}
+	return unmarshalMessage(data, &r.pending)
+}
+
+func (r *msgReader) readFull(p []byte) error {
+	oob := make([]byte, syscall.CmsgSpace(16*4))
+	for len(p) > 0 {
+		n, oobn, _, _, err := r.conn.ReadMsgUnix(p, oob)
+		if oobn > 0 {
+			r.parseRights(oob[:oobn])
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.EOF
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+func (r *msgReader) parseRights(oob []byte) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		fds, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			continue
+		}
+		r.pending = append(r.pending, fds...)
+	}
+}
+
+func (r *msgReader) closeFDs() {
+	for _, fd := range r.pending {
+		syscall.Close(fd)
+	}
+	r.pending = nil
+}
@@ -0,0 +1,556 @@
+package dbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// ObjectPath is a D-Bus object path.
+type ObjectPath string
+
+// Signature is a D-Bus type signature.
+type Signature string
+
+// UnixFD is a file descriptor passed over the bus. Received descriptors are owned by the
+// receiver, who should close them.
+type UnixFD int
+
+// Variant is a value along with its signature.
+type Variant struct {
+	Sig   Signature
+	Value interface{}
+}
+
+// MakeVariant wraps a value in a variant, inferring its signature from the Go type. It
+// supports the basic types, variants, and maps of strings to variants.
+func MakeVariant(v interface{}) Variant {
+	return Variant{Sig: signatureOf(v), Value: v}
+}
+
+func signatureOf(v interface{}) Signature {
+	switch v := v.(type) {
+	case byte:
+		return "y"
+	case bool:
+		return "b"
+	case int16:
+		return "n"
+	case uint16:
+		return "q"
+	case int32:
+		return "i"
+	case uint32:
+		return "u"
+	case int64:
+		return "x"
+	case uint64:
+		return "t"
+	case float64:
+		return "d"
+	case string:
+		return "s"
+	case ObjectPath:
+		return "o"
+	case Signature:
+		return "g"
+	case UnixFD:
+		return "h"
+	case Variant:
+		return "v"
+	case []byte:
+		return "ay"
+	case []string:
+		return "as"
+	case map[string]Variant:
+		return "a{sv}"
+	default:
+		panic(fmt.Sprintf("dbus: can't infer the signature of %T", v))
+	}
+}
+
+// splitType returns the first complete type of the signature and the rest of it.
+func splitType(sig string) (string, string, error) {
+	if sig == "" {
+		return "", "", errors.New("Empty signature")
+	}
+	switch sig[0] {
+	case 'y', 'b', 'n', 'q', 'i', 'u', 'x', 't', 'd', 's', 'o', 'g', 'h', 'v':
+		return sig[:1], sig[1:], nil
+	case 'a':
+		elem, rest, err := splitType(sig[1:])
+		if err != nil {
+			return "", "", err
+		}
+		return "a" + elem, rest, nil
+	case '(', '{':
+		closer := byte(')')
+		if sig[0] == '{' {
+			closer = '}'
+		}
+		rest := sig[1:]
+		for len(rest) > 0 && rest[0] != closer {
+			var err error
+			if _, rest, err = splitType(rest); err != nil {
+				return "", "", err
+			}
+		}
+		if rest == "" {
+			return "", "", fmt.Errorf("Unterminated signature: %s", sig)
+		}
+		return sig[:len(sig)-len(rest)+1], rest[1:], nil
+	}
+	return "", "", fmt.Errorf("Invalid signature: %s", sig)
+}
+
+// splitTypes returns each of the complete types in the signature.
+func splitTypes(sig string) ([]string, error) {
+	var types []string
+	for sig != "" {
+		var typ string
+		var err error
+		if typ, sig, err = splitType(sig); err != nil {
+			return nil, err
+		}
+		types = append(types, typ)
+	}
+	return types, nil
+}
+
+// alignment returns the alignment of the first type in the signature.
+func alignment(sig string) int {
+	switch sig[0] {
+	case 'n', 'q':
+		return 2
+	case 'b', 'i', 'u', 's', 'o', 'a', 'h':
+		return 4
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	}
+	return 1
+}
+
+// encoder writes values in little endian wire format. Offsets are relative to the start
+// of the message, which is how padding is computed.
+type encoder struct {
+	buf []byte
+	fds []int
+}
+
+func (e *encoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.align(4)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) uint64(v uint64) {
+	e.align(8)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) encode(sig string, args []interface{}) error {
+	types, err := splitTypes(sig)
+	if err != nil {
+		return err
+	}
+	if len(types) != len(args) {
+		return fmt.Errorf("Signature %s needs %d values, got %d", sig, len(types), len(args))
+	}
+	for i, typ := range types {
+		if err := e.value(typ, reflect.ValueOf(args[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) value(sig string, v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("Nil value for type %s", sig)
+	}
+	// Unwrap interfaces, as found in []interface{}
+	for v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	mismatch := func() error { return fmt.Errorf("Can't encode %s as type %s", v.Type(), sig) }
+	switch sig[0] {
+	case 'y':
+		if !isUint(v) {
+			return mismatch()
+		}
+		e.buf = append(e.buf, byte(v.Uint()))
+	case 'b':
+		if v.Kind() != reflect.Bool {
+			return mismatch()
+		}
+		var b uint32
+		if v.Bool() {
+			b = 1
+		}
+		e.uint32(b)
+	case 'n', 'q':
+		n, ok := integer(v)
+		if !ok {
+			return mismatch()
+		}
+		e.align(2)
+		var b [2]byte
+		binary.LittleEndian.PutUint16(b[:], uint16(n))
+		e.buf = append(e.buf, b[:]...)
+	case 'i', 'u', 'h':
+		n, ok := integer(v)
+		if !ok {
+			return mismatch()
+		}
+		if sig[0] == 'h' {
+			e.fds = append(e.fds, int(n))
+			n = uint64(len(e.fds) - 1)
+		}
+		e.uint32(uint32(n))
+	case 'x', 't':
+		n, ok := integer(v)
+		if !ok {
+			return mismatch()
+		}
+		e.uint64(n)
+	case 'd':
+		if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+			return mismatch()
+		}
+		e.uint64(math.Float64bits(v.Float()))
+	case 's', 'o':
+		if v.Kind() != reflect.String {
+			return mismatch()
+		}
+		e.uint32(uint32(v.Len()))
+		e.buf = append(e.buf, v.String()...)
+		e.buf = append(e.buf, 0)
+	case 'g':
+		if v.Kind() != reflect.String || v.Len() > 255 {
+			return mismatch()
+		}
+		e.signature(v.String())
+	case 'v':
+		variant, ok := v.Interface().(Variant)
+		if !ok {
+			return mismatch()
+		}
+		if _, rest, err := splitType(string(variant.Sig)); err != nil || rest != "" {
+			return fmt.Errorf("Variant signature must be a single type: %s", variant.Sig)
+		}
+		e.signature(string(variant.Sig))
+		return e.value(string(variant.Sig), reflect.ValueOf(variant.Value))
+	case 'a':
+		return e.array(sig[1:], v)
+	case '(':
+		fields, ok := v.Interface().([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		e.align(8)
+		return e.encode(sig[1:len(sig)-1], fields)
+	default:
+		return fmt.Errorf("Can't encode type %s", sig)
+	}
+	return nil
+}
+
+func (e *encoder) signature(sig string) {
+	e.buf = append(e.buf, byte(len(sig)))
+	e.buf = append(e.buf, sig...)
+	e.buf = append(e.buf, 0)
+}
+
+func (e *encoder) array(elem string, v reflect.Value) error {
+	// The length is patched in once the elements are written, it doesn't include the
+	// padding before the first element.
+	e.uint32(0)
+	lenAt := len(e.buf) - 4
+	e.align(alignment(elem))
+	start := len(e.buf)
+	switch {
+	case elem[0] == '{':
+		if v.Kind() != reflect.Map {
+			return fmt.Errorf("Can't encode %s as type a%s", v.Type(), elem)
+		}
+		types, err := splitTypes(elem[1 : len(elem)-1])
+		if err != nil {
+			return err
+		}
+		if len(types) != 2 {
+			return fmt.Errorf("Invalid dict entry: %s", elem)
+		}
+		// Sort the keys so messages are deterministic
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		for _, key := range keys {
+			e.align(8)
+			if err := e.value(types[0], key); err != nil {
+				return err
+			}
+			if err := e.value(types[1], v.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+	case v.Kind() == reflect.Slice || v.Kind() == reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := e.value(elem, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Can't encode %s as type a%s", v.Type(), elem)
+	}
+	binary.LittleEndian.PutUint32(e.buf[lenAt:], uint32(len(e.buf)-start))
+	return nil
+}
+
+func isUint(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+func integer(v reflect.Value) (uint64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint(), true
+	}
+	return 0, false
+}
+
+// decoder reads values in the wire format of the given byte order. Values are decoded
+// as the Go types listed in the package documentation.
+type decoder struct {
+	order binary.ByteOrder
+	data  []byte
+	pos   int
+	fds   []int
+	depth int
+}
+
+var errShort = errors.New("Message is truncated")
+
+func (d *decoder) align(n int) error {
+	pos := (d.pos + n - 1) / n * n
+	if pos > len(d.data) {
+		return errShort
+	}
+	d.pos = pos
+	return nil
+}
+
+func (d *decoder) read(n int) ([]byte, error) {
+	if d.pos+n > len(d.data) || n < 0 {
+		return nil, errShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	if err := d.align(4); err != nil {
+		return 0, err
+	}
+	b, err := d.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint32(b), nil
+}
+
+func (d *decoder) decode(sig string) ([]interface{}, error) {
+	types, err := splitTypes(sig)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(types))
+	for i, typ := range types {
+		if values[i], err = d.value(typ); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (d *decoder) value(sig string) (interface{}, error) {
+	// The spec limits nesting to 64 levels, which also bounds the recursion here
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > 64 {
+		return nil, errors.New("Message is nested too deeply")
+	}
+	switch sig[0] {
+	case 'y':
+		b, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0], nil
+	case 'b':
+		n, err := d.uint32()
+		return n != 0, err
+	case 'n', 'q':
+		if err := d.align(2); err != nil {
+			return nil, err
+		}
+		b, err := d.read(2)
+		if err != nil {
+			return nil, err
+		}
+		if sig[0] == 'n' {
+			return int16(d.order.Uint16(b)), nil
+		}
+		return d.order.Uint16(b), nil
+	case 'i':
+		n, err := d.uint32()
+		return int32(n), err
+	case 'u':
+		return d.uint32()
+	case 'h':
+		n, err := d.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if int(n) >= len(d.fds) {
+			return nil, fmt.Errorf("Message refers to file descriptor %d, but has %d", n, len(d.fds))
+		}
+		return UnixFD(d.fds[n]), nil
+	case 'x', 't', 'd':
+		if err := d.align(8); err != nil {
+			return nil, err
+		}
+		b, err := d.read(8)
+		if err != nil {
+			return nil, err
+		}
+		n := d.order.Uint64(b)
+		switch sig[0] {
+		case 'x':
+			return int64(n), nil
+		case 'd':
+			return math.Float64frombits(n), nil
+		}
+		return n, nil
+	case 's', 'o':
+		n, err := d.uint32()
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.read(int(n) + 1)
+		if err != nil {
+			return nil, err
+		}
+		if sig[0] == 'o' {
+			return ObjectPath(b[:n]), nil
+		}
+		return string(b[:n]), nil
+	case 'g':
+		return d.signature()
+	case 'v':
+		vsig, err := d.signature()
+		if err != nil {
+			return nil, err
+		}
+		if _, rest, err := splitType(string(vsig)); err != nil || rest != "" {
+			return nil, fmt.Errorf("Invalid variant signature: %s", vsig)
+		}
+		v, err := d.value(string(vsig))
+		return Variant{Sig: vsig, Value: v}, err
+	case 'a':
+		return d.array(sig[1:])
+	case '(':
+		if err := d.align(8); err != nil {
+			return nil, err
+		}
+		return d.decode(sig[1 : len(sig)-1])
+	}
+	return nil, fmt.Errorf("Can't decode type %s", sig)
+}
+
+func (d *decoder) signature() (Signature, error) {
+	n, err := d.read(1)
+	if err != nil {
+		return "", err
+	}
+	b, err := d.read(int(n[0]) + 1)
+	if err != nil {
+		return "", err
+	}
+	return Signature(b[:n[0]]), nil
+}
+
+// array decodes arrays of bytes as []byte, dicts with string keys as
+// map[string]interface{}, other dicts as map[interface{}]interface{}, and everything
+// else as []interface{}.
+func (d *decoder) array(elem string) (interface{}, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.align(alignment(elem)); err != nil {
+		return nil, err
+	}
+	end := d.pos + int(n)
+	if end > len(d.data) || end < d.pos {
+		return nil, errShort
+	}
+	if elem == "y" {
+		b, err := d.read(int(n))
+		return append([]byte(nil), b...), err
+	}
+	if elem[0] == '{' {
+		types, err := splitTypes(elem[1 : len(elem)-1])
+		if err != nil {
+			return nil, err
+		}
+		if len(types) != 2 {
+			return nil, fmt.Errorf("Invalid dict entry: %s", elem)
+		}
+		strMap, anyMap := map[string]interface{}{}, map[interface{}]interface{}{}
+		for d.pos < end {
+			if err := d.align(8); err != nil {
+				return nil, err
+			}
+			kv, err := d.decode(elem[1 : len(elem)-1])
+			if err != nil {
+				return nil, err
+			}
+			if key, ok := kv[0].(string); ok {
+				strMap[key] = kv[1]
+			} else {
+				anyMap[kv[0]] = kv[1]
+			}
+		}
+		if types[0] == "s" {
+			return strMap, nil
+		}
+		return anyMap, nil
+	}
+	values := []interface{}{}
+	for d.pos < end {
+		v, err := d.value(elem)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
@@ -0,0 +1,216 @@
+package dbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MessageType is the type of a message.
+type MessageType byte
+
+// Message types.
+const (
+	TypeMethodCall   MessageType = 1
+	TypeMethodReturn MessageType = 2
+	TypeError        MessageType = 3
+	TypeSignal       MessageType = 4
+)
+
+// FlagNoReplyExpected marks a method call that should not be answered.
+const FlagNoReplyExpected byte = 0x1
+
+// Header field codes
+const (
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSender      = 7
+	fieldSignature   = 8
+	fieldUnixFDs     = 9
+)
+
+// maxMessageSize is the largest message the spec allows.
+const maxMessageSize = 1 << 27
+
+// Message is a message sent or received on the bus.
+type Message struct {
+	Type        MessageType
+	Flags       byte
+	Serial      uint32
+	Path        ObjectPath
+	Interface   string
+	Member      string
+	ErrorName   string
+	ReplySerial uint32
+	Destination string
+	Sender      string
+	Signature   Signature
+	Body        []interface{}
+}
+
+// Error is an error reply to a method call.
+type Error struct {
+	Name    string
+	Message string
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Name
+	}
+	return fmt.Sprintf("%s: %s", e.Name, e.Message)
+}
+
+// marshal encodes the message, returning the file descriptors that go with it.
+func (m *Message) marshal() ([]byte, []int, error) {
+	body := &encoder{}
+	if err := body.encode(string(m.Signature), m.Body); err != nil {
+		return nil, nil, err
+	}
+
+	var fields [][]interface{}
+	field := func(code byte, v interface{}) {
+		fields = append(fields, []interface{}{code, MakeVariant(v)})
+	}
+	if m.Path != "" {
+		field(fieldPath, m.Path)
+	}
+	if m.Interface != "" {
+		field(fieldInterface, m.Interface)
+	}
+	if m.Member != "" {
+		field(fieldMember, m.Member)
+	}
+	if m.ErrorName != "" {
+		field(fieldErrorName, m.ErrorName)
+	}
+	if m.ReplySerial != 0 {
+		field(fieldReplySerial, m.ReplySerial)
+	}
+	if m.Destination != "" {
+		field(fieldDestination, m.Destination)
+	}
+	if m.Sender != "" {
+		field(fieldSender, m.Sender)
+	}
+	if m.Signature != "" {
+		field(fieldSignature, m.Signature)
+	}
+	if len(body.fds) > 0 {
+		field(fieldUnixFDs, uint32(len(body.fds)))
+	}
+
+	e := &encoder{buf: []byte{'l', byte(m.Type), m.Flags, 1}}
+	e.uint32(uint32(len(body.buf)))
+	e.uint32(m.Serial)
+	if err := e.encode("a(yv)", []interface{}{fields}); err != nil {
+		return nil, nil, err
+	}
+	e.align(8)
+	return append(e.buf, body.buf...), body.fds, nil
+}
+
+// messageLength returns the full length of the message starting with the given 16 bytes.
+func messageLength(head []byte) (int, error) {
+	order, err := byteOrder(head[0])
+	if err != nil {
+		return 0, err
+	}
+	bodyLen := int(order.Uint32(head[4:]))
+	fieldsLen := int(order.Uint32(head[12:]))
+	// The header is padded to 8 bytes after the fields
+	n := (16+fieldsLen+7)/8*8 + bodyLen
+	if bodyLen > maxMessageSize || fieldsLen > maxMessageSize || n > maxMessageSize {
+		return 0, errors.New("Message is too large")
+	}
+	return n, nil
+}
+
+func byteOrder(b byte) (binary.ByteOrder, error) {
+	switch b {
+	case 'l':
+		return binary.LittleEndian, nil
+	case 'B':
+		return binary.BigEndian, nil
+	}
+	return nil, fmt.Errorf("Invalid byte order %q", b)
+}
+
+// unmarshalMessage decodes a complete message. The file descriptors it carries are taken
+// from the front of pending, which holds those received but not yet claimed.
+func unmarshalMessage(data []byte, pending *[]int) (*Message, error) {
+	order, err := byteOrder(data[0])
+	if err != nil {
+		return nil, err
+	}
+	if data[3] != 1 {
+		return nil, fmt.Errorf("Unsupported protocol version %d", data[3])
+	}
+	m := &Message{Type: MessageType(data[1]), Flags: data[2]}
+	d := &decoder{order: order, data: data, pos: 12}
+	fields, err := d.value("a(yv)")
+	if err != nil {
+		return nil, err
+	}
+	m.Serial = order.Uint32(data[8:])
+	var numFDs uint32
+	for _, f := range fields.([]interface{}) {
+		f := f.([]interface{})
+		v := f[1].(Variant).Value
+		var ok bool
+		switch f[0].(byte) {
+		case fieldPath:
+			m.Path, ok = v.(ObjectPath)
+		case fieldInterface:
+			m.Interface, ok = v.(string)
+		case fieldMember:
+			m.Member, ok = v.(string)
+		case fieldErrorName:
+			m.ErrorName, ok = v.(string)
+		case fieldReplySerial:
+			m.ReplySerial, ok = v.(uint32)
+		case fieldDestination:
+			m.Destination, ok = v.(string)
+		case fieldSender:
+			m.Sender, ok = v.(string)
+		case fieldSignature:
+			m.Signature, ok = v.(Signature)
+		case fieldUnixFDs:
+			numFDs, ok = v.(uint32)
+		default:
+			// Unknown fields must be ignored
+			ok = true
+		}
+		if !ok {
+			return nil, fmt.Errorf("Header field %d has the wrong type", f[0])
+		}
+	}
+	if int(numFDs) > len(*pending) {
+		return nil, fmt.Errorf("Message has %d file descriptors, received %d", numFDs, len(*pending))
+	}
+	d.fds, *pending = (*pending)[:numFDs:numFDs], (*pending)[numFDs:]
+	if err := d.align(8); err != nil {
+		return nil, err
+	}
+	if m.Body, err = d.decode(string(m.Signature)); err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New("Message body is longer than its signature")
+	}
+	return m, nil
+}
+
+// toError returns the error carried by an error message.
+func (m *Message) toError() error {
+	e := &Error{Name: m.ErrorName}
+	if len(m.Body) > 0 {
+		e.Message, _ = m.Body[0].(string)
+	}
+	return e
+}
@@ -2,6 +2,7 @@ package log
 
 import (
 	"fmt"
+	"io"
 	glog "log"
 	"os"
 	"path"
@@ -19,6 +20,13 @@ func init() {
 	debugLogger = glog.New(os.Stderr, "DEBUG: ", glog.Ldate|glog.Ltime)
 }
 
+// SetOutput sets the destination of all loggers.
+func SetOutput(w io.Writer) {
+	for _, l := range []*glog.Logger{infoLogger, warningLogger, errorLogger, debugLogger} {
+		l.SetOutput(w)
+	}
+}
+
 func formatNormal(args ...interface{}) string {
 	_, file, line, _ := runtime.Caller(2)
 	out := fmt.Sprintf("%s:%d: ", path.Base(file), line)
@@ -0,0 +1,348 @@
+//go:build linux
+// +build linux
+
+// Package portal implements a client for the ScreenCast and RemoteDesktop interfaces of
+// xdg-desktop-portal, which is how Wayland compositors share the screen and accept
+// input from other processes.
+package portal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/dbus"
+)
+
+// Names of the portal on the bus.
+const (
+	DesktopName            = "org.freedesktop.portal.Desktop"
+	DesktopPath            = dbus.ObjectPath("/org/freedesktop/portal/desktop")
+	ScreenCastInterface    = "org.freedesktop.portal.ScreenCast"
+	RemoteDesktopInterface = "org.freedesktop.portal.RemoteDesktop"
+	RequestInterface       = "org.freedesktop.portal.Request"
+	SessionInterface       = "org.freedesktop.portal.Session"
+)
+
+const (
+	requestPathPrefix     = "/org/freedesktop/portal/desktop/request/"
+	defaultRequestTimeout = 2 * time.Minute
+)
+
+// Response codes of requests
+const (
+	responseSuccess   uint32 = 0
+	responseCancelled uint32 = 1
+)
+
+// Source types that can be selected for a screencast.
+const (
+	SourceMonitor uint32 = 1
+	SourceWindow  uint32 = 2
+	SourceVirtual uint32 = 4
+)
+
+// Cursor modes for a screencast.
+const (
+	CursorHidden   uint32 = 1
+	CursorEmbedded uint32 = 2
+)
+
+// Device types for a remote desktop session.
+const (
+	DeviceKeyboard uint32 = 1
+	DevicePointer  uint32 = 2
+)
+
+// Linux input event codes of the pointer buttons, see linux/input-event-codes.h.
+const (
+	ButtonLeft   int32 = 0x110
+	ButtonRight  int32 = 0x111
+	ButtonMiddle int32 = 0x112
+	ButtonSide   int32 = 0x113
+)
+
+// Scroll axes.
+const (
+	AxisVertical   uint32 = 0
+	AxisHorizontal uint32 = 1
+)
+
+// ErrCancelled is returned when the user dismisses the portal dialog.
+var ErrCancelled = errors.New("The screencast was cancelled")
+
+// Opts are options for starting a session.
+type Opts struct {
+	// SourceTypes is a mask of the kinds of source the user may pick from.
+	SourceTypes uint32
+	// CursorMode is how the cursor is included in the stream.
+	CursorMode uint32
+	// RemoteDesktop requests keyboard and pointer input along with the screencast.
+	RemoteDesktop bool
+	// Timeout bounds how long each request, including any dialog shown to the user,
+	// may take. Defaults to two minutes.
+	Timeout time.Duration
+}
+
+// Stream is a PipeWire stream of a session.
+type Stream struct {
+	// NodeID is the PipeWire node of the stream.
+	NodeID uint32
+	// X, Y, Width and Height are the position and size of the source in compositor
+	// coordinates, when the portal reports them.
+	X, Y, Width, Height int
+	// SourceType is the kind of source the user picked.
+	SourceType uint32
+}
+
+// Session is a screencast session, optionally with remote desktop input.
+type Session struct {
+	conn    *dbus.Conn
+	handle  dbus.ObjectPath
+	timeout time.Duration
+
+	// Streams are the streams the user picked.
+	Streams []Stream
+	// Devices is the mask of input devices granted, zero without remote desktop.
+	Devices uint32
+}
+
+var tokenCounter uint32
+
+// newToken returns a handle token unique to the process.
+func newToken() string {
+	return fmt.Sprintf("gsvnc%d", atomic.AddUint32(&tokenCounter, 1))
+}
+
+// Start creates a session and starts it, which usually shows the user a dialog to pick
+// what to share. It blocks until the user has answered.
+func Start(conn *dbus.Conn, opts *Opts) (*Session, error) {
+	s := &Session{conn: conn, timeout: opts.Timeout}
+	if s.timeout == 0 {
+		s.timeout = defaultRequestTimeout
+	}
+
+	iface := ScreenCastInterface
+	if opts.RemoteDesktop {
+		iface = RemoteDesktopInterface
+	}
+	results, err := s.request(iface, "CreateSession", "a{sv}", map[string]dbus.Variant{
+		"session_handle_token": dbus.MakeVariant(newToken()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not create portal session: %s", err.Error())
+	}
+	// The handle is a string here, not an object path
+	handle, ok := variantValue(results, "session_handle").(string)
+	if !ok {
+		return nil, errors.New("Portal did not return a session handle")
+	}
+	s.handle = dbus.ObjectPath(handle)
+
+	if opts.RemoteDesktop {
+		if _, err := s.request(RemoteDesktopInterface, "SelectDevices", "oa{sv}", s.handle, map[string]dbus.Variant{
+			"types": dbus.MakeVariant(DeviceKeyboard | DevicePointer),
+		}); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("Could not select input devices: %s", err.Error())
+		}
+	}
+
+	if _, err := s.request(ScreenCastInterface, "SelectSources", "oa{sv}", s.handle, map[string]dbus.Variant{
+		"types":       dbus.MakeVariant(opts.SourceTypes),
+		"multiple":    dbus.MakeVariant(false),
+		"cursor_mode": dbus.MakeVariant(opts.CursorMode),
+	}); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("Could not select screencast sources: %s", err.Error())
+	}
+
+	// There is no parent window to attach the dialog to
+	if results, err = s.request(iface, "Start", "osa{sv}", s.handle, "", map[string]dbus.Variant{}); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("Could not start portal session: %s", err.Error())
+	}
+	if s.Streams, err = parseStreams(variantValue(results, "streams")); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if len(s.Streams) == 0 {
+		s.Close()
+		return nil, errors.New("Portal session has no streams")
+	}
+	if opts.RemoteDesktop {
+		s.Devices, _ = variantValue(results, "devices").(uint32)
+	}
+	return s, nil
+}
+
+// OpenPipeWireRemote returns a file descriptor for a PipeWire connection that can access
+// the streams of the session. The caller owns the descriptor.
+func (s *Session) OpenPipeWireRemote() (int, error) {
+	reply, err := s.conn.Call(DesktopName, DesktopPath, ScreenCastInterface, "OpenPipeWireRemote", "oa{sv}",
+		s.handle, map[string]dbus.Variant{})
+	if err != nil {
+		return -1, fmt.Errorf("Could not open PipeWire remote: %s", err.Error())
+	}
+	if len(reply) != 1 {
+		return -1, errors.New("Invalid reply to OpenPipeWireRemote")
+	}
+	fd, ok := reply[0].(dbus.UnixFD)
+	if !ok {
+		return -1, errors.New("Invalid reply to OpenPipeWireRemote")
+	}
+	return int(fd), nil
+}
+
+// PointerMotionAbsolute moves the pointer to a position within a stream, in the
+// coordinates of the stream.
+func (s *Session) PointerMotionAbsolute(stream uint32, x, y float64) error {
+	return s.notify("NotifyPointerMotionAbsolute", "oa{sv}udd", stream, x, y)
+}
+
+// PointerButton presses or releases a button, given as a Linux input event code.
+func (s *Session) PointerButton(button int32, pressed bool) error {
+	return s.notify("NotifyPointerButton", "oa{sv}iu", button, state(pressed))
+}
+
+// PointerAxisDiscrete scrolls by a number of steps along an axis.
+func (s *Session) PointerAxisDiscrete(axis uint32, steps int32) error {
+	return s.notify("NotifyPointerAxisDiscrete", "oa{sv}ui", axis, steps)
+}
+
+// KeyboardKeysym presses or releases a key, given as an X11 keysym.
+func (s *Session) KeyboardKeysym(keysym int32, pressed bool) error {
+	return s.notify("NotifyKeyboardKeysym", "oa{sv}iu", keysym, state(pressed))
+}
+
+// Close closes the session. The connection is left open.
+func (s *Session) Close() error {
+	return s.conn.CallNoReply(DesktopName, s.handle, SessionInterface, "Close", "")
+}
+
+// notify sends an input event. Replies aren't waited for, so input isn't held up by
+// round trips to the portal.
+func (s *Session) notify(method string, sig dbus.Signature, args ...interface{}) error {
+	args = append([]interface{}{s.handle, map[string]dbus.Variant{}}, args...)
+	return s.conn.CallNoReply(DesktopName, DesktopPath, RemoteDesktopInterface, method, sig, args...)
+}
+
+func state(pressed bool) uint32 {
+	if pressed {
+		return 1
+	}
+	return 0
+}
+
+// request calls a portal method that answers with a Request object, and waits for the
+// Response signal on it. The handle token is added to the options, which are the last
+// argument.
+func (s *Session) request(iface, method string, sig dbus.Signature, args ...interface{}) (map[string]interface{}, error) {
+	token := newToken()
+	args[len(args)-1].(map[string]dbus.Variant)["handle_token"] = dbus.MakeVariant(token)
+
+	// Subscribe to the path the request will have before making it, otherwise the
+	// response could arrive first.
+	path := requestPath(s.conn.UniqueName(), token)
+	sub, err := s.subscribe(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { sub.Close() }()
+
+	reply, err := s.conn.Call(DesktopName, DesktopPath, iface, method, sig, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) != 1 {
+		return nil, fmt.Errorf("Invalid reply to %s", method)
+	}
+	if handle, ok := reply[0].(dbus.ObjectPath); ok && handle != path {
+		// Portals before version 0.9 don't use the handle token
+		sub.Close()
+		if sub, err = s.subscribe(handle); err != nil {
+			return nil, err
+		}
+	}
+
+	select {
+	case msg, ok := <-sub.C():
+		if !ok {
+			return nil, dbus.ErrClosed
+		}
+		if len(msg.Body) != 2 {
+			return nil, fmt.Errorf("Invalid response to %s", method)
+		}
+		code, _ := msg.Body[0].(uint32)
+		results, _ := msg.Body[1].(map[string]interface{})
+		switch code {
+		case responseSuccess:
+			return results, nil
+		case responseCancelled:
+			return nil, ErrCancelled
+		}
+		return nil, fmt.Errorf("%s failed", method)
+	case <-time.After(s.timeout):
+		return nil, fmt.Errorf("Timed out waiting for a response to %s", method)
+	}
+}
+
+func (s *Session) subscribe(path dbus.ObjectPath) (*dbus.Subscription, error) {
+	return s.conn.Subscribe(dbus.MatchRule{
+		Sender:    DesktopName,
+		Path:      path,
+		Interface: RequestInterface,
+		Member:    "Response",
+	})
+}
+
+// requestPath returns the object path of the request made with the given token.
+func requestPath(uniqueName, token string) dbus.ObjectPath {
+	sender := strings.ReplaceAll(strings.TrimPrefix(uniqueName, ":"), ".", "_")
+	return dbus.ObjectPath(requestPathPrefix + sender + "/" + token)
+}
+
+// variantValue returns the value of the variant stored under key, or nil.
+func variantValue(results map[string]interface{}, key string) interface{} {
+	v, ok := results[key].(dbus.Variant)
+	if !ok {
+		return nil
+	}
+	return v.Value
+}
+
+// parseStreams parses the a(ua{sv}) list of streams returned by Start.
+func parseStreams(v interface{}) ([]Stream, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("Portal did not return any streams")
+	}
+	streams := make([]Stream, 0, len(list))
+	for _, item := range list {
+		fields, ok := item.([]interface{})
+		if !ok || len(fields) != 2 {
+			return nil, errors.New("Portal returned an invalid stream")
+		}
+		node, _ := fields[0].(uint32)
+		props, _ := fields[1].(map[string]interface{})
+		stream := Stream{NodeID: node}
+		stream.X, stream.Y = intPair(variantValue(props, "position"))
+		stream.Width, stream.Height = intPair(variantValue(props, "size"))
+		stream.SourceType, _ = variantValue(props, "source_type").(uint32)
+		streams = append(streams, stream)
+	}
+	return streams, nil
+}
+
+// intPair reads an (ii) struct.
+func intPair(v interface{}) (int, int) {
+	pair, ok := v.([]interface{})
+	if !ok || len(pair) != 2 {
+		return 0, 0
+	}
+	a, _ := pair[0].(int32)
+	b, _ := pair[1].(int32)
+	return int(a), int(b)
+}
@@ -0,0 +1,318 @@
+//go:build linux
+// +build linux
+
+package portal
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/dbus"
+)
+
+// busConfig is the configuration of a private session bus that lets anyone own names
+// and call anything.
+const busConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:path=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startBus starts a private dbus-daemon for the test and returns its address.
+func startBus(t *testing.T) string {
+	t.Helper()
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon is not installed")
+	}
+	dir := t.TempDir()
+	config := filepath.Join(dir, "bus.conf")
+	if err := ioutil.WriteFile(config, []byte(fmt.Sprintf(busConfig, filepath.Join(dir, "bus"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(daemon, "--config-file="+config, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal("Reading the bus address: ", err)
+	}
+	return strings.TrimSpace(addr)
+}
+
+// mockPortal serves the portal interfaces on a bus. Requests are answered with the
+// response set for their method, or never if there is none.
+type mockPortal struct {
+	t         *testing.T
+	conn      *dbus.Conn
+	responses map[string]uint32
+	calls     chan *dbus.Message
+	// The pipe passed by OpenPipeWireRemote, standing in for a PipeWire socket
+	pipe, remote *os.File
+}
+
+const mockSessionHandle = "/org/freedesktop/portal/desktop/session/1_1/gsvnc"
+
+func newMockPortal(t *testing.T, addr string, responses map[string]uint32) *mockPortal {
+	t.Helper()
+	conn, err := dbus.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.RequestName(DesktopName); err != nil {
+		t.Fatal(err)
+	}
+	m := &mockPortal{t: t, conn: conn, responses: responses, calls: make(chan *dbus.Message, 32)}
+	conn.HandleCalls(m.handle)
+	return m
+}
+
+// handle answers a call and then records it, so that whatever it set up is visible to
+// the test once it sees the call.
+func (m *mockPortal) handle(call *dbus.Message) (sig dbus.Signature, body []interface{}, err error) {
+	defer func() { m.calls <- call }()
+	switch call.Member {
+	case "CreateSession", "SelectDevices", "SelectSources", "Start":
+		return m.request(call)
+	case "OpenPipeWireRemote":
+		// The write end is kept open until the test ends, it is only duplicated when
+		// the reply is sent.
+		if m.pipe, m.remote, err = os.Pipe(); err != nil {
+			return "", nil, err
+		}
+		m.t.Cleanup(func() {
+			m.pipe.Close()
+			m.remote.Close()
+		})
+		return "h", []interface{}{dbus.UnixFD(m.remote.Fd())}, nil
+	}
+	return "", nil, nil
+}
+
+// request answers a method returning a Request object. The response is emitted before
+// the reply, which clients must be ready for since they subscribe first.
+func (m *mockPortal) request(call *dbus.Message) (dbus.Signature, []interface{}, error) {
+	opts, _ := call.Body[len(call.Body)-1].(map[string]interface{})
+	token, _ := variantValue(opts, "handle_token").(string)
+	if token == "" {
+		return "", nil, &dbus.Error{Name: "org.freedesktop.DBus.Error.InvalidArgs", Message: "No handle token"}
+	}
+	path := requestPath(call.Sender, token)
+	code, ok := m.responses[call.Member]
+	if !ok {
+		return "o", []interface{}{path}, nil
+	}
+	results := map[string]dbus.Variant{}
+	switch call.Member {
+	case "CreateSession":
+		results["session_handle"] = dbus.MakeVariant(mockSessionHandle)
+	case "Start":
+		results["devices"] = dbus.MakeVariant(DeviceKeyboard | DevicePointer)
+		results["streams"] = dbus.Variant{Sig: "a(ua{sv})", Value: []interface{}{
+			[]interface{}{uint32(42), map[string]dbus.Variant{
+				"position":    {Sig: "(ii)", Value: []interface{}{int32(10), int32(20)}},
+				"size":        {Sig: "(ii)", Value: []interface{}{int32(640), int32(480)}},
+				"source_type": dbus.MakeVariant(SourceMonitor),
+			}},
+		}}
+	}
+	if err := m.conn.Emit(path, RequestInterface, "Response", "ua{sv}", code, results); err != nil {
+		m.t.Error("Emitting response: ", err)
+	}
+	return "o", []interface{}{path}, nil
+}
+
+// expect returns the next call made to the portal, checking its interface and method.
+func (m *mockPortal) expect(iface, member string) *dbus.Message {
+	m.t.Helper()
+	select {
+	case call := <-m.calls:
+		if call.Interface != iface || call.Member != member {
+			m.t.Fatalf("Expected a call to %s.%s, got %s.%s", iface, member, call.Interface, call.Member)
+		}
+		return call
+	case <-time.After(time.Second * 5):
+		m.t.Fatalf("Timed out waiting for a call to %s.%s", iface, member)
+	}
+	return nil
+}
+
+func dialBus(t *testing.T, addr string) *dbus.Conn {
+	t.Helper()
+	conn, err := dbus.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+var allSucceed = map[string]uint32{
+	"CreateSession": responseSuccess,
+	"SelectDevices": responseSuccess,
+	"SelectSources": responseSuccess,
+	"Start":         responseSuccess,
+}
+
+func TestStartRemoteDesktop(t *testing.T) {
+	addr := startBus(t)
+	m := newMockPortal(t, addr, allSucceed)
+	conn := dialBus(t, addr)
+
+	s, err := Start(conn, &Opts{SourceTypes: SourceMonitor, CursorMode: CursorEmbedded, RemoteDesktop: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.expect(RemoteDesktopInterface, "CreateSession")
+	devices := m.expect(RemoteDesktopInterface, "SelectDevices")
+	if types := variantValue(devices.Body[1].(map[string]interface{}), "types"); types != DeviceKeyboard|DevicePointer {
+		t.Fatalf("Expected keyboard and pointer devices, got %v", types)
+	}
+	sources := m.expect(ScreenCastInterface, "SelectSources")
+	if sources.Body[0] != dbus.ObjectPath(mockSessionHandle) {
+		t.Fatalf("Expected the session handle, got %v", sources.Body[0])
+	}
+	if mode := variantValue(sources.Body[1].(map[string]interface{}), "cursor_mode"); mode != CursorEmbedded {
+		t.Fatalf("Expected the embedded cursor mode, got %v", mode)
+	}
+	m.expect(RemoteDesktopInterface, "Start")
+
+	want := Stream{NodeID: 42, X: 10, Y: 20, Width: 640, Height: 480, SourceType: SourceMonitor}
+	if len(s.Streams) != 1 || s.Streams[0] != want {
+		t.Fatalf("Expected stream %+v, got %+v", want, s.Streams)
+	}
+	if s.Devices != DeviceKeyboard|DevicePointer {
+		t.Fatalf("Expected keyboard and pointer devices, got %d", s.Devices)
+	}
+
+	// The PipeWire remote is a descriptor passed over the bus
+	fd, err := s.OpenPipeWireRemote()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.expect(ScreenCastInterface, "OpenPipeWireRemote")
+	remote := os.NewFile(uintptr(fd), "pipewire")
+	defer remote.Close()
+	if _, err := remote.Write([]byte("ok")); err != nil {
+		t.Fatal("Writing to the remote: ", err)
+	}
+	buf := make([]byte, 2)
+	if _, err := m.pipe.Read(buf); err != nil || string(buf) != "ok" {
+		t.Fatalf("Expected the remote to be the pipe of the portal, read %q, %v", buf, err)
+	}
+
+	if err := s.PointerButton(ButtonLeft, true); err != nil {
+		t.Fatal(err)
+	}
+	button := m.expect(RemoteDesktopInterface, "NotifyPointerButton")
+	if button.Body[2] != ButtonLeft || button.Body[3] != uint32(1) {
+		t.Fatalf("Unexpected button event %v", button.Body)
+	}
+	if err := s.KeyboardKeysym(0xff0d, false); err != nil {
+		t.Fatal(err)
+	}
+	key := m.expect(RemoteDesktopInterface, "NotifyKeyboardKeysym")
+	if key.Body[2] != int32(0xff0d) || key.Body[3] != uint32(0) {
+		t.Fatalf("Unexpected key event %v", key.Body)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if call := m.expect(SessionInterface, "Close"); call.Path != mockSessionHandle {
+		t.Fatalf("Expected the session to be closed, got a call on %s", call.Path)
+	}
+}
+
+func TestStartScreenCast(t *testing.T) {
+	addr := startBus(t)
+	m := newMockPortal(t, addr, allSucceed)
+	conn := dialBus(t, addr)
+
+	s, err := Start(conn, &Opts{SourceTypes: SourceWindow, CursorMode: CursorHidden})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	m.expect(ScreenCastInterface, "CreateSession")
+	sources := m.expect(ScreenCastInterface, "SelectSources")
+	if types := variantValue(sources.Body[1].(map[string]interface{}), "types"); types != SourceWindow {
+		t.Fatalf("Expected window sources, got %v", types)
+	}
+	m.expect(ScreenCastInterface, "Start")
+	if s.Devices != 0 {
+		t.Fatalf("Expected no devices without remote desktop, got %d", s.Devices)
+	}
+}
+
+func TestStartCancelled(t *testing.T) {
+	addr := startBus(t)
+	m := newMockPortal(t, addr, map[string]uint32{
+		"CreateSession": responseSuccess,
+		"SelectSources": responseSuccess,
+		"Start":         responseCancelled,
+	})
+	conn := dialBus(t, addr)
+
+	if _, err := Start(conn, &Opts{SourceTypes: SourceMonitor}); err == nil || !strings.Contains(err.Error(), ErrCancelled.Error()) {
+		t.Fatalf("Expected the session to be cancelled, got %v", err)
+	}
+	m.expect(ScreenCastInterface, "CreateSession")
+	m.expect(ScreenCastInterface, "SelectSources")
+	m.expect(ScreenCastInterface, "Start")
+	m.expect(SessionInterface, "Close")
+}
+
+func TestStartTimeout(t *testing.T) {
+	addr := startBus(t)
+	// The user never answers the dialog
+	m := newMockPortal(t, addr, map[string]uint32{
+		"CreateSession": responseSuccess,
+		"SelectSources": responseSuccess,
+	})
+	conn := dialBus(t, addr)
+
+	start := time.Now()
+	_, err := Start(conn, &Opts{SourceTypes: SourceMonitor, Timeout: time.Millisecond * 100})
+	if err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Fatalf("Start took %s to time out", elapsed)
+	}
+	m.expect(ScreenCastInterface, "CreateSession")
+	m.expect(ScreenCastInterface, "SelectSources")
+	m.expect(ScreenCastInterface, "Start")
+	m.expect(SessionInterface, "Close")
+}
+
+func TestRequestPath(t *testing.T) {
+	if got := requestPath(":1.42", "gsvnc1"); got != "/org/freedesktop/portal/desktop/request/1_42/gsvnc1" {
+		t.Fatalf("Unexpected request path %s", got)
+	}
+}
@@ -40,6 +40,11 @@ func Write(buf io.Writer, v interface{}) error {
 	return binary.Write(buf, binary.BigEndian, v)
 }
 
+// Read is a convenience wrapper for using the binary package to read from a buffer.
+func Read(buf io.Reader, v interface{}) error {
+	return binary.Read(buf, binary.BigEndian, v)
+}
+
 const charset = "abcdefghijklmnopqrstuvwxyz" +
 	"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
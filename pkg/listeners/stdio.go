@@ -0,0 +1,55 @@
+package listeners
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+// Stdio returns a net.Conn reading from stdin and writing to stdout. This is used for
+// serving a single connection handed over by inetd or a similar super-server, or by
+// an SSH ProxyCommand.
+//
+// Nothing else may read from stdin or write to stdout while the connection is in use.
+func Stdio() net.Conn {
+	in, out := stdioFiles()
+	return &stdioConn{in: in, out: out}
+}
+
+// stdioConn implements a net.Conn over a pair of files.
+type stdioConn struct {
+	in, out *os.File
+}
+
+func (s *stdioConn) Read(b []byte) (int, error)  { return s.in.Read(b) }
+func (s *stdioConn) Write(b []byte) (int, error) { return s.out.Write(b) }
+
+// Close closes both stdin and stdout.
+func (s *stdioConn) Close() error {
+	inErr := s.in.Close()
+	if err := s.out.Close(); err != nil {
+		return err
+	}
+	return inErr
+}
+
+func (s *stdioConn) LocalAddr() net.Addr  { return stdioAddr{} }
+func (s *stdioConn) RemoteAddr() net.Addr { return stdioAddr{} }
+
+// Deadlines are only supported when stdin and stdout can be polled. Errors are ignored
+// the same way as for any other connection that does not support them.
+func (s *stdioConn) SetDeadline(t time.Time) error {
+	if err := s.in.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return s.out.SetWriteDeadline(t)
+}
+
+func (s *stdioConn) SetReadDeadline(t time.Time) error  { return s.in.SetReadDeadline(t) }
+func (s *stdioConn) SetWriteDeadline(t time.Time) error { return s.out.SetWriteDeadline(t) }
+
+// stdioAddr is the net.Addr of both ends of a stdio connection.
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
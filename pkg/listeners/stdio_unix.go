@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package listeners
+
+import (
+	"os"
+	"syscall"
+)
+
+// stdioFiles returns stdin and stdout in non-blocking mode, so that they are managed by
+// the runtime poller and support deadlines. If that fails, the blocking files are returned.
+func stdioFiles() (in, out *os.File) {
+	if err := syscall.SetNonblock(syscall.Stdin, true); err != nil {
+		return os.Stdin, os.Stdout
+	}
+	if err := syscall.SetNonblock(syscall.Stdout, true); err != nil {
+		return os.Stdin, os.Stdout
+	}
+	return os.NewFile(uintptr(syscall.Stdin), "/dev/stdin"), os.NewFile(uintptr(syscall.Stdout), "/dev/stdout")
+}
@@ -0,0 +1,6 @@
+package listeners
+
+import "os"
+
+// stdioFiles returns stdin and stdout. Deadlines are not supported on Windows.
+func stdioFiles() (in, out *os.File) { return os.Stdin, os.Stdout }
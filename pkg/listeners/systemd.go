@@ -0,0 +1,60 @@
+package listeners
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// Systemd returns the listeners passed to the process by systemd socket activation,
+// keyed by the name given to them with FileDescriptorName=. Sockets without a name are
+// keyed by the name of their socket unit. If the process was not socket activated,
+// an empty map is returned.
+//
+// The LISTEN_* environment variables are unset, so the sockets are not passed on to
+// child processes.
+func Systemd() (map[string][]net.Listener, error) {
+	out := make(map[string][]net.Listener)
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return out, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count == 0 {
+		return out, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		// FileListener dups the descriptor
+		f.Close()
+		if err != nil {
+			for _, ll := range out {
+				for _, l := range ll {
+					l.Close()
+				}
+			}
+			return nil, fmt.Errorf("Could not use socket %d (%s) passed by systemd: %s", listenFDsStart+i, name, err.Error())
+		}
+		out[name] = append(out[name], l)
+	}
+	return out, nil
+}
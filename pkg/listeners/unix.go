@@ -0,0 +1,28 @@
+// Package listeners provides listeners and connections for serving gsvnc over
+// transports other than plain TCP.
+package listeners
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// Unix listens on a Unix socket at the given path, created with the given mode. A socket
+// left behind by a previous process is removed, but an error is returned if another
+// process is still serving on it or if the path is not a socket.
+func Unix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("The socket %s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return listenUnix(path, mode)
+}
@@ -0,0 +1,54 @@
+//go:build !windows
+// +build !windows
+
+package listeners
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gsvnc.sock")
+	l, err := Unix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Fatalf("Expected a socket with mode 0600, got %s", fi.Mode())
+	}
+	if _, err := Unix(path, 0600); err == nil {
+		t.Fatal("Expected a socket in use to be refused")
+	}
+
+	// A socket left behind by a process that is gone is replaced
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if l, err = Unix(path, 0660); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0660 {
+		t.Fatalf("Expected the new socket to have mode 0660, got %v, %v", fi, err)
+	}
+}
+
+func TestUnixNotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gsvnc.sock")
+	if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unix(path, 0600); err == nil {
+		t.Fatal("Expected a path that is not a socket to be refused")
+	}
+	if body, err := ioutil.ReadFile(path); err != nil || string(body) != "data" {
+		t.Fatalf("Expected the file to be left alone, got %q, %v", body, err)
+	}
+}
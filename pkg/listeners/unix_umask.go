@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package listeners
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// umaskMux serializes changes to the umask, which is shared by the whole process.
+var umaskMux sync.Mutex
+
+// listenUnix creates the socket with the umask set to the given mode, so that it is
+// never reachable with wider permissions.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	umaskMux.Lock()
+	defer umaskMux.Unlock()
+	old := syscall.Umask(int(^mode & os.ModePerm))
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,19 @@
+package listeners
+
+import (
+	"net"
+	"os"
+)
+
+// listenUnix creates the socket and sets its mode. There is no umask on Windows.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
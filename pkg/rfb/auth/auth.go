@@ -10,6 +10,23 @@ type Type interface {
 	Negotiate(wr *buffer.ReadWriter) error
 }
 
+// UserNegotiator is implemented by auth types that can tell which user authenticated,
+// rather than only checking a shared secret.
+type UserNegotiator interface {
+	// NegotiateUser negotiates authentication like Negotiate, and returns the name of the
+	// user that authenticated. The name is empty if no user was identified.
+	NegotiateUser(rw *buffer.ReadWriter) (string, error)
+}
+
+// Negotiate negotiates the given auth type, returning the user that authenticated if
+// the type implements UserNegotiator.
+func Negotiate(t Type, rw *buffer.ReadWriter) (string, error) {
+	if un, ok := t.(UserNegotiator); ok {
+		return un.NegotiateUser(rw)
+	}
+	return "", t.Negotiate(rw)
+}
+
 // DefaultAuthTypes is the default enabled list of auth types.
 var DefaultAuthTypes = []Type{
 	&None{},
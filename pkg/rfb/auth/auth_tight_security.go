@@ -45,8 +45,15 @@ func (t *TightSecurity) Code() uint8 { return 16 }
 
 // Negotiate will negotiate tight security.
 func (t *TightSecurity) Negotiate(rw *buffer.ReadWriter) error {
+	_, err := t.NegotiateUser(rw)
+	return err
+}
+
+// NegotiateUser implements UserNegotiator, returning the user identified by the
+// tight auth type the client picked, if any.
+func (t *TightSecurity) NegotiateUser(rw *buffer.ReadWriter) (string, error) {
 	if err := t.negotiateTightTunnel(rw); err != nil {
-		return err
+		return "", err
 	}
 	return t.negotiateTightAuth(rw)
 }
@@ -91,7 +98,7 @@ func (t *TightSecurity) negotiateTightTunnel(rw *buffer.ReadWriter) error {
 	return nil
 }
 
-func (t *TightSecurity) negotiateTightAuth(rw *buffer.ReadWriter) error {
+func (t *TightSecurity) negotiateTightAuth(rw *buffer.ReadWriter) (string, error) {
 	buf := new(bytes.Buffer)
 	caps := t.getEnabledAuthCaps()
 	util.Write(buf, uint32(len(caps)))
@@ -106,9 +113,9 @@ func (t *TightSecurity) negotiateTightAuth(rw *buffer.ReadWriter) error {
 
 	authType := t.AuthGetter(uint8(auth))
 	if authType == nil {
-		return fmt.Errorf("client requested unsupported tight auth type: %d", auth)
+		return "", fmt.Errorf("client requested unsupported tight auth type: %d", auth)
 	}
-	return authType.Negotiate(rw)
+	return Negotiate(authType, rw)
 }
 
 func (t *TightSecurity) getEnabledAuthCaps() []types.TightCapability {
@@ -1,9 +1,12 @@
 package auth
 
 import (
+	"crypto/cipher"
 	"crypto/des"
 	"crypto/rand"
+	"crypto/subtle"
 	"errors"
+	"sort"
 
 	"github.com/tinyzimmer/gsvnc/pkg/buffer"
 )
@@ -11,54 +14,116 @@ import (
 // VNCAuth represents VNCAuthentication.
 type VNCAuth struct {
 	Password string
+	// PasswordGetter, if set, is used to retrieve the password for each
+	// negotiation instead of the static Password.
+	PasswordGetter func() string
+	// UsersGetter, if set, returns passwords by username. VNC authentication only
+	// carries a password, so the user is the one whose password the client sent.
+	UsersGetter func() map[string]string
 }
 
 // Code returns the code for vnc uth.
 func (a *VNCAuth) Code() uint8 { return 2 }
 
-// Negotiate immediately returns nil.
+// Negotiate will negotiate VNC authentication.
 func (a *VNCAuth) Negotiate(rw *buffer.ReadWriter) error {
+	_, err := a.NegotiateUser(rw)
+	return err
+}
+
+// NegotiateUser implements UserNegotiator. The username is empty when the client
+// sent the server password.
+func (a *VNCAuth) NegotiateUser(rw *buffer.ReadWriter) (string, error) {
 	key := a.Password
-	keyBytes := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	if a.PasswordGetter != nil {
+		key = a.PasswordGetter()
+	}
+	var users map[string]string
+	if a.UsersGetter != nil {
+		users = a.UsersGetter()
+	}
+
+	challenge := make([]byte, 16)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", err
+	}
+
+	rw.Dispatch(challenge)
 
-	if len(key) > 8 {
-		key = key[:8]
+	response := make([]byte, 16)
+	if err := rw.Read(response); err != nil {
+		return "", err
 	}
 
-	for i := 0; i < len(key); i++ {
-		keyBytes[i] = a.reverseBits(key[i])
+	if key != "" || len(users) == 0 {
+		ok, err := checkResponse(key, challenge, response)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return "", nil
+		}
+	}
+	// Sorted, so a password shared by several users always picks the same one
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ok, err := checkResponse(users[name], challenge, response)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return name, nil
+		}
 	}
 
-	block, err := des.NewCipher(keyBytes)
+	return "", errors.New("Password is invalid")
+}
+
+// checkResponse returns true if the response is the challenge encrypted with the
+// given password.
+func checkResponse(password string, challenge, response []byte) (bool, error) {
+	expected, err := EncryptChallenge(password, challenge)
 	if err != nil {
-		return err
+		return false, err
 	}
+	return subtle.ConstantTimeCompare(expected, response) == 1, nil
+}
 
-	challenge := make([]byte, 16)
-	_, err = rand.Read(challenge)
+// EncryptChallenge returns the response a client sends to the given challenge, which is
+// the challenge encrypted with the password.
+func EncryptChallenge(password string, challenge []byte) ([]byte, error) {
+	block, err := newVNCAuthCipher(password)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	res := make([]byte, len(challenge))
+	for i := 0; i+8 <= len(challenge); i += 8 {
+		block.Encrypt(res[i:i+8], challenge[i:i+8])
 	}
+	return res, nil
+}
 
-	rw.Dispatch(challenge)
+// newVNCAuthCipher returns the DES cipher for the given password. Only the first eight
+// characters are used, each with its bits reversed.
+func newVNCAuthCipher(password string) (cipher.Block, error) {
+	keyBytes := []byte{0, 0, 0, 0, 0, 0, 0, 0}
 
-	res := make([]byte, 0)
-	for i := 0; i < 2; i++ {
-		b := make([]byte, 8)
-		rw.Read(b)
-		decrypted := make([]byte, 8)
-		block.Decrypt(decrypted, b)
-		res = append(res, decrypted...)
+	if len(password) > 8 {
+		password = password[:8]
 	}
 
-	if string(res) != string(challenge) {
-		return errors.New("Password is invalid")
+	for i := 0; i < len(password); i++ {
+		keyBytes[i] = reverseBits(password[i])
 	}
 
-	return nil
+	return des.NewCipher(keyBytes)
 }
 
-func (a *VNCAuth) reverseBits(b byte) byte {
+func reverseBits(b byte) byte {
 	var reverse = [256]int{
 		0, 128, 64, 192, 32, 160, 96, 224,
 		16, 144, 80, 208, 48, 176, 112, 240,
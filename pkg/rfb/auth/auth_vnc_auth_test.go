@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/tinyzimmer/gsvnc/pkg/buffer"
+)
+
+// respond negotiates VNC authentication with the given auth type, answering the
+// challenge with the given password.
+func respond(t *testing.T, a Type, password string) (string, error) {
+	t.Helper()
+	server, client := net.Pipe()
+	defer client.Close()
+	rw := buffer.NewReadWriteBuffer(server)
+	defer rw.Close()
+
+	go func() {
+		challenge := make([]byte, 16)
+		if _, err := io.ReadFull(client, challenge); err != nil {
+			return
+		}
+		response, _ := EncryptChallenge(password, challenge)
+		client.Write(response)
+	}()
+	return Negotiate(a, rw)
+}
+
+func TestVNCAuthPassword(t *testing.T) {
+	a := &VNCAuth{Password: "secret"}
+	if user, err := respond(t, a, "secret"); err != nil || user != "" {
+		t.Fatalf("Expected the server password to be accepted anonymously, got %q, %v", user, err)
+	}
+	if _, err := respond(t, a, "wrong"); err == nil {
+		t.Fatal("Expected a wrong password to be refused")
+	}
+}
+
+func TestVNCAuthUsers(t *testing.T) {
+	a := &VNCAuth{
+		PasswordGetter: func() string { return "" },
+		UsersGetter: func() map[string]string {
+			return map[string]string{"alice": "alicepw", "bob": "bobpw"}
+		},
+	}
+	for _, name := range []string{"alice", "bob"} {
+		user, err := respond(t, a, name+"pw")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user != name {
+			t.Fatalf("Expected %q to authenticate, got %q", name, user)
+		}
+	}
+	// Without a server password, an empty one isn't accepted
+	if _, err := respond(t, a, ""); err == nil {
+		t.Fatal("Expected an empty password to be refused")
+	}
+	if _, err := respond(t, a, "nobody"); err == nil {
+		t.Fatal("Expected an unknown password to be refused")
+	}
+}
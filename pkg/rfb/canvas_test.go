@@ -0,0 +1,93 @@
+package rfb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
+)
+
+func TestCanvasViewOnly(t *testing.T) {
+	canvas := providers.NewCanvas(16, 8)
+	keys := make(chan uint32, 16)
+	pointers := make(chan int, 16)
+	clipboard := make(chan string, 16)
+	canvas.OnKey = func(keysym uint32, down bool) {
+		if down {
+			keys <- keysym
+		}
+	}
+	canvas.OnPointer = func(x, y int, buttonMask uint8) { pointers <- x }
+	canvas.OnClipboard = func(text string) { clipboard <- text }
+
+	s := newTestServer(t, &ServerOpts{Display: canvas})
+	defer s.shutdown(t)
+	c, _ := s.connect(t)
+	defer c.Close()
+	id := s.GetSessions()[0].ID
+
+	send := func(key uint32, x int, text string) {
+		t.Helper()
+		if err := c.KeyEvent(key, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.PointerEvent(x, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.CutText(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// expect checks the next input delivered to the canvas. Input is handled in order,
+	// so anything dropped before it is never seen.
+	expect := func(key uint32, x int, text string) {
+		t.Helper()
+		timeout := time.After(time.Second * 5)
+		select {
+		case got := <-keys:
+			if got != key {
+				t.Fatalf("Expected key %#x, got %#x", key, got)
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for a key event")
+		}
+		select {
+		case got := <-pointers:
+			if got != x {
+				t.Fatalf("Expected a pointer event at %d, got %d", x, got)
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for a pointer event")
+		}
+		select {
+		case got := <-clipboard:
+			if got != text {
+				t.Fatalf("Expected clipboard text %q, got %q", text, got)
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for clipboard text")
+		}
+	}
+
+	send('a', 1, "one")
+	expect('a', 1, "one")
+
+	if err := s.SetViewOnly(id, true); err != nil {
+		t.Fatal(err)
+	}
+	send('b', 2, "two")
+	select {
+	case <-keys:
+		t.Fatal("Expected no key events while view-only")
+	case <-pointers:
+		t.Fatal("Expected no pointer events while view-only")
+	case <-clipboard:
+		t.Fatal("Expected no clipboard text while view-only")
+	case <-time.After(time.Millisecond * 300):
+	}
+	if err := s.SetViewOnly(id, false); err != nil {
+		t.Fatal(err)
+	}
+	send('c', 3, "three")
+	expect('c', 3, "three")
+}
@@ -0,0 +1,525 @@
+// Package client implements an RFB client, used to relay other VNC servers.
+//
+// The client always asks for 32-bit true colour pixels laid out like image.RGBA, so
+// updates are decoded straight into the framebuffer.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/auth"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/types"
+)
+
+// Encodings supported by the client.
+const (
+	EncodingRaw         int32 = 0
+	EncodingCopyRect    int32 = 1
+	EncodingRRE         int32 = 2
+	EncodingHextile     int32 = 5
+	EncodingZRLE        int32 = 16
+	EncodingDesktopSize int32 = -223
+)
+
+// DefaultEncodings are the encodings requested when none are given, in order of
+// preference.
+var DefaultEncodings = []int32{EncodingCopyRect, EncodingZRLE, EncodingHextile, EncodingRRE, EncodingRaw}
+
+// Security types
+const (
+	securityInvalid uint8 = 0
+	securityNone    uint8 = 1
+	securityVNCAuth uint8 = 2
+)
+
+// Client to server message types
+const (
+	msgSetPixelFormat           uint8 = 0
+	msgSetEncodings             uint8 = 2
+	msgFramebufferUpdateRequest uint8 = 3
+	msgKeyEvent                 uint8 = 4
+	msgPointerEvent             uint8 = 5
+	msgClientCutText            uint8 = 6
+)
+
+// Server to client message types
+const (
+	msgFramebufferUpdate   uint8 = 0
+	msgSetColourMapEntries uint8 = 1
+	msgBell                uint8 = 2
+	msgServerCutText       uint8 = 3
+)
+
+// maxCutText is the longest cut text accepted from the server.
+const maxCutText = 10 << 20
+
+// pixelFormat is the format requested from the server. With these shifts a little
+// endian pixel is the R, G, B and padding bytes of an image.RGBA pixel.
+var pixelFormat = types.PixelFormat{
+	BPP:        32,
+	Depth:      24,
+	BigEndian:  0,
+	TrueColour: 1,
+	RedMax:     255,
+	GreenMax:   255,
+	BlueMax:    255,
+	RedShift:   0,
+	GreenShift: 8,
+	BlueShift:  16,
+}
+
+// Opts are options for a client connection.
+type Opts struct {
+	// Password is used if the server asks for VNC authentication.
+	Password string
+	// Shared asks the server to leave other clients connected.
+	Shared bool
+	// Encodings are the encodings to request in order of preference. Defaults to
+	// DefaultEncodings. DesktopSize is always requested.
+	Encodings []int32
+	// OnUpdate is called after each framebuffer update is applied, with the region
+	// that changed.
+	OnUpdate func(rect image.Rectangle)
+	// OnResize is called when the server changes the size of the framebuffer, before
+	// OnUpdate is called for the whole new framebuffer.
+	OnResize func(width, height int)
+	// OnCutText is called when the server sends new clipboard text.
+	OnCutText func(text string)
+	// OnBell is called when the server rings the bell.
+	OnBell func()
+}
+
+// Client is a connection to an RFB server.
+type Client struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	opts     *Opts
+	writeMux sync.Mutex
+
+	// Name is the desktop name sent by the server.
+	Name string
+
+	fb    *image.RGBA
+	fbMux sync.RWMutex
+
+	zrle *zlibStream
+}
+
+// Dial connects to the server at the given address and completes the handshake. The
+// timeout bounds both.
+func Dial(address string, timeout time.Duration, opts *Opts) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	c, err := NewClient(conn, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// NewClient completes the handshake on the given connection and sets up the pixel
+// format and encodings. Nil options connect without a password.
+func NewClient(conn net.Conn, opts *Opts) (*Client, error) {
+	if opts == nil {
+		opts = &Opts{}
+	}
+	c := &Client{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		opts: opts,
+		zrle: &zlibStream{},
+	}
+	if err := c.handshake(); err != nil {
+		return nil, err
+	}
+	if err := c.setPixelFormat(); err != nil {
+		return nil, err
+	}
+	encs := opts.Encodings
+	if len(encs) == 0 {
+		encs = DefaultEncodings
+	}
+	if err := c.setEncodings(append(encs[:len(encs):len(encs)], EncodingDesktopSize)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Size returns the current size of the framebuffer.
+func (c *Client) Size() (width, height int) {
+	c.fbMux.RLock()
+	defer c.fbMux.RUnlock()
+	b := c.fb.Bounds()
+	return b.Dx(), b.Dy()
+}
+
+// Framebuffer calls f with the framebuffer, which is not modified until f returns.
+// The framebuffer must not be retained, it is replaced when the server resizes it.
+func (c *Client) Framebuffer(f func(fb *image.RGBA)) {
+	c.fbMux.RLock()
+	defer c.fbMux.RUnlock()
+	f(c.fb)
+}
+
+// Close closes the connection.
+func (c *Client) Close() error { return c.conn.Close() }
+
+// handshake negotiates the protocol version and security, and exchanges the init
+// messages.
+func (c *Client) handshake() error {
+	version := make([]byte, 12)
+	if _, err := io.ReadFull(c.r, version); err != nil {
+		return fmt.Errorf("Could not read server version: %s", err.Error())
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(version), "RFB %03d.%03d\n", &major, &minor); err != nil || major != 3 {
+		return fmt.Errorf("Unsupported server version %q", version)
+	}
+	// Later minor versions, such as the 3.889 of Apple, are treated as 3.8
+	switch {
+	case minor >= 8:
+		minor = 8
+	case minor == 7:
+	default:
+		minor = 3
+	}
+	if err := c.write([]byte(fmt.Sprintf("RFB 003.%03d\n", minor))); err != nil {
+		return err
+	}
+
+	secType, err := c.negotiateSecurity(minor)
+	if err != nil {
+		return err
+	}
+	if secType == securityVNCAuth {
+		challenge := make([]byte, 16)
+		if _, err := io.ReadFull(c.r, challenge); err != nil {
+			return err
+		}
+		res, err := auth.EncryptChallenge(c.opts.Password, challenge)
+		if err != nil {
+			return err
+		}
+		if err := c.write(res); err != nil {
+			return err
+		}
+	}
+	// Versions before 3.8 don't send a result without authentication
+	if secType == securityVNCAuth || minor == 8 {
+		var result uint32
+		if err := binary.Read(c.r, binary.BigEndian, &result); err != nil {
+			return err
+		}
+		if result != 0 {
+			if minor == 8 {
+				if reason, err := c.readReason(); err == nil && reason != "" {
+					return fmt.Errorf("Authentication failed: %s", reason)
+				}
+			}
+			return errors.New("Authentication failed")
+		}
+	}
+
+	shared := uint8(0)
+	if c.opts.Shared {
+		shared = 1
+	}
+	if err := c.write([]byte{shared}); err != nil {
+		return err
+	}
+	var init struct {
+		Width, Height uint16
+		Format        types.PixelFormat
+		_             [3]byte
+	}
+	if err := binary.Read(c.r, binary.BigEndian, &init); err != nil {
+		return fmt.Errorf("Could not read server init: %s", err.Error())
+	}
+	name, err := c.readReason()
+	if err != nil {
+		return err
+	}
+	c.Name = name
+	c.fb = newFramebuffer(int(init.Width), int(init.Height))
+	return nil
+}
+
+// negotiateSecurity picks a security type, preferring VNC authentication when there is
+// a password.
+func (c *Client) negotiateSecurity(minor int) (uint8, error) {
+	if minor == 3 {
+		// The server decides
+		var secType uint32
+		if err := binary.Read(c.r, binary.BigEndian, &secType); err != nil {
+			return 0, err
+		}
+		switch uint8(secType) {
+		case securityInvalid:
+			return 0, c.readFailure()
+		case securityNone, securityVNCAuth:
+			return uint8(secType), nil
+		}
+		return 0, fmt.Errorf("Unsupported security type %d", secType)
+	}
+
+	count, err := c.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, c.readFailure()
+	}
+	offered := make([]byte, count)
+	if _, err := io.ReadFull(c.r, offered); err != nil {
+		return 0, err
+	}
+	var hasNone, hasVNCAuth bool
+	for _, t := range offered {
+		switch t {
+		case securityNone:
+			hasNone = true
+		case securityVNCAuth:
+			hasVNCAuth = true
+		}
+	}
+	var secType uint8
+	switch {
+	case hasVNCAuth && (c.opts.Password != "" || !hasNone):
+		secType = securityVNCAuth
+	case hasNone:
+		secType = securityNone
+	default:
+		return 0, fmt.Errorf("Server offers no supported security types: %v", offered)
+	}
+	return secType, c.write([]byte{secType})
+}
+
+// readFailure reads the reason the server refused the connection.
+func (c *Client) readFailure() error {
+	reason, err := c.readReason()
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("Server refused the connection: %s", reason)
+}
+
+// readReason reads a string prefixed with its length.
+func (c *Client) readReason() (string, error) {
+	var length uint32
+	if err := binary.Read(c.r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	if length > maxCutText {
+		return "", fmt.Errorf("String of %d bytes is too long", length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (c *Client) setPixelFormat() error {
+	return c.send(msgSetPixelFormat, [3]byte{}, pixelFormat, [3]byte{})
+}
+
+func (c *Client) setEncodings(encs []int32) error {
+	return c.send(msgSetEncodings, uint8(0), uint16(len(encs)), encs)
+}
+
+// RequestUpdate asks the server for an update of the whole framebuffer. An incremental
+// update only contains what changed since the last one.
+func (c *Client) RequestUpdate(incremental bool) error {
+	width, height := c.Size()
+	req := types.FrameBufferUpdateRequest{Width: uint16(width), Height: uint16(height)}
+	if incremental {
+		req.IncrementalFlag = 1
+	}
+	return c.send(msgFramebufferUpdateRequest, req)
+}
+
+// KeyEvent sends a key press or release. The key is an X11 keysym.
+func (c *Client) KeyEvent(keysym uint32, down bool) error {
+	ev := types.KeyEvent{Key: keysym}
+	if down {
+		ev.DownFlag = 1
+	}
+	return c.send(msgKeyEvent, ev.DownFlag, [2]byte{}, ev.Key)
+}
+
+// PointerEvent sends the pointer position and button state. The position is clamped
+// to the framebuffer.
+func (c *Client) PointerEvent(x, y int, buttonMask uint8) error {
+	width, height := c.Size()
+	return c.send(msgPointerEvent, types.PointerEvent{
+		ButtonMask: buttonMask,
+		X:          uint16(clamp(x, width-1)),
+		Y:          uint16(clamp(y, height-1)),
+	})
+}
+
+// CutText sends clipboard text. RFB text is Latin-1, characters outside of it are
+// replaced with question marks.
+func (c *Client) CutText(text string) error {
+	buf := make([]byte, 0, len(text))
+	for _, r := range text {
+		if r > 0xff {
+			r = '?'
+		}
+		buf = append(buf, byte(r))
+	}
+	return c.send(msgClientCutText, [3]byte{}, uint32(len(buf)), buf)
+}
+
+// Run reads messages from the server until the connection fails or is closed, calling
+// the callbacks in the options. Updates must be requested with RequestUpdate.
+func (c *Client) Run() error {
+	for {
+		msgType, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch msgType {
+		case msgFramebufferUpdate:
+			err = c.readUpdate()
+		case msgSetColourMapEntries:
+			// True colour is always requested, but the message must still be consumed
+			var hdr struct {
+				_                  byte
+				FirstColour, Count uint16
+			}
+			if err = binary.Read(c.r, binary.BigEndian, &hdr); err == nil {
+				_, err = c.r.Discard(int(hdr.Count) * 6)
+			}
+		case msgBell:
+			if c.opts.OnBell != nil {
+				c.opts.OnBell()
+			}
+		case msgServerCutText:
+			err = c.readCutText()
+		default:
+			return fmt.Errorf("Unsupported message type %d from server", msgType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readCutText reads clipboard text, which is Latin-1.
+func (c *Client) readCutText() error {
+	if _, err := c.r.Discard(3); err != nil {
+		return err
+	}
+	text, err := c.readReason()
+	if err != nil {
+		return err
+	}
+	runes := make([]rune, len(text))
+	for i := 0; i < len(text); i++ {
+		runes[i] = rune(text[i])
+	}
+	if c.opts.OnCutText != nil {
+		c.opts.OnCutText(string(runes))
+	}
+	return nil
+}
+
+// readUpdate reads a framebuffer update and applies it to the framebuffer.
+func (c *Client) readUpdate() error {
+	var hdr struct {
+		_     byte
+		Count uint16
+	}
+	if err := binary.Read(c.r, binary.BigEndian, &hdr); err != nil {
+		return err
+	}
+	var damaged image.Rectangle
+	var resized bool
+	c.fbMux.Lock()
+	for i := 0; i < int(hdr.Count); i++ {
+		var rect types.FrameBufferRectangle
+		if err := binary.Read(c.r, binary.BigEndian, &rect); err != nil {
+			c.fbMux.Unlock()
+			return err
+		}
+		r := image.Rect(int(rect.X), int(rect.Y), int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height))
+		if rect.EncType == EncodingDesktopSize {
+			c.fb = newFramebuffer(r.Dx(), r.Dy())
+			damaged, resized = c.fb.Bounds(), true
+			continue
+		}
+		if !r.In(c.fb.Bounds()) {
+			c.fbMux.Unlock()
+			return fmt.Errorf("Rectangle %v is outside the framebuffer", r)
+		}
+		if err := c.decode(rect.EncType, r); err != nil {
+			c.fbMux.Unlock()
+			return err
+		}
+		damaged = damaged.Union(r)
+	}
+	width, height := c.fb.Bounds().Dx(), c.fb.Bounds().Dy()
+	c.fbMux.Unlock()
+
+	if resized && c.opts.OnResize != nil {
+		c.opts.OnResize(width, height)
+	}
+	if c.opts.OnUpdate != nil {
+		c.opts.OnUpdate(damaged)
+	}
+	return nil
+}
+
+// send writes a message made of the given values.
+func (c *Client) send(msgType uint8, data ...interface{}) error {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(msgType)
+	for _, v := range data {
+		if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return c.write(buf.Bytes())
+}
+
+func (c *Client) write(b []byte) error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func newFramebuffer(width, height int) *image.RGBA {
+	fb := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 3; i < len(fb.Pix); i += 4 {
+		fb.Pix[i] = 0xff
+	}
+	return fb
+}
+
+func clamp(v, max int) int {
+	if v < 0 {
+		return 0
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,361 @@
+package client
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+)
+
+// Hextile subencoding flags
+const (
+	hextileRaw                 = 1
+	hextileBackgroundSpecified = 2
+	hextileForegroundSpecified = 4
+	hextileAnySubrects         = 8
+	hextileSubrectsColoured    = 16
+)
+
+// Tile sizes of the tiled encodings
+const (
+	hextileTileSize = 16
+	zrleTileSize    = 64
+)
+
+// pixel is a pixel in the requested format, which is also how image.RGBA stores it.
+type pixel [4]byte
+
+// decode reads a rectangle of the given encoding into the framebuffer, which must
+// be locked.
+func (c *Client) decode(enc int32, r image.Rectangle) error {
+	switch enc {
+	case EncodingRaw:
+		return c.readRaw(c.r, r, 4)
+	case EncodingCopyRect:
+		return c.readCopyRect(r)
+	case EncodingRRE:
+		return c.readRRE(r)
+	case EncodingHextile:
+		return c.readHextile(r)
+	case EncodingZRLE:
+		return c.readZRLE(r)
+	}
+	return fmt.Errorf("Unsupported encoding %d from server", enc)
+}
+
+// readRaw reads the pixels of a rectangle row by row. ZRLE sends pixels without the
+// padding byte, so the size of a pixel is given.
+func (c *Client) readRaw(rd io.Reader, r image.Rectangle, size int) error {
+	row := make([]byte, r.Dx()*size)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		if _, err := io.ReadFull(rd, row); err != nil {
+			return err
+		}
+		dst := c.fb.Pix[c.fb.PixOffset(r.Min.X, y):]
+		for x := 0; x < r.Dx(); x++ {
+			copy(dst[x*4:x*4+3], row[x*size:])
+			dst[x*4+3] = 0xff
+		}
+	}
+	return nil
+}
+
+// readCopyRect copies another region of the framebuffer into the rectangle.
+func (c *Client) readCopyRect(r image.Rectangle) error {
+	var src struct{ X, Y uint16 }
+	if err := binary.Read(c.r, binary.BigEndian, &src); err != nil {
+		return err
+	}
+	sr := r.Sub(r.Min).Add(image.Pt(int(src.X), int(src.Y)))
+	if !sr.In(c.fb.Bounds()) {
+		return fmt.Errorf("CopyRect source %v is outside the framebuffer", sr)
+	}
+	// The regions may overlap, rows are copied in the order that keeps the source intact
+	rowLen := r.Dx() * 4
+	copyRow := func(i int) {
+		copy(c.fb.Pix[c.fb.PixOffset(r.Min.X, r.Min.Y+i):][:rowLen], c.fb.Pix[c.fb.PixOffset(sr.Min.X, sr.Min.Y+i):][:rowLen])
+	}
+	if sr.Min.Y < r.Min.Y {
+		for i := r.Dy() - 1; i >= 0; i-- {
+			copyRow(i)
+		}
+		return nil
+	}
+	for i := 0; i < r.Dy(); i++ {
+		copyRow(i)
+	}
+	return nil
+}
+
+// readRRE reads a background colour followed by solid subrectangles.
+func (c *Client) readRRE(r image.Rectangle) error {
+	var hdr struct {
+		Count      uint32
+		Background pixel
+	}
+	if err := binary.Read(c.r, binary.BigEndian, &hdr); err != nil {
+		return err
+	}
+	c.fill(r, hdr.Background)
+	for i := uint32(0); i < hdr.Count; i++ {
+		var sub struct {
+			Colour              pixel
+			X, Y, Width, Height uint16
+		}
+		if err := binary.Read(c.r, binary.BigEndian, &sub); err != nil {
+			return err
+		}
+		sr := image.Rect(int(sub.X), int(sub.Y), int(sub.X)+int(sub.Width), int(sub.Y)+int(sub.Height))
+		c.fill(sr.Add(r.Min).Intersect(r), sub.Colour)
+	}
+	return nil
+}
+
+// readHextile reads a rectangle split into tiles of 16x16 pixels. The background and
+// foreground colours carry over from one tile to the next.
+func (c *Client) readHextile(r image.Rectangle) error {
+	var bg, fg pixel
+	for ty := r.Min.Y; ty < r.Max.Y; ty += hextileTileSize {
+		for tx := r.Min.X; tx < r.Max.X; tx += hextileTileSize {
+			tile := image.Rect(tx, ty, tx+hextileTileSize, ty+hextileTileSize).Intersect(r)
+			sub, err := c.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if sub&hextileRaw != 0 {
+				if err := c.readRaw(c.r, tile, 4); err != nil {
+					return err
+				}
+				continue
+			}
+			if sub&hextileBackgroundSpecified != 0 {
+				if _, err := io.ReadFull(c.r, bg[:]); err != nil {
+					return err
+				}
+			}
+			c.fill(tile, bg)
+			if sub&hextileForegroundSpecified != 0 {
+				if _, err := io.ReadFull(c.r, fg[:]); err != nil {
+					return err
+				}
+			}
+			if sub&hextileAnySubrects == 0 {
+				continue
+			}
+			count, err := c.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			for i := 0; i < int(count); i++ {
+				colour := fg
+				if sub&hextileSubrectsColoured != 0 {
+					if _, err := io.ReadFull(c.r, colour[:]); err != nil {
+						return err
+					}
+				}
+				var geom [2]byte
+				if _, err := io.ReadFull(c.r, geom[:]); err != nil {
+					return err
+				}
+				x, y := tile.Min.X+int(geom[0]>>4), tile.Min.Y+int(geom[0]&0xf)
+				w, h := int(geom[1]>>4)+1, int(geom[1]&0xf)+1
+				c.fill(image.Rect(x, y, x+w, y+h).Intersect(tile), colour)
+			}
+		}
+	}
+	return nil
+}
+
+// zlibStream inflates the zlib data of ZRLE rectangles. All rectangles of a connection
+// are one stream, each ending with a flush.
+type zlibStream struct {
+	buf bytes.Buffer
+	r   io.ReadCloser
+}
+
+// feed adds the compressed data of a rectangle.
+func (z *zlibStream) feed(r io.Reader, n int64) error {
+	if _, err := io.CopyN(&z.buf, r, n); err != nil {
+		return err
+	}
+	if z.r == nil {
+		zr, err := zlib.NewReader(&z.buf)
+		if err != nil {
+			return err
+		}
+		z.r = zr
+	}
+	return nil
+}
+
+func (z *zlibStream) Read(p []byte) (int, error) { return z.r.Read(p) }
+
+// readZRLE reads a rectangle split into tiles of 64x64 pixels, each of which is raw,
+// solid, palette or run-length encoded.
+func (c *Client) readZRLE(r image.Rectangle) error {
+	var length uint32
+	if err := binary.Read(c.r, binary.BigEndian, &length); err != nil {
+		return err
+	}
+	if err := c.zrle.feed(c.r, int64(length)); err != nil {
+		return fmt.Errorf("Could not read ZRLE data: %s", err.Error())
+	}
+	zr := c.zrle
+	for ty := r.Min.Y; ty < r.Max.Y; ty += zrleTileSize {
+		for tx := r.Min.X; tx < r.Max.X; tx += zrleTileSize {
+			tile := image.Rect(tx, ty, tx+zrleTileSize, ty+zrleTileSize).Intersect(r)
+			if err := c.readZRLETile(zr, tile); err != nil {
+				return fmt.Errorf("Invalid ZRLE tile: %s", err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// readZRLETile reads one tile of a ZRLE rectangle. Pixels are compressed to three
+// bytes, since the padding byte is always zero.
+func (c *Client) readZRLETile(zr io.Reader, tile image.Rectangle) error {
+	var sub [1]byte
+	if _, err := io.ReadFull(zr, sub[:]); err != nil {
+		return err
+	}
+	switch subenc := int(sub[0]); {
+	case subenc == 0:
+		return c.readRaw(zr, tile, 3)
+
+	case subenc == 1:
+		palette, err := readCPixels(zr, 1)
+		if err != nil {
+			return err
+		}
+		c.fill(tile, palette[0])
+		return nil
+
+	case subenc <= 16:
+		palette, err := readCPixels(zr, subenc)
+		if err != nil {
+			return err
+		}
+		bits := 4
+		switch {
+		case subenc == 2:
+			bits = 1
+		case subenc <= 4:
+			bits = 2
+		}
+		// Rows of indices are packed from the most significant bit and padded to bytes
+		row := make([]byte, (tile.Dx()*bits+7)/8)
+		mask := byte(1<<uint(bits) - 1)
+		for y := tile.Min.Y; y < tile.Max.Y; y++ {
+			if _, err := io.ReadFull(zr, row); err != nil {
+				return err
+			}
+			for x := 0; x < tile.Dx(); x++ {
+				shift := uint(8 - bits - (x*bits)%8)
+				idx := int(row[x*bits/8]>>shift) & int(mask)
+				if idx >= len(palette) {
+					return fmt.Errorf("palette index %d out of range", idx)
+				}
+				c.setPixel(tile.Min.X+x, y, palette[idx])
+			}
+		}
+		return nil
+
+	case subenc == 128:
+		return c.readRuns(zr, tile, func() (pixel, int, error) {
+			p, err := readCPixels(zr, 1)
+			if err != nil {
+				return pixel{}, 0, err
+			}
+			n, err := readRunLength(zr)
+			return p[0], n, err
+		})
+
+	case subenc >= 130:
+		palette, err := readCPixels(zr, subenc-128)
+		if err != nil {
+			return err
+		}
+		return c.readRuns(zr, tile, func() (pixel, int, error) {
+			var idx [1]byte
+			if _, err := io.ReadFull(zr, idx[:]); err != nil {
+				return pixel{}, 0, err
+			}
+			i := int(idx[0] & 0x7f)
+			if i >= len(palette) {
+				return pixel{}, 0, fmt.Errorf("palette index %d out of range", i)
+			}
+			// Runs of one pixel have no length
+			if idx[0]&0x80 == 0 {
+				return palette[i], 1, nil
+			}
+			n, err := readRunLength(zr)
+			return palette[i], n, err
+		})
+	}
+	return fmt.Errorf("unsupported subencoding %d", sub[0])
+}
+
+// readRuns fills a tile from left to right and top to bottom with the runs returned
+// by next.
+func (c *Client) readRuns(zr io.Reader, tile image.Rectangle, next func() (pixel, int, error)) error {
+	total := tile.Dx() * tile.Dy()
+	for i := 0; i < total; {
+		p, n, err := next()
+		if err != nil {
+			return err
+		}
+		if n > total-i {
+			return fmt.Errorf("run of %d pixels overflows the tile", n)
+		}
+		for end := i + n; i < end; i++ {
+			c.setPixel(tile.Min.X+i%tile.Dx(), tile.Min.Y+i/tile.Dx(), p)
+		}
+	}
+	return nil
+}
+
+// readCPixels reads n compressed pixels.
+func readCPixels(zr io.Reader, n int) ([]pixel, error) {
+	buf := make([]byte, n*3)
+	if _, err := io.ReadFull(zr, buf); err != nil {
+		return nil, err
+	}
+	pixels := make([]pixel, n)
+	for i := range pixels {
+		copy(pixels[i][:3], buf[i*3:])
+	}
+	return pixels, nil
+}
+
+// readRunLength reads a run length, the sum of its bytes plus one where every byte
+// but the last is 255.
+func readRunLength(zr io.Reader) (int, error) {
+	n := 1
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(zr, b[:]); err != nil {
+			return 0, err
+		}
+		n += int(b[0])
+		if b[0] != 0xff {
+			return n, nil
+		}
+	}
+}
+
+// fill fills a region of the framebuffer with a pixel.
+func (c *Client) fill(r image.Rectangle, p pixel) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c.setPixel(x, y, p)
+		}
+	}
+}
+
+func (c *Client) setPixel(x, y int, p pixel) {
+	i := c.fb.PixOffset(x, y)
+	c.fb.Pix[i], c.fb.Pix[i+1], c.fb.Pix[i+2], c.fb.Pix[i+3] = p[0], p[1], p[2], 0xff
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+var (
+	red   = pixel{0xff, 0, 0}
+	green = pixel{0, 0xff, 0}
+	blue  = pixel{0, 0, 0xff}
+	white = pixel{0xff, 0xff, 0xff}
+	black = pixel{}
+)
+
+// newTestClient returns a client with a black framebuffer of the given size that reads
+// the given data.
+func newTestClient(width, height int, data []byte) *Client {
+	return &Client{
+		r:    bufio.NewReader(bytes.NewReader(data)),
+		fb:   newFramebuffer(width, height),
+		zrle: &zlibStream{},
+	}
+}
+
+// message builds the big-endian encoding of the given values.
+func message(t *testing.T, values ...interface{}) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, v := range values {
+		if err := binary.Write(&buf, binary.BigEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func expectPixel(t *testing.T, c *Client, x, y int, want pixel) {
+	t.Helper()
+	if got := c.fb.RGBAAt(x, y); got.R != want[0] || got.G != want[1] || got.B != want[2] || got.A != 0xff {
+		t.Fatalf("Expected pixel (%d, %d) to be %v, got %v", x, y, want, got)
+	}
+}
+
+// expectPixels checks the framebuffer against rows of pixels, starting at the origin.
+func expectPixels(t *testing.T, c *Client, rows ...[]pixel) {
+	t.Helper()
+	for y, row := range rows {
+		for x, want := range row {
+			expectPixel(t, c, x, y, want)
+		}
+	}
+}
+
+func TestDecodeRaw(t *testing.T) {
+	c := newTestClient(3, 2, message(t, red, green, blue, white))
+	if err := c.decode(EncodingRaw, image.Rect(1, 0, 3, 2)); err != nil {
+		t.Fatal(err)
+	}
+	expectPixels(t, c,
+		[]pixel{black, red, green},
+		[]pixel{black, blue, white},
+	)
+	if err := c.decode(EncodingRaw, image.Rect(0, 0, 1, 1)); err == nil {
+		t.Fatal("Expected an error for truncated data")
+	}
+}
+
+func TestDecodeCopyRect(t *testing.T) {
+	rows := [][]pixel{
+		{red, green, blue},
+		{white, black, red},
+		{green, green, green},
+	}
+	c := newTestClient(3, 3, nil)
+	for y, row := range rows {
+		for x, p := range row {
+			c.setPixel(x, y, p)
+		}
+	}
+	// Copy the top two rows down by one, overlapping the source
+	c.r = bufio.NewReader(bytes.NewReader(message(t, uint16(0), uint16(0))))
+	if err := c.decode(EncodingCopyRect, image.Rect(0, 1, 3, 3)); err != nil {
+		t.Fatal(err)
+	}
+	expectPixels(t, c, rows[0], rows[0], rows[1])
+
+	c.r = bufio.NewReader(bytes.NewReader(message(t, uint16(2), uint16(2))))
+	if err := c.decode(EncodingCopyRect, image.Rect(0, 0, 2, 2)); err == nil {
+		t.Fatal("Expected an error for a source outside the framebuffer")
+	}
+}
+
+func TestDecodeRRE(t *testing.T) {
+	c := newTestClient(4, 3, message(t,
+		uint32(2), blue,
+		red, uint16(1), uint16(0), uint16(2), uint16(1),
+		// Clipped to the rectangle
+		green, uint16(2), uint16(1), uint16(5), uint16(5),
+	))
+	if err := c.decode(EncodingRRE, image.Rect(0, 0, 3, 2)); err != nil {
+		t.Fatal(err)
+	}
+	expectPixels(t, c,
+		[]pixel{blue, red, red, black},
+		[]pixel{blue, blue, green, black},
+		[]pixel{black, black, black, black},
+	)
+}
+
+func TestDecodeHextile(t *testing.T) {
+	// Three tiles of a 40x2 rectangle: one with a subrectangle, one reusing the
+	// background of the first, and a raw one.
+	raw := make([]interface{}, 0, 16)
+	for i := 0; i < 16; i++ {
+		raw = append(raw, white)
+	}
+	data := message(t, append([]interface{}{
+		uint8(hextileBackgroundSpecified | hextileForegroundSpecified | hextileAnySubrects), blue, red,
+		uint8(1), uint8(1<<4 | 0), uint8(1<<4 | 1), // 2x2 at (1, 0)
+		uint8(hextileAnySubrects | hextileSubrectsColoured),
+		uint8(1), green, uint8(0<<4 | 1), uint8(0<<4 | 0), // 1x1 at (0, 1)
+		uint8(hextileRaw),
+	}, raw...)...)
+	c := newTestClient(40, 2, data)
+	if err := c.decode(EncodingHextile, image.Rect(0, 0, 40, 2)); err != nil {
+		t.Fatal(err)
+	}
+	expectPixels(t, c,
+		[]pixel{blue, red, red, blue},
+		[]pixel{blue, red, red, blue},
+	)
+	for _, tc := range []struct {
+		x, y int
+		want pixel
+	}{{16, 0, blue}, {16, 1, green}, {17, 1, blue}, {31, 1, blue}, {32, 0, white}, {39, 1, white}} {
+		expectPixel(t, c, tc.x, tc.y, tc.want)
+	}
+}
+
+func TestDecodeZRLE(t *testing.T) {
+	// All rectangles of a connection share one zlib stream
+	var stream bytes.Buffer
+	zw := zlib.NewWriter(&stream)
+	rect := func(tiles ...[]byte) []byte {
+		for _, tile := range tiles {
+			zw.Write(tile)
+		}
+		if err := zw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		data := append(message(t, uint32(stream.Len())), stream.Bytes()...)
+		stream.Reset()
+		return data
+	}
+	cpixel := func(p pixel) []byte { return p[:3] }
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	c := newTestClient(70, 2, nil)
+	var data []byte
+	// A solid 64x2 tile, and a 6x2 tile with a palette of two colours packed one bit
+	// per pixel
+	data = append(data, rect(
+		cat([]byte{1}, cpixel(red)),
+		cat([]byte{2}, cpixel(green), cpixel(blue), []byte{0x54, 0xa8}),
+	)...)
+	// A plain RLE tile, a palette RLE tile and a raw tile
+	data = append(data, rect(cat([]byte{128}, cpixel(white), []byte{1}, cpixel(blue), []byte{0}))...)
+	data = append(data, rect(cat([]byte{130}, cpixel(black), cpixel(green), []byte{0x81, 1, 0}))...)
+	data = append(data, rect(cat([]byte{0}, cpixel(red), cpixel(blue)))...)
+	c.r = bufio.NewReader(bytes.NewReader(data))
+
+	if err := c.decode(EncodingZRLE, image.Rect(0, 0, 70, 2)); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		x, y int
+		want pixel
+	}{{0, 0, red}, {63, 1, red}, {64, 0, green}, {65, 0, blue}, {66, 0, green}, {69, 0, blue}, {64, 1, blue}, {65, 1, green}} {
+		expectPixel(t, c, tc.x, tc.y, tc.want)
+	}
+
+	if err := c.decode(EncodingZRLE, image.Rect(0, 0, 3, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.decode(EncodingZRLE, image.Rect(0, 1, 3, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.decode(EncodingZRLE, image.Rect(3, 0, 5, 1)); err != nil {
+		t.Fatal(err)
+	}
+	expectPixels(t, c,
+		[]pixel{white, white, blue, red, blue},
+		[]pixel{green, green, black},
+	)
+}
@@ -1,11 +1,15 @@
 package rfb
 
 import (
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/tinyzimmer/gsvnc/pkg/buffer"
 	"github.com/tinyzimmer/gsvnc/pkg/display"
 	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/auth"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/encodings"
 	"github.com/tinyzimmer/gsvnc/pkg/rfb/events"
 )
 
@@ -15,34 +19,122 @@ type Conn struct {
 	s       *Server
 	buf     *buffer.ReadWriter
 	display *display.Display
+
+	// Session information
+	id          string
+	remoteAddr  string
+	username    string
+	authType    auth.Type
+	connectedAt time.Time
+	counter     *countingConn
+
+	// The deadline for the version handshake. Zero means no deadline, which is used
+	// for connections parked at a repeater until a viewer arrives.
+	versionTimeout time.Duration
+
+	// Set once the handshake is complete, and when the session is disconnected through
+	// the server. Guarded by the server's connection lock.
+	admitted      bool
+	disconnecting bool
 }
 
-func (s *Server) newConn(c net.Conn) *Conn {
+// newConn sets up a client connection on the given network connection. If its display
+// can't be created, the network connection is closed and an error returned.
+func (s *Server) newConn(netConn net.Conn) (*Conn, error) {
+	id := s.nextConnID()
+	remoteAddr := remoteAddrOf(netConn)
+	c := &countingConn{Conn: netConn}
 	buf := buffer.NewReadWriteBuffer(c)
+	// Changes to the enabled encodings only apply to new connections
+	enabledEncodings := s.getEnabledEncodings()
+	d, err := display.NewDisplay(&display.Opts{
+		Width:           s.width,
+		Height:          s.height,
+		Buffer:          buf,
+		DisplayProvider: s.displayProvider,
+		ProviderOptions: s.providerOptions,
+		SharedProvider:  s.sharedProvider,
+		GetEncodingFunc: func(encs []int32) encodings.Encoding { return pickEncoding(enabledEncodings, encs) },
+		Clipboard:       s.clipboard,
+		ClipboardPolicy: s.clipboardPolicy,
+		ConnID:          fmt.Sprintf("%s (%s)", id, remoteAddr),
+	})
+	if err != nil {
+		log.Errorf("Refusing client %s: %s", remoteAddr, err.Error())
+		buf.Close()
+		netConn.Close()
+		return nil, err
+	}
 	conn := &Conn{
-		c:   c,
-		s:   s,
-		buf: buf,
-		display: display.NewDisplay(&display.Opts{
-			Width:           s.width,
-			Height:          s.height,
-			Buffer:          buf,
-			DisplayProvider: s.displayProvider,
-			GetEncodingFunc: s.GetEncoding,
-		}),
+		c:              c,
+		s:              s,
+		buf:            buf,
+		id:             id,
+		remoteAddr:     remoteAddr,
+		connectedAt:    time.Now(),
+		counter:        c,
+		versionTimeout: s.versionTimeout,
+		display:        d,
 	}
-	return conn
+	return conn, nil
+}
+
+// flushTimeout is how long to wait for queued messages to be written to a client
+// when closing its connection.
+const flushTimeout = time.Second * 5
+
+// close writes out any queued messages and closes the connection.
+func (c *Conn) close() {
+	c.c.SetWriteDeadline(time.Now().Add(flushTimeout))
+	c.buf.Close()
+	c.c.Close()
+}
+
+// setDeadline sets the deadline for the next phase of the connection. A zero
+// timeout clears it. If the server is shutting down or the session is being
+// disconnected, the deadline is set to now.
+func (c *Conn) setDeadline(timeout time.Duration) {
+	c.s.connsMux.Lock()
+	defer c.s.connsMux.Unlock()
+	if c.s.shuttingDown || c.disconnecting {
+		c.c.SetDeadline(time.Now())
+		return
+	}
+	if timeout == 0 {
+		c.c.SetDeadline(time.Time{})
+		return
+	}
+	c.c.SetDeadline(time.Now().Add(timeout))
+}
+
+func (c *Conn) isDisconnecting() bool {
+	c.s.connsMux.Lock()
+	defer c.s.connsMux.Unlock()
+	return c.disconnecting
 }
 
 func (c *Conn) serve() {
-	defer c.c.Close()
+	defer c.close()
 
+	c.display.SetUser(c.username)
 	if err := c.display.Start(); err != nil {
 		log.Errorf("Error starting display: %s", err)
 		return
 	}
 	defer c.display.Close()
 
+	// Disconnect the client if the display provider stops
+	served := make(chan struct{})
+	defer close(served)
+	go func() {
+		select {
+		case <-c.display.Done():
+			log.Infof("Display provider stopped, disconnecting client %s", c.display.ConnID())
+			c.c.Close()
+		case <-served:
+		}
+	}()
+
 	// Get a map of event handlers for this connection
 	eventHandlers := c.s.GetEventHandlerMap()
 	defer events.CloseEventHandlers(eventHandlers)
@@ -51,6 +143,13 @@ func (c *Conn) serve() {
 	for {
 		cmd, err := c.buf.ReadByte()
 		if err != nil {
+			if c.s.isShuttingDown() {
+				log.Infof("Disconnecting client %s, server is shutting down", c.display.ConnID())
+				return
+			}
+			if c.isDisconnecting() {
+				return
+			}
 			log.Errorf("Client disconnect: %s", err.Error())
 			return
 		}
@@ -12,9 +12,8 @@ import (
 func applyPixelFormat(img *image.RGBA, format *types.PixelFormat) []byte {
 	formattedImage := new(bytes.Buffer)
 	b := img.Bounds()
-	width, height := b.Dx(), b.Dy()
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
 			col := img.At(x, y)
 			r16, g16, b16, _ := col.RGBA()
 			r16 = inRange(r16, format.RedMax)
@@ -1,6 +1,8 @@
 package events
 
 import (
+	"errors"
+
 	"github.com/tinyzimmer/gsvnc/pkg/buffer"
 	"github.com/tinyzimmer/gsvnc/pkg/display"
 	"github.com/tinyzimmer/gsvnc/pkg/rfb/types"
@@ -22,7 +24,21 @@ func (c *ClientCutText) Handle(buf *buffer.ReadWriter, d *display.Display) error
 		return err
 	}
 
-	req.Text = make([]byte, req.Length)
+	size := int(req.Length)
+	if req.IsExtended() {
+		if !d.ExtendedClipboardEnabled() {
+			return errors.New("client sent extended clipboard message without negotiating it")
+		}
+		size = -size
+	}
+
+	// Check the size and policy before allocating anything
+	if !d.CutTextAllowed(size, req.IsExtended()) {
+		_, err := buf.Reader().Discard(size)
+		return err
+	}
+
+	req.Text = make([]byte, size)
 
 	if err := buf.Read(&req.Text); err != nil {
 		return err
@@ -0,0 +1,144 @@
+package rfb
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/auth"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/encodings"
+)
+
+// GetEnabledEncodings returns the names of the encodings enabled for new connections.
+func (s *Server) GetEnabledEncodings() []string {
+	encs := s.getEnabledEncodings()
+	out := make([]string, len(encs))
+	for i, enc := range encs {
+		out[i] = reflect.TypeOf(enc).Elem().Name()
+	}
+	return out
+}
+
+// SetEnabledEncodings sets the encodings enabled for new connections by name. The
+// names must be from the default set of encodings. Existing connections are unaffected.
+func (s *Server) SetEnabledEncodings(names []string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("At least one encoding must be enabled")
+	}
+	encs := make([]encodings.Encoding, 0, len(names))
+	for _, name := range names {
+		enc := findByName(encodings.GetDefaults(), name)
+		if enc == nil {
+			return fmt.Errorf("Unknown encoding: %s", name)
+		}
+		encs = append(encs, enc.(encodings.Encoding))
+	}
+	s.featuresMux.Lock()
+	s.enabledEncodings = encs
+	s.featuresMux.Unlock()
+	log.Info("Enabled encodings for new connections: ", names)
+	return nil
+}
+
+// GetEnabledAuthTypes returns the names of the security types enabled for new connections.
+func (s *Server) GetEnabledAuthTypes() []string {
+	tt := s.getEnabledAuthTypes()
+	out := make([]string, len(tt))
+	for i, t := range tt {
+		out[i] = reflect.TypeOf(t).Elem().Name()
+	}
+	return out
+}
+
+// SetEnabledAuthTypes sets the security types enabled for new connections by name. The
+// names must be from the default set of security types. Existing connections are unaffected.
+func (s *Server) SetEnabledAuthTypes(names []string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("At least one security type must be enabled")
+	}
+	tt := make([]auth.Type, 0, len(names))
+	for _, name := range names {
+		t := findByName(auth.GetDefaults(), name)
+		if t == nil {
+			return fmt.Errorf("Unknown security type: %s", name)
+		}
+		tt = append(tt, t.(auth.Type))
+	}
+	tt = s.configureAuthTypes(tt)
+	s.featuresMux.Lock()
+	s.enabledAuthTypes = tt
+	s.featuresMux.Unlock()
+	log.Info("Enabled security types for new connections: ", names)
+	return nil
+}
+
+// SetPassword sets the password used by VNCAuth for new connections.
+func (s *Server) SetPassword(password string) {
+	s.featuresMux.Lock()
+	defer s.featuresMux.Unlock()
+	s.serverPassword = password
+}
+
+func (s *Server) getPassword() string {
+	s.featuresMux.RLock()
+	defer s.featuresMux.RUnlock()
+	return s.serverPassword
+}
+
+// SetUsers sets the VNCAuth passwords by username used for new connections.
+func (s *Server) SetUsers(users map[string]string) {
+	s.featuresMux.Lock()
+	defer s.featuresMux.Unlock()
+	s.users = users
+}
+
+func (s *Server) getUsers() map[string]string {
+	s.featuresMux.RLock()
+	defer s.featuresMux.RUnlock()
+	return s.users
+}
+
+func (s *Server) getEnabledEncodings() []encodings.Encoding {
+	s.featuresMux.RLock()
+	defer s.featuresMux.RUnlock()
+	return s.enabledEncodings
+}
+
+func (s *Server) getEnabledAuthTypes() []auth.Type {
+	s.featuresMux.RLock()
+	defer s.featuresMux.RUnlock()
+	return s.enabledAuthTypes
+}
+
+// configureAuthTypes returns copies of the given auth types, with any that need access to
+// the server wired up to it. Copies are used so that servers sharing the same (usually
+// default) auth types don't overwrite each other's configuration.
+func (s *Server) configureAuthTypes(tt []auth.Type) []auth.Type {
+	out := make([]auth.Type, len(tt))
+	for i, t := range tt {
+		rv := reflect.New(reflect.TypeOf(t).Elem())
+		rv.Elem().Set(reflect.ValueOf(t).Elem())
+		out[i] = rv.Interface().(auth.Type)
+		switch a := out[i].(type) {
+		case *auth.TightSecurity:
+			a.AuthGetter = s.GetAuth
+			// TODO: Configure capabilities
+		case *auth.VNCAuth:
+			a.PasswordGetter = s.getPassword
+			a.UsersGetter = s.getUsers
+		}
+	}
+	return out
+}
+
+// findByName returns the item in the given slice whose type has the given name.
+func findByName(items interface{}, name string) interface{} {
+	rv := reflect.ValueOf(items)
+	for i := 0; i < rv.Len(); i++ {
+		item := rv.Index(i).Interface()
+		if reflect.TypeOf(item).Elem().Name() == name {
+			return item
+		}
+	}
+	return nil
+}
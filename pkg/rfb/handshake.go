@@ -15,20 +15,28 @@ import (
 
 func (c *Conn) doHandshake() error {
 
+	c.setDeadline(c.versionTimeout)
 	ver, err := versions.NegotiateProtocolVersion(c.buf)
 	if err != nil {
 		return err
 	}
 
+	c.setDeadline(c.s.authTimeout)
 	var authType auth.Type
 	if authType, err = c.negotiateAuth(ver, c.buf); err != nil {
 		return err
 	}
+	c.authType = authType
 
 	log.Info("Reading client init")
+	c.setDeadline(c.s.clientInitTimeout)
 
 	// ClientInit
-	if _, err := c.buf.ReadByte(); err != nil {
+	shared, err := c.buf.ReadByte()
+	if err != nil {
+		return err
+	}
+	if err := c.s.admitConn(c, shared != 0); err != nil {
 		return err
 	}
 
@@ -54,9 +62,31 @@ func (c *Conn) doHandshake() error {
 	}
 
 	c.buf.Dispatch(buf.Bytes())
+
+	// The handshake is complete, clear the deadline
+	c.setDeadline(0)
 	return nil
 }
 
+// refuse negotiates the protocol version with the client and then refuses the
+// connection with the given reason, before closing it.
+func (c *Conn) refuse(reason string) {
+	defer c.close()
+
+	c.setDeadline(c.versionTimeout)
+	if _, err := versions.NegotiateProtocolVersion(c.buf); err != nil {
+		log.Error("Error negotiating version with refused client: ", err.Error())
+		return
+	}
+
+	// 6.1.2. An empty list of security types followed by the reason
+	buf := new(bytes.Buffer)
+	util.Write(buf, uint8(0))
+	util.Write(buf, uint32(len(reason)))
+	util.Write(buf, []byte(reason))
+	c.buf.Dispatch(buf.Bytes())
+}
+
 const (
 	statusOK     = 0
 	statusFailed = 1
@@ -69,8 +99,9 @@ func (c *Conn) negotiateAuth(ver string, rw *buffer.ReadWriter) (auth.Type, erro
 
 	log.Info("Negotiating security")
 
-	util.Write(buf, uint8(len(c.s.enabledAuthTypes)))
-	for _, t := range c.s.enabledAuthTypes {
+	enabledAuthTypes := c.s.getEnabledAuthTypes()
+	util.Write(buf, uint8(len(enabledAuthTypes)))
+	for _, t := range enabledAuthTypes {
 		util.Write(buf, t.Code())
 	}
 	rw.Dispatch(buf.Bytes())
@@ -85,14 +116,30 @@ func (c *Conn) negotiateAuth(ver string, rw *buffer.ReadWriter) (auth.Type, erro
 	authType := c.s.GetAuth(wanted)
 	log.Info("Using security: ", reflect.TypeOf(authType).Elem().Name())
 
-	if err := authType.Negotiate(rw); err != nil {
+	username, err := auth.Negotiate(authType, rw)
+	if err != nil {
 		log.Error("Authentication failed")
+		reason := "Authentication failed"
+		if c.s.isShuttingDown() {
+			reason = "Server is shutting down"
+		}
 		buf = new(bytes.Buffer)
 		util.Write(buf, uint32(statusFailed))
+		if ver >= versions.V8 {
+			// 6.1.3. Version 3.8 follows a failed SecurityResult with the reason
+			util.Write(buf, uint32(len(reason)))
+			util.Write(buf, []byte(reason))
+		}
 		rw.Dispatch(buf.Bytes())
 		return nil, err
 	}
 
+	// Users identified by a websocket token keep that name
+	if username != "" {
+		log.Infof("Client %s authenticated as %q", c.remoteAddr, username)
+		c.username = username
+	}
+
 	if ver >= versions.V8 {
 		// 6.1.3. SecurityResult
 		buf = new(bytes.Buffer)
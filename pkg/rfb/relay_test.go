@@ -0,0 +1,151 @@
+package rfb
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/client"
+)
+
+// upstreamCanvas is a canvas filled with a color that records the input sent to it.
+type upstreamCanvas struct {
+	*providers.Canvas
+	keys     chan uint32
+	pointers chan image.Point
+}
+
+func newUpstreamCanvas(fill color.Color) *upstreamCanvas {
+	u := &upstreamCanvas{
+		Canvas:   providers.NewCanvas(16, 8),
+		keys:     make(chan uint32, 16),
+		pointers: make(chan image.Point, 16),
+	}
+	u.OnKey = func(keysym uint32, down bool) {
+		if down {
+			u.keys <- keysym
+		}
+	}
+	u.OnPointer = func(x, y int, buttonMask uint8) { u.pointers <- image.Pt(x, y) }
+	draw.Draw(u.Image(), u.Bounds(), image.NewUniform(fill), image.Point{}, draw.Src)
+	return u
+}
+
+// newRelay returns a server relaying the VNC server at addr.
+func newRelay(t *testing.T, addr string) *testServer {
+	t.Helper()
+	d, err := providers.New(providers.ProviderVNC, providers.Options{"address": addr, "timeout": "1s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestServer(t, &ServerOpts{Display: d})
+}
+
+// waitForColor requests full updates until the pixel at (x, y) has the given color.
+func waitForColor(t *testing.T, c *client.Client, x, y int, want color.RGBA) {
+	t.Helper()
+	var got color.RGBA
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		c.Framebuffer(func(fb *image.RGBA) { got = fb.RGBAAt(x, y) })
+		if got == want {
+			return
+		}
+		if err := c.RequestUpdate(false); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatalf("Expected pixel (%d, %d) to become %v, it is %v", x, y, want, got)
+}
+
+var (
+	red  = color.RGBA{R: 255, A: 255}
+	blue = color.RGBA{B: 255, A: 255}
+)
+
+func TestVNCRelay(t *testing.T) {
+	upstream := newUpstreamCanvas(red)
+	us := newTestServer(t, &ServerOpts{Display: upstream})
+	defer us.shutdown(t)
+	relay := newRelay(t, us.addr)
+	defer relay.shutdown(t)
+
+	c, _ := relay.connect(t)
+	defer c.Close()
+	if w, h := c.Size(); w != 16 || h != 8 {
+		t.Fatalf("Expected the size of the upstream server, got %dx%d", w, h)
+	}
+	waitForColor(t, c, 3, 3, red)
+
+	// Changes upstream are relayed
+	rect := image.Rect(4, 2, 8, 6)
+	upstream.Lock()
+	draw.Draw(upstream.Image(), rect, image.NewUniform(blue), image.Point{}, draw.Src)
+	upstream.Unlock()
+	upstream.MarkDirty(rect)
+	waitForColor(t, c, 5, 3, blue)
+	waitForColor(t, c, 0, 0, red)
+
+	// Input is forwarded upstream
+	if err := c.KeyEvent(0x61, true); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case keysym := <-upstream.keys:
+		if keysym != 0x61 {
+			t.Fatalf("Expected keysym 0x61 upstream, got %#x", keysym)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Key event was not forwarded upstream")
+	}
+	if err := c.PointerEvent(7, 5, 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pt := <-upstream.pointers:
+		if pt != image.Pt(7, 5) {
+			t.Fatalf("Expected the pointer at (7, 5) upstream, got %s", pt)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Pointer event was not forwarded upstream")
+	}
+}
+
+func TestVNCRelayReconnects(t *testing.T) {
+	us := newTestServer(t, &ServerOpts{Display: newUpstreamCanvas(red)})
+	relay := newRelay(t, us.addr)
+	defer relay.shutdown(t)
+
+	c, ran := relay.connect(t)
+	defer c.Close()
+	waitForColor(t, c, 0, 0, red)
+
+	// Clients stay connected while the upstream server is gone
+	us.shutdown(t)
+	select {
+	case err := <-ran:
+		t.Fatal("Client was disconnected when the upstream server went away: ", err)
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	// And see the new one once it is reachable again
+	upstream := newUpstreamCanvas(blue)
+	us = newTestServerAt(t, us.addr, &ServerOpts{Display: upstream})
+	defer us.shutdown(t)
+	waitForColor(t, c, 0, 0, blue)
+	if err := c.KeyEvent(0x62, true); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case keysym := <-upstream.keys:
+		if keysym != 0x62 {
+			t.Fatalf("Expected keysym 0x62 upstream, got %#x", keysym)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Key event was not forwarded to the new upstream server")
+	}
+}
@@ -0,0 +1,138 @@
+package rfb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+)
+
+// Default UltraVNC repeater ports. Servers register on the server port, viewers connect
+// to the viewer port.
+const (
+	DefaultRepeaterServerPort = "5500"
+	DefaultRepeaterViewerPort = "5901"
+)
+
+// repeaterPreambleSize is the fixed size of the ID or host:port string sent to a repeater.
+const repeaterPreambleSize = 250
+
+// repeaterVersion is sent by a repeater to connections on its viewer port before it reads
+// the destination.
+const repeaterVersion = "RFB 000.000\n"
+
+// RepeaterOpts represents options for connecting through an UltraVNC repeater. Exactly
+// one of ID or Dest must be set.
+type RepeaterOpts struct {
+	// The address of the repeater. The port defaults to DefaultRepeaterServerPort in
+	// mode II and DefaultRepeaterViewerPort in mode I.
+	Addr string
+	// Mode II: register with the repeater under the given numeric ID and wait for a
+	// viewer connecting with the same ID. An "ID:" prefix is optional.
+	ID string
+	// Mode I: have the repeater route the connection to a listening viewer at the
+	// given host:port.
+	Dest string
+	// Backoff settings for re-registering when the repeater drops the link. Reconnect
+	// is always enabled.
+	ConnectOpts
+}
+
+// preamble returns the 250 byte, null padded, preamble sent to the repeater.
+func (o *RepeaterOpts) preamble() ([]byte, error) {
+	var str string
+	switch {
+	case o.ID != "" && o.Dest != "":
+		return nil, errors.New("Only one of a repeater ID or destination may be set")
+	case o.ID != "":
+		id := strings.TrimPrefix(o.ID, "ID:")
+		if id == "" || strings.Trim(id, "0123456789") != "" {
+			return nil, fmt.Errorf("Repeater ID must be numeric: %s", o.ID)
+		}
+		str = "ID:" + id
+	case o.Dest != "":
+		str = o.Dest
+	default:
+		return nil, errors.New("One of a repeater ID or destination must be set")
+	}
+	if len(str) >= repeaterPreambleSize {
+		return nil, fmt.Errorf("Repeater ID or destination is too long: %s", str)
+	}
+	preamble := make([]byte, repeaterPreambleSize)
+	copy(preamble, str)
+	return preamble, nil
+}
+
+// ServeRepeater connects to the repeater configured in the ServerOpts. See ConnectRepeater.
+func (s *Server) ServeRepeater(ctx context.Context) error {
+	if s.repeaterOpts == nil {
+		return errors.New("No repeater configured")
+	}
+	return s.ConnectRepeater(ctx, s.repeaterOpts)
+}
+
+// ConnectRepeater connects to an UltraVNC repeater and serves the viewer on the other
+// end like any other client. In mode II the connection waits at the repeater, without a
+// handshake deadline, until a viewer with the same ID connects.
+//
+// The server re-registers whenever the repeater drops the link or the viewer disconnects.
+// It returns once the context is cancelled, Shutdown is called, or MaxAttempts is reached.
+func (s *Server) ConnectRepeater(ctx context.Context, opts *RepeaterOpts) error {
+	preamble, err := opts.preamble()
+	if err != nil {
+		return err
+	}
+	modeI := opts.Dest != ""
+	addr := withDefaultPort(opts.Addr, DefaultRepeaterServerPort)
+	if modeI {
+		addr = withDefaultPort(opts.Addr, DefaultRepeaterViewerPort)
+	}
+	connectOpts := opts.ConnectOpts.withDefaults()
+	connectOpts.Reconnect = true
+
+	return s.dialLoop(ctx, "repeater at "+addr, connectOpts, func(ctx context.Context) error {
+		c, err := s.dial(ctx, addr, connectOpts.DialTimeout)
+		if err != nil {
+			return err
+		}
+		defer s.closeOnDone(ctx, c.Close)()
+
+		c.SetDeadline(time.Now().Add(connectOpts.DialTimeout))
+		if modeI {
+			// The repeater treats us like a viewer, it sends a dummy version first
+			ver := make([]byte, len(repeaterVersion))
+			if _, err := io.ReadFull(c, ver); err != nil {
+				c.Close()
+				return err
+			}
+			if !strings.HasPrefix(string(ver), "RFB ") {
+				c.Close()
+				return fmt.Errorf("Unexpected greeting from repeater: %q", ver)
+			}
+		}
+		if _, err := c.Write(preamble); err != nil {
+			c.Close()
+			return err
+		}
+		c.SetDeadline(time.Time{})
+
+		if modeI {
+			log.Infof("Connected to repeater at %s, routing to %s", addr, opts.Dest)
+		} else {
+			log.Infof("Registered with repeater at %s as %s, waiting for a viewer", addr, strings.TrimRight(string(preamble), "\x00"))
+		}
+
+		conn, err := s.newConn(c)
+		if err != nil {
+			return err
+		}
+		if !modeI {
+			conn.versionTimeout = 0
+		}
+		return s.serveConn(conn)
+	})
+}
@@ -0,0 +1,169 @@
+package rfb
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/client"
+)
+
+func TestRepeaterPreamble(t *testing.T) {
+	for _, tc := range []struct {
+		opts    RepeaterOpts
+		want    string
+		wantErr bool
+	}{
+		{opts: RepeaterOpts{ID: "1234"}, want: "ID:1234"},
+		{opts: RepeaterOpts{ID: "ID:1234"}, want: "ID:1234"},
+		{opts: RepeaterOpts{Dest: "viewer:5500"}, want: "viewer:5500"},
+		{opts: RepeaterOpts{ID: "abc"}, wantErr: true},
+		{opts: RepeaterOpts{ID: "1", Dest: "viewer"}, wantErr: true},
+		{opts: RepeaterOpts{}, wantErr: true},
+		{opts: RepeaterOpts{Dest: string(make([]byte, repeaterPreambleSize))}, wantErr: true},
+	} {
+		preamble, err := tc.opts.preamble()
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("Expected an error for %+v", tc.opts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(preamble) != repeaterPreambleSize || string(bytes.TrimRight(preamble, "\x00")) != tc.want {
+			t.Errorf("Expected a padded %q, got %q", tc.want, preamble)
+		}
+	}
+}
+
+// fakeRepeater accepts the connections of a server on a local listener.
+type fakeRepeater struct {
+	t  *testing.T
+	ln net.Listener
+}
+
+func newFakeRepeater(t *testing.T) *fakeRepeater {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeRepeater{t: t, ln: ln}
+}
+
+// accept accepts the next connection from the server and reads its preamble. In mode I
+// the repeater version is sent first.
+func (r *fakeRepeater) accept(modeI bool) (net.Conn, string) {
+	r.t.Helper()
+	conn, err := acceptWithin(r.ln, time.Second*5)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	if modeI {
+		if _, err := conn.Write([]byte(repeaterVersion)); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+	preamble := make([]byte, repeaterPreambleSize)
+	if _, err := io.ReadFull(conn, preamble); err != nil {
+		r.t.Fatal("Reading preamble: ", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, string(bytes.TrimRight(preamble, "\x00"))
+}
+
+func TestConnectRepeater(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		opts  RepeaterOpts
+		modeI bool
+		want  string
+	}{
+		{name: "ModeI", opts: RepeaterOpts{Dest: "viewer.example.com:5500"}, modeI: true, want: "viewer.example.com:5500"},
+		{name: "ModeII", opts: RepeaterOpts{ID: "1234"}, want: "ID:1234"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			serverOpts := &ServerOpts{}
+			if !tc.modeI {
+				// The version timeout doesn't apply while waiting at the repeater
+				serverOpts.VersionTimeout = time.Millisecond * 20
+			}
+			s := newTestServer(t, serverOpts)
+			defer s.shutdown(t)
+			r := newFakeRepeater(t)
+			defer r.ln.Close()
+
+			opts := tc.opts
+			opts.Addr = r.ln.Addr().String()
+			opts.MinBackoff = time.Millisecond * 10
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- s.ConnectRepeater(ctx, &opts) }()
+
+			// The repeater hands the connection to a viewer, which then disconnects.
+			// The server connects to the repeater again.
+			for i := 0; i < 2; i++ {
+				conn, preamble := r.accept(tc.modeI)
+				if preamble != tc.want {
+					t.Fatalf("Expected preamble %q, got %q", tc.want, preamble)
+				}
+				if !tc.modeI && i == 0 {
+					time.Sleep(time.Millisecond * 50)
+				}
+				c, err := client.NewClient(conn, nil)
+				if err != nil {
+					t.Fatal("Handshake through the repeater: ", err)
+				}
+				if n := len(s.GetSessions()); n != 1 {
+					t.Fatalf("Expected one session, got %d", n)
+				}
+				c.Close()
+			}
+
+			cancel()
+			select {
+			case err := <-done:
+				if err != context.Canceled {
+					t.Fatalf("Expected context.Canceled, got %v", err)
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatal("ConnectRepeater did not return after the context was cancelled")
+			}
+		})
+	}
+}
+
+func TestConnectRepeaterRetriesBadGreeting(t *testing.T) {
+	s := newTestServer(t, &ServerOpts{})
+	defer s.shutdown(t)
+	r := newFakeRepeater(t)
+	defer r.ln.Close()
+
+	opts := &RepeaterOpts{Addr: r.ln.Addr().String(), Dest: "viewer:5500"}
+	opts.MinBackoff = time.Millisecond * 10
+	opts.MaxAttempts = 2
+	done := make(chan error, 1)
+	go func() { done <- s.ConnectRepeater(context.Background(), opts) }()
+
+	for i := 0; i < 2; i++ {
+		conn, err := acceptWithin(r.ln, time.Second*5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("HTTP/1.1 400\n"))
+		conn.Close()
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Expected an error after MaxAttempts")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("ConnectRepeater did not give up after MaxAttempts")
+	}
+}
@@ -0,0 +1,134 @@
+package rfb
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+)
+
+// DefaultListeningViewerPort is the port viewers listen on for reverse connections.
+const DefaultListeningViewerPort = "5500"
+
+// Default reverse connection settings.
+const (
+	DefaultConnectMinBackoff  = time.Second
+	DefaultConnectMaxBackoff  = time.Minute
+	DefaultConnectDialTimeout = time.Second * 10
+)
+
+// ConnectOpts represents options for reverse connections to listening viewers.
+type ConnectOpts struct {
+	// Reconnect re-dials the viewer whenever the connection fails or is closed.
+	Reconnect bool
+	// The delay between reconnects starts at MinBackoff and doubles after each failed
+	// attempt up to MaxBackoff. It is reset once a viewer completes the handshake.
+	MinBackoff, MaxBackoff time.Duration
+	// The number of consecutive failed attempts before giving up. Zero means unlimited.
+	MaxAttempts int
+	// The timeout for dialing the viewer.
+	DialTimeout time.Duration
+}
+
+func (o *ConnectOpts) withDefaults() *ConnectOpts {
+	out := &ConnectOpts{}
+	if o != nil {
+		*out = *o
+	}
+	if out.MinBackoff <= 0 {
+		out.MinBackoff = DefaultConnectMinBackoff
+	}
+	if out.MaxBackoff < out.MinBackoff {
+		out.MaxBackoff = DefaultConnectMaxBackoff
+		if out.MaxBackoff < out.MinBackoff {
+			out.MaxBackoff = out.MinBackoff
+		}
+	}
+	if out.DialTimeout <= 0 {
+		out.DialTimeout = DefaultConnectDialTimeout
+	}
+	return out
+}
+
+// Connect dials a listening viewer at the given address and serves it like any other
+// client. If the address has no port, DefaultListeningViewerPort is used. Nil options
+// make a single attempt.
+//
+// Without Reconnect, Connect blocks until the viewer disconnects and returns an error
+// if the viewer could not be reached or did not complete the handshake. With Reconnect,
+// it only returns once the context is cancelled, Shutdown is called, or MaxAttempts is
+// reached. Cancelling the context disconnects the current viewer.
+func (s *Server) Connect(ctx context.Context, addr string, opts *ConnectOpts) error {
+	addr = withDefaultPort(addr, DefaultListeningViewerPort)
+	opts = opts.withDefaults()
+	return s.dialLoop(ctx, "listening viewer at "+addr, opts, func(ctx context.Context) error {
+		c, err := s.dial(ctx, addr, opts.DialTimeout)
+		if err != nil {
+			return err
+		}
+		log.Info("Connected to listening viewer at ", addr)
+		defer s.closeOnDone(ctx, c.Close)()
+		return s.handleConn(c)
+	})
+}
+
+// dialLoop calls attempt until it succeeds, or according to the reconnect options.
+// Successful attempts reset the backoff.
+func (s *Server) dialLoop(ctx context.Context, name string, opts *ConnectOpts, attempt func(context.Context) error) error {
+	backoff := opts.MinBackoff
+	var failures int
+	for {
+		if s.isShuttingDown() {
+			return ErrServerClosed
+		}
+
+		err := attempt(ctx)
+		switch {
+		case s.isShuttingDown():
+			return ErrServerClosed
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case !opts.Reconnect:
+			return err
+		case err == nil:
+			backoff, failures = opts.MinBackoff, 0
+			log.Infof("Connection to %s closed, reconnecting in %s", name, backoff)
+		default:
+			failures++
+			if opts.MaxAttempts > 0 && failures >= opts.MaxAttempts {
+				log.Errorf("Giving up on %s after %d attempts", name, failures)
+				return err
+			}
+			log.Warningf("Connection to %s failed (%s), retrying in %s", name, err, backoff)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if err != nil {
+			backoff *= 2
+			if backoff > opts.MaxBackoff {
+				backoff = opts.MaxBackoff
+			}
+		}
+	}
+}
+
+// dial opens a TCP connection to the given address.
+func (s *Server) dial(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var dialer net.Dialer
+	return dialer.DialContext(dialCtx, "tcp", addr)
+}
+
+// withDefaultPort adds the given port to the address if it doesn't have one.
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, port)
+	}
+	return addr
+}
@@ -0,0 +1,127 @@
+package rfb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/client"
+)
+
+func TestDialLoopBackoff(t *testing.T) {
+	s := NewServer(&ServerOpts{Display: providers.NewCanvas(1, 1)})
+	opts := (&ConnectOpts{
+		Reconnect:   true,
+		MinBackoff:  time.Millisecond * 20,
+		MaxBackoff:  time.Millisecond * 80,
+		MaxAttempts: 6,
+	}).withDefaults()
+
+	// Attempts fail, except the third, which resets the backoff
+	var times []time.Time
+	failed := errors.New("failed")
+	err := s.dialLoop(context.Background(), "test", opts, func(context.Context) error {
+		times = append(times, time.Now())
+		if len(times) == 3 {
+			return nil
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("Expected the last error after MaxAttempts, got %v", err)
+	}
+	// Two failures, a success, then six failures
+	if len(times) != 9 {
+		t.Fatalf("Expected 9 attempts, got %d", len(times))
+	}
+	expected := []time.Duration{20, 40, 20, 20, 40, 80, 80, 80}
+	for i, want := range expected {
+		want *= time.Millisecond
+		if got := times[i+1].Sub(times[i]); got < want || got > want+time.Millisecond*250 {
+			t.Errorf("Attempt %d waited %s, expected %s", i+2, got, want)
+		}
+	}
+}
+
+func TestDialLoopStops(t *testing.T) {
+	s := NewServer(&ServerOpts{Display: providers.NewCanvas(1, 1)})
+	failed := errors.New("failed")
+
+	// Without Reconnect there is a single attempt
+	var attempts int
+	opts := (&ConnectOpts{MinBackoff: time.Millisecond}).withDefaults()
+	if err := s.dialLoop(context.Background(), "test", opts, func(context.Context) error {
+		attempts++
+		return failed
+	}); err != failed || attempts != 1 {
+		t.Fatalf("Expected a single failed attempt, got %d attempts and %v", attempts, err)
+	}
+
+	// Cancelling the context stops waiting for the next attempt
+	opts = (&ConnectOpts{Reconnect: true, MinBackoff: time.Hour}).withDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.dialLoop(ctx, "test", opts, func(context.Context) error { return failed })
+	}()
+	time.Sleep(time.Millisecond * 50)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Cancelling the context did not stop the loop")
+	}
+}
+
+func TestConnectReconnectsToViewer(t *testing.T) {
+	s := newTestServer(t, &ServerOpts{})
+	defer s.shutdown(t)
+
+	// A listening viewer
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Connect(ctx, ln.Addr().String(), &ConnectOpts{Reconnect: true, MinBackoff: time.Millisecond * 10})
+	}()
+
+	// The server connects again after the viewer hangs up
+	for i := 0; i < 2; i++ {
+		conn, err := acceptWithin(ln, time.Second*5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := client.NewClient(conn, nil)
+		if err != nil {
+			t.Fatal("Handshake with the server: ", err)
+		}
+		c.Close()
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Connect did not return after the context was cancelled")
+	}
+}
+
+// acceptWithin accepts a connection, failing if none arrives within the timeout.
+func acceptWithin(ln net.Listener, timeout time.Duration) (net.Conn, error) {
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(timeout))
+	return ln.Accept()
+}
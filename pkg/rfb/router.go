@@ -0,0 +1,342 @@
+package rfb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+	"github.com/tinyzimmer/gsvnc/pkg/token"
+)
+
+// DefaultDisplayPathPrefix is the path prefix a Router serves each display's websocket on.
+const DefaultDisplayPathPrefix = "/ws/"
+
+// RouterOpts represents options for a Router.
+type RouterOpts struct {
+	// Websocket connections to <PathPrefix><name> are routed to the display with
+	// the given name. Defaults to DefaultDisplayPathPrefix.
+	PathPrefix string
+	// Static tokens mapped to the name of the display they select, like websockify's
+	// token plugins. Tokens are read from the TokenParam query parameter or cookie.
+	Tokens map[string]string
+	// If set, tokens that are not in Tokens are validated, and their Display claim
+	// selects the display. Connections then need a token, also on display paths, and
+	// the token must be for the display of the path. The Router authorizes websocket
+	// connections itself, the TokenValidator of each display's Server is not used.
+	TokenValidator token.Validator
+	// Defaults to DefaultTokenParam.
+	TokenParam string
+	// Static files, such as a web client, to serve at the root. If it contains a
+	// vnc.html, the root lists links to each display.
+	WebRoot http.FileSystem
+}
+
+// Router hosts several named displays, each served by its own Server with its own
+// provider, resolution, password and encodings. Displays are reached over RFB by
+// serving each Server on its own listener, and over websockify through the Router.
+type Router struct {
+	opts    RouterOpts
+	servers map[string]*Server
+	mux     sync.RWMutex
+
+	httpServers  map[*http.Server]struct{}
+	shuttingDown bool
+	httpMux      sync.Mutex
+}
+
+// NewRouter returns a new Router with no displays.
+func NewRouter(opts *RouterOpts) *Router {
+	r := &Router{
+		servers:     make(map[string]*Server),
+		httpServers: make(map[*http.Server]struct{}),
+	}
+	if opts != nil {
+		r.opts = *opts
+	}
+	if r.opts.PathPrefix == "" {
+		r.opts.PathPrefix = DefaultDisplayPathPrefix
+	}
+	if !strings.HasSuffix(r.opts.PathPrefix, "/") {
+		r.opts.PathPrefix += "/"
+	}
+	if r.opts.TokenParam == "" {
+		r.opts.TokenParam = DefaultTokenParam
+	}
+	return r
+}
+
+// Add adds a display with the given name.
+func (r *Router) Add(name string, s *Server) error {
+	if name == "" || strings.ContainsAny(name, "/?#") {
+		return fmt.Errorf("Invalid display name: %q", name)
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.servers[name]; ok {
+		return fmt.Errorf("Display %q already exists", name)
+	}
+	r.servers[name] = s
+	s.connsMux.Lock()
+	s.displayName = name
+	s.connsMux.Unlock()
+	return nil
+}
+
+// Display returns the server for the display with the given name, or nil.
+func (r *Router) Display(name string) *Server {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return r.servers[name]
+}
+
+// Displays returns the names of all displays in alphabetical order.
+func (r *Router) Displays() []string {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	names := make([]string, 0, len(r.servers))
+	for name := range r.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ServeWebsockify serves websockify connections for all displays on the given listener.
+// It blocks until the context is cancelled, Shutdown is called, or the listener fails.
+func (r *Router) ServeWebsockify(ctx context.Context, ln net.Listener) error {
+	srvr := &http.Server{
+		Addr:        ln.Addr().String(),
+		ReadTimeout: time.Second * 300, WriteTimeout: time.Second * 300,
+		Handler: r,
+	}
+	r.httpMux.Lock()
+	if r.shuttingDown {
+		r.httpMux.Unlock()
+		return ErrServerClosed
+	}
+	r.httpServers[srvr] = struct{}{}
+	r.httpMux.Unlock()
+	defer func() {
+		r.httpMux.Lock()
+		delete(r.httpServers, srvr)
+		r.httpMux.Unlock()
+	}()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go func() {
+		select {
+		case <-ctx.Done():
+			srvr.Close()
+		case <-stopCh:
+		}
+	}()
+
+	err := srvr.Serve(ln)
+	r.httpMux.Lock()
+	shuttingDown := r.shuttingDown
+	r.httpMux.Unlock()
+	if shuttingDown {
+		return ErrServerClosed
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Shutdown stops serving websockify connections and shuts down all displays. See
+// Server.Shutdown.
+func (r *Router) Shutdown(ctx context.Context) error {
+	r.httpMux.Lock()
+	r.shuttingDown = true
+	for srvr := range r.httpServers {
+		srvr.Close()
+	}
+	r.httpMux.Unlock()
+
+	servers := r.allServers()
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *Server) { errs <- s.Shutdown(ctx) }(s)
+	}
+	var err error
+	for range servers {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ServeHTTP routes websocket connections to displays by path or token, and serves the
+// web root otherwise.
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.HasPrefix(req.URL.Path, r.opts.PathPrefix) {
+		name := strings.Trim(strings.TrimPrefix(req.URL.Path, r.opts.PathPrefix), "/")
+		if r.Display(name) == nil {
+			http.NotFound(w, req)
+			return
+		}
+		r.serveWebsocket(w, req, name)
+		return
+	}
+
+	if isWebsocketUpgrade(req) {
+		r.serveWebsocket(w, req, "")
+		return
+	}
+
+	if r.opts.WebRoot == nil {
+		http.NotFound(w, req)
+		return
+	}
+	if req.URL.Path == "/" && !exists(r.opts.WebRoot, "/index.html") && exists(r.opts.WebRoot, "/vnc.html") {
+		r.serveIndex(w)
+		return
+	}
+	http.FileServer(r.opts.WebRoot).ServeHTTP(w, req)
+}
+
+// serveWebsocket authorizes a websocket connection and hands it to the display it is
+// for. The name is empty when the token selects the display.
+func (r *Router) serveWebsocket(w http.ResponseWriter, req *http.Request, name string) {
+	s, claims, fromCookie, err := r.authorize(req, name)
+	if err != nil {
+		log.Warningf("Rejecting websocket connection from %s: %s", req.RemoteAddr, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.upgradeWebsocket(w, req, claims, fromCookie)
+}
+
+// authorize returns the display for the request, along with the claims of its token if it
+// was validated by the TokenValidator. If a display name is given, the token must be for
+// that display. Requests without a token are only allowed on a display path when there
+// is no TokenValidator.
+func (r *Router) authorize(req *http.Request, name string) (s *Server, claims *token.Claims, fromCookie bool, err error) {
+	tok, fromCookie := readToken(req, r.opts.TokenParam)
+	switch {
+	case tok == "" && name == "":
+		return nil, nil, false, errors.New("no display path or token provided")
+	case tok == "" && r.opts.TokenValidator != nil:
+		return nil, nil, false, errors.New("no token provided")
+	case tok == "":
+		// Display paths are open without a validator, static tokens only select a display
+	default:
+		display, ok := r.opts.Tokens[tok]
+		if !ok {
+			if r.opts.TokenValidator == nil {
+				return nil, nil, false, errors.New("unknown token")
+			}
+			if claims, err = r.opts.TokenValidator.Validate(tok); err != nil {
+				return nil, nil, false, err
+			}
+			display = claims.Display
+		}
+		if name != "" && display != name {
+			return nil, nil, false, fmt.Errorf("token is not valid for display %q", name)
+		}
+		name = display
+	}
+	if s = r.Display(name); s == nil {
+		return nil, nil, false, fmt.Errorf("token selects unknown display %q", name)
+	}
+	return s, claims, fromCookie, nil
+}
+
+// allServers returns the servers of all displays.
+func (r *Router) allServers() []*Server {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	servers := make([]*Server, 0, len(r.servers))
+	for _, s := range r.servers {
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+// GetSessions returns the sessions of all displays, ordered by connection time. Session
+// IDs are unique across displays.
+func (r *Router) GetSessions() []Session {
+	out := make([]Session, 0)
+	for _, s := range r.allServers() {
+		out = append(out, s.GetSessions()...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ConnectedAt.Before(out[j].ConnectedAt) })
+	return out
+}
+
+// serverFor returns the display with the session of the given ID.
+func (r *Router) serverFor(id string) (*Server, error) {
+	for _, s := range r.allServers() {
+		if _, err := s.getConn(id); err == nil {
+			return s, nil
+		}
+	}
+	return nil, ErrSessionNotFound
+}
+
+// GetSession returns a snapshot of the session with the given ID on any display.
+func (r *Router) GetSession(id string) (Session, error) {
+	s, err := r.serverFor(id)
+	if err != nil {
+		return Session{}, err
+	}
+	return s.GetSession(id)
+}
+
+// Disconnect disconnects the session with the given ID on any display.
+func (r *Router) Disconnect(id string) error {
+	s, err := r.serverFor(id)
+	if err != nil {
+		return err
+	}
+	return s.Disconnect(id)
+}
+
+// SetViewOnly sets whether input from the session with the given ID is ignored.
+func (r *Router) SetViewOnly(id string, viewOnly bool) error {
+	s, err := r.serverFor(id)
+	if err != nil {
+		return err
+	}
+	return s.SetViewOnly(id, viewOnly)
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>gsvnc</title></head>
+<body>
+<h1>Displays</h1>
+<ul>
+{{- range . }}
+<li><a href="vnc.html?path={{ .Path }}">{{ .Name }}</a></li>
+{{- end }}
+</ul>
+</body>
+</html>
+`))
+
+// serveIndex lists links to the web client for each display.
+func (r *Router) serveIndex(w http.ResponseWriter) {
+	type link struct{ Name, Path string }
+	links := make([]link, 0)
+	for _, name := range r.Displays() {
+		path := strings.TrimPrefix(r.opts.PathPrefix, "/") + name
+		links = append(links, link{Name: name, Path: url.QueryEscape(path)})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTemplate.Execute(w, links); err != nil {
+		log.Error("Error rendering display index: ", err.Error())
+	}
+}
@@ -0,0 +1,167 @@
+package rfb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/auth"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/client"
+	"github.com/tinyzimmer/gsvnc/pkg/token"
+)
+
+// newTestRouter returns a router with the displays "a" and "b", served over http.
+func newTestRouter(t *testing.T, opts *RouterOpts) (*Router, *httptest.Server) {
+	t.Helper()
+	router := NewRouter(opts)
+	for _, name := range []string{"a", "b"} {
+		s := NewServer(&ServerOpts{
+			Display:          providers.NewCanvas(16, 8),
+			EnabledAuthTypes: []auth.Type{&auth.None{}},
+		})
+		if err := router.Add(name, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return router, httptest.NewServer(router)
+}
+
+// dialWebsocket connects an RFB client to the router at the given path.
+func dialWebsocket(srv *httptest.Server, path string) (*client.Client, error) {
+	cfg, err := websocket.NewConfig("ws"+strings.TrimPrefix(srv.URL, "http")+path, srv.URL)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Protocol = []string{subprotocolBinary}
+	ws, err := websocket.DialConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	ws.SetDeadline(time.Now().Add(time.Second * 5))
+	c, err := client.NewClient(ws, nil)
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	ws.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// upgradeStatus returns the status of a websocket upgrade request to the router.
+func upgradeStatus(t *testing.T, srv *httptest.Server, path string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestRouterTokens(t *testing.T) {
+	validator := token.NewHMAC([]byte("secret"))
+	sign := func(display string) string {
+		tok, err := validator.Sign(&token.Claims{Subject: "alice", Display: display})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	router, srv := newTestRouter(t, &RouterOpts{
+		TokenValidator: validator,
+		Tokens:         map[string]string{"static-a": "a"},
+	})
+	defer srv.Close()
+	defer router.Shutdown(context.Background())
+
+	for _, tc := range []struct {
+		name string
+		path string
+		want int
+	}{
+		{"PathWithoutToken", "/ws/a", http.StatusUnauthorized},
+		{"PathWithTokenForOtherDisplay", "/ws/b?token=" + sign("a"), http.StatusUnauthorized},
+		{"PathWithStaticTokenForOtherDisplay", "/ws/b?token=static-a", http.StatusUnauthorized},
+		{"PathWithInvalidToken", "/ws/a?token=invalid", http.StatusUnauthorized},
+		{"UnknownDisplay", "/ws/c?token=" + sign("c"), http.StatusNotFound},
+		{"TokenForUnknownDisplay", "/?token=" + sign("c"), http.StatusUnauthorized},
+		{"PathWithToken", "/ws/b?token=" + sign("b"), http.StatusSwitchingProtocols},
+		{"PathWithStaticToken", "/ws/a?token=static-a", http.StatusSwitchingProtocols},
+		{"Token", "/?token=" + sign("b"), http.StatusSwitchingProtocols},
+		{"StaticToken", "/?token=static-a", http.StatusSwitchingProtocols},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := upgradeStatus(t, srv, tc.path); got != tc.want {
+				t.Fatalf("Expected status %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRouterSessions(t *testing.T) {
+	validator := token.NewHMAC([]byte("secret"))
+	router, srv := newTestRouter(t, &RouterOpts{TokenValidator: validator})
+	defer srv.Close()
+	defer router.Shutdown(context.Background())
+
+	events := make(map[string]<-chan SessionEvent)
+	for _, name := range router.Displays() {
+		ch, unsubscribe := router.Display(name).Subscribe()
+		defer unsubscribe()
+		events[name] = ch
+	}
+
+	ids := make(map[string]string)
+	for _, name := range []string{"a", "b"} {
+		tok, _ := validator.Sign(&token.Claims{Subject: "user-" + name, Display: name})
+		c, err := dialWebsocket(srv, "/ws/"+name+"?token="+tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		ev := waitForEvent(t, events[name], SessionConnected)
+		if ev.Session.Display != name || ev.Session.Username != "user-"+name {
+			t.Fatalf("Unexpected session %+v", ev.Session)
+		}
+		ids[name] = ev.Session.ID
+	}
+	if ids["a"] == ids["b"] {
+		t.Fatalf("Sessions of different displays share the ID %s", ids["a"])
+	}
+
+	sessions := router.GetSessions()
+	if len(sessions) != 2 || sessions[0].Display != "a" || sessions[1].Display != "b" {
+		t.Fatalf("Expected a session on each display, got %+v", sessions)
+	}
+	if err := router.SetViewOnly(ids["b"], true); err != nil {
+		t.Fatal(err)
+	}
+	if sess, err := router.GetSession(ids["b"]); err != nil || !sess.ViewOnly {
+		t.Fatalf("Expected the session on b to be view-only, got %+v, %v", sess, err)
+	}
+	if err := router.Disconnect(ids["b"]); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvent(t, events["b"], SessionDisconnected)
+	if _, err := router.GetSession(ids["b"]); err != ErrSessionNotFound {
+		t.Fatalf("Expected ErrSessionNotFound after disconnecting, got %v", err)
+	}
+	if _, err := router.GetSession(ids["a"]); err != nil {
+		t.Fatal("Session on the other display was affected: ", err)
+	}
+}
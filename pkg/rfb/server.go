@@ -1,40 +1,156 @@
 package rfb
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"reflect"
+	"sync"
 	"time"
 
-	"golang.org/x/net/websocket"
-
+	"github.com/tinyzimmer/gsvnc/pkg/display"
 	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
 	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
 	"github.com/tinyzimmer/gsvnc/pkg/rfb/auth"
 	"github.com/tinyzimmer/gsvnc/pkg/rfb/encodings"
 	"github.com/tinyzimmer/gsvnc/pkg/rfb/events"
+	"github.com/tinyzimmer/gsvnc/pkg/token"
 )
 
 // ServerOpts represents options that can be used to configure a new RFB server.
 type ServerOpts struct {
-	DisplayProvider  providers.Provider
-	Width, Height    int
-	ServerPassword   string
+	DisplayProvider providers.Provider
+	Width, Height   int
+	ServerPassword  string
+	// VNCAuth passwords by username. A client that sends one of them is recorded as that
+	// user on its session and display, like the subject of a websocket token.
+	Users            map[string]string
 	EnabledEncodings []encodings.Encoding
 	EnabledAuthTypes []auth.Type
 	EnabledEvents    []events.Event
+	ClipboardPolicy  *display.ClipboardPolicy
+	SharePolicy      SharePolicy
+
+	// Options for the display provider. See providers.OptionsFor for the options
+	// each provider accepts.
+	DisplayProviderOptions providers.Options
+	// A display provider instance to use instead of creating one from DisplayProvider,
+	// such as a providers.Canvas.
+	Display providers.Display
+
+	// Deadlines for each phase of the handshake. Zero values use the defaults.
+	VersionTimeout    time.Duration
+	AuthTimeout       time.Duration
+	ClientInitTimeout time.Duration
+
+	// The maximum number of concurrent connections, including ones still in the
+	// handshake. Zero means unlimited.
+	MaxConnections int
+
+	// An UltraVNC repeater to connect to with ServeRepeater.
+	Repeater *RepeaterOpts
+
+	// The path websockify connections are upgraded on. Defaults to DefaultWebsockifyPath.
+	WebsockifyPath string
+	// Static files, such as a web client, to serve from the websockify listener.
+	WebRoot http.FileSystem
+	// Origins allowed to open websockify connections, or "*" for any. If empty, any
+	// origin is allowed unless the token is read from a cookie, then only the same origin.
+	AllowedOrigins []string
+	// If set, websockify connections must carry a token accepted by the validator, in
+	// the TokenParam query parameter or cookie. The token's subject and view-only flag
+	// are applied to the session.
+	TokenValidator token.Validator
+	// Defaults to DefaultTokenParam.
+	TokenParam string
+}
+
+// Default handshake deadlines. The auth phase is longer since clients usually prompt
+// for a password during it.
+const (
+	DefaultVersionTimeout    = time.Second * 10
+	DefaultAuthTimeout       = time.Minute * 2
+	DefaultClientInitTimeout = time.Second * 10
+)
+
+// SharePolicy determines how the server handles clients that ask for exclusive access
+// to the display by clearing the shared-flag in their ClientInit.
+type SharePolicy string
+
+// SharePolicy options.
+const (
+	// SharePolicyDisconnect disconnects all other clients when a non-shared client connects.
+	// This is the behavior described by the RFB protocol and the default.
+	SharePolicyDisconnect SharePolicy = "disconnect"
+	// SharePolicyRefuse refuses non-shared clients while other clients are connected.
+	SharePolicyRefuse SharePolicy = "refuse"
+	// SharePolicyAlways ignores the shared-flag and treats every client as shared.
+	SharePolicyAlways SharePolicy = "always"
+)
+
+// SharePolicies lists all valid share policy options.
+var SharePolicies = []SharePolicy{SharePolicyDisconnect, SharePolicyRefuse, SharePolicyAlways}
+
+// newDisplayProvider creates the display provider for the given options, logging
+// any error. Connections fail to start their display when there is no provider.
+func newDisplayProvider(opts *ServerOpts) providers.Display {
+	if opts.Display != nil {
+		return opts.Display
+	}
+	d, err := providers.New(opts.DisplayProvider, opts.DisplayProviderOptions)
+	if err != nil {
+		log.Errorf("Could not create display provider: %s", err.Error())
+		return nil
+	}
+	return d
 }
 
 // NewServer creates a new RFB server with an initial width and height.
 func NewServer(opts *ServerOpts) *Server {
+	provider := newDisplayProvider(opts)
+	width, height := opts.Width, opts.Height
+	if sizer, ok := provider.(providers.Sizer); ok && (width == 0 || height == 0) {
+		width, height = sizer.Size()
+	}
+	clipboard := display.NewClipboard(0)
+	if h, ok := provider.(providers.ClipboardHandler); ok {
+		clipboard.SetHandler(h)
+	}
+	sharedProvider := providers.NewShared(provider)
+	if iso, ok := provider.(providers.Isolated); ok && iso.Isolated() {
+		// Each connection creates its own provider, this one was only needed for the size
+		sharedProvider = nil
+		provider.Close()
+	}
 	server := &Server{
-		displayProvider:  opts.DisplayProvider,
-		width:            opts.Width,
-		height:           opts.Height,
-		serverPassword:   opts.ServerPassword,
-		enabledEncodings: opts.EnabledEncodings,
-		enabledAuthTypes: opts.EnabledAuthTypes,
-		enabledEvents:    opts.EnabledEvents,
+		displayProvider:   opts.DisplayProvider,
+		providerOptions:   opts.DisplayProviderOptions,
+		width:             width,
+		height:            height,
+		serverPassword:    opts.ServerPassword,
+		users:             opts.Users,
+		enabledEncodings:  opts.EnabledEncodings,
+		enabledAuthTypes:  opts.EnabledAuthTypes,
+		enabledEvents:     opts.EnabledEvents,
+		clipboard:         clipboard,
+		clipboardPolicy:   opts.ClipboardPolicy,
+		sharePolicy:       opts.SharePolicy,
+		sharedProvider:    sharedProvider,
+		conns:             make(map[*Conn]struct{}),
+		listeners:         make(map[net.Listener]struct{}),
+		httpServers:       make(map[*http.Server]struct{}),
+		subscribers:       make(map[chan SessionEvent]struct{}),
+		versionTimeout:    opts.VersionTimeout,
+		authTimeout:       opts.AuthTimeout,
+		clientInitTimeout: opts.ClientInitTimeout,
+		repeaterOpts:      opts.Repeater,
+		websockifyPath:    opts.WebsockifyPath,
+		webRoot:           opts.WebRoot,
+		allowedOrigins:    opts.AllowedOrigins,
+		tokenValidator:    opts.TokenValidator,
+		tokenParam:        opts.TokenParam,
 	}
 
 	// Configure default events if any are empty
@@ -47,14 +163,29 @@ func NewServer(opts *ServerOpts) *Server {
 	if len(opts.EnabledEvents) == 0 {
 		server.enabledEvents = events.GetDefaults()
 	}
-
-	// Configure tight if enabled
-	if server.TightIsEnabled() {
-		iface := server.GetAuthByName("TightSecurity")
-		tight := iface.(*auth.TightSecurity)
-		tight.AuthGetter = server.GetAuth
-		// TODO: Configure capabilities
+	if opts.SharePolicy == "" {
+		server.sharePolicy = SharePolicyDisconnect
+	}
+	if opts.VersionTimeout == 0 {
+		server.versionTimeout = DefaultVersionTimeout
 	}
+	if opts.AuthTimeout == 0 {
+		server.authTimeout = DefaultAuthTimeout
+	}
+	if opts.ClientInitTimeout == 0 {
+		server.clientInitTimeout = DefaultClientInitTimeout
+	}
+	if opts.WebsockifyPath == "" {
+		server.websockifyPath = DefaultWebsockifyPath
+	}
+	if opts.TokenParam == "" {
+		server.tokenParam = DefaultTokenParam
+	}
+	if opts.MaxConnections > 0 {
+		server.connSlots = make(chan struct{}, opts.MaxConnections)
+	}
+
+	server.enabledAuthTypes = server.configureAuthTypes(server.enabledAuthTypes)
 
 	return server
 }
@@ -64,70 +195,330 @@ func NewServer(opts *ServerOpts) *Server {
 type Server struct {
 	width, height    int
 	serverPassword   string
+	users            map[string]string
 	displayProvider  providers.Provider
+	providerOptions  providers.Options
 	enabledEncodings []encodings.Encoding
 	enabledAuthTypes []auth.Type
 	enabledEvents    []events.Event
+	featuresMux      sync.RWMutex
+	clipboard        *display.Clipboard
+	clipboardPolicy  *display.ClipboardPolicy
+	sharePolicy      SharePolicy
+	sharedProvider   *providers.Shared // Nil when each connection has its own provider
+	repeaterOpts     *RepeaterOpts
+	websockifyPath   string
+	webRoot          http.FileSystem
+	allowedOrigins   []string
+	tokenValidator   token.Validator
+	tokenParam       string
+
+	versionTimeout, authTimeout, clientInitTimeout time.Duration
+
+	// The name of the display when the server is added to a Router. Guarded by connsMux.
+	displayName string
+
+	// All connections, including ones still in the handshake
+	conns     map[*Conn]struct{}
+	connsWg   sync.WaitGroup
+	connsMux  sync.Mutex
+	connSlots chan struct{}
+
+	// Listeners and state used for shutting down
+	listeners    map[net.Listener]struct{}
+	httpServers  map[*http.Server]struct{}
+	shuttingDown bool
+
+	// Session event subscribers
+	subscribers    map[chan SessionEvent]struct{}
+	subscribersMux sync.Mutex
 }
 
+// ErrServerClosed is returned by the Serve methods after a call to Shutdown.
+var ErrServerClosed = errors.New("rfb: Server closed")
+
 // Serve binds the RFB server to the given listener and starts serving connections.
-func (s *Server) Serve(ln net.Listener) error {
+// It blocks until the context is cancelled, Shutdown is called, or the listener
+// returns an error. Cancelling the context only stops accepting new connections,
+// use Shutdown to disconnect clients.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	if !s.trackListener(ln) {
+		return ErrServerClosed
+	}
+	defer s.untrackListener(ln)
+
+	stopWatch := s.closeOnDone(ctx, ln.Close)
+	defer stopWatch()
+
 	for {
 
 		// Accept a new connection
 		c, err := ln.Accept()
 		if err != nil {
+			if s.isShuttingDown() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			return err
 		}
 
 		log.Info("New client connection from ", c.RemoteAddr().String())
 
-		// Create a new client connection
-		conn := s.newConn(c)
+		go s.handleConn(c)
+	}
+}
+
+// ServeWebsockify will serve websockify connections on the given listener. It blocks
+// under the same conditions as Serve. To serve wss:// connections, or TLS-wrapped RFB
+// with Serve, wrap the listener with tls.NewListener.
+func (s *Server) ServeWebsockify(ctx context.Context, ln net.Listener) error {
+	srvr := &http.Server{
+		Addr:        ln.Addr().String(),
+		ReadTimeout: time.Second * 300, WriteTimeout: time.Second * 300,
+		Handler: s.websockifyHandler(),
+	}
+	if !s.trackHTTPServer(srvr) {
+		return ErrServerClosed
+	}
+	defer s.untrackHTTPServer(srvr)
+
+	stopWatch := s.closeOnDone(ctx, srvr.Close)
+	defer stopWatch()
+
+	err := srvr.Serve(ln)
+	if s.isShuttingDown() {
+		return ErrServerClosed
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// ServeConn serves a single client connection, such as one handed over by inetd. It
+// blocks until the client disconnects and returns an error if the client did not
+// complete the handshake.
+func (s *Server) ServeConn(c net.Conn) error {
+	log.Info("New client connection from ", c.RemoteAddr().String())
+	return s.handleConn(c)
+}
 
-		// Do the rfb handshake
-		if err := conn.doHandshake(); err != nil {
-			log.Error("Error during server-client handshake: ", err.Error())
+// Shutdown gracefully shuts down the server. It stops accepting new connections,
+// then disconnects all clients after writing out any messages queued for them.
+// Clients that are authenticating are told the server is shutting down in their
+// SecurityResult, connected clients see the connection close once their queued
+// updates are written, since RFB has no message for it. Display providers are
+// closed as the last client using them disconnects.
+//
+// If the context expires before all clients are disconnected, their connections
+// are closed forcibly and the context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.connsMux.Lock()
+	s.shuttingDown = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for srvr := range s.httpServers {
+		srvr.Close()
+	}
+	log.Infof("Shutting down, disconnecting %d client(s)", len(s.conns))
+	for conn := range s.conns {
+		// Unblock any pending reads. Connections in the handshake send the
+		// client the reason before closing, and all of them flush their write
+		// queue before closing.
+		conn.c.SetReadDeadline(time.Now())
+	}
+	s.connsMux.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.connsWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.connsMux.Lock()
+		for conn := range s.conns {
 			conn.c.Close()
-			continue
 		}
+		s.connsMux.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
 
-		// handle events
-		go conn.serve()
+// closeOnDone calls the given function when the context is done. The returned
+// function must be called to stop watching the context.
+func (s *Server) closeOnDone(ctx context.Context, closeFunc func() error) (stop func()) {
+	stopCh := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeFunc()
+		case <-stopCh:
+		}
+	}()
+	return func() { close(stopCh) }
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+	return s.shuttingDown
+}
+
+func (s *Server) trackListener(ln net.Listener) bool {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+	if s.shuttingDown {
+		return false
 	}
+	s.listeners[ln] = struct{}{}
+	return true
 }
 
-// ServeWebsockify will serve websockify connections on the given host and port.
-func (s *Server) ServeWebsockify(ln net.Listener) error {
-	srvr := &http.Server{
-		Addr:        ln.Addr().String(),
-		ReadTimeout: time.Second * 300, WriteTimeout: time.Second * 300,
-		Handler: &websocket.Server{
-			Handshake: func(cfg *websocket.Config, r *http.Request) error { return nil },
-			Handler: func(wsconn *websocket.Conn) {
-				log.Info("New websocket client connection from ", wsconn.Request().RemoteAddr)
-				wsconn.PayloadType = websocket.BinaryFrame
-				// Create a new client connection
-				conn := s.newConn(wsconn)
+func (s *Server) untrackListener(ln net.Listener) {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+	delete(s.listeners, ln)
+}
+
+func (s *Server) trackHTTPServer(srvr *http.Server) bool {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.httpServers[srvr] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackHTTPServer(srvr *http.Server) {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+	delete(s.httpServers, srvr)
+}
+
+// handleConn runs the full lifecycle of a client connection. It blocks until
+// the client disconnects. An error is returned if the client never made it past
+// the handshake.
+func (s *Server) handleConn(c net.Conn) error {
+	// Create a new client connection
+	conn, err := s.newConn(c)
+	if err != nil {
+		return err
+	}
+	return s.serveConn(conn)
+}
+
+// serveConn runs the full lifecycle of the given client connection.
+func (s *Server) serveConn(conn *Conn) error {
+	c := conn.c
+	if !s.trackConn(conn) {
+		conn.close()
+		return ErrServerClosed
+	}
+	defer s.untrackConn(conn)
 
-				// Do the rfb handshake
-				if err := conn.doHandshake(); err != nil {
-					log.Error("Error during server-client handshake: ", err.Error())
-					conn.c.Close()
-					return
-				}
+	if !s.acquireConnSlot() {
+		log.Warningf("Refusing client %s: maximum of %d connections reached", c.RemoteAddr(), cap(s.connSlots))
+		conn.refuse("Too many connections")
+		return errors.New("Too many connections")
+	}
+	defer s.releaseConnSlot()
+
+	// Do the rfb handshake
+	if err := conn.doHandshake(); err != nil {
+		log.Error("Error during server-client handshake: ", err.Error())
+		conn.close()
+		return err
+	}
+
+	// handle events
+	conn.serve()
+	return nil
+}
+
+// acquireConnSlot returns false if the maximum number of connections has been reached.
+func (s *Server) acquireConnSlot() bool {
+	if s.connSlots == nil {
+		return true
+	}
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) releaseConnSlot() {
+	if s.connSlots != nil {
+		<-s.connSlots
+	}
+}
 
-				// handle events
-				conn.serve()
-			},
-		},
+// trackConn registers a new connection with the server. It returns false if the
+// server is shutting down.
+func (s *Server) trackConn(c *Conn) bool {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+	if s.shuttingDown {
+		return false
 	}
-	return srvr.Serve(ln)
+	s.conns[c] = struct{}{}
+	s.connsWg.Add(1)
+	return true
+}
+
+// untrackConn removes the given connection from the server.
+func (s *Server) untrackConn(c *Conn) {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+	delete(s.conns, c)
+	s.connsWg.Done()
+	if c.admitted {
+		log.Infof("Client %s disconnected", c.display.ConnID())
+		s.publishSessionEvent(SessionEvent{Type: SessionDisconnected, Session: c.session()})
+	}
+}
+
+// admitConn marks the given connection as having completed the handshake, applying the
+// share policy according to the client's shared-flag. An error is returned if the client
+// is refused.
+func (s *Server) admitConn(c *Conn, shared bool) error {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+	others := make([]*Conn, 0)
+	for other := range s.conns {
+		if other != c && other.admitted {
+			others = append(others, other)
+		}
+	}
+	if !shared && len(others) > 0 {
+		switch s.sharePolicy {
+		case SharePolicyRefuse:
+			return fmt.Errorf("client requested exclusive access while %d other client(s) are connected", len(others))
+		case SharePolicyDisconnect:
+			log.Infof("Client %s requested exclusive access, disconnecting %d other client(s)", c.c.RemoteAddr(), len(others))
+			for _, other := range others {
+				other.c.Close()
+			}
+		}
+	}
+	c.admitted = true
+	s.publishSessionEvent(SessionEvent{Type: SessionConnected, Session: c.session()})
+	return nil
 }
 
 // AuthIsSupported returns true if the given auth type is supported.
 func (s *Server) AuthIsSupported(code uint8) bool {
-	for _, t := range s.enabledAuthTypes {
+	for _, t := range s.getEnabledAuthTypes() {
 		if t.Code() == code {
 			return true
 		}
@@ -139,7 +530,7 @@ func (s *Server) AuthIsSupported(code uint8) bool {
 // the need to generate (or, in the future, read in) the server password.
 func (s *Server) VNCAuthIsEnabled() bool {
 	t := &auth.VNCAuth{}
-	for _, a := range s.enabledAuthTypes {
+	for _, a := range s.getEnabledAuthTypes() {
 		if a.Code() == t.Code() {
 			return true
 		}
@@ -151,7 +542,7 @@ func (s *Server) VNCAuthIsEnabled() bool {
 // capabilities being mutated by the user also need to be updated here.
 func (s *Server) TightIsEnabled() bool {
 	t := &auth.TightSecurity{}
-	for _, a := range s.enabledAuthTypes {
+	for _, a := range s.getEnabledAuthTypes() {
 		if a.Code() == t.Code() {
 			return true
 		}
@@ -161,7 +552,7 @@ func (s *Server) TightIsEnabled() bool {
 
 // GetAuth returns the auth handler for the given code.
 func (s *Server) GetAuth(code uint8) auth.Type {
-	for _, t := range s.enabledAuthTypes {
+	for _, t := range s.getEnabledAuthTypes() {
 		if t.Code() == code {
 			return t
 		}
@@ -171,7 +562,7 @@ func (s *Server) GetAuth(code uint8) auth.Type {
 
 // GetAuthByName returns the auth interface by the given name.
 func (s *Server) GetAuthByName(name string) auth.Type {
-	for _, t := range s.enabledAuthTypes {
+	for _, t := range s.getEnabledAuthTypes() {
 		if reflect.TypeOf(t).Elem().Name() == name {
 			return t
 		}
@@ -193,8 +584,14 @@ func (s *Server) GetEventHandlerMap() map[uint8]events.Event {
 // that can be served. If none of the requested encodings are supported (should
 // never happen as at least RAW is required by RFC) this function returns nil.
 func (s *Server) GetEncoding(encs []int32) encodings.Encoding {
+	return pickEncoding(s.getEnabledEncodings(), encs)
+}
+
+// pickEncoding returns the first of the requested encodings that is in the given list
+// of enabled encodings.
+func pickEncoding(enabled []encodings.Encoding, encs []int32) encodings.Encoding {
 	for _, e := range encs {
-		for _, supported := range s.enabledEncodings {
+		for _, supported := range enabled {
 			if e == supported.Code() {
 				log.Debugf("Using %s encoding", reflect.TypeOf(supported).Elem().Name())
 				return supported
@@ -0,0 +1,241 @@
+package rfb
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"image"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/display/providers"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/auth"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/client"
+)
+
+// testServer is a server drawing a canvas, serving on a local listener.
+type testServer struct {
+	*Server
+	addr   string
+	served chan error
+}
+
+func newTestServer(t *testing.T, opts *ServerOpts) *testServer {
+	t.Helper()
+	return newTestServerAt(t, "127.0.0.1:0", opts)
+}
+
+// newTestServerAt is newTestServer listening on the given address.
+func newTestServerAt(t *testing.T, addr string, opts *ServerOpts) *testServer {
+	t.Helper()
+	if opts.Display == nil {
+		opts.Display = providers.NewCanvas(16, 8)
+	}
+	if len(opts.EnabledAuthTypes) == 0 {
+		opts.EnabledAuthTypes = []auth.Type{&auth.None{}}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{Server: NewServer(opts), addr: ln.Addr().String(), served: make(chan error, 1)}
+	go func() { s.served <- s.Serve(context.Background(), ln) }()
+	return s
+}
+
+// shutdown shuts the server down and checks Serve returned.
+func (s *testServer) shutdown(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal("Shutdown: ", err)
+	}
+	select {
+	case err := <-s.served:
+		if err != ErrServerClosed {
+			t.Fatalf("Expected Serve to return ErrServerClosed, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Serve did not return after Shutdown")
+	}
+}
+
+// connect connects a client to the server and waits for the first full update.
+func (s *testServer) connect(t *testing.T) (*client.Client, chan error) {
+	t.Helper()
+	updated := make(chan struct{}, 1)
+	c, err := client.Dial(s.addr, time.Second*5, &client.Opts{
+		Encodings: []int32{client.EncodingRaw},
+		OnUpdate: func(image.Rectangle) {
+			select {
+			case updated <- struct{}{}:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := make(chan error, 1)
+	go func() { ran <- c.Run() }()
+	if err := c.RequestUpdate(false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-updated:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Timed out waiting for the first update")
+	}
+	return c, ran
+}
+
+func TestShutdownDisconnectsClients(t *testing.T) {
+	s := newTestServer(t, &ServerOpts{})
+	c, ran := s.connect(t)
+	defer c.Close()
+	if n := len(s.GetSessions()); n != 1 {
+		t.Fatalf("Expected one session, got %d", n)
+	}
+
+	s.shutdown(t)
+	select {
+	case err := <-ran:
+		if err == nil {
+			t.Fatal("Expected the client to see the connection end")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Client was not disconnected by Shutdown")
+	}
+	if n := len(s.GetSessions()); n != 0 {
+		t.Fatalf("Expected no sessions after Shutdown, got %d", n)
+	}
+
+	// New connections are refused
+	if _, err := client.Dial(s.addr, time.Second, nil); err == nil {
+		t.Fatal("Expected connections to fail after Shutdown")
+	}
+}
+
+func TestShutdownNotifiesAuthenticatingClients(t *testing.T) {
+	s := newTestServer(t, &ServerOpts{
+		ServerPassword:   "secret",
+		EnabledAuthTypes: []auth.Type{&auth.VNCAuth{}},
+	})
+
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	r := bufio.NewReader(conn)
+
+	// Stop in the middle of VNC authentication, as if the user was typing the password
+	if _, err := io.ReadFull(r, make([]byte, 12)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("RFB 003.008\n"))
+	types := make([]byte, 2)
+	if _, err := io.ReadFull(r, types); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{2})
+	if _, err := io.ReadFull(r, make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Shutdown(context.Background())
+
+	var result struct{ Status, Length uint32 }
+	if err := binary.Read(r, binary.BigEndian, &result); err != nil {
+		t.Fatal("Reading security result: ", err)
+	}
+	reason := make([]byte, result.Length)
+	if _, err := io.ReadFull(r, reason); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != statusFailed || string(reason) != "Server is shutting down" {
+		t.Fatalf("Unexpected security result %d %q", result.Status, reason)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestServeAndShutdownDoNotLeak(t *testing.T) {
+	// Let goroutines of earlier tests finish
+	time.Sleep(time.Millisecond * 100)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 5; i++ {
+		s := newTestServer(t, &ServerOpts{})
+		for j := 0; j < 2; j++ {
+			c, _ := s.connect(t)
+			defer c.Close()
+		}
+		s.shutdown(t)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("%d goroutines before, %d after:\n%s", before, runtime.NumGoroutine(), buf)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func TestShutdownContextExpiry(t *testing.T) {
+	s := newTestServer(t, &ServerOpts{})
+	c, _ := s.connect(t)
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Shutdown(ctx); err != nil && err != context.Canceled {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if n := len(s.GetSessions()); n != 0 {
+		t.Fatalf("Expected no sessions after Shutdown, got %d", n)
+	}
+}
+
+// isolatedCanvas is a canvas that isn't shared between connections.
+type isolatedCanvas struct {
+	*providers.Canvas
+	closed bool
+}
+
+func (c *isolatedCanvas) Isolated() bool { return true }
+
+func (c *isolatedCanvas) Close() error {
+	c.closed = true
+	return c.Canvas.Close()
+}
+
+func TestNewServerUsesDisplay(t *testing.T) {
+	canvas := providers.NewCanvas(16, 8)
+	s := NewServer(&ServerOpts{Display: canvas})
+	if s.sharedProvider == nil || s.sharedProvider.Provider() != canvas {
+		t.Fatal("Expected the server to share the given display")
+	}
+	if w, h := s.width, s.height; w != 16 || h != 8 {
+		t.Fatalf("Expected the size of the display, got %dx%d", w, h)
+	}
+
+	// An isolated display is only used for its size
+	iso := &isolatedCanvas{Canvas: providers.NewCanvas(4, 2)}
+	s = NewServer(&ServerOpts{Display: iso})
+	if s.sharedProvider != nil || !iso.closed {
+		t.Fatal("Expected the isolated display to be closed")
+	}
+	if w, h := s.width, s.height; w != 4 || h != 2 {
+		t.Fatalf("Expected the size of the display, got %dx%d", w, h)
+	}
+}
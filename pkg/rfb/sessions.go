@@ -0,0 +1,204 @@
+package rfb
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/types"
+)
+
+// ErrSessionNotFound is returned when a session ID does not match any connected client.
+var ErrSessionNotFound = errors.New("rfb: Session not found")
+
+// Session is a snapshot of the state of a connected client.
+type Session struct {
+	ID           string            `json:"id"`
+	Display      string            `json:"display,omitempty"`
+	RemoteAddr   string            `json:"remoteAddr"`
+	AuthType     string            `json:"authType,omitempty"`
+	Username     string            `json:"username,omitempty"`
+	Encoding     string            `json:"encoding,omitempty"`
+	PixelFormat  types.PixelFormat `json:"pixelFormat"`
+	ViewOnly     bool              `json:"viewOnly"`
+	ConnectedAt  time.Time         `json:"connectedAt"`
+	BytesRead    uint64            `json:"bytesRead"`
+	BytesWritten uint64            `json:"bytesWritten"`
+}
+
+// SessionEventType represents the type of a session event.
+type SessionEventType string
+
+// Session event types.
+const (
+	SessionConnected    SessionEventType = "connected"
+	SessionDisconnected SessionEventType = "disconnected"
+)
+
+// SessionEvent is sent to subscribers when a client connects or disconnects.
+type SessionEvent struct {
+	Type    SessionEventType `json:"type"`
+	Session Session          `json:"session"`
+}
+
+// GetSessions returns a snapshot of all clients that have completed the handshake,
+// ordered by connection time.
+func (s *Server) GetSessions() []Session {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+	out := make([]Session, 0, len(s.conns))
+	for c := range s.conns {
+		if c.admitted {
+			out = append(out, c.session())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ConnectedAt.Before(out[j].ConnectedAt) })
+	return out
+}
+
+// GetSession returns a snapshot of the session with the given ID.
+func (s *Server) GetSession(id string) (Session, error) {
+	c, err := s.getConn(id)
+	if err != nil {
+		return Session{}, err
+	}
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+	return c.session(), nil
+}
+
+// Disconnect disconnects the session with the given ID. Any messages queued for the
+// client are written out before the connection is closed.
+func (s *Server) Disconnect(id string) error {
+	c, err := s.getConn(id)
+	if err != nil {
+		return err
+	}
+	log.Infof("Disconnecting client %s", c.display.ConnID())
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+	// Unblock any pending reads, the connection will close itself. A handshake that is
+	// still finishing sees the flag instead of clearing the deadline.
+	c.disconnecting = true
+	return c.c.SetReadDeadline(time.Now())
+}
+
+// SetViewOnly sets whether input from the session with the given ID is ignored.
+func (s *Server) SetViewOnly(id string, viewOnly bool) error {
+	c, err := s.getConn(id)
+	if err != nil {
+		return err
+	}
+	log.Infof("Setting view-only to %v for client %s", viewOnly, c.display.ConnID())
+	c.display.SetViewOnly(viewOnly)
+	return nil
+}
+
+// Subscribe returns a channel that receives an event whenever a client connects or
+// disconnects, and a function to stop the subscription. Events are dropped if the
+// channel is not drained.
+func (s *Server) Subscribe() (<-chan SessionEvent, func()) {
+	ch := make(chan SessionEvent, 16)
+	s.subscribersMux.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.subscribersMux.Unlock()
+	return ch, func() {
+		s.subscribersMux.Lock()
+		defer s.subscribersMux.Unlock()
+		if _, ok := s.subscribers[ch]; ok {
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (s *Server) publishSessionEvent(ev SessionEvent) {
+	s.subscribersMux.Lock()
+	defer s.subscribersMux.Unlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			log.Warning("Session event subscriber is behind, dropping event")
+		}
+	}
+}
+
+func (s *Server) getConn(id string) (*Conn, error) {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+	for c := range s.conns {
+		if c.admitted && c.id == id {
+			return c, nil
+		}
+	}
+	return nil, ErrSessionNotFound
+}
+
+// connCounter numbers connections across all servers, so session IDs are unique within
+// the process, such as for the displays of a Router.
+var connCounter uint64
+
+// nextConnID returns a new unique connection ID.
+func (s *Server) nextConnID() string {
+	return strconv.FormatUint(atomic.AddUint64(&connCounter, 1), 10)
+}
+
+// session returns a snapshot of the connection's state. The server's connection lock
+// must be held.
+func (c *Conn) session() Session {
+	sess := Session{
+		ID:           c.id,
+		Display:      c.s.displayName,
+		RemoteAddr:   c.remoteAddr,
+		Username:     c.username,
+		ViewOnly:     c.display.ViewOnly(),
+		PixelFormat:  *c.display.GetPixelFormat(),
+		ConnectedAt:  c.connectedAt,
+		BytesRead:    c.counter.bytesRead(),
+		BytesWritten: c.counter.bytesWritten(),
+	}
+	if c.authType != nil {
+		sess.AuthType = reflect.TypeOf(c.authType).Elem().Name()
+	}
+	if enc := c.display.GetCurrentEncoding(); enc != nil {
+		sess.Encoding = reflect.TypeOf(enc).Elem().Name()
+	}
+	return sess
+}
+
+// remoteAddrOf returns the address of the client on the other end of the connection.
+func remoteAddrOf(c net.Conn) string {
+	// The remote address of a websocket is the origin, use the request instead
+	if ws, ok := c.(interface{ Request() *http.Request }); ok {
+		return ws.Request().RemoteAddr
+	}
+	return c.RemoteAddr().String()
+}
+
+// countingConn wraps a net.Conn and counts the bytes read and written.
+type countingConn struct {
+	net.Conn
+	read, written uint64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.read, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) bytesRead() uint64    { return atomic.LoadUint64(&c.read) }
+func (c *countingConn) bytesWritten() uint64 { return atomic.LoadUint64(&c.written) }
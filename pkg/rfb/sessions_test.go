@@ -0,0 +1,120 @@
+package rfb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/auth"
+	"github.com/tinyzimmer/gsvnc/pkg/rfb/client"
+)
+
+// waitForEvent returns the next session event, which must be of the given type.
+func waitForEvent(t *testing.T, events <-chan SessionEvent, typ SessionEventType) SessionEvent {
+	t.Helper()
+	select {
+	case ev := <-events:
+		if ev.Type != typ {
+			t.Fatalf("Expected a %s event, got %+v", typ, ev)
+		}
+		return ev
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Timed out waiting for a %s event", typ)
+	}
+	return SessionEvent{}
+}
+
+func TestSessionRecordsVNCAuthUser(t *testing.T) {
+	s := newTestServer(t, &ServerOpts{
+		ServerPassword:   "shared",
+		Users:            map[string]string{"alice": "alicepw"},
+		EnabledAuthTypes: []auth.Type{&auth.VNCAuth{}},
+	})
+	defer s.shutdown(t)
+
+	events, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+
+	for _, tc := range []struct{ password, username string }{
+		{"alicepw", "alice"},
+		{"shared", ""},
+	} {
+		c, err := client.Dial(s.addr, time.Second*5, &client.Opts{Password: tc.password})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev := waitForEvent(t, events, SessionConnected)
+		if ev.Session.Username != tc.username || ev.Session.AuthType != "VNCAuth" {
+			t.Fatalf("Unexpected session for password %q: %+v", tc.password, ev.Session)
+		}
+		sess, err := s.GetSession(ev.Session.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sess.Username != tc.username {
+			t.Fatalf("Expected username %q, got %q", tc.username, sess.Username)
+		}
+		c.Close()
+		waitForEvent(t, events, SessionDisconnected)
+	}
+
+	if _, err := client.Dial(s.addr, time.Second*5, &client.Opts{Password: "wrong"}); err == nil {
+		t.Fatal("Expected a wrong password to be refused")
+	}
+}
+
+func TestSessionSnapshotsDuringHandshakes(t *testing.T) {
+	s := newTestServer(t, &ServerOpts{})
+	defer s.shutdown(t)
+
+	// Clients set their pixel format and encodings right after the handshake, while
+	// sessions are being listed
+	stop := make(chan struct{})
+	listed := make(chan struct{})
+	go func() {
+		defer close(listed)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.GetSessions()
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		c, _ := s.connect(t)
+		c.Close()
+	}
+	close(stop)
+	<-listed
+}
+
+func TestSessionDisconnectDuringHandshake(t *testing.T) {
+	s := newTestServer(t, &ServerOpts{})
+	defer s.shutdown(t)
+	events, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+
+	c, done := s.connect(t)
+	defer c.Close()
+	id := waitForEvent(t, events, SessionConnected).Session.ID
+	conn, err := s.getConn(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Disconnect(id); err != nil {
+		t.Fatal(err)
+	}
+	// The handshake clears its deadline once the session is registered, which must not
+	// undo a disconnect that came in first
+	conn.setDeadline(0)
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected the client to be disconnected")
+	}
+	waitForEvent(t, events, SessionDisconnected)
+	if err := s.Disconnect(id); err != ErrSessionNotFound {
+		t.Fatalf("Expected the session to be gone, got %v", err)
+	}
+}
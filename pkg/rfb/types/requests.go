@@ -49,7 +49,13 @@ type FrameBufferRectangle struct {
 }
 
 // ClientCutText is a message signaling that the client has new text in its cut buffer.
+//
+// When the Extended Clipboard pseudo-encoding is in use, the length is negative and
+// Text holds the raw extended clipboard payload.
 type ClientCutText struct {
-	Length uint32
+	Length int32
 	Text   []uint8
 }
+
+// IsExtended returns true if this is an Extended Clipboard message.
+func (c *ClientCutText) IsExtended() bool { return c.Length < 0 }
@@ -0,0 +1,213 @@
+package rfb
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/tinyzimmer/gsvnc/pkg/internal/log"
+	"github.com/tinyzimmer/gsvnc/pkg/token"
+)
+
+// DefaultWebsockifyPath is the default path websockify connections are upgraded on.
+const DefaultWebsockifyPath = "/websockify"
+
+// DefaultTokenParam is the default query parameter and cookie websockify tokens are read from.
+const DefaultTokenParam = "token"
+
+// Websocket subprotocols. Binary frames are used if the client doesn't ask for either.
+const (
+	subprotocolBinary = "binary"
+	subprotocolBase64 = "base64"
+)
+
+// websockifyHandler returns the handler for the websockify listener. Websocket upgrades
+// are accepted on the websockify path, and on any path not served by the web root for
+// clients that connect to the root. Everything else is served from the web root.
+func (s *Server) websockifyHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.websockifyPath, s.serveWebsocket)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if isWebsocketUpgrade(r) {
+			s.serveWebsocket(w, r)
+			return
+		}
+		if s.webRoot == nil {
+			http.NotFound(w, r)
+			return
+		}
+		// Point noVNC style clients at the websockify path
+		if r.URL.Path == "/" && !exists(s.webRoot, "/index.html") && exists(s.webRoot, "/vnc.html") {
+			path := url.QueryEscape(strings.TrimPrefix(s.websockifyPath, "/"))
+			http.Redirect(w, r, "/vnc.html?path="+path, http.StatusFound)
+			return
+		}
+		http.FileServer(s.webRoot).ServeHTTP(w, r)
+	})
+	return mux
+}
+
+// serveWebsocket checks the origin and token of a websocket request before upgrading it
+// and handing the connection to the RFB server.
+func (s *Server) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	claims, fromCookie, err := s.authorizeWebsocket(r)
+	if err != nil {
+		log.Warningf("Rejecting websocket connection from %s: %s", r.RemoteAddr, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.upgradeWebsocket(w, r, claims, fromCookie)
+}
+
+// upgradeWebsocket checks the origin of an authorized websocket request before upgrading
+// it and handing the connection to the RFB server. The claims, if any, are applied to
+// the session.
+func (s *Server) upgradeWebsocket(w http.ResponseWriter, r *http.Request, claims *token.Claims, fromCookie bool) {
+	if err := s.checkOrigin(r, fromCookie); err != nil {
+		log.Warningf("Rejecting websocket connection from %s: %s", r.RemoteAddr, err)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	ws := &websocket.Server{
+		Handshake: func(cfg *websocket.Config, r *http.Request) error {
+			cfg.Protocol = selectSubprotocol(cfg.Protocol)
+			return nil
+		},
+		Handler: func(wsconn *websocket.Conn) {
+			log.Info("New websocket client connection from ", wsconn.Request().RemoteAddr)
+			var c net.Conn = wsconn
+			if proto := wsconn.Config().Protocol; len(proto) > 0 && proto[0] == subprotocolBase64 {
+				c = &base64Conn{Conn: wsconn}
+				wsconn.PayloadType = websocket.TextFrame
+			} else {
+				wsconn.PayloadType = websocket.BinaryFrame
+			}
+			conn, err := s.newConn(c)
+			if err != nil {
+				return
+			}
+			if claims != nil {
+				conn.username = claims.Subject
+				conn.display.SetViewOnly(claims.ViewOnly)
+			}
+			s.serveConn(conn)
+		},
+	}
+	ws.ServeHTTP(w, r)
+}
+
+// authorizeWebsocket validates the token carried by the request, if a token validator
+// is configured. It also returns whether the token was read from a cookie.
+func (s *Server) authorizeWebsocket(r *http.Request) (claims *token.Claims, fromCookie bool, err error) {
+	if s.tokenValidator == nil {
+		return nil, false, nil
+	}
+	tok, fromCookie := readToken(r, s.tokenParam)
+	if tok == "" {
+		return nil, false, errors.New("no token provided")
+	}
+	claims, err = s.tokenValidator.Validate(tok)
+	return claims, fromCookie, err
+}
+
+// readToken returns the token carried by the request in the given query parameter or
+// cookie, and whether it was read from the cookie.
+func readToken(r *http.Request, param string) (tok string, fromCookie bool) {
+	if tok = r.URL.Query().Get(param); tok != "" {
+		return tok, false
+	}
+	if cookie, err := r.Cookie(param); err == nil && cookie.Value != "" {
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+// checkOrigin checks the Origin of a websocket request against the allowed origins. If
+// none are configured any origin is allowed, unless the request is authorized by a cookie,
+// which a browser would send along with a cross-site request. Then only the same origin
+// is allowed. Requests without an Origin do not come from a browser and are allowed.
+func (s *Server) checkOrigin(r *http.Request, fromCookie bool) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	if len(s.allowedOrigins) == 0 {
+		if !fromCookie {
+			return nil
+		}
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, r.Host) {
+			return fmt.Errorf("cross-origin request from %s with a cookie token", origin)
+		}
+		return nil
+	}
+	for _, allowed := range s.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %s is not allowed", origin)
+}
+
+// selectSubprotocol picks the subprotocol to use from the ones offered by the client.
+func selectSubprotocol(offered []string) []string {
+	for _, want := range []string{subprotocolBinary, subprotocolBase64} {
+		for _, p := range offered {
+			if p == want {
+				return []string{p}
+			}
+		}
+	}
+	return nil
+}
+
+// base64Conn implements the base64 websockify subprotocol used by old noVNC clients.
+// Every message is base64 encoded and sent as a text frame.
+type base64Conn struct {
+	*websocket.Conn
+	rbuf []byte
+}
+
+func (b *base64Conn) Read(p []byte) (int, error) {
+	for len(b.rbuf) == 0 {
+		var msg string
+		if err := websocket.Message.Receive(b.Conn, &msg); err != nil {
+			return 0, err
+		}
+		data, err := base64.StdEncoding.DecodeString(msg)
+		if err != nil {
+			return 0, err
+		}
+		b.rbuf = data
+	}
+	n := copy(p, b.rbuf)
+	b.rbuf = b.rbuf[n:]
+	return n, nil
+}
+
+func (b *base64Conn) Write(p []byte) (int, error) {
+	if err := websocket.Message.Send(b.Conn, base64.StdEncoding.EncodeToString(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func isWebsocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func exists(fs http.FileSystem, name string) bool {
+	f, err := fs.Open(name)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
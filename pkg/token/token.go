@@ -0,0 +1,127 @@
+// Package token implements the signed tokens used to authorize websockify connections.
+// Tokens are JWTs signed with HMAC-SHA256 (HS256).
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Errors returned when validating a token.
+var (
+	ErrMalformed        = errors.New("token: Malformed token")
+	ErrUnsupportedAlg   = errors.New("token: Unsupported signing algorithm")
+	ErrInvalidSignature = errors.New("token: Invalid signature")
+	ErrExpired          = errors.New("token: Token is expired")
+	ErrNotYetValid      = errors.New("token: Token is not valid yet")
+)
+
+// Claims represents the claims carried by a token.
+type Claims struct {
+	// The identity of the user, recorded as the session's username.
+	Subject string `json:"sub,omitempty"`
+	// Whether input from the session is ignored.
+	ViewOnly bool `json:"view_only,omitempty"`
+	// The display the token grants access to, when routing between several displays.
+	Display string `json:"display,omitempty"`
+	// Unix timestamps. Zero values are not checked.
+	ExpiresAt int64 `json:"exp,omitempty"`
+	NotBefore int64 `json:"nbf,omitempty"`
+	IssuedAt  int64 `json:"iat,omitempty"`
+}
+
+// Validator validates tokens and returns their claims.
+type Validator interface {
+	Validate(token string) (*Claims, error)
+}
+
+// header is the JOSE header of a token.
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// HMAC signs and validates HS256 tokens with a shared secret.
+type HMAC struct {
+	secret []byte
+	// Allowed clock skew when checking exp and nbf.
+	Leeway time.Duration
+}
+
+// NewHMAC returns a new HMAC signer and validator for the given secret.
+func NewHMAC(secret []byte) *HMAC {
+	return &HMAC{secret: secret, Leeway: time.Minute}
+}
+
+// Sign returns a signed token for the given claims.
+func (h *HMAC) Sign(claims *Claims) (string, error) {
+	hdr, err := json.Marshal(&header{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := encode(hdr) + "." + encode(body)
+	return signed + "." + encode(h.sign(signed)), nil
+}
+
+// Validate checks the signature and validity period of the given token and returns
+// its claims.
+func (h *HMAC) Validate(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var hdr header
+	if err := decodeJSON(parts[0], &hdr); err != nil {
+		return nil, ErrMalformed
+	}
+	if hdr.Alg != "HS256" {
+		return nil, ErrUnsupportedAlg
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !hmac.Equal(sig, h.sign(parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidSignature
+	}
+
+	claims := &Claims{}
+	if err := decodeJSON(parts[1], claims); err != nil {
+		return nil, ErrMalformed
+	}
+	now := time.Now()
+	if claims.ExpiresAt != 0 && now.Add(-h.Leeway).Unix() > claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+	if claims.NotBefore != 0 && now.Add(h.Leeway).Unix() < claims.NotBefore {
+		return nil, ErrNotYetValid
+	}
+	return claims, nil
+}
+
+func (h *HMAC) sign(data string) []byte {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func encode(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func decodeJSON(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,112 @@
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"strings"
+	"testing"
+	"time"
+)
+
+// forge returns a token with the given raw header and claims, signed with the secret
+// using HS256.
+func forge(secret, hdr, claims string) string {
+	signed := encode([]byte(hdr)) + "." + encode([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + encode(mac.Sum(nil))
+}
+
+func TestHMACValidate(t *testing.T) {
+	h := NewHMAC([]byte("secret"))
+	now := time.Now()
+	sign := func(claims *Claims) string {
+		tok, err := h.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	valid := sign(&Claims{Subject: "alice", ViewOnly: true, Display: "a", IssuedAt: now.Unix()})
+	parts := strings.Split(valid, ".")
+	otherSig := strings.Split(forge("other", `{"alg":"HS256","typ":"JWT"}`, `{"sub":"alice"}`), ".")[2]
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"Valid", valid, nil},
+		{"ValidWithinPeriod", sign(&Claims{NotBefore: now.Add(-time.Hour).Unix(), ExpiresAt: now.Add(time.Hour).Unix()}), nil},
+		{"Expired", sign(&Claims{ExpiresAt: now.Add(-time.Hour).Unix()}), ErrExpired},
+		{"ExpiredWithinLeeway", sign(&Claims{ExpiresAt: now.Add(-h.Leeway / 2).Unix()}), nil},
+		{"ExpiredBeyondLeeway", sign(&Claims{ExpiresAt: now.Add(-h.Leeway * 2).Unix()}), ErrExpired},
+		{"NotYetValid", sign(&Claims{NotBefore: now.Add(time.Hour).Unix()}), ErrNotYetValid},
+		{"NotYetValidWithinLeeway", sign(&Claims{NotBefore: now.Add(h.Leeway / 2).Unix()}), nil},
+		{"NotYetValidBeyondLeeway", sign(&Claims{NotBefore: now.Add(h.Leeway * 2).Unix()}), ErrNotYetValid},
+		{"WrongSignature", parts[0] + "." + parts[1] + "." + otherSig, ErrInvalidSignature},
+		{"WrongSecret", forge("other", `{"alg":"HS256"}`, `{"sub":"alice"}`), ErrInvalidSignature},
+		{"TamperedClaims", parts[0] + "." + encode([]byte(`{"sub":"mallory"}`)) + "." + parts[2], ErrInvalidSignature},
+		{"AlgNone", encode([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".", ErrUnsupportedAlg},
+		{"AlgNoneCased", encode([]byte(`{"alg":"None"}`)) + "." + parts[1] + ".", ErrUnsupportedAlg},
+		// A token signed with the secret under another algorithm name is refused
+		// before its signature is considered.
+		{"AlgConfusionRS256", forge("secret", `{"alg":"RS256"}`, `{"sub":"alice"}`), ErrUnsupportedAlg},
+		{"AlgConfusionHS512", forge("secret", `{"alg":"HS512"}`, `{"sub":"alice"}`), ErrUnsupportedAlg},
+		{"MissingAlg", forge("secret", `{"typ":"JWT"}`, `{"sub":"alice"}`), ErrUnsupportedAlg},
+		{"Empty", "", ErrMalformed},
+		{"TwoSegments", parts[0] + "." + parts[1], ErrMalformed},
+		{"FourSegments", valid + ".", ErrMalformed},
+		{"TruncatedSignature", valid[:len(valid)-4], ErrInvalidSignature},
+		{"TruncatedClaims", parts[0] + "." + parts[1][:len(parts[1])-3] + "." + parts[2], ErrInvalidSignature},
+		{"HeaderNotBase64", "!!!." + parts[1] + "." + parts[2], ErrMalformed},
+		{"HeaderNotJSON", encode([]byte("HS256")) + "." + parts[1] + "." + parts[2], ErrMalformed},
+		{"SignatureNotBase64", parts[0] + "." + parts[1] + ".!!!", ErrMalformed},
+		{"ClaimsNotJSON", forge("secret", `{"alg":"HS256"}`, `not json`), ErrMalformed},
+		{"ClaimsWrongType", forge("secret", `{"alg":"HS256"}`, `{"exp":"tomorrow"}`), ErrMalformed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			claims, err := h.Validate(tc.token)
+			if err != tc.want {
+				t.Fatalf("Expected error %v, got %v", tc.want, err)
+			}
+			if err == nil && claims == nil {
+				t.Fatal("Expected claims for a valid token")
+			}
+		})
+	}
+}
+
+func TestHMACRoundTrip(t *testing.T) {
+	h := NewHMAC([]byte("secret"))
+	want := Claims{
+		Subject:   "alice",
+		ViewOnly:  true,
+		Display:   "a",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		IssuedAt:  time.Now().Unix(),
+	}
+	tok, err := h.Sign(&want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := h.Validate(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != want {
+		t.Fatalf("Expected claims %+v, got %+v", want, *got)
+	}
+}
+
+func TestHMACNoLeeway(t *testing.T) {
+	h := NewHMAC([]byte("secret"))
+	h.Leeway = 0
+	tok, err := h.Sign(&Claims{ExpiresAt: time.Now().Add(-2 * time.Second).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Validate(tok); err != ErrExpired {
+		t.Fatalf("Expected a token expired seconds ago to be refused without leeway, got %v", err)
+	}
+}
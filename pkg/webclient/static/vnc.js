@@ -0,0 +1,551 @@
+// A small RFB client for gsvnc. It speaks RFB 3.8 over a websocket and supports the
+// None and VNC security types, and the Tight (JPEG) and Raw encodings.
+//
+// Query parameters follow noVNC where they overlap: host, port, path, encrypt,
+// password, autoconnect, view_only and shared. A token parameter is passed on to the
+// websocket URL.
+'use strict';
+
+(function () {
+    const secNone = 1;
+    const secVNC = 2;
+
+    const encRaw = 0;
+    const encTight = 7;
+
+    const msgFramebufferUpdate = 0;
+    const msgSetColourMap = 1;
+    const msgBell = 2;
+    const msgServerCutText = 3;
+
+    const keysyms = {
+        Backspace: 0xff08, Tab: 0xff09, Enter: 0xff0d, Escape: 0xff1b, Delete: 0xffff,
+        Home: 0xff50, ArrowLeft: 0xff51, ArrowUp: 0xff52, ArrowRight: 0xff53, ArrowDown: 0xff54,
+        PageUp: 0xff55, PageDown: 0xff56, End: 0xff57, Insert: 0xff63, ContextMenu: 0xff67,
+        Pause: 0xff13, ScrollLock: 0xff14, PrintScreen: 0xff61, NumLock: 0xff7f, CapsLock: 0xffe5,
+        AltGraph: 0xfe03,
+    };
+    const codeKeysyms = {
+        ShiftLeft: 0xffe1, ShiftRight: 0xffe2, ControlLeft: 0xffe3, ControlRight: 0xffe4,
+        AltLeft: 0xffe9, AltRight: 0xffea, MetaLeft: 0xffeb, MetaRight: 0xffec,
+        OSLeft: 0xffeb, OSRight: 0xffec,
+    };
+
+    // keysymFor returns the X11 keysym for a keyboard event.
+    function keysymFor(ev) {
+        if (codeKeysyms[ev.code]) {
+            return codeKeysyms[ev.code];
+        }
+        if (keysyms[ev.key]) {
+            return keysyms[ev.key];
+        }
+        const fn = /^F([0-9]{1,2})$/.exec(ev.key);
+        if (fn) {
+            return 0xffbe + parseInt(fn[1], 10) - 1;
+        }
+        const cp = ev.key.codePointAt(0);
+        if (cp !== undefined && String.fromCodePoint(cp) === ev.key) {
+            return cp < 0x100 ? cp : 0x01000000 | cp;
+        }
+        return null;
+    }
+
+    class RFBClient {
+        constructor(url, canvas, opts) {
+            this.canvas = canvas;
+            this.ctx = canvas.getContext('2d');
+            this.opts = opts;
+            this.buf = new Uint8Array(0);
+            this.pos = 0;
+            this.busy = false;
+            this.state = this.readVersion;
+            this.pressed = {};
+            this.buttons = 0;
+
+            this.ws = new WebSocket(url, opts.protocols || []);
+            this.ws.binaryType = 'arraybuffer';
+            this.ws.onmessage = (ev) => this.receive(new Uint8Array(ev.data));
+            this.ws.onclose = (ev) => this.disconnected(ev.reason || 'Connection closed');
+            this.ws.onerror = () => this.disconnected('Connection error');
+        }
+
+        // Status and teardown
+
+        status(msg) { this.opts.onStatus(msg); }
+
+        disconnected(reason) {
+            if (!this.state) {
+                return;
+            }
+            this.state = null;
+            this.unbindInput();
+            this.status('Disconnected: ' + reason);
+        }
+
+        close() {
+            this.ws.close();
+            this.disconnected('Closed by user');
+        }
+
+        // Buffer handling
+
+        receive(data) {
+            const rest = this.buf.subarray(this.pos);
+            const buf = new Uint8Array(rest.length + data.length);
+            buf.set(rest);
+            buf.set(data, rest.length);
+            this.buf = buf;
+            this.pos = 0;
+            this.process();
+        }
+
+        process() {
+            try {
+                while (this.state && !this.busy && this.state()) {
+                    // Keep going while states consume data
+                }
+            } catch (err) {
+                this.ws.close();
+                this.disconnected(err.message);
+            }
+        }
+
+        have(n) { return this.buf.length - this.pos >= n; }
+        peekU8(off) { return this.buf[this.pos + off]; }
+        peekU32(off) {
+            const b = this.buf, p = this.pos + off;
+            return ((b[p] << 24) | (b[p + 1] << 16) | (b[p + 2] << 8) | b[p + 3]) >>> 0;
+        }
+        u8() { return this.buf[this.pos++]; }
+        u16() { const v = (this.buf[this.pos] << 8) | this.buf[this.pos + 1]; this.pos += 2; return v; }
+        u32() { const v = this.peekU32(0); this.pos += 4; return v; }
+        s32() { return this.u32() | 0; }
+        bytes(n) { const v = this.buf.subarray(this.pos, this.pos + n); this.pos += n; return v; }
+        str(n) { return String.fromCharCode.apply(null, this.bytes(n)); }
+
+        send(bytes) {
+            if (this.ws.readyState === WebSocket.OPEN) {
+                this.ws.send(new Uint8Array(bytes));
+            }
+        }
+
+        // Handshake
+
+        readVersion() {
+            if (!this.have(12)) {
+                return false;
+            }
+            const ver = this.str(12);
+            if (ver !== 'RFB 003.008\n') {
+                throw new Error('Unsupported server version: ' + ver.trim());
+            }
+            this.send(Array.from('RFB 003.008\n', c => c.charCodeAt(0)));
+            this.state = this.readSecurityTypes;
+            return true;
+        }
+
+        readSecurityTypes() {
+            if (!this.have(1)) {
+                return false;
+            }
+            const n = this.peekU8(0);
+            if (n === 0) {
+                this.state = this.readFailure;
+                this.pos++;
+                return true;
+            }
+            if (!this.have(1 + n)) {
+                return false;
+            }
+            this.pos++;
+            const types = Array.from(this.bytes(n));
+            if (types.includes(secNone)) {
+                this.send([secNone]);
+                this.state = this.readSecurityResult;
+            } else if (types.includes(secVNC)) {
+                this.send([secVNC]);
+                this.state = this.readVNCChallenge;
+            } else {
+                throw new Error('No supported security types offered: ' + types.join(', '));
+            }
+            return true;
+        }
+
+        readVNCChallenge() {
+            if (!this.have(16)) {
+                return false;
+            }
+            const challenge = this.bytes(16).slice();
+            this.busy = true;
+            this.opts.getPassword().then((password) => {
+                this.send(Array.from(window.vncEncrypt(password, challenge)));
+                this.state = this.readSecurityResult;
+                this.busy = false;
+                this.process();
+            });
+            return false;
+        }
+
+        readSecurityResult() {
+            if (!this.have(4)) {
+                return false;
+            }
+            if (this.u32() !== 0) {
+                this.state = this.readFailure;
+                return true;
+            }
+            // ClientInit
+            this.send([this.opts.shared ? 1 : 0]);
+            this.state = this.readServerInit;
+            return true;
+        }
+
+        readFailure() {
+            if (!this.have(4) || !this.have(4 + this.peekU32(0))) {
+                return false;
+            }
+            throw new Error(this.str(this.u32()) || 'Authentication failed');
+        }
+
+        readServerInit() {
+            if (!this.have(24) || !this.have(24 + this.peekU32(20))) {
+                return false;
+            }
+            this.width = this.u16();
+            this.height = this.u16();
+            this.bytes(16); // The server pixel format, ours is set below
+            this.name = this.str(this.u32());
+            this.resize(this.width, this.height);
+
+            // SetPixelFormat: 32bpp little endian RGBX, which maps directly to ImageData
+            this.send([0, 0, 0, 0, 32, 24, 0, 1, 0, 255, 0, 255, 0, 255, 0, 8, 16, 0, 0, 0]);
+            // SetEncodings
+            const encs = [encTight, encRaw];
+            const msg = [2, 0, 0, encs.length];
+            for (const e of encs) {
+                msg.push((e >> 24) & 0xff, (e >> 16) & 0xff, (e >> 8) & 0xff, e & 0xff);
+            }
+            this.send(msg);
+
+            this.bindInput();
+            this.requestUpdate(false);
+            this.status('Connected to ' + this.name);
+            this.state = this.readMessage;
+            return true;
+        }
+
+        // Server messages
+
+        readMessage() {
+            if (!this.have(1)) {
+                return false;
+            }
+            switch (this.peekU8(0)) {
+            case msgFramebufferUpdate:
+                if (!this.have(4)) {
+                    return false;
+                }
+                this.pos += 2;
+                this.rects = this.u16();
+                this.state = this.readRect;
+                return true;
+            case msgSetColourMap:
+                if (!this.have(6) || !this.have(6 + ((this.buf[this.pos + 4] << 8) | this.buf[this.pos + 5]) * 6)) {
+                    return false;
+                }
+                this.pos += 4;
+                this.bytes(this.u16() * 6);
+                return true;
+            case msgBell:
+                this.pos++;
+                return true;
+            case msgServerCutText: {
+                if (!this.have(8)) {
+                    return false;
+                }
+                const len = this.peekU32(4) | 0;
+                if (len < 0) {
+                    throw new Error('Unexpected extended clipboard message');
+                }
+                if (!this.have(8 + len)) {
+                    return false;
+                }
+                this.pos += 8;
+                this.opts.onClipboard(this.str(len));
+                return true;
+            }
+            default:
+                throw new Error('Unsupported server message: ' + this.peekU8(0));
+            }
+        }
+
+        readRect() {
+            if (this.rects === 0) {
+                this.state = this.readMessage;
+                this.requestUpdate(true);
+                return true;
+            }
+            if (!this.have(12)) {
+                return false;
+            }
+            const start = this.pos;
+            const x = this.u16(), y = this.u16(), w = this.u16(), h = this.u16();
+            const enc = this.s32();
+            let done;
+            switch (enc) {
+            case encRaw:
+                done = this.readRaw(x, y, w, h);
+                break;
+            case encTight:
+                done = this.readTight(x, y, w, h);
+                break;
+            default:
+                throw new Error('Unsupported encoding: ' + enc);
+            }
+            if (!done) {
+                // Wait for the rest of the rectangle
+                this.pos = start;
+                return false;
+            }
+            this.rects--;
+            return true;
+        }
+
+        readRaw(x, y, w, h) {
+            const size = w * h * 4;
+            if (!this.have(size)) {
+                return false;
+            }
+            const img = this.ctx.createImageData(w, h);
+            img.data.set(this.bytes(size));
+            for (let i = 3; i < img.data.length; i += 4) {
+                img.data[i] = 255;
+            }
+            this.ctx.putImageData(img, x, y);
+            return true;
+        }
+
+        readTight(x, y, w, h) {
+            if (!this.have(1)) {
+                return false;
+            }
+            const ctl = this.peekU8(0) >> 4;
+            if (ctl !== 0x09) {
+                throw new Error('Unsupported tight compression: ' + ctl);
+            }
+            // Compact length
+            let len = 0, n = 1;
+            for (let shift = 0; n <= 3; n++, shift += 7) {
+                if (!this.have(1 + n)) {
+                    return false;
+                }
+                const b = this.peekU8(n);
+                len |= (n === 3 ? b : b & 0x7f) << shift;
+                if (n === 3 || !(b & 0x80)) {
+                    break;
+                }
+            }
+            if (!this.have(1 + n + len)) {
+                return false;
+            }
+            this.pos += 1 + n;
+            const blob = new Blob([this.bytes(len).slice()], { type: 'image/jpeg' });
+
+            // Decoding is asynchronous, stop processing until it's drawn so that
+            // rectangles are drawn in order.
+            this.busy = true;
+            createImageBitmap(blob).then((bmp) => {
+                this.ctx.drawImage(bmp, x, y);
+            }).catch((err) => {
+                console.error('Could not decode JPEG rectangle', err);
+            }).finally(() => {
+                this.busy = false;
+                this.process();
+            });
+            return true;
+        }
+
+        resize(w, h) {
+            this.canvas.width = w;
+            this.canvas.height = h;
+        }
+
+        // Client messages
+
+        requestUpdate(incremental) {
+            const w = this.width, h = this.height;
+            this.send([3, incremental ? 1 : 0, 0, 0, 0, 0, w >> 8, w & 0xff, h >> 8, h & 0xff]);
+        }
+
+        sendKey(keysym, down) {
+            this.send([4, down ? 1 : 0, 0, 0,
+                (keysym >> 24) & 0xff, (keysym >> 16) & 0xff, (keysym >> 8) & 0xff, keysym & 0xff]);
+        }
+
+        sendPointer(x, y, mask) {
+            this.send([5, mask, x >> 8, x & 0xff, y >> 8, y & 0xff]);
+        }
+
+        sendClipboard(text) {
+            const bytes = [];
+            for (const c of text) {
+                const cp = c.codePointAt(0);
+                bytes.push(cp < 0x100 ? cp : 0x3f); // Latin-1, '?' for anything else
+            }
+            const n = bytes.length;
+            this.send([6, 0, 0, 0, (n >> 24) & 0xff, (n >> 16) & 0xff, (n >> 8) & 0xff, n & 0xff].concat(bytes));
+        }
+
+        // Input
+
+        bindInput() {
+            if (this.opts.viewOnly) {
+                return;
+            }
+            const c = this.canvas;
+            this.handlers = {
+                keydown: (ev) => this.onKey(ev, true),
+                keyup: (ev) => this.onKey(ev, false),
+                mousedown: (ev) => this.onMouse(ev),
+                mouseup: (ev) => this.onMouse(ev),
+                mousemove: (ev) => this.onMouse(ev),
+                wheel: (ev) => this.onWheel(ev),
+                contextmenu: (ev) => ev.preventDefault(),
+                blur: () => this.releaseKeys(),
+            };
+            for (const [name, fn] of Object.entries(this.handlers)) {
+                c.addEventListener(name, fn);
+            }
+            c.tabIndex = 0;
+            c.focus();
+        }
+
+        unbindInput() {
+            if (!this.handlers) {
+                return;
+            }
+            for (const [name, fn] of Object.entries(this.handlers)) {
+                this.canvas.removeEventListener(name, fn);
+            }
+            this.handlers = null;
+        }
+
+        onKey(ev, down) {
+            ev.preventDefault();
+            // Release the same keysym that was pressed, even if modifiers changed since
+            let keysym = down ? keysymFor(ev) : this.pressed[ev.code];
+            if (keysym === null || keysym === undefined) {
+                return;
+            }
+            if (down) {
+                this.pressed[ev.code] = keysym;
+            } else {
+                delete this.pressed[ev.code];
+            }
+            this.sendKey(keysym, down);
+        }
+
+        releaseKeys() {
+            for (const keysym of Object.values(this.pressed)) {
+                this.sendKey(keysym, false);
+            }
+            this.pressed = {};
+        }
+
+        position(ev) {
+            const r = this.canvas.getBoundingClientRect();
+            const x = Math.floor((ev.clientX - r.left) * this.canvas.width / r.width);
+            const y = Math.floor((ev.clientY - r.top) * this.canvas.height / r.height);
+            return [Math.max(0, Math.min(x, this.width - 1)), Math.max(0, Math.min(y, this.height - 1))];
+        }
+
+        onMouse(ev) {
+            ev.preventDefault();
+            // DOM buttons are left, right, middle. RFB buttons are left, middle, right.
+            const b = ev.buttons;
+            this.buttons = (b & 1) | ((b & 4) >> 1) | ((b & 2) << 1);
+            const [x, y] = this.position(ev);
+            this.sendPointer(x, y, this.buttons);
+        }
+
+        onWheel(ev) {
+            ev.preventDefault();
+            if (ev.deltaY === 0) {
+                return;
+            }
+            const [x, y] = this.position(ev);
+            const bit = ev.deltaY < 0 ? 8 : 16;
+            this.sendPointer(x, y, this.buttons | bit);
+            this.sendPointer(x, y, this.buttons);
+        }
+    }
+
+    // UI
+
+    const params = new URLSearchParams(location.search);
+    const $ = (id) => document.getElementById(id);
+    let client = null;
+
+    function wsURL() {
+        const secure = params.has('encrypt') ? params.get('encrypt') === 'true' || params.get('encrypt') === '1' : location.protocol === 'https:';
+        const host = params.get('host') || location.hostname;
+        const port = params.get('port') || location.port;
+        let path = params.get('path') || 'websockify';
+        if (!path.startsWith('/')) {
+            path = '/' + path;
+        }
+        if (params.get('token') && !/[?&]token=/.test(path)) {
+            path += (path.includes('?') ? '&' : '?') + 'token=' + encodeURIComponent(params.get('token'));
+        }
+        return (secure ? 'wss://' : 'ws://') + host + (port ? ':' + port : '') + path;
+    }
+
+    function connect() {
+        if (client) {
+            client.close();
+        }
+        $('connect').disabled = true;
+        $('disconnect').disabled = false;
+        client = new RFBClient(wsURL(), $('screen'), {
+            shared: params.get('shared') !== 'false',
+            viewOnly: params.get('view_only') === 'true',
+            protocols: ['binary'],
+            onStatus: (msg) => {
+                $('status').textContent = msg;
+                if (msg.startsWith('Disconnected')) {
+                    $('connect').disabled = false;
+                    $('disconnect').disabled = true;
+                }
+            },
+            onClipboard: (text) => { $('clipboard').value = text; },
+            getPassword: () => {
+                if (params.get('password')) {
+                    return Promise.resolve(params.get('password'));
+                }
+                return new Promise((resolve) => {
+                    const form = $('password-form');
+                    form.hidden = false;
+                    $('password').focus();
+                    form.onsubmit = (ev) => {
+                        ev.preventDefault();
+                        form.hidden = true;
+                        resolve($('password').value);
+                        $('password').value = '';
+                        $('screen').focus();
+                    };
+                });
+            },
+        });
+        $('status').textContent = 'Connecting to ' + wsURL();
+    }
+
+    window.addEventListener('load', () => {
+        $('connect').onclick = connect;
+        $('disconnect').onclick = () => client && client.close();
+        $('clipboard-send').onclick = () => client && client.sendClipboard($('clipboard').value);
+        $('scale').onchange = (ev) => $('screen').classList.toggle('scaled', ev.target.checked);
+        if (params.get('autoconnect') !== 'false') {
+            connect();
+        }
+    });
+})();
@@ -0,0 +1,25 @@
+// Package webclient embeds a browser based RFB client that can be served from the
+// websockify listener.
+//
+// The client follows the noVNC conventions for its entry point (vnc.html) and query
+// parameters, so a noVNC checkout can be served in its place.
+package webclient
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// FS returns the file system containing the web client.
+func FS() http.FileSystem {
+	sub, err := fs.Sub(static, "static")
+	if err != nil {
+		// The directory is embedded at build time
+		panic(err)
+	}
+	return http.FS(sub)
+}